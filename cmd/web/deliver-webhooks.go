@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"github.com/454270186/Hotel-booking-web-application/internal/handler"
+	"time"
+)
+
+// deliverWebhooks sends the due webhook deliveries every interval
+func deliverWebhooks(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			handler.Repo.DeliverWebhooks(context.Background())
+		}
+	}()
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/454270186/Hotel-booking-web-application/internal/driver"
 	"github.com/454270186/Hotel-booking-web-application/internal/handler"
 	"github.com/454270186/Hotel-booking-web-application/internal/helpers"
+	"github.com/454270186/Hotel-booking-web-application/internal/mailer"
 	"github.com/454270186/Hotel-booking-web-application/internal/render"
 	"github.com/alexedwards/scs/v2"
 	"log"
@@ -17,7 +18,8 @@ import (
 	"time"
 )
 
-const portNumber = ":8080"
+// portNumber is the address the application listens on, set by run from the configured port
+var portNumber = ":8080"
 
 var app config.AppConfig
 var session *scs.SessionManager
@@ -29,11 +31,29 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.SQL.Close()
+	if db.SQL != nil {
+		defer db.SQL.Close()
+	}
+
+	if app.MailInterval > 0 {
+		fmt.Println("Starting mail sender...")
+		sendMail(app.MailInterval)
+	}
+
+	if app.NotificationInterval > 0 {
+		fmt.Println("Starting reminder emails...")
+		sendNotifications(app.NotificationInterval)
+	}
+
+	if app.ICalSyncInterval > 0 {
+		fmt.Println("Starting calendar sync...")
+		syncCalendars(app.ICalSyncInterval)
+	}
 
-	defer close(app.MailChan)
-	fmt.Println("Starting mail listener...")
-	listenForMail()
+	if app.WebhookInterval > 0 {
+		fmt.Println("Starting webhook delivery...")
+		deliverWebhooks(app.WebhookInterval)
+	}
 
 	//http.HandleFunc("/", handler.Repo.Home)
 	//http.HandleFunc("/about", handler.Repo.About)
@@ -61,28 +81,48 @@ func run() (*driver.DB, error) {
 	gob.Register(Models.RoomRestriction{})
 	gob.Register(map[string]int{})
 
-	// read flags
-	inProduction := flag.Bool("production", true, "Application is in production")
-	useCache := flag.Bool("cache", true, "Use template cache")
-	dbHost := flag.String("dbhost", "localhost", "Database host")
-	dbName := flag.String("dbname", "", "Database name")
-	dbUser := flag.String("dbuser", "", "Database user")
-	dbPass := flag.String("dbpass", "", "Database password")
-	dbPort := flag.String("dbport", "5432", "Database port")
-	dbSSL := flag.String("dbssl", "disable", "Database ssl settings (disable, prefer, require)")
-
-	flag.Parse()
-	if *dbName == "" || *dbUser == "" || *dbPass == "" {
-		fmt.Println("Missing required flags")
-		os.Exit(1)
+	// read the config file, the environment and the flags
+	s, err := loadSettings(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.Mail.Mailer {
+	case "smtp":
+		app.Mailer, err = mailer.NewSMTP(s.smtpConfig())
+	case "file":
+		app.Mailer, err = mailer.NewFile(s.Mail.Dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("setting up the mailer: %w", err)
 	}
 
-	mailChan := make(chan Models.MailData)
-	app.MailChan = mailChan
+	// validate checked the times and time zone already
+	app.CheckInTime, _ = parseTimeOfDay(s.Property.CheckIn)
+	app.CheckOutTime, _ = parseTimeOfDay(s.Property.CheckOut)
+	app.TimeZone, _ = time.LoadLocation(s.Property.TimeZone)
+
+	portNumber = fmt.Sprintf(":%d", s.Port)
 
 	// change this to true when in production
-	app.InProduction = *inProduction
-	app.UseCache = *useCache
+	app.InProduction = s.Production
+	app.UseCache = s.Cache
+	app.DBTimeout = s.Database.Timeout
+	app.CancellationDeadline = s.Reservations.CancellationDeadline
+	app.LoginMaxAttempts = s.Login.Attempts
+	app.LoginMaxAttemptsPerIP = s.Login.IPAttempts
+	app.LoginAttemptWindow = s.Login.Window
+	app.LoginLockout = s.Login.Lockout
+	app.LoginDelay = s.Login.Delay
+	app.ICalSyncInterval = s.ICalSync
+	app.WebhookInterval = s.WebhookInterval
+	app.MailInterval = s.Mail.Interval
+	app.MailFrom = s.Mail.From
+	app.OwnerEmail = s.Mail.Owner
+	app.PropertyAddress = s.Property.Address
+	app.NotificationInterval = s.Notifications.Interval
+	app.ArrivalReminderDays = s.Notifications.ReminderDays
+	app.ThankYouDays = s.Notifications.ThankYouDays
 
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	app.InfoLog = infoLog
@@ -90,33 +130,66 @@ func run() (*driver.DB, error) {
 	app.ErrorLog = errorLog
 
 	session = scs.New()
-	session.Lifetime = 24 * time.Hour
+	session.Lifetime = s.Session.Lifetime
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
 	session.Cookie.Secure = app.InProduction
 	app.Session = session
 
-	// connect to database
-	log.Println("Connect to database...")
-	connectionStr := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", *dbHost, *dbPort, *dbName, *dbUser, *dbPass, *dbSSL)
-	db, err := driver.ConnectSQL(connectionStr)
+	tc, err := render.CreateTemplateCache()
 	if err != nil {
-		log.Fatal("Cannot connect to database, Dying...")
+		return nil, fmt.Errorf("loading the page templates: %w", err)
 	}
-	log.Println("Connected to database")
 
-	tc, err := render.CreateTemplateCache()
+	app.TemplateCache = tc
+
+	app.MailTemplateCache, app.MailTextTemplateCache, err = render.CreateMailTemplateCache()
 	if err != nil {
-		log.Fatal(err)
-		return nil, err
+		return nil, fmt.Errorf("loading the email templates: %w", err)
 	}
 
-	app.TemplateCache = tc
+	var db *driver.DB
+	var repo *handler.Repository
+	if s.Demo {
+		log.Println("Using in-memory database, nothing will be persisted")
+		db = &driver.DB{}
+		repo = handler.NewMemoryRepo(&app)
+	} else if s.Database.Driver == "sqlite" {
+		log.Println("Connect to database...")
+		db, err = driver.ConnectSQLite(s.Database.Name)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to the database: %w", err)
+		}
+		log.Println("Connected to database")
+
+		repo = handler.NewSQLiteRepo(&app, db)
+	} else {
+		// connect to database
+		log.Println("Connect to database...")
+		connectionStr := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", s.Database.Host,
+			s.Database.Port, s.Database.Name, s.Database.User, s.Database.Password, s.Database.SSL)
+		db, err = driver.ConnectSQL(connectionStr)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to the database: %w", err)
+		}
+		log.Println("Connected to database")
+
+		repo = handler.NewRepo(&app, db)
+	}
 
-	repo := handler.NewRepo(&app, db)
 	handler.NewHandler(repo) // new and set repository for handler
 	render.NewRenderer(&app) // new and set up app config for render
 	helpers.NewHelpers(&app) // new and set up app config for helpers
 
 	return db, nil
 }
+
+// parseTimeOfDay parses a time of day such as 15:00 as the time since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
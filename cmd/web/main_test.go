@@ -1,8 +1,14 @@
 package main
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func TestRun(t *testing.T) {
+	// run() parses the command line, so point it at the in-memory database
+	os.Args = append(os.Args, "-demo", "-production=false")
+
 	_, err := run()
 	if err != nil {
 		t.Error("failed run")
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/handler"
 	"github.com/454270186/Hotel-booking-web-application/internal/helpers"
 	"github.com/justinas/nosurf"
 	"net/http"
+	"strings"
 )
 
 func WriteToConsole(next http.Handler) http.Handler {
@@ -14,9 +19,21 @@ func WriteToConsole(next http.Handler) http.Handler {
 	})
 }
 
-// NoSurf adds CSRF protection to all POST request
+// NoSurf adds CSRF protection to all POST request. API requests with a bearer token are exempt, they are
+// authenticated by the token rather than by cookies, so they can't be forged by another site
 func NoSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		_, ok := helpers.BearerToken(r)
+		return ok && strings.HasPrefix(r.URL.Path, "/api/")
+	})
+	csrfHandler.SetFailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			handler.Repo.APITokenRequired(w, r)
+			return
+		}
+		http.Error(w, http.StatusText(nosurf.FailureCode), nosurf.FailureCode)
+	}))
 
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
@@ -33,6 +50,8 @@ func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
+// Auth only lets through logged in users. The user is loaded again on every request, so a deactivated or locked
+// user is logged out right away, and a changed role counts from the next request on
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !helpers.IsAuthenticated(r) {
@@ -41,6 +60,51 @@ func Auth(next http.Handler) http.Handler {
 			return
 		}
 
+		u, err := handler.Repo.DB.GetUserByID(r.Context(), session.GetInt(r.Context(), "user_id"))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			helpers.ServeError(w, err)
+			return
+		}
+		if err != nil || !u.Active || u.Locked() {
+			_ = session.Destroy(r.Context())
+			session.Put(r.Context(), "error", "Your account can't be used at the moment, please log in again")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+
+		// RequirePermission and the templates read the role from the session
+		if session.GetInt(r.Context(), "access_level") != u.AccessLevel {
+			session.Put(r.Context(), "access_level", u.AccessLevel)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TwoFactorSetup keeps users whose role requires two-factor authentication on their profile page until they set it up
+func TwoFactorSetup(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if session.GetBool(r.Context(), "two_factor_setup") {
+			session.Put(r.Context(), "warning", "Your role requires two-factor authentication, set it up to continue")
+			http.Redirect(w, r, "/admin/profile", http.StatusSeeOther)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequirePermission only lets through logged in users whose role has permission p
+func RequirePermission(p Models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := Models.Role(session.GetInt(r.Context(), "access_level"))
+			if !role.Can(p) {
+				helpers.ClientError(w, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPIObject is a decoded object of the OpenAPI document
+type openAPIObject = map[string]interface{}
+
+// resolveRef follows the $ref of obj within the document, if it has one
+func resolveRef(spec, obj openAPIObject) (openAPIObject, error) {
+	ref, ok := obj["$ref"].(string)
+	if !ok {
+		return obj, nil
+	}
+
+	node := interface{}(spec)
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, ok := node.(openAPIObject)
+		if !ok {
+			return nil, fmt.Errorf("can't resolve %s", ref)
+		}
+		node = m[part]
+	}
+
+	resolved, ok := node.(openAPIObject)
+	if !ok {
+		return nil, fmt.Errorf("can't resolve %s", ref)
+	}
+
+	return resolveRef(spec, resolved)
+}
+
+// responseSchema returns the JSON schema the document gives for the response of path and method with status
+func responseSchema(spec openAPIObject, path, method string, status int) (openAPIObject, error) {
+	op, ok := spec["paths"].(openAPIObject)[path].(openAPIObject)[method].(openAPIObject)
+	if !ok {
+		return nil, fmt.Errorf("%s %s is not documented", method, path)
+	}
+
+	resp, ok := op["responses"].(openAPIObject)[strconv.Itoa(status)].(openAPIObject)
+	if !ok {
+		return nil, fmt.Errorf("status %d of %s %s is not documented", status, method, path)
+	}
+	resp, err := resolveRef(spec, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, ok := resp["content"].(openAPIObject)["application/json"].(openAPIObject)["schema"].(openAPIObject)
+	if !ok {
+		return nil, fmt.Errorf("status %d of %s %s has no JSON schema", status, method, path)
+	}
+
+	return schema, nil
+}
+
+// validateSchema returns how v breaks schema. Objects must not have properties the schema leaves out,
+// so the document can't fall behind the handlers
+func validateSchema(spec, schema openAPIObject, v interface{}, at string) []string {
+	schema, err := resolveRef(spec, schema)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	if v == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return []string{at + ": is null"}
+	}
+
+	var problems []string
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return []string{at + ": is not an object"}
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, field := range required {
+			if _, ok := obj[field.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: misses %s", at, field))
+			}
+		}
+		properties, _ := schema["properties"].(openAPIObject)
+		for field, value := range obj {
+			if property, ok := properties[field].(openAPIObject); ok {
+				problems = append(problems, validateSchema(spec, property, value, at+"."+field)...)
+			} else if additional, ok := schema["additionalProperties"].(openAPIObject); ok {
+				problems = append(problems, validateSchema(spec, additional, value, at+"."+field)...)
+			} else {
+				problems = append(problems, fmt.Sprintf("%s: %s is not documented", at, field))
+			}
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return []string{at + ": is not an array"}
+		}
+		for i, item := range items {
+			problems = append(problems, validateSchema(spec, schema["items"].(openAPIObject), item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return []string{at + ": is not a string"}
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == s
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: %q is not one of %v", at, s, enum))
+			}
+		}
+		if schema["format"] == "date" {
+			if _, err := time.Parse("2006-01-02", s); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a date", at, s))
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) {
+			problems = append(problems, at+": is not an integer")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			problems = append(problems, at+": is not a boolean")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s: the validator doesn't know type %v", at, schema["type"]))
+	}
+
+	return problems
+}
+
+func TestRoutesOpenAPI(t *testing.T) {
+	ts := setUpMemoryApp(t)
+
+	var spec struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	resp, err := http.Get(ts.URL + "/api/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+
+	// every JSON route has to be in the document, and the document must not describe routes that don't exist
+	documented := 0
+	for _, item := range spec.Paths {
+		documented += len(item)
+	}
+	routed := 0
+	err = chi.Walk(routes(&app).(chi.Routes), func(method, route string, h http.Handler, mw ...func(http.Handler) http.Handler) error {
+		if !strings.HasPrefix(route, "/api/v1/") && route != "/search-availability-json" {
+			return nil
+		}
+		routed++
+		if _, ok := spec.Paths[route][strings.ToLower(method)]; !ok {
+			t.Errorf("%s %s is not in the OpenAPI document", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routed != documented {
+		t.Errorf("the OpenAPI document describes %d operations, but there are %d routes", documented, routed)
+	}
+}
+
+func TestRoutesOpenAPIResponses(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	app.CancellationDeadline = 48 * time.Hour
+	t.Cleanup(func() { app.CancellationDeadline = 0 })
+
+	document, err := os.ReadFile("internal/handler/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec openAPIObject
+	if err := json.Unmarshal(document, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(spec["openapi"].(string), "3.") {
+		t.Fatalf("expected an OpenAPI 3 document, got %v", spec["openapi"])
+	}
+
+	guest := newGuest(t)
+	if served := getBody(t, guest, ts.URL+"/api/openapi.json"); served != string(document) {
+		t.Fatal("the document is not served")
+	}
+
+	token := newAPIToken(t, Models.ScopeAvailabilityRead, Models.ScopeReservationsRead, Models.ScopeReservationsWrite)
+	covered := make(map[string]bool)
+
+	// check sends a request through the routes of the site, checks its status and validates the response
+	// against the document
+	// check sends a request, with the given header lines as pairs of name and value
+	check := func(method, path, pattern, contentType, body string, status int, header ...string) map[string]interface{} {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := guest.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		got, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, path, status, resp.StatusCode, got)
+		}
+		covered[strings.ToLower(method)+" "+pattern] = true
+
+		schema, err := responseSchema(spec, pattern, strings.ToLower(method), resp.StatusCode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal(got, &v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		for _, problem := range validateSchema(spec, schema, v, "body") {
+			t.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, problem)
+		}
+
+		return v
+	}
+
+	form := "application/x-www-form-urlencoded"
+	js := "application/json"
+	// the availability form is posted by the site's own pages, so it needs the CSRF token
+	stay := url.Values{
+		"start":      {"2050-01-01"},
+		"end":        {"2050-01-03"},
+		"room_id":    {"1"},
+		"csrf_token": {getBody(t, guest, ts.URL+"/test-csrf-token")},
+	}
+	check("POST", "/search-availability-json", "/search-availability-json", form, stay.Encode(), http.StatusOK)
+	stay.Set("room_id", "x")
+	check("POST", "/search-availability-json", "/search-availability-json", form, stay.Encode(), http.StatusOK)
+
+	check("GET", "/api/v1/rooms", "/api/v1/rooms", js, "", http.StatusOK)
+	check("GET", "/api/v1/availability?start_date=2050-01-01&end_date=2050-01-03", "/api/v1/availability", js, "", http.StatusOK)
+	check("GET", "/api/v1/availability?start_date=2050-01-03", "/api/v1/availability", js, "", http.StatusUnprocessableEntity)
+
+	booking := `{"room_id": 1, "start_date": "2050-01-01", "end_date": "2050-01-03",
+		"first_name": "Erfei", "last_name": "Yu", "email": "guest@example.com", "phone": "555-555-5555"}`
+	res := check("POST", "/api/v1/reservations", "/api/v1/reservations", js, booking, http.StatusCreated)
+	check("POST", "/api/v1/reservations", "/api/v1/reservations", js, booking, http.StatusConflict)
+	check("POST", "/api/v1/reservations", "/api/v1/reservations", js, `{"room_id": "1"}`, http.StatusBadRequest)
+	check("POST", "/api/v1/reservations", "/api/v1/reservations", js, `{"room_id": 1}`, http.StatusUnprocessableEntity)
+
+	code := res["confirmation_code"].(string)
+	reservation := "/api/v1/reservations/{code}"
+	check("GET", "/api/v1/reservations/"+code, reservation, js, "", http.StatusOK, "X-Guest-Email", "guest@example.com")
+	check("GET", "/api/v1/reservations/"+code, reservation, js, "", http.StatusNotFound, "X-Guest-Email", "other@example.com")
+	check("GET", "/api/v1/reservations/"+code, reservation, js, "", http.StatusUnprocessableEntity)
+
+	cancel := "/api/v1/reservations/{code}/cancel"
+	check("POST", "/api/v1/reservations/"+code+"/cancel", cancel, js, `{"email": "guest@example.com"}`, http.StatusOK)
+	check("POST", "/api/v1/reservations/"+code+"/cancel", cancel, js, `{"email": "guest@example.com"}`, http.StatusConflict)
+
+	token = "unknown"
+	check("GET", "/api/v1/rooms", "/api/v1/rooms", js, "", http.StatusUnauthorized)
+	token = ""
+	check("GET", "/api/v1/rooms", "/api/v1/rooms", js, "", http.StatusUnauthorized)
+
+	// every documented operation has to be checked against a real response
+	var missing []string
+	for path, item := range spec["paths"].(openAPIObject) {
+		for method := range item.(openAPIObject) {
+			if !covered[method+" "+path] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		t.Errorf("no response was validated for %v", missing)
+	}
+}
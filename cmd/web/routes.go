@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
 	"github.com/454270186/Hotel-booking-web-application/internal/config"
 	"github.com/454270186/Hotel-booking-web-application/internal/handler"
 	"github.com/go-chi/chi/v5"
@@ -29,6 +30,9 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Get("/about", handler.Repo.About)
 	mux.Get("/generals-quarters", handler.Repo.Generals)
 	mux.Get("/majors-suite", handler.Repo.Majors)
+	mux.Get("/rooms", handler.Repo.Rooms)
+	mux.Get("/rooms/{slug}", handler.Repo.Room)
+	mux.Get("/ical/{token}.ics", handler.Repo.RoomICal)
 
 	mux.Get("/search-availability", handler.Repo.Availability)
 	mux.Post("/search-availability", handler.Repo.PostAvailability)
@@ -43,9 +47,40 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Post("/make-reservation", handler.Repo.PostReservation)
 	mux.Get("/reservation-summary", handler.Repo.ReservationSummary)
 
+	mux.Get("/my-reservation", handler.Repo.MyReservation)
+	mux.Post("/my-reservation", handler.Repo.PostMyReservation)
+	mux.Get("/my-reservation/details", handler.Repo.MyReservationDetails)
+	mux.Post("/my-reservation/cancel", handler.Repo.PostCancelMyReservation)
+	mux.Post("/my-reservation/change", handler.Repo.PostChangeMyReservation)
+
 	mux.Get("/user/login", handler.Repo.ShowLogin)
 	mux.Post("/user/login", handler.Repo.PostShowLogin)
 	mux.Get("/user/logout", handler.Repo.Logout)
+	mux.Get("/user/forgot-password", handler.Repo.ForgotPassword)
+	mux.Post("/user/forgot-password", handler.Repo.PostForgotPassword)
+	mux.Get("/user/reset-password", handler.Repo.ResetPassword)
+	mux.Post("/user/reset-password", handler.Repo.PostResetPassword)
+	mux.Get("/user/two-factor", handler.Repo.TwoFactor)
+	mux.Post("/user/two-factor", handler.Repo.PostTwoFactor)
+
+	mux.Get("/api/openapi.json", handler.Repo.APISpec)
+
+	// the JSON API is versioned, so its clients keep working when a later version changes it.
+	// Clients authenticate with API tokens, whose scopes decide what they may do
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.NotFound(handler.Repo.APINotFound)
+		mux.MethodNotAllowed(handler.Repo.APIMethodNotAllowed)
+
+		availability := mux.With(handler.Repo.RequireAPIToken(Models.ScopeAvailabilityRead))
+		read := mux.With(handler.Repo.RequireAPIToken(Models.ScopeReservationsRead))
+		write := mux.With(handler.Repo.RequireAPIToken(Models.ScopeReservationsWrite))
+
+		availability.Get("/rooms", handler.Repo.APIRooms)
+		availability.Get("/availability", handler.Repo.APIAvailability)
+		write.Post("/reservations", handler.Repo.APICreateReservation)
+		read.Get("/reservations/{code}", handler.Repo.APIReservation)
+		write.Post("/reservations/{code}/cancel", handler.Repo.APICancelReservation)
+	})
 
 	// 处理静态文件，让网页可以访问到static文件夹里的文件
 	// 这一步非常重要！！
@@ -53,20 +88,81 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
 	mux.Route("/admin", func(mux chi.Router) {
-		//mux.Use(Auth)
-
-		mux.Get("/dashboard", handler.Repo.AdminDashboard)
-
-		mux.Get("/reservations-new", handler.Repo.AdminNewReservations)
-		mux.Get("/reservations-all", handler.Repo.AdminAllReservations)
-		mux.Get("/reservations-calendar", handler.Repo.AdminReservationsCalendar)
-		mux.Post("/reservations-calendar", handler.Repo.AdminPostReservationsCalendar)
-
-		mux.Get("/process-reservation/{src}/{id}/do", handler.Repo.AdminProcessReservation)
-		mux.Get("/delete-reservation/{src}/{id}/do", handler.Repo.AdminDeleteReservation)
-
-		mux.Get("/reservations/{src}/{id}/show", handler.Repo.AdminShowReservation)
-		mux.Post("/reservations/{src}/{id}", handler.Repo.AdminPostShowReservation)
+		mux.Use(Auth)
+
+		mux.Get("/profile", handler.Repo.AdminProfile)
+		mux.Post("/profile/two-factor", handler.Repo.AdminPostEnableTwoFactor)
+		mux.Post("/profile/two-factor/disable", handler.Repo.AdminPostDisableTwoFactor)
+		mux.Post("/profile/recovery-codes", handler.Repo.AdminPostRecoveryCodes)
+
+		// everything but the profile waits for two-factor authentication to be set up where it is required
+		enrolled := mux.With(TwoFactorSetup)
+		view := enrolled.With(RequirePermission(Models.PermViewReservations))
+		edit := enrolled.With(RequirePermission(Models.PermEditReservations))
+		del := enrolled.With(RequirePermission(Models.PermDeleteReservations))
+		rooms := enrolled.With(RequirePermission(Models.PermManageRooms))
+		users := enrolled.With(RequirePermission(Models.PermManageUsers))
+		tokens := enrolled.With(RequirePermission(Models.PermManageAPITokens))
+		webhooks := enrolled.With(RequirePermission(Models.PermManageWebhooks))
+		mail := enrolled.With(RequirePermission(Models.PermManageMail))
+
+		view.Get("/dashboard", handler.Repo.AdminDashboard)
+
+		view.Get("/reservations-new", handler.Repo.AdminNewReservations)
+		view.Get("/reservations-all", handler.Repo.AdminAllReservations)
+		view.Get("/reservations-calendar", handler.Repo.AdminReservationsCalendar)
+		edit.Post("/reservations-calendar", handler.Repo.AdminPostReservationsCalendar)
+
+		edit.Get("/process-reservation/{src}/{id}/do", handler.Repo.AdminProcessReservation)
+		del.Get("/delete-reservation/{src}/{id}/do", handler.Repo.AdminDeleteReservation)
+
+		view.Get("/reservations/{src}/{id}/show", handler.Repo.AdminShowReservation)
+		edit.Post("/reservations/{src}/{id}", handler.Repo.AdminPostShowReservation)
+
+		rooms.Get("/rooms", handler.Repo.AdminRooms)
+		rooms.Get("/rooms/new", handler.Repo.AdminNewRoom)
+		rooms.Post("/rooms/new", handler.Repo.AdminPostNewRoom)
+		rooms.Get("/rooms/{id}", handler.Repo.AdminShowRoom)
+		rooms.Post("/rooms/{id}", handler.Repo.AdminPostShowRoom)
+		rooms.Get("/delete-room/{id}/do", handler.Repo.AdminDeleteRoom)
+		rooms.Get("/new-ical-token/{id}/do", handler.Repo.AdminNewRoomICalToken)
+
+		rooms.Get("/rooms/{id}/rates", handler.Repo.AdminRoomRates)
+		rooms.Post("/rooms/{id}/rates", handler.Repo.AdminPostRoomRates)
+		rooms.Post("/rooms/{id}/seasonal-rates", handler.Repo.AdminPostSeasonalRate)
+		rooms.Get("/delete-seasonal-rate/{room}/{id}/do", handler.Repo.AdminDeleteSeasonalRate)
+
+		rooms.Get("/rooms/{id}/calendars", handler.Repo.AdminRoomCalendars)
+		rooms.Post("/rooms/{id}/calendars", handler.Repo.AdminPostRoomCalendar)
+		rooms.Post("/rooms/{id}/calendars/{feed}", handler.Repo.AdminPostRoomCalendarFile)
+		rooms.Get("/sync-room-calendar/{room}/{id}/do", handler.Repo.AdminSyncRoomCalendar)
+		rooms.Get("/delete-room-calendar/{room}/{id}/do", handler.Repo.AdminDeleteRoomCalendar)
+
+		users.Get("/users", handler.Repo.AdminUsers)
+		users.Get("/users/new", handler.Repo.AdminNewUser)
+		users.Post("/users/new", handler.Repo.AdminPostNewUser)
+		users.Get("/users/{id}", handler.Repo.AdminShowUser)
+		users.Post("/users/{id}", handler.Repo.AdminPostShowUser)
+		users.Post("/users/{id}/password", handler.Repo.AdminPostUserPassword)
+		users.Post("/users/{id}/deactivate", handler.Repo.AdminDeactivateUser)
+		users.Post("/users/{id}/disable-two-factor", handler.Repo.AdminDisableUserTwoFactor)
+		users.Post("/users/{id}/unlock", handler.Repo.AdminUnlockUser)
+		users.Post("/users/two-factor", handler.Repo.AdminPostTwoFactorLevels)
+
+		tokens.Get("/api-tokens", handler.Repo.AdminAPITokens)
+		tokens.Post("/api-tokens", handler.Repo.AdminPostAPIToken)
+		tokens.Get("/revoke-api-token/{id}/do", handler.Repo.AdminRevokeAPIToken)
+
+		webhooks.Get("/webhooks", handler.Repo.AdminWebhooks)
+		webhooks.Post("/webhooks", handler.Repo.AdminPostWebhook)
+		webhooks.Get("/webhooks/{id}", handler.Repo.AdminShowWebhook)
+		webhooks.Post("/webhooks/{id}", handler.Repo.AdminPostShowWebhook)
+		webhooks.Get("/new-webhook-secret/{id}/do", handler.Repo.AdminNewWebhookSecret)
+		webhooks.Get("/delete-webhook/{id}/do", handler.Repo.AdminDeleteWebhook)
+		webhooks.Get("/retry-webhook-delivery/{webhook}/{id}/do", handler.Repo.AdminRetryWebhookDelivery)
+
+		mail.Get("/mail", handler.Repo.AdminFailedMail)
+		mail.Get("/resend-mail/{id}/do", handler.Repo.AdminResendMail)
 	})
 
 	return mux
@@ -1,10 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
 	"github.com/454270186/Hotel-booking-web-application/internal/config"
+	"github.com/454270186/Hotel-booking-web-application/internal/handler"
+	"github.com/454270186/Hotel-booking-web-application/internal/helpers"
+	"github.com/454270186/Hotel-booking-web-application/internal/ical"
+	"github.com/454270186/Hotel-booking-web-application/internal/mailer"
+	"github.com/454270186/Hotel-booking-web-application/internal/render"
+	"github.com/454270186/Hotel-booking-web-application/internal/totp"
+	"github.com/alexedwards/scs/v2"
 	"github.com/go-chi/chi/v5"
+	"github.com/justinas/nosurf"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRoutes(t *testing.T) {
@@ -19,3 +49,1636 @@ func TestRoutes(t *testing.T) {
 	}
 
 }
+
+// setUpMemoryApp points the package level app at an in-memory repository and returns a test server
+// serving routes() plus a helper route that hands out the CSRF token of the current session
+func setUpMemoryApp(t *testing.T) *httptest.Server {
+	app.InProduction = false
+	app.UseCache = true
+	tc, err := render.CreateTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.TemplateCache = tc
+	app.MailTemplateCache, app.MailTextTemplateCache, err = render.CreateMailTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.MailFrom = "bookings@example.com"
+	app.OwnerEmail = "owner@example.com"
+	app.Mailer = mailer.NewMemory()
+	app.PropertyAddress = "1 Main Street, Springfield"
+	app.CheckInTime = 15 * time.Hour
+	app.CheckOutTime = 11 * time.Hour
+	app.TimeZone = time.UTC
+	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	// TestRun leaves the default login throttling behind, tests that need it turn it on themselves
+	app.LoginMaxAttempts = 0
+	app.LoginMaxAttemptsPerIP = 0
+	app.LoginAttemptWindow = 0
+	app.LoginLockout = 0
+	app.LoginDelay = 0
+
+	// what run registers for the session, such as the block maps of the reservations calendar
+	gob.Register(Models.Reservation{})
+	gob.Register(map[string]int{})
+
+	session = scs.New()
+	session.Lifetime = 24 * time.Hour
+	app.Session = session
+
+	handler.NewHandler(handler.NewMemoryRepo(&app))
+	render.NewRenderer(&app)
+	helpers.NewHelpers(&app)
+
+	mux := routes(&app).(*chi.Mux)
+	mux.Get("/test-csrf-token", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(nosurf.Token(r)))
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// pendingMail returns the messages waiting in the outbox, newest first
+func pendingMail(t *testing.T) []Models.MailMessage {
+	t.Helper()
+
+	mail, err := handler.Repo.DB.GetMailMessages(context.Background(), Models.MailPending, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mail
+}
+
+// newGuest returns a client with its own cookie jar, i.e. its own session
+func newGuest(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{Jar: jar}
+}
+
+// postForm posts values to path, adding the CSRF token of the client's session
+func postForm(t *testing.T, ts *httptest.Server, client *http.Client, path string, values url.Values) *http.Response {
+	resp, _ := postFormBody(t, ts, client, path, values)
+
+	return resp
+}
+
+// postFormBody is postForm, also returning the body of the page the post ended at
+func postFormBody(t *testing.T, ts *httptest.Server, client *http.Client, path string, values url.Values) (*http.Response, string) {
+	resp, err := client.Get(ts.URL + "/test-csrf-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	values.Set("csrf_token", string(token))
+	resp, err = client.PostForm(ts.URL+path, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	return resp, string(body)
+}
+
+// postMultipart posts values and file as the "file" field of a multipart form, adding the CSRF token of
+// the client's session, and returns the body of the page the post ended at
+func postMultipart(t *testing.T, ts *httptest.Server, client *http.Client, path string, values url.Values, file string) string {
+	resp, err := client.Get(ts.URL + "/test-csrf-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	values.Set("csrf_token", string(token))
+	for key := range values {
+		_ = mw.WriteField(key, values.Get(key))
+	}
+	fw, err := mw.CreateFormFile("file", "calendar.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write([]byte(file))
+	_ = mw.Close()
+
+	resp, err = client.Post(ts.URL+path, mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	return string(body)
+}
+
+// chooseRoom searches availability and picks roomID, leaving the client on the make-reservation page
+func chooseRoom(t *testing.T, ts *httptest.Server, client *http.Client, roomID string) {
+	resp := postForm(t, ts, client, "/search-availability", url.Values{
+		"start": {"2050-01-01"},
+		"end":   {"2050-01-03"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("search availability returned %d", resp.StatusCode)
+	}
+
+	resp, err := client.Get(ts.URL + "/choose-room/" + roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.Request.URL.Path != "/make-reservation" {
+		t.Fatalf("choose room ended at %s", resp.Request.URL.Path)
+	}
+}
+
+// makeReservation posts the guest details for the room chosen by chooseRoom
+func makeReservation(t *testing.T, ts *httptest.Server, client *http.Client, roomID string) *http.Response {
+	return postForm(t, ts, client, "/make-reservation", url.Values{
+		"first_name": {"Erfei"},
+		"last_name":  {"Yu"},
+		"email":      {"guest@example.com"},
+		"phone":      {"555-555-5555"},
+		"room_id":    {roomID},
+	})
+}
+
+func TestRoutesBookingEndToEnd(t *testing.T) {
+	ts := setUpMemoryApp(t)
+
+	guest := newGuest(t)
+	chooseRoom(t, ts, guest, "1")
+	resp := makeReservation(t, ts, guest, "1")
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/reservation-summary" {
+		t.Fatalf("make reservation ended at %s with %d", resp.Request.URL.Path, resp.StatusCode)
+	}
+
+	start, _ := time.Parse("2006-01-02", "2050-01-02")
+	end, _ := time.Parse("2006-01-02", "2050-01-04")
+	ok, err := handler.Repo.DB.SearchAvailabilityByDateByRoomID(context.Background(), start, end, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("room 1 should be booked after the reservation")
+	}
+
+	rooms, err := handler.Repo.DB.SearchAvailabilityForAllRooms(context.Background(), start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].ID != 2 {
+		t.Errorf("expected only room 2 to be available, got %v", rooms)
+	}
+
+	reservations, err := handler.Repo.DB.AllNewReservations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != 1 || reservations[0].Room.RoomName != "General's Quarters" {
+		t.Fatalf("expected one new reservation for General's Quarters, got %v", reservations)
+	}
+
+	// 2050-01-01 is a Saturday, so one weekend night and one standard night
+	if reservations[0].TotalPrice != 10900+8900 {
+		t.Errorf("expected a total price of 19800, got %d", reservations[0].TotalPrice)
+	}
+}
+
+func TestRoutesDoubleBooking(t *testing.T) {
+	ts := setUpMemoryApp(t)
+
+	first := newGuest(t)
+	second := newGuest(t)
+
+	// both guests see the room as available before either of them books it
+	chooseRoom(t, ts, first, "1")
+	chooseRoom(t, ts, second, "1")
+
+	resp := makeReservation(t, ts, first, "1")
+	if resp.Request.URL.Path != "/reservation-summary" {
+		t.Fatalf("first reservation ended at %s", resp.Request.URL.Path)
+	}
+
+	resp = makeReservation(t, ts, second, "1")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("second reservation should be rejected with %d, got %d", http.StatusConflict, resp.StatusCode)
+	}
+
+	reservations, err := handler.Repo.DB.AllReservations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != 1 {
+		t.Errorf("expected exactly one reservation, got %d", len(reservations))
+	}
+}
+
+func TestRoutesBookRoomInvalidDates(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	guest := newGuest(t)
+
+	for _, query := range []string{"s=nope&e=2050-01-03", "s=2050-01-01&e=", "s=2050-01-03&e=2050-01-01", ""} {
+		resp, err := guest.Get(ts.URL + "/book-room?id=1&" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/search-availability" {
+			t.Errorf("booking with %q ended at %s with %d", query, resp.Request.URL.Path, resp.StatusCode)
+		}
+		if !strings.Contains(string(body), "Please choose valid arrival and departure dates") {
+			t.Errorf("booking with %q doesn't say what is wrong", query)
+		}
+	}
+}
+
+func TestRoutesBookingRoomNotOffered(t *testing.T) {
+	ts := setUpMemoryApp(t)
+
+	inactive, err := handler.Repo.DB.InsertRoom(context.Background(), Models.Room{RoomName: "Closed Wing", Slug: "closed-wing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guest := newGuest(t)
+	chooseRoom(t, ts, guest, "1")
+	for _, id := range []string{strconv.Itoa(inactive), "99"} {
+		resp, err := guest.Get(ts.URL + "/choose-room/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.Request.URL.Path != "/search-availability" {
+			t.Errorf("choosing room %s ended at %s", id, resp.Request.URL.Path)
+		}
+	}
+
+	// a tampered room_id is rejected with the form, not booked or answered with an error
+	for _, id := range []string{strconv.Itoa(inactive), "99"} {
+		resp, body := postFormBody(t, ts, guest, "/make-reservation", url.Values{
+			"first_name": {"Erfei"},
+			"last_name":  {"Yu"},
+			"email":      {"guest@example.com"},
+			"room_id":    {id},
+		})
+		if resp.StatusCode != http.StatusOK || !strings.Contains(body, "There is no such room.") {
+			t.Errorf("booking room %s returned %d without the form error", id, resp.StatusCode)
+		}
+	}
+
+	reservations, err := handler.Repo.DB.AllReservations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != 0 {
+		t.Errorf("expected no reservations, got %d", len(reservations))
+	}
+}
+
+func TestRoutesGuestCancellation(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	app.CancellationDeadline = 48 * time.Hour
+	t.Cleanup(func() { app.CancellationDeadline = 0 })
+
+	guest := newGuest(t)
+	chooseRoom(t, ts, guest, "1")
+	makeReservation(t, ts, guest, "1")
+
+	reservations, err := handler.Repo.DB.AllReservations(context.Background())
+	if err != nil || len(reservations) != 1 {
+		t.Fatalf("expected one reservation, got %d and %v", len(reservations), err)
+	}
+	code := reservations[0].ConfirmationCode
+	if len(code) != 10 {
+		t.Fatalf("expected a 10 character confirmation code, got %q", code)
+	}
+
+	// someone else can't use the code without the email it was booked with
+	other := newGuest(t)
+	resp := postForm(t, ts, other, "/my-reservation", url.Values{"code": {code}, "email": {"other@example.com"}})
+	if resp.Request.URL.Path != "/my-reservation" {
+		t.Fatalf("look up with the wrong email ended at %s", resp.Request.URL.Path)
+	}
+	resp = postForm(t, ts, other, "/my-reservation/cancel", url.Values{})
+	if resp.Request.URL.Path != "/my-reservation" {
+		t.Fatalf("cancel without a look up ended at %s", resp.Request.URL.Path)
+	}
+
+	resp = postForm(t, ts, guest, "/my-reservation", url.Values{"code": {code}, "email": {"Guest@Example.com"}})
+	if resp.Request.URL.Path != "/my-reservation/details" {
+		t.Fatalf("look up ended at %s", resp.Request.URL.Path)
+	}
+
+	resp = postForm(t, ts, guest, "/my-reservation/cancel", url.Values{})
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/my-reservation/details" {
+		t.Fatalf("cancel ended at %s with %d", resp.Request.URL.Path, resp.StatusCode)
+	}
+
+	res, err := handler.Repo.DB.GetReservationByID(context.Background(), reservations[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Cancelled != 1 {
+		t.Error("reservation should be cancelled")
+	}
+
+	ok, err := handler.Repo.DB.SearchAvailabilityByDateByRoomID(context.Background(), res.StartDate, res.EndDate, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("room 1 should be available again after the cancellation")
+	}
+
+	fresh, err := handler.Repo.DB.AllNewReservations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fresh) != 0 {
+		t.Errorf("cancelled reservations should not be listed as new, got %d", len(fresh))
+	}
+}
+
+func TestRoutesGuestLookupThrottle(t *testing.T) {
+	ts := setUpMemoryApp(t)
+
+	guest := newGuest(t)
+	chooseRoom(t, ts, guest, "1")
+	makeReservation(t, ts, guest, "1")
+	reservations, err := handler.Repo.DB.AllReservations(context.Background())
+	if err != nil || len(reservations) != 1 {
+		t.Fatalf("expected one reservation, got %d and %v", len(reservations), err)
+	}
+	code := reservations[0].ConfirmationCode
+
+	// a client IP may get 10 lookups wrong, then even the right code is refused for a while
+	for i := 0; i < 10; i++ {
+		resp := postForm(t, ts, guest, "/my-reservation", url.Values{"code": {"ZZZZ23456" + strconv.Itoa(i)}, "email": {"guest@example.com"}})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong lookup %d returned %d", i+1, resp.StatusCode)
+		}
+	}
+
+	resp, body := postFormBody(t, ts, guest, "/my-reservation", url.Values{"code": {code}, "email": {"guest@example.com"}})
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, "Too many reservations were not found") {
+		t.Errorf("expected the lookup to be refused with %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	token := newAPIToken(t, Models.ScopeReservationsRead)
+	status := apiReservation(t, ts, token, code, "guest@example.com", nil)
+	if status != http.StatusTooManyRequests {
+		t.Errorf("expected the API to refuse the lookup with %d, got %d", http.StatusTooManyRequests, status)
+	}
+}
+
+func TestRoutesAdminPermissions(t *testing.T) {
+	ts := setUpMemoryApp(t)
+
+	resp, err := newGuest(t).Get(ts.URL + "/admin/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.Request.URL.Path != "/user/login" {
+		t.Fatalf("anonymous admin request ended at %s", resp.Request.URL.Path)
+	}
+
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+	for _, path := range []string{"/admin/rooms", "/admin/rooms/1/calendars", "/admin/users", "/admin/users/new", "/admin/users/1", "/admin/webhooks", "/admin/mail"} {
+		resp, err = owner.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != path {
+			t.Fatalf("owner got %d at %s on %s", resp.StatusCode, resp.Request.URL.Path, path)
+		}
+	}
+
+	// a demotion counts from the next request, also in the session that is already logged in
+	u, err := handler.Repo.DB.GetUserByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.AccessLevel = int(Models.RoleReadOnly)
+	if err := handler.Repo.DB.UpdateUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+
+	readOnly := newGuest(t)
+	postForm(t, ts, readOnly, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/admin/reservations-all", http.StatusOK},
+		{"/admin/rooms", http.StatusForbidden},
+		{"/admin/users", http.StatusForbidden},
+		{"/admin/rooms/1/calendars", http.StatusForbidden},
+		{"/admin/api-tokens", http.StatusForbidden},
+		{"/admin/webhooks", http.StatusForbidden},
+		{"/admin/mail", http.StatusForbidden},
+		{"/admin/delete-reservation/all/1/do", http.StatusForbidden},
+	}
+	for _, client := range []*http.Client{readOnly, owner} {
+		for _, e := range tests {
+			resp, err := client.Get(ts.URL + e.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != e.status {
+				t.Errorf("read only user got %d on %s, expected %d", resp.StatusCode, e.path, e.status)
+			}
+		}
+	}
+}
+
+func TestRoutesDeactivatedUser(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	ctx := context.Background()
+
+	id, err := handler.Repo.DB.InsertUser(ctx, Models.User{
+		FirstName:   "Front",
+		LastName:    "Desk",
+		Email:       "desk@here.com",
+		Password:    "secret123",
+		AccessLevel: int(Models.RoleFrontDesk),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+	staff := newGuest(t)
+	postForm(t, ts, staff, "/user/login", url.Values{"email": {"desk@here.com"}, "password": {"secret123"}})
+
+	// adminPath returns where a GET of path ended for client
+	adminPath := func(client *http.Client, path string) string {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		return resp.Request.URL.Path
+	}
+
+	if got := adminPath(staff, "/admin/reservations-all"); got != "/admin/reservations-all" {
+		t.Fatalf("staff request ended at %s", got)
+	}
+
+	// the token of the staff member must not outlive their account
+	token, err := helpers.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = handler.Repo.DB.InsertAPIToken(ctx, Models.APIToken{
+		Name:      "desk",
+		TokenHash: helpers.HashToken(token),
+		Scopes:    string(Models.ScopeAvailabilityRead),
+		UserID:    id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := apiRequest(t, ts, token, "GET", "/api/v1/rooms", nil, nil); status != http.StatusOK {
+		t.Fatalf("the token of the staff member got %d", status)
+	}
+
+	// a link of another site can't deactivate anyone
+	deactivate := fmt.Sprintf("/admin/users/%d/deactivate", id)
+	adminPath(owner, deactivate)
+	if u, _ := handler.Repo.DB.GetUserByID(ctx, id); !u.Active {
+		t.Fatal("a GET deactivated the user")
+	}
+	if resp := postForm(t, ts, owner, deactivate, url.Values{}); resp.Request.URL.Path != "/admin/users" {
+		t.Fatalf("deactivating ended at %s", resp.Request.URL.Path)
+	}
+	if status := apiRequest(t, ts, token, "GET", "/api/v1/rooms", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("the token of the deactivated user got %d", status)
+	}
+	// tokens that weren't revoked, such as those of users deactivated before tokens were, are refused too
+	tokens, err := handler.Repo.DB.AllAPITokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range tokens {
+		if tok.UserID == id && !tok.Revoked() {
+			t.Errorf("token %d of the deactivated user wasn't revoked", tok.ID)
+		}
+	}
+	stale, err := helpers.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = handler.Repo.DB.InsertAPIToken(ctx, Models.APIToken{
+		Name:      "stale",
+		TokenHash: helpers.HashToken(stale),
+		Scopes:    string(Models.ScopeAvailabilityRead),
+		UserID:    id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := apiRequest(t, ts, stale, "GET", "/api/v1/rooms", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("an unrevoked token of the deactivated user got %d", status)
+	}
+	if resp := postForm(t, ts, owner, "/admin/users/99/deactivate", url.Values{}); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deactivating an unknown user got %d", resp.StatusCode)
+	}
+
+	// the staff member is logged out on their next request, and stays logged out
+	for i := 0; i < 2; i++ {
+		if got := adminPath(staff, "/admin/reservations-all"); got != "/user/login" {
+			t.Errorf("request %d of the deactivated user ended at %s", i+1, got)
+		}
+	}
+
+	// the same goes for a user who is locked while logged in
+	if err := handler.Repo.DB.LockUser(ctx, 1, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := adminPath(owner, "/admin/dashboard"); got != "/user/login" {
+		t.Errorf("request of the locked user ended at %s", got)
+	}
+}
+
+func TestRoutesPasswordReset(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	guest := newGuest(t)
+	resp := postForm(t, ts, guest, "/user/forgot-password", url.Values{"email": {"nobody@here.com"}})
+	if mail := pendingMail(t); resp.Request.URL.Path != "/user/login" || len(mail) != 0 {
+		t.Fatalf("unknown email ended at %s with %d mails", resp.Request.URL.Path, len(mail))
+	}
+
+	postForm(t, ts, guest, "/user/forgot-password", url.Values{"email": {"Me@Me.com"}})
+	mail := pendingMail(t)
+	if len(mail) == 0 {
+		t.Fatal("no password reset email was queued")
+	}
+	msg := mail[0]
+	// the link has to work from a mail client, so it is absolute
+	link := regexp.MustCompile(`href="(` + regexp.QuoteMeta(ts.URL) + `/user/reset-password\?token=([A-Za-z0-9_-]+))"`)
+	token := link.FindStringSubmatch(msg.Content)
+	if msg.To != "me@me.com" || token == nil {
+		t.Fatalf("unexpected email to %s: %s", msg.To, msg.Content)
+	}
+
+	resp, err := guest.Get(token[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/user/reset-password" {
+		t.Fatalf("reset link ended at %s with %d", resp.Request.URL.Path, resp.StatusCode)
+	}
+
+	values := url.Values{"token": {token[2]}, "password": {"new password"}, "password_confirm": {"new password"}}
+	resp = postForm(t, ts, guest, "/user/reset-password", values)
+	if resp.Request.URL.Path != "/user/login" {
+		t.Fatalf("reset ended at %s", resp.Request.URL.Path)
+	}
+	resp = postForm(t, ts, guest, "/user/reset-password", values)
+	if resp.Request.URL.Path != "/user/forgot-password" {
+		t.Errorf("reusing the token ended at %s", resp.Request.URL.Path)
+	}
+
+	if _, _, err := handler.Repo.DB.Authenticate(context.Background(), "me@me.com", "new password"); err != nil {
+		t.Errorf("expected the new password to work, got %v", err)
+	}
+}
+
+func TestRoutesStaffInvitation(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+
+	postForm(t, ts, owner, "/admin/users/new", url.Values{
+		"first_name":       {"Front"},
+		"last_name":        {"Desk"},
+		"email":            {"desk@here.com"},
+		"access_level":     {"2"},
+		"password":         {"secret123"},
+		"password_confirm": {"secret123"},
+	})
+	mail := pendingMail(t)
+	if len(mail) != 1 || mail[0].To != "desk@here.com" {
+		t.Fatalf("expected one invitation to desk@here.com, got %d mails", len(mail))
+	}
+	if !strings.Contains(mail[0].Content, `href="`+ts.URL+`/user/login"`) {
+		t.Errorf("invitation doesn't link to the login page: %s", mail[0].Content)
+	}
+}
+
+func TestRoutesTwoFactor(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	login := url.Values{"email": {"me@me.com"}, "password": {"password"}}
+
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", login)
+	profile := getBody(t, owner, ts.URL+"/admin/profile")
+	secret := regexp.MustCompile(`Key: <span class="text-monospace">([A-Z2-7]+)</span>`).FindStringSubmatch(profile)
+	if secret == nil {
+		t.Fatal("no secret on the profile page")
+	}
+	code, err := totp.Code(secret[1], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, profile = postFormBody(t, ts, owner, "/admin/profile/two-factor", url.Values{"code": {code}})
+	recoveryCodes := regexp.MustCompile(`[A-Z2-9]{5}-[A-Z2-9]{5}`).FindAllString(profile, -1)
+	if len(recoveryCodes) != 10 {
+		t.Fatalf("expected 10 recovery codes after enabling two-factor authentication, got %d", len(recoveryCodes))
+	}
+
+	// the password alone no longer logs in
+	other := newGuest(t)
+	resp := postForm(t, ts, other, "/user/login", login)
+	if resp.Request.URL.Path != "/user/two-factor" {
+		t.Fatalf("login with two-factor authentication ended at %s", resp.Request.URL.Path)
+	}
+	resp, err = other.Get(ts.URL + "/admin/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.Request.URL.Path != "/user/login" {
+		t.Errorf("a pending login reached %s", resp.Request.URL.Path)
+	}
+	// the code was used to enable two-factor authentication, so it can't log in again
+	resp = postForm(t, ts, other, "/user/two-factor", url.Values{"code": {code}})
+	if resp.Request.URL.Path != "/user/two-factor" {
+		t.Errorf("a replayed code ended at %s", resp.Request.URL.Path)
+	}
+	resp = postForm(t, ts, other, "/user/two-factor", url.Values{"code": {strings.ToLower(recoveryCodes[0])}})
+	if resp.Request.URL.Path != "/admin/profile" {
+		t.Fatalf("login with a recovery code ended at %s", resp.Request.URL.Path)
+	}
+
+	third := newGuest(t)
+	postForm(t, ts, third, "/user/login", login)
+	resp = postForm(t, ts, third, "/user/two-factor", url.Values{"code": {recoveryCodes[0]}})
+	if resp.Request.URL.Path != "/user/two-factor" {
+		t.Errorf("a used recovery code ended at %s", resp.Request.URL.Path)
+	}
+
+	// owners now need two-factor authentication, so without it they are held on the profile page
+	postForm(t, ts, owner, "/admin/users/two-factor", url.Values{"require_4": {"1"}})
+	if err := handler.Repo.DB.DisableTwoFactor(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	fourth := newGuest(t)
+	resp = postForm(t, ts, fourth, "/user/login", login)
+	if resp.Request.URL.Path != "/admin/profile" {
+		t.Fatalf("login without required two-factor authentication ended at %s", resp.Request.URL.Path)
+	}
+	resp, err = fourth.Get(ts.URL + "/admin/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.Request.URL.Path != "/admin/profile" {
+		t.Errorf("the dashboard was reachable before setting up two-factor authentication, ended at %s", resp.Request.URL.Path)
+	}
+}
+
+func TestRoutesResetUserTwoFactor(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	ctx := context.Background()
+
+	id, err := handler.Repo.DB.InsertUser(ctx, Models.User{
+		FirstName:   "Front",
+		LastName:    "Desk",
+		Email:       "desk@here.com",
+		Password:    "secret123",
+		AccessLevel: int(Models.RoleFrontDesk),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.Repo.DB.EnableTwoFactor(ctx, id, secret, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+	path := fmt.Sprintf("/admin/users/%d/disable-two-factor", id)
+
+	// a link or a form of another site has neither the method nor the CSRF token
+	resp, err := owner.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	resp, err = owner.PostForm(ts.URL+path, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if u, _ := handler.Repo.DB.GetUserByID(ctx, id); !u.TOTPEnabled {
+		t.Fatal("two-factor authentication was turned off without the CSRF token")
+	}
+
+	resp = postForm(t, ts, owner, path, url.Values{})
+	if resp.Request.URL.Path != fmt.Sprintf("/admin/users/%d", id) {
+		t.Errorf("resetting ended at %s", resp.Request.URL.Path)
+	}
+	if u, _ := handler.Repo.DB.GetUserByID(ctx, id); u.TOTPEnabled {
+		t.Error("two-factor authentication is still on")
+	}
+
+	if resp := postForm(t, ts, owner, "/admin/users/99/disable-two-factor", url.Values{}); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("resetting an unknown user got %d", resp.StatusCode)
+	}
+}
+
+func TestRoutesTwoFactorLockout(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	app.LoginMaxAttempts = 3
+	app.LoginMaxAttemptsPerIP = 100
+	app.LoginAttemptWindow = time.Minute
+	app.LoginLockout = time.Minute
+	app.LoginDelay = time.Nanosecond
+	t.Cleanup(func() {
+		app.LoginMaxAttempts = 0
+		app.LoginMaxAttemptsPerIP = 0
+		app.LoginAttemptWindow = 0
+		app.LoginLockout = 0
+		app.LoginDelay = 0
+	})
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.Repo.DB.EnableTwoFactor(context.Background(), 1, secret, nil); err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	// someone who knows the password guesses one code per login, which must not start afresh every time
+	attacker := newGuest(t)
+	login := url.Values{"email": {"me@me.com"}, "password": {"password"}}
+	for i := 0; i < app.LoginMaxAttempts; i++ {
+		resp := postForm(t, ts, attacker, "/user/login", login)
+		if resp.Request.URL.Path != "/user/two-factor" {
+			t.Fatalf("login %d ended at %s", i+1, resp.Request.URL.Path)
+		}
+		postForm(t, ts, attacker, "/user/two-factor", url.Values{"code": {wrong}})
+	}
+
+	u, err := handler.Repo.DB.GetUserByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.Locked() {
+		t.Fatal("wrong codes didn't lock the account")
+	}
+	if mail := pendingMail(t); len(mail) != 1 || mail[0].Subject != "Account Locked" {
+		t.Errorf("expected a lockout email, got %d mails", len(mail))
+	}
+
+	resp := postForm(t, ts, attacker, "/user/login", login)
+	if resp.Request.URL.Path != "/user/login" {
+		t.Errorf("login of the locked user ended at %s", resp.Request.URL.Path)
+	}
+}
+
+func TestRoutesLoginLockout(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	app.LoginMaxAttempts = 3
+	app.LoginMaxAttemptsPerIP = 100
+	app.LoginAttemptWindow = time.Minute
+	app.LoginLockout = time.Minute
+	app.LoginDelay = time.Hour
+	t.Cleanup(func() {
+		app.LoginMaxAttempts = 0
+		app.LoginMaxAttemptsPerIP = 0
+		app.LoginAttemptWindow = 0
+		app.LoginLockout = 0
+		app.LoginDelay = 0
+	})
+
+	// after a failure the next try has to wait, even before the account is locked
+	attacker := newGuest(t)
+	wrong := url.Values{"email": {"other@here.com"}, "password": {"wrong"}}
+	_, body := postFormBody(t, ts, attacker, "/user/login", wrong)
+	if !strings.Contains(body, "Invalid login credentials") {
+		t.Fatal("first failed login was not reported as invalid credentials")
+	}
+	_, body = postFormBody(t, ts, attacker, "/user/login", wrong)
+	if !strings.Contains(body, "Too many failed logins") {
+		t.Fatal("second login right after a failure was not delayed")
+	}
+
+	app.LoginDelay = time.Nanosecond
+	wrong = url.Values{"email": {"me@me.com"}, "password": {"wrong"}}
+	for i := 0; i < app.LoginMaxAttempts; i++ {
+		postForm(t, ts, attacker, "/user/login", wrong)
+	}
+	mail := pendingMail(t)
+	if len(mail) == 0 {
+		t.Fatal("no lockout email was queued")
+	}
+	msg := mail[0]
+	if msg.To != "me@me.com" || msg.Subject != "Account Locked" {
+		t.Errorf("unexpected email to %s: %s", msg.To, msg.Subject)
+	}
+
+	owner := newGuest(t)
+	login := url.Values{"email": {"me@me.com"}, "password": {"password"}}
+	resp := postForm(t, ts, owner, "/user/login", login)
+	if resp.Request.URL.Path != "/user/login" {
+		t.Fatalf("login of a locked user ended at %s", resp.Request.URL.Path)
+	}
+
+	_, err := handler.Repo.DB.InsertUser(context.Background(), Models.User{
+		FirstName:   "Other",
+		LastName:    "Owner",
+		Email:       "boss@me.com",
+		Password:    "password",
+		AccessLevel: int(Models.RoleOwner),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	boss := newGuest(t)
+	postForm(t, ts, boss, "/user/login", url.Values{"email": {"boss@me.com"}, "password": {"password"}})
+	if !strings.Contains(getBody(t, boss, ts.URL+"/admin/users/1"), "is locked until") {
+		t.Error("the user page doesn't show the lock")
+	}
+	resp, err = boss.Get(ts.URL + "/admin/users/1/unlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if u, _ := handler.Repo.DB.GetUserByID(context.Background(), 1); !u.Locked() {
+		t.Fatal("a GET unlocked the user")
+	}
+	postForm(t, ts, boss, "/admin/users/1/unlock", url.Values{})
+
+	// the email is matched regardless of case, as it is when the account is looked up for the lockout
+	resp = postForm(t, ts, owner, "/user/login", url.Values{"email": {"Me@Me.com"}, "password": {"password"}})
+	if resp.Request.URL.Path != "/" {
+		t.Fatalf("login after unlocking ended at %s", resp.Request.URL.Path)
+	}
+	attempts, err := handler.Repo.DB.GetLoginAttempts(context.Background(), "me@me.com", "", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range attempts {
+		if a.Email == "me@me.com" {
+			t.Fatal("the login with differently cased email counted as a failure")
+		}
+	}
+
+	// the failure for other@here.com still counts against the client IP
+	app.LoginMaxAttemptsPerIP = 1
+	_, body = postFormBody(t, ts, newGuest(t), "/user/login", url.Values{"email": {"boss@me.com"}, "password": {"password"}})
+	if !strings.Contains(body, "Too many failed logins") {
+		t.Error("login from a blocked IP was not refused")
+	}
+}
+
+// newAPIToken stores an API token with scopes, created by the seeded owner, and returns it
+func newAPIToken(t *testing.T, scopes ...Models.Scope) string {
+	token, err := helpers.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, s := range scopes {
+		names = append(names, string(s))
+	}
+	_, err = handler.Repo.DB.InsertAPIToken(context.Background(), Models.APIToken{
+		Name:      "test",
+		TokenHash: helpers.HashToken(token),
+		Scopes:    strings.Join(names, " "),
+		UserID:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// apiRequest sends body as JSON to the API with the bearer token, if there is one, and decodes the JSON response
+// into out, returning the status code
+func apiRequest(t *testing.T, ts *httptest.Server, token, method, path string, body, out interface{}) int {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return apiDo(t, req, out)
+}
+
+// apiReservation fetches the reservation with code through the API, sending email in the X-Guest-Email header
+func apiReservation(t *testing.T, ts *httptest.Server, token, code, email string, out interface{}) int {
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/reservations/"+code, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Guest-Email", email)
+
+	return apiDo(t, req, out)
+}
+
+// apiDo sends an API request, decoding the JSON response into out if it isn't nil, and returns its status
+func apiDo(t *testing.T, req *http.Request, out interface{}) int {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("%s %s returned content type %q", req.Method, req.URL.Path, ct)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestRoutesAPI(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	app.CancellationDeadline = 48 * time.Hour
+	t.Cleanup(func() { app.CancellationDeadline = 0 })
+	token := newAPIToken(t, Models.Scopes...)
+
+	var rooms struct {
+		Rooms []struct {
+			ID   int    `json:"id"`
+			Slug string `json:"slug"`
+		} `json:"rooms"`
+	}
+	if status := apiRequest(t, ts, token, "GET", "/api/v1/rooms", nil, &rooms); status != http.StatusOK || len(rooms.Rooms) == 0 {
+		t.Fatalf("listing rooms returned %d with %d rooms", status, len(rooms.Rooms))
+	}
+
+	var availability struct {
+		Rooms []struct {
+			ID         int `json:"id"`
+			TotalPrice int `json:"total_price"`
+		} `json:"rooms"`
+	}
+	status := apiRequest(t, ts, token, "GET", "/api/v1/availability?start_date=2050-01-01&end_date=2050-01-03", nil, &availability)
+	if status != http.StatusOK || len(availability.Rooms) != len(rooms.Rooms) || availability.Rooms[0].TotalPrice <= 0 {
+		t.Fatalf("availability returned %d with %+v", status, availability.Rooms)
+	}
+
+	booking := map[string]interface{}{
+		"room_id":    1,
+		"start_date": "2050-01-01",
+		"end_date":   "2050-01-03",
+		"first_name": "Erfei",
+		"last_name":  "Yu",
+		"email":      "guest@example.com",
+	}
+	var res struct {
+		ConfirmationCode string `json:"confirmation_code"`
+		TotalPrice       int    `json:"total_price"`
+		Cancelled        bool   `json:"cancelled"`
+		CanCancel        bool   `json:"can_cancel"`
+	}
+	if status := apiRequest(t, ts, token, "POST", "/api/v1/reservations", booking, &res); status != http.StatusCreated {
+		t.Fatalf("creating a reservation returned %d", status)
+	}
+	if len(res.ConfirmationCode) != 10 || res.TotalPrice != availability.Rooms[0].TotalPrice || !res.CanCancel {
+		t.Fatalf("unexpected reservation %+v", res)
+	}
+
+	var apiErr struct {
+		Error struct {
+			Code   string              `json:"code"`
+			Fields map[string][]string `json:"fields"`
+		} `json:"error"`
+	}
+	if status := apiRequest(t, ts, token, "POST", "/api/v1/reservations", booking, &apiErr); status != http.StatusConflict || apiErr.Error.Code != "room_unavailable" {
+		t.Errorf("double booking returned %d with %q", status, apiErr.Error.Code)
+	}
+
+	status = apiRequest(t, ts, token, "GET", "/api/v1/availability?start_date=2050-01-02&end_date=2050-01-04&room_id=1", nil, &availability)
+	if status != http.StatusOK || len(availability.Rooms) != 0 {
+		t.Errorf("booked room 1 is still available: %d with %+v", status, availability.Rooms)
+	}
+
+	code := res.ConfirmationCode
+	if status := apiReservation(t, ts, token, code, "Guest@Example.com", &res); status != http.StatusOK || res.ConfirmationCode != code {
+		t.Fatalf("fetching the reservation returned %d with %+v", status, res)
+	}
+	if status := apiReservation(t, ts, token, code, "other@example.com", &apiErr); status != http.StatusNotFound {
+		t.Errorf("fetching with the wrong email returned %d", status)
+	}
+	if status := apiRequest(t, ts, token, "GET", "/api/v1/reservations/"+code+"?email=guest@example.com", nil, &apiErr); status != http.StatusUnprocessableEntity {
+		t.Errorf("fetching with the email in the query returned %d, expected %d", status, http.StatusUnprocessableEntity)
+	}
+
+	cancel := map[string]string{"email": "guest@example.com"}
+	if status := apiRequest(t, ts, token, "POST", "/api/v1/reservations/"+code+"/cancel", cancel, &res); status != http.StatusOK || !res.Cancelled {
+		t.Fatalf("cancelling returned %d with %+v", status, res)
+	}
+	if status := apiRequest(t, ts, token, "POST", "/api/v1/reservations/"+code+"/cancel", cancel, &apiErr); status != http.StatusConflict || apiErr.Error.Code != "cannot_cancel" {
+		t.Errorf("cancelling twice returned %d with %q", status, apiErr.Error.Code)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		status int
+		field  string
+	}{
+		{"bad dates", "GET", "/api/v1/availability?start_date=tomorrow&end_date=2050-01-03", nil, http.StatusUnprocessableEntity, "start_date"},
+		{"end before start", "GET", "/api/v1/availability?start_date=2050-01-03&end_date=2050-01-01", nil, http.StatusUnprocessableEntity, "end_date"},
+		{"past dates", "GET", "/api/v1/availability?start_date=2000-01-01&end_date=2000-01-03", nil, http.StatusUnprocessableEntity, "start_date"},
+		{"bad room", "GET", "/api/v1/availability?start_date=2050-01-01&end_date=2050-01-03&room_id=x", nil, http.StatusUnprocessableEntity, "room_id"},
+		{"unknown room", "POST", "/api/v1/reservations", map[string]interface{}{"room_id": 99, "start_date": "2050-02-01", "end_date": "2050-02-03", "first_name": "Erfei", "last_name": "Yu", "email": "guest@example.com"}, http.StatusUnprocessableEntity, "room_id"},
+		{"missing email", "POST", "/api/v1/reservations", map[string]interface{}{"room_id": 1, "start_date": "2050-02-01", "end_date": "2050-02-03", "first_name": "Erfei", "last_name": "Yu"}, http.StatusUnprocessableEntity, "email"},
+		{"unknown field", "POST", "/api/v1/reservations", map[string]interface{}{"room": 1}, http.StatusBadRequest, ""},
+		{"unknown path", "GET", "/api/v1/nothing", nil, http.StatusNotFound, ""},
+		{"wrong method", "DELETE", "/api/v1/rooms", nil, http.StatusMethodNotAllowed, ""},
+	}
+	for _, e := range tests {
+		apiErr.Error.Code, apiErr.Error.Fields = "", nil
+		status := apiRequest(t, ts, token, e.method, e.path, e.body, &apiErr)
+		if status != e.status || apiErr.Error.Code == "" {
+			t.Errorf("%s: got %d with code %q, expected %d", e.name, status, apiErr.Error.Code, e.status)
+		}
+		if e.field != "" && len(apiErr.Error.Fields[e.field]) == 0 {
+			t.Errorf("%s: expected an error for %s, got %v", e.name, e.field, apiErr.Error.Fields)
+		}
+	}
+}
+
+func TestRoutesAPITokens(t *testing.T) {
+	ts := setUpMemoryApp(t)
+
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+	_, body := postFormBody(t, ts, owner, "/admin/api-tokens", url.Values{"name": {"channel manager"}})
+	if !strings.Contains(body, "Choose at least one scope.") {
+		t.Fatal("a token without scopes was not rejected")
+	}
+	_, body = postFormBody(t, ts, owner, "/admin/api-tokens", url.Values{
+		"name":   {"channel manager"},
+		"scopes": {string(Models.ScopeAvailabilityRead)},
+	})
+	token := regexp.MustCompile(`<p class="text-monospace mb-0">([A-Za-z0-9_-]+)</p>`).FindStringSubmatch(body)
+	if token == nil {
+		t.Fatal("the new token was not shown")
+	}
+	if strings.Contains(getBody(t, owner, ts.URL+"/admin/api-tokens"), token[1]) {
+		t.Error("the new token was shown twice")
+	}
+
+	var apiErr struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if status := apiRequest(t, ts, "", "GET", "/api/v1/rooms", nil, &apiErr); status != http.StatusUnauthorized || apiErr.Error.Code != "unauthorized" {
+		t.Errorf("a request without a token returned %d with %q", status, apiErr.Error.Code)
+	}
+	if status := apiRequest(t, ts, "", "POST", "/api/v1/reservations", map[string]int{"room_id": 1}, &apiErr); status != http.StatusUnauthorized {
+		t.Errorf("a post without a token returned %d", status)
+	}
+	if status := apiRequest(t, ts, "wrong", "GET", "/api/v1/rooms", nil, &apiErr); status != http.StatusUnauthorized {
+		t.Errorf("a request with an unknown token returned %d", status)
+	}
+	if status := apiRequest(t, ts, token[1], "GET", "/api/v1/rooms", nil, nil); status != http.StatusOK {
+		t.Errorf("a request with the token returned %d", status)
+	}
+
+	// a post with the token needs no CSRF token, but the scope of the token has to allow it
+	if status := apiRequest(t, ts, token[1], "POST", "/api/v1/reservations", map[string]int{"room_id": 1}, &apiErr); status != http.StatusForbidden || apiErr.Error.Code != "forbidden" {
+		t.Errorf("a post outside the scope of the token returned %d with %q", status, apiErr.Error.Code)
+	}
+
+	tokens, err := handler.Repo.DB.AllAPITokens(context.Background())
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("expected 1 token, got %d and %v", len(tokens), err)
+	}
+	if tokens[0].LastUsedAt.IsZero() || tokens[0].TokenHash == token[1] {
+		t.Errorf("unexpected stored token %+v", tokens[0])
+	}
+
+	resp, err := owner.Get(ts.URL + fmt.Sprintf("/admin/revoke-api-token/%d/do", tokens[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if status := apiRequest(t, ts, token[1], "GET", "/api/v1/rooms", nil, &apiErr); status != http.StatusUnauthorized {
+		t.Errorf("a request with a revoked token returned %d", status)
+	}
+}
+
+func TestRoutesICalFeed(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	ctx := context.Background()
+
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+	if strings.Contains(getBody(t, owner, ts.URL+"/admin/rooms/1"), "/ical/") {
+		t.Fatal("a room without a feed shows a feed URL")
+	}
+	body := getBody(t, owner, ts.URL+"/admin/new-ical-token/1/do")
+	feed := regexp.MustCompile(`value="(http://[^"]+/ical/[A-Za-z0-9_-]+\.ics)"`).FindStringSubmatch(body)
+	if feed == nil {
+		t.Fatal("the feed URL was not shown")
+	}
+
+	start := time.Now().AddDate(0, 0, 10).Truncate(24 * time.Hour)
+	resID, err := handler.Repo.DB.CreateReservation(ctx, Models.Reservation{
+		FirstName: "Erfei",
+		LastName:  "Yu",
+		Email:     "guest@example.com",
+		StartDate: start,
+		EndDate:   start.AddDate(0, 0, 2),
+		RoomID:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.Repo.DB.InsertBlockForRoom(ctx, 1, start.AddDate(0, 0, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// getFeed returns the feed with its folded lines joined
+	getFeed := func() string {
+		resp, err := http.Get(feed[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/calendar; charset=utf-8" {
+			t.Fatalf("the feed returned %d with %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return strings.ReplaceAll(string(b), "\r\n ", "")
+	}
+
+	ics := getFeed()
+	host := strings.Split(strings.TrimPrefix(ts.URL, "http://"), ":")[0]
+	expected := []string{
+		"X-WR-CALNAME:General's Quarters\r\n",
+		fmt.Sprintf("UID:reservation-%d@%s\r\n", resID, host),
+		"DTSTART;VALUE=DATE:" + start.Format("20060102") + "\r\n",
+		"DTEND;VALUE=DATE:" + start.AddDate(0, 0, 2).Format("20060102") + "\r\n",
+		"UID:block-",
+		"DTSTART;VALUE=DATE:" + start.AddDate(0, 0, 5).Format("20060102") + "\r\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(ics, e) {
+			t.Errorf("expected the feed to contain %q, got\n%s", e, ics)
+		}
+	}
+	if strings.Contains(ics, "guest@example.com") || strings.Contains(ics, "Erfei") {
+		t.Error("the feed shows who the guest is")
+	}
+	uids := regexp.MustCompile(`UID:.*`).FindAllString(ics, -1)
+	if again := regexp.MustCompile(`UID:.*`).FindAllString(getFeed(), -1); strings.Join(uids, ",") != strings.Join(again, ",") {
+		t.Errorf("the UIDs changed from %v to %v", uids, again)
+	}
+
+	// a cancelled reservation leaves the feed
+	if err := handler.Repo.DB.CancelReservation(ctx, resID); err != nil {
+		t.Fatal(err)
+	}
+	if ics := getFeed(); strings.Contains(ics, "UID:reservation-") || !strings.Contains(ics, "UID:block-") {
+		t.Errorf("expected only the block after cancelling, got\n%s", ics)
+	}
+
+	// a new URL locks out whoever has the old one
+	_ = getBody(t, owner, ts.URL+"/admin/new-ical-token/1/do")
+	resp, err := http.Get(feed[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("the old feed URL returned %d", resp.StatusCode)
+	}
+}
+
+func TestRoutesICalImport(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	ctx := context.Background()
+
+	// the other site's calendar, events are nights from start
+	start := time.Now().AddDate(0, 0, 20).Truncate(24 * time.Hour)
+	var mu sync.Mutex
+	events := map[string][2]int{"one@other": {0, 2}, "two@other": {4, 6}, "three@other": {10, 12}, "four@other": {14, 15}}
+	failing := false
+	calendar := func(events map[string][2]int) string {
+		var c ical.Calendar
+		for uid, nights := range events {
+			c.Events = append(c.Events, ical.Event{
+				UID:   uid,
+				Start: start.AddDate(0, 0, nights[0]),
+				End:   start.AddDate(0, 0, nights[1]),
+			})
+		}
+		var buf bytes.Buffer
+		_ = c.Encode(&buf)
+		return buf.String()
+	}
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, calendar(events))
+	}))
+	defer other.Close()
+
+	// a reservation already takes the nights of the third event
+	_, err := handler.Repo.DB.CreateReservation(ctx, Models.Reservation{
+		FirstName: "Erfei",
+		Email:     "guest@example.com",
+		StartDate: start.AddDate(0, 0, 10),
+		EndDate:   start.AddDate(0, 0, 12),
+		RoomID:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+	_, body := postFormBody(t, ts, owner, "/admin/rooms/1/calendars", url.Values{"name": {"Other"}, "url": {"ftp://other"}})
+	if !strings.Contains(body, "Enter the http, https or webcal URL of the calendar.") {
+		t.Fatal("an ftp URL was not rejected")
+	}
+	_, body = postFormBody(t, ts, owner, "/admin/rooms/1/calendars", url.Values{"name": {"Other"}, "url": {other.URL}})
+	if !strings.Contains(body, "1 events were skipped as their nights are already taken") {
+		t.Errorf("the skipped event was not reported:\n%s", body)
+	}
+
+	// external returns the external blocks of a room by their UID
+	external := func(roomID int) map[string]Models.RoomRestriction {
+		restrictions, err := handler.Repo.DB.GetRestrictionsForRoomByDate(ctx, roomID, start.AddDate(0, 0, -1), start.AddDate(0, 0, 30))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks := make(map[string]Models.RoomRestriction)
+		for _, r := range restrictions {
+			if r.RestrictionID == Models.RestrictionExternal {
+				blocks[r.ExternalUID] = r
+			}
+		}
+		return blocks
+	}
+	nights := func(r Models.RoomRestriction) [2]int {
+		return [2]int{int(r.StartDate.Sub(start).Hours() / 24), int(r.EndDate.Sub(start).Hours() / 24)}
+	}
+
+	blocks := external(1)
+	if len(blocks) != 3 || nights(blocks["one@other"]) != [2]int{0, 2} || nights(blocks["two@other"]) != [2]int{4, 6} {
+		t.Fatalf("unexpected blocks %+v", blocks)
+	}
+	if available, _ := handler.Repo.DB.SearchAvailabilityByDateByRoomID(ctx, start, start.AddDate(0, 0, 1), 1); available {
+		t.Error("the room is still available on the nights of an external booking")
+	}
+	cal := getBody(t, owner, ts.URL+fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", start.Year(), start.Month()))
+	if !strings.Contains(cal, "Blocked by an external calendar") {
+		t.Error("the reservations calendar doesn't show the external blocks")
+	}
+
+	// the next sync moves, removes and keeps blocks as their events changed
+	mu.Lock()
+	events = map[string][2]int{"one@other": {1, 3}, "four@other": {14, 15}}
+	mu.Unlock()
+	handler.Repo.SyncICalFeeds(ctx)
+
+	synced := external(1)
+	if len(synced) != 2 || nights(synced["one@other"]) != [2]int{1, 3} || synced["four@other"].ID != blocks["four@other"].ID {
+		t.Errorf("unexpected blocks after the sync %+v", synced)
+	}
+	feeds, err := handler.Repo.DB.GetICalFeedsForRoom(ctx, 1)
+	if err != nil || len(feeds) != 1 || feeds[0].Blocks != 2 || feeds[0].Skipped != 0 || feeds[0].LastError != "" {
+		t.Fatalf("unexpected status %+v and %v", feeds, err)
+	}
+
+	// a failing site is recorded, and its blocks are kept
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	handler.Repo.SyncICalFeeds(ctx)
+	feeds, _ = handler.Repo.DB.GetICalFeedsForRoom(ctx, 1)
+	if !strings.Contains(feeds[0].LastError, "503") || len(external(1)) != 2 {
+		t.Errorf("unexpected status %q with %d blocks after a failed sync", feeds[0].LastError, len(external(1)))
+	}
+
+	// uploaded calendars are synced from their file, and again when it is replaced
+	body = postMultipart(t, ts, owner, "/admin/rooms/2/calendars", url.Values{"name": {"Agency"}}, "not a calendar")
+	if !strings.Contains(body, "The file is not a valid calendar") {
+		t.Error("an invalid file was not rejected")
+	}
+	postMultipart(t, ts, owner, "/admin/rooms/2/calendars", url.Values{"name": {"Agency"}},
+		calendar(map[string][2]int{"agency-1": {0, 3}}))
+	if blocks := external(2); len(blocks) != 1 || nights(blocks["agency-1"]) != [2]int{0, 3} {
+		t.Errorf("unexpected blocks from the file %+v", blocks)
+	}
+	feeds, _ = handler.Repo.DB.GetICalFeedsForRoom(ctx, 2)
+	if len(feeds) != 1 || !feeds[0].Uploaded() {
+		t.Fatalf("unexpected feeds %+v", feeds)
+	}
+	postMultipart(t, ts, owner, fmt.Sprintf("/admin/rooms/2/calendars/%d", feeds[0].ID), url.Values{}, calendar(nil))
+	if blocks := external(2); len(blocks) != 0 {
+		t.Errorf("the blocks of the replaced file were kept %+v", blocks)
+	}
+
+	// repeating events aren't expanded, so they are left out and reported rather than blocking only their first nights
+	weekly := strings.Replace(calendar(map[string][2]int{"weekly@other": {0, 2}}), "END:VEVENT",
+		"RRULE:FREQ=WEEKLY;COUNT=4\r\nEND:VEVENT", 1)
+	body = postMultipart(t, ts, owner, fmt.Sprintf("/admin/rooms/2/calendars/%d", feeds[0].ID), url.Values{}, weekly)
+	if !strings.Contains(body, "1 repeating events were left out, block their nights by hand") {
+		t.Errorf("the repeating event was not reported:\n%s", body)
+	}
+	feeds, _ = handler.Repo.DB.GetICalFeedsForRoom(ctx, 2)
+	if blocks := external(2); len(blocks) != 0 || feeds[0].Recurring != 1 || feeds[0].Blocks != 0 {
+		t.Errorf("unexpected blocks %+v and status %+v for a repeating event", blocks, feeds[0])
+	}
+
+	// deleting a calendar frees its nights
+	_ = getBody(t, owner, ts.URL+fmt.Sprintf("/admin/delete-room-calendar/1/%d/do", feeds[0].ID-1))
+	if blocks := external(1); len(blocks) != 0 {
+		t.Errorf("the blocks of the deleted calendar were kept %+v", blocks)
+	}
+}
+
+func TestRoutesWebhooks(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	ctx := context.Background()
+
+	// the back office, which fails while status says so
+	type received struct {
+		event, signature string
+		body             []byte
+	}
+	var mu sync.Mutex
+	var got []received
+	status := http.StatusOK
+	backOffice := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, received{r.Header.Get("X-Webhook-Event"), r.Header.Get("X-Webhook-Signature"), body})
+		w.WriteHeader(status)
+	}))
+	defer backOffice.Close()
+	deliver := func(backOfficeStatus int) []received {
+		mu.Lock()
+		status, got = backOfficeStatus, nil
+		mu.Unlock()
+		handler.Repo.DeliverWebhooks(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+	_, body := postFormBody(t, ts, owner, "/admin/webhooks", url.Values{"name": {"Back office"}, "url": {"ftp://back-office"},
+		"events": {"reservation.created"}})
+	if !strings.Contains(body, "Enter the http or https URL of the endpoint.") {
+		t.Fatal("an ftp URL was not rejected")
+	}
+	resp, body := postFormBody(t, ts, owner, "/admin/webhooks", url.Values{"name": {"Back office"}, "url": {backOffice.URL},
+		"events": {"reservation.created", "reservation.deleted"}})
+	hook, err := handler.Repo.DB.GetWebhookByID(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Request.URL.Path != "/admin/webhooks/1" || !strings.Contains(body, hook.Secret) || hook.Secret == "" {
+		t.Fatalf("the new webhook ended at %s without its secret", resp.Request.URL.Path)
+	}
+
+	// a new reservation is delivered, signed with the secret
+	guest := newGuest(t)
+	chooseRoom(t, ts, guest, "1")
+	makeReservation(t, ts, guest, "1")
+	deliveries := deliver(http.StatusOK)
+	if len(deliveries) != 1 || deliveries[0].event != "reservation.created" {
+		t.Fatalf("expected one reservation.created delivery, got %+v", deliveries)
+	}
+	timestamp := strings.TrimPrefix(strings.Split(deliveries[0].signature, ",")[0], "t=")
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(deliveries[0].body)
+	if deliveries[0].signature != "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("the signature %s doesn't match the body", deliveries[0].signature)
+	}
+	var payload struct {
+		Event       string `json:"event"`
+		Reservation struct {
+			ID        int    `json:"id"`
+			Email     string `json:"email"`
+			StartDate string `json:"start_date"`
+		} `json:"reservation"`
+	}
+	if err := json.Unmarshal(deliveries[0].body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Reservation.ID != 1 || payload.Reservation.Email != "guest@example.com" || payload.Reservation.StartDate != "2050-01-01" {
+		t.Errorf("unexpected payload %s", deliveries[0].body)
+	}
+	if deliveries := deliver(http.StatusOK); len(deliveries) != 0 {
+		t.Errorf("a delivered event was sent again: %+v", deliveries)
+	}
+
+	// events the webhook isn't subscribed to aren't sent
+	postForm(t, ts, owner, "/admin/reservations/all/1", url.Values{"first_name": {"Erfei"}, "last_name": {"Yu"},
+		"email": {"guest@example.com"}, "phone": {"555"}})
+	if deliveries := deliver(http.StatusOK); len(deliveries) != 0 {
+		t.Errorf("an unsubscribed event was sent: %+v", deliveries)
+	}
+
+	// a failed delivery is retried later, or right away when asked to
+	_ = getBody(t, owner, ts.URL+"/admin/delete-reservation/all/1/do")
+	if deliveries := deliver(http.StatusInternalServerError); len(deliveries) != 1 || deliveries[0].event != "reservation.deleted" {
+		t.Fatalf("expected one reservation.deleted delivery, got %+v", deliveries)
+	}
+	if deliveries := deliver(http.StatusOK); len(deliveries) != 0 {
+		t.Errorf("a failed delivery was retried before its wait: %+v", deliveries)
+	}
+	log, err := handler.Repo.DB.GetWebhookDeliveries(ctx, 1, 10)
+	if err != nil || len(log) != 2 {
+		t.Fatalf("expected two deliveries, got %+v and %v", log, err)
+	}
+	if log[0].Attempts != 1 || log[0].ResponseStatus != http.StatusInternalServerError || !log[0].NextAttemptAt.After(time.Now()) {
+		t.Errorf("unexpected failed delivery %+v", log[0])
+	}
+	if page := getBody(t, owner, ts.URL+"/admin/webhooks/1"); !strings.Contains(page, "500 Internal Server Error") {
+		t.Error("the webhook page doesn't show the failed attempt")
+	}
+	_ = getBody(t, owner, ts.URL+fmt.Sprintf("/admin/retry-webhook-delivery/1/%d/do", log[0].ID))
+	if deliveries := deliver(http.StatusOK); len(deliveries) != 1 {
+		t.Errorf("the retried delivery was not sent: %+v", deliveries)
+	}
+	log, _ = handler.Repo.DB.GetWebhookDeliveries(ctx, 1, 10)
+	if !log[0].Delivered() || log[0].Attempts != 2 {
+		t.Errorf("unexpected retried delivery %+v", log[0])
+	}
+
+	// inactive webhooks aren't sent anything
+	postForm(t, ts, owner, "/admin/webhooks/1", url.Values{"name": {"Back office"}, "url": {backOffice.URL},
+		"events": {"reservation.created"}})
+	chooseRoom(t, ts, guest, "2")
+	makeReservation(t, ts, guest, "2")
+	if deliveries := deliver(http.StatusOK); len(deliveries) != 0 {
+		t.Errorf("an inactive webhook was sent %+v", deliveries)
+	}
+}
+
+// getBody returns the body of the page at u
+func getBody(t *testing.T, client *http.Client, u string) string {
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func TestRoutesMailOutbox(t *testing.T) {
+	ts := setUpMemoryApp(t)
+	ctx := context.Background()
+
+	outbox := app.Mailer.(*mailer.Memory)
+	outbox.Fail(errors.New("dial tcp: connection refused"))
+	// sendDue makes the waiting messages due and runs the mail job
+	sendDue := func() {
+		for _, msg := range pendingMail(t) {
+			msg.NextAttemptAt = time.Now()
+			if err := handler.Repo.DB.UpdateMailMessage(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		handler.Repo.SendMail(ctx)
+	}
+
+	// the mail of a reservation is written with it, and not at all when it fails
+	guest, other := newGuest(t), newGuest(t)
+	chooseRoom(t, ts, guest, "1")
+	chooseRoom(t, ts, other, "1")
+	makeReservation(t, ts, guest, "1")
+	if resp := makeReservation(t, ts, other, "1"); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("second reservation got %d", resp.StatusCode)
+	}
+	mail := pendingMail(t)
+	if len(mail) != 2 || mail[1].To != "guest@example.com" || mail[1].Subject != "Reservation Confirmation" {
+		t.Fatalf("expected the confirmation and the owner notification, got %+v", mail)
+	}
+	if mail[0].To != app.OwnerEmail || mail[1].From != app.MailFrom {
+		t.Errorf("expected the notification to go to the owner from the configured sender, got %s from %s", mail[0].To, mail[1].From)
+	}
+	if !strings.Contains(mail[1].PlainContent, "Dear Erfei,") || !strings.Contains(mail[1].Content, "<strong>") {
+		t.Errorf("expected the confirmation as HTML and plain text, got %q and %q", mail[1].Content, mail[1].PlainContent)
+	}
+	if len(mail[1].Attachments) != 1 || len(mail[0].Attachments) != 0 {
+		t.Fatalf("expected only the confirmation to have an attachment, got %d and %d", len(mail[1].Attachments), len(mail[0].Attachments))
+	}
+	invite := mail[1].Attachments[0]
+	for _, e := range []string{"DTSTART:20500101T150000Z", "DTEND:20500103T110000Z", `LOCATION:1 Main Street\, Springfield`, "SUMMARY:Stay at General's Quarters"} {
+		if !strings.Contains(string(invite.Data), e) {
+			t.Errorf("expected the invite %s to contain %q, got\n%s", invite.Name, e, invite.Data)
+		}
+	}
+
+	// a mail server that is down only delays the mail
+	owner := newGuest(t)
+	postForm(t, ts, owner, "/user/login", url.Values{"email": {"me@me.com"}, "password": {"password"}})
+	sendDue()
+	if page := getBody(t, owner, ts.URL+"/admin/mail"); !strings.Contains(page, "Retrying") || !strings.Contains(page, "connection refused") {
+		t.Error("the messages being retried are not listed")
+	}
+	for i := 1; i < 8; i++ {
+		sendDue()
+	}
+	if mail := pendingMail(t); len(mail) != 0 || len(outbox.Messages()) != 0 {
+		t.Fatalf("expected the messages to be given up, %d are pending and %d sent", len(mail), len(outbox.Messages()))
+	}
+	failed, err := handler.Repo.DB.GetMailMessages(ctx, Models.MailFailed, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := getBody(t, owner, ts.URL+"/admin/mail")
+	if len(failed) != 2 || !strings.Contains(page, fmt.Sprintf("/admin/resend-mail/%d/do", failed[1].ID)) {
+		t.Fatalf("expected both messages to be listed as failed, got %d", len(failed))
+	}
+
+	// a resent message gets a fresh set of attempts
+	outbox.Fail(nil)
+	getBody(t, owner, fmt.Sprintf("%s/admin/resend-mail/%d/do", ts.URL, failed[1].ID))
+	handler.Repo.SendMail(ctx)
+	if sent := outbox.Messages(); len(sent) != 1 || sent[0].To != "guest@example.com" || len(sent[0].Attachments) != 1 {
+		t.Fatalf("expected the confirmation to be resent, got %+v", sent)
+	}
+	handler.Repo.SendMail(ctx)
+	if len(outbox.Messages()) != 1 {
+		t.Errorf("a sent message was sent again")
+	}
+	if failed, _ := handler.Repo.DB.GetMailMessages(ctx, Models.MailFailed, 10); len(failed) != 1 {
+		t.Errorf("expected the owner notification to stay failed, got %d failed", len(failed))
+	}
+}
@@ -1,42 +1,19 @@
 package main
 
 import (
-	"github.com/454270186/Hotel-booking-web-application/internal/Models"
-	mail "github.com/xhit/go-simple-mail/v2"
-	"log"
+	"context"
+	"github.com/454270186/Hotel-booking-web-application/internal/handler"
 	"time"
 )
 
-func listenForMail() {
+// sendMail sends the due messages of the mail outbox every interval
+func sendMail(interval time.Duration) {
 	go func() {
-		for {
-			msg := <-app.MailChan
-			sendMSG(msg)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			handler.Repo.SendMail(context.Background())
 		}
 	}()
 }
-
-func sendMSG(m Models.MailData) {
-	server := mail.NewSMTPClient()
-	server.Host = "localhost"
-	server.Port = 1025
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
-
-	client, err := server.Connect()
-	if err != nil {
-		errorLog.Println(err)
-	}
-
-	email := mail.NewMSG()
-	email.SetFrom(m.From).AddTo(m.To).SetSubject(m.Subject)
-	email.SetBody(mail.TextHTML, m.Content)
-
-	err = email.Send(client)
-	if err != nil {
-		errorLog.Println(err)
-	} else {
-		log.Println("Email sent!")
-	}
-}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"github.com/454270186/Hotel-booking-web-application/internal/handler"
+	"time"
+)
+
+// sendNotifications queues the due arrival reminders and thank-you emails right away and then every interval
+func sendNotifications(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			handler.Repo.SendNotifications(context.Background())
+			<-ticker.C
+		}
+	}()
+}
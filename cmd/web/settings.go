@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/mailer"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configEnv names the environment variable with the path of the config file, which -config overrides
+const configEnv = "BOOKINGS_CONFIG"
+
+// settings is the configuration of the application. The defaults are overridden by the YAML config file, then by
+// the environment variables of the env tags and then by the command line flags
+type settings struct {
+	Port       int  `yaml:"port" env:"BOOKINGS_PORT"`
+	Production bool `yaml:"production" env:"BOOKINGS_PRODUCTION"`
+	Cache      bool `yaml:"cache" env:"BOOKINGS_CACHE"`
+	// Demo uses an in-memory database instead of Database
+	Demo bool `yaml:"demo" env:"BOOKINGS_DEMO"`
+
+	Database struct {
+		Driver   string        `yaml:"driver" env:"BOOKINGS_DB_DRIVER"`
+		Host     string        `yaml:"host" env:"BOOKINGS_DB_HOST"`
+		Port     string        `yaml:"port" env:"BOOKINGS_DB_PORT"`
+		Name     string        `yaml:"name" env:"BOOKINGS_DB_NAME"`
+		User     string        `yaml:"user" env:"BOOKINGS_DB_USER"`
+		Password string        `yaml:"password" env:"BOOKINGS_DB_PASSWORD"`
+		SSL      string        `yaml:"ssl" env:"BOOKINGS_DB_SSL"`
+		Timeout  time.Duration `yaml:"timeout" env:"BOOKINGS_DB_TIMEOUT"`
+	} `yaml:"database"`
+
+	Session struct {
+		Lifetime time.Duration `yaml:"lifetime" env:"BOOKINGS_SESSION_LIFETIME"`
+	} `yaml:"session"`
+
+	Reservations struct {
+		CancellationDeadline time.Duration `yaml:"cancellation_deadline" env:"BOOKINGS_CANCELLATION_DEADLINE"`
+	} `yaml:"reservations"`
+
+	Login struct {
+		Attempts   int           `yaml:"attempts" env:"BOOKINGS_LOGIN_ATTEMPTS"`
+		IPAttempts int           `yaml:"ip_attempts" env:"BOOKINGS_LOGIN_IP_ATTEMPTS"`
+		Window     time.Duration `yaml:"window" env:"BOOKINGS_LOGIN_WINDOW"`
+		Lockout    time.Duration `yaml:"lockout" env:"BOOKINGS_LOGIN_LOCKOUT"`
+		Delay      time.Duration `yaml:"delay" env:"BOOKINGS_LOGIN_DELAY"`
+	} `yaml:"login"`
+
+	Mail struct {
+		Mailer   string        `yaml:"mailer" env:"BOOKINGS_MAILER"`
+		Dir      string        `yaml:"dir" env:"BOOKINGS_MAIL_DIR"`
+		From     string        `yaml:"from" env:"BOOKINGS_MAIL_FROM"`
+		Owner    string        `yaml:"owner" env:"BOOKINGS_OWNER_EMAIL"`
+		Interval time.Duration `yaml:"interval" env:"BOOKINGS_MAIL_INTERVAL"`
+		SMTP     struct {
+			Host     string        `yaml:"host" env:"BOOKINGS_SMTP_HOST"`
+			Port     int           `yaml:"port" env:"BOOKINGS_SMTP_PORT"`
+			User     string        `yaml:"user" env:"BOOKINGS_SMTP_USER"`
+			Password string        `yaml:"password" env:"BOOKINGS_SMTP_PASSWORD"`
+			TLS      string        `yaml:"tls" env:"BOOKINGS_SMTP_TLS"`
+			Timeout  time.Duration `yaml:"timeout" env:"BOOKINGS_SMTP_TIMEOUT"`
+		} `yaml:"smtp"`
+	} `yaml:"mail"`
+
+	Notifications struct {
+		Interval     time.Duration `yaml:"interval" env:"BOOKINGS_NOTIFY_INTERVAL"`
+		ReminderDays int           `yaml:"reminder_days" env:"BOOKINGS_REMINDER_DAYS"`
+		ThankYouDays int           `yaml:"thank_you_days" env:"BOOKINGS_THANK_YOU_DAYS"`
+	} `yaml:"notifications"`
+
+	Property struct {
+		Address  string `yaml:"address" env:"BOOKINGS_ADDRESS"`
+		CheckIn  string `yaml:"check_in" env:"BOOKINGS_CHECK_IN"`
+		CheckOut string `yaml:"check_out" env:"BOOKINGS_CHECK_OUT"`
+		TimeZone string `yaml:"time_zone" env:"BOOKINGS_TIME_ZONE"`
+	} `yaml:"property"`
+
+	ICalSync        time.Duration `yaml:"ical_sync" env:"BOOKINGS_ICAL_SYNC"`
+	WebhookInterval time.Duration `yaml:"webhook_interval" env:"BOOKINGS_WEBHOOK_INTERVAL"`
+}
+
+// loadSettings reads the settings from the config file, the environment as looked up by env and the command line
+// args parsed with fs, and validates them
+func loadSettings(fs *flag.FlagSet, args []string, env func(string) (string, bool)) (settings, error) {
+	var s settings
+
+	configPath := fs.String("config", "", "YAML config file, the environment and these flags override its settings")
+	fs.IntVar(&s.Port, "port", 8080, "Port the application listens on")
+	fs.BoolVar(&s.Production, "production", true, "Application is in production")
+	fs.BoolVar(&s.Cache, "cache", true, "Use template cache")
+	fs.BoolVar(&s.Demo, "demo", false, "Use an in-memory database instead of Postgres")
+	fs.StringVar(&s.Database.Driver, "dbdriver", "postgres", "Database driver (postgres, sqlite)")
+	fs.StringVar(&s.Database.Host, "dbhost", "localhost", "Database host")
+	fs.StringVar(&s.Database.Name, "dbname", "", "Database name, or the database file for sqlite")
+	fs.StringVar(&s.Database.User, "dbuser", "", "Database user")
+	fs.StringVar(&s.Database.Password, "dbpass", "", "Database password")
+	fs.StringVar(&s.Database.Port, "dbport", "5432", "Database port")
+	fs.StringVar(&s.Database.SSL, "dbssl", "disable", "Database ssl settings (disable, prefer, require)")
+	fs.DurationVar(&s.Database.Timeout, "dbtimeout", 3*time.Second, "Timeout for a single database query")
+	fs.DurationVar(&s.Session.Lifetime, "sessionlifetime", 24*time.Hour, "How long a session lasts")
+	fs.DurationVar(&s.Reservations.CancellationDeadline, "cancellationdeadline", 48*time.Hour, "How long before arrival guests can still cancel")
+	fs.IntVar(&s.Login.Attempts, "loginattempts", 5, "Failed logins before an account is locked, 0 never locks")
+	fs.IntVar(&s.Login.IPAttempts, "loginipattempts", 20, "Failed logins before a client IP is blocked, 0 never blocks")
+	fs.DurationVar(&s.Login.Window, "loginwindow", 15*time.Minute, "How long failed logins are counted, 0 turns off login throttling")
+	fs.DurationVar(&s.Login.Lockout, "loginlockout", 15*time.Minute, "How long a locked account stays locked")
+	fs.DurationVar(&s.Login.Delay, "logindelay", time.Second, "Wait after a failed login, doubled with every further failure")
+	fs.DurationVar(&s.ICalSync, "icalsync", 30*time.Minute, "How often external calendars are synced, 0 only syncs them on demand")
+	fs.DurationVar(&s.WebhookInterval, "webhookinterval", 10*time.Second, "How often due webhook deliveries are sent, 0 doesn't send them")
+	fs.DurationVar(&s.Mail.Interval, "mailinterval", 10*time.Second, "How often due mail of the outbox is sent, 0 doesn't send it")
+	fs.StringVar(&s.Mail.Mailer, "mailer", "smtp", "How emails are sent (smtp, file)")
+	fs.StringVar(&s.Mail.Dir, "maildir", "mail", "Directory the file mailer writes .eml files to")
+	fs.StringVar(&s.Mail.SMTP.Host, "smtphost", "localhost", "SMTP server host")
+	fs.IntVar(&s.Mail.SMTP.Port, "smtpport", 1025, "SMTP server port")
+	fs.StringVar(&s.Mail.SMTP.User, "smtpuser", "", "SMTP user, no authentication if empty")
+	fs.StringVar(&s.Mail.SMTP.Password, "smtppass", "", "SMTP password")
+	fs.StringVar(&s.Mail.SMTP.TLS, "smtptls", mailer.TLSNone, "SMTP TLS mode (none, starttls, tls)")
+	fs.DurationVar(&s.Mail.SMTP.Timeout, "smtptimeout", 10*time.Second, "Timeout for connecting to and sending through the SMTP server")
+	fs.StringVar(&s.Mail.From, "mailfrom", "me@here.com", "Sender of the emails")
+	fs.StringVar(&s.Mail.Owner, "owneremail", "Owner@ow.com", "Where notifications for the property owner are sent")
+	fs.StringVar(&s.Property.Address, "address", "", "Address of the property, for the calendar invites of reservations")
+	fs.StringVar(&s.Property.CheckIn, "checkin", "15:00", "Check-in time (HH:MM)")
+	fs.StringVar(&s.Property.CheckOut, "checkout", "11:00", "Check-out time (HH:MM)")
+	fs.StringVar(&s.Property.TimeZone, "timezone", "Local", "Time zone of the property, such as America/New_York")
+	fs.DurationVar(&s.Notifications.Interval, "notifyinterval", time.Hour, "How often due reminder and thank-you emails are queued, 0 doesn't queue them")
+	fs.IntVar(&s.Notifications.ReminderDays, "reminderdays", 3, "Days before arrival guests are reminded of their stay, 0 doesn't remind them")
+	fs.IntVar(&s.Notifications.ThankYouDays, "thankyoudays", 1, "Days after departure guests are thanked and asked for feedback, 0 doesn't thank them")
+
+	if err := fs.Parse(args); err != nil {
+		return s, err
+	}
+
+	// the flags are applied again on top of the file and the environment, so remember which were given
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	path := *configPath
+	if path == "" {
+		path, _ = env(configEnv)
+	}
+	if path != "" {
+		if err := s.loadFile(path); err != nil {
+			return s, err
+		}
+	}
+
+	if err := loadEnv(reflect.ValueOf(&s).Elem(), env); err != nil {
+		return s, err
+	}
+
+	for name, value := range given {
+		if err := fs.Set(name, value); err != nil {
+			return s, err
+		}
+	}
+
+	return s, s.validate()
+}
+
+// loadFile overrides the settings with those of the YAML file at path. Unknown keys are an error, as they are
+// most likely misspelled
+func (s *settings) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading the config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading the config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// loadEnv overrides the fields of the struct v whose env tag names a variable that env finds
+func loadEnv(v reflect.Value, env func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := loadEnv(field, env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		value, ok := env(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+	}
+
+	return nil
+}
+
+// setField parses value into field, which is a string, bool, int or time.Duration
+func setField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("expected a duration such as 90s or 2h")
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("expected true or false")
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("expected a number")
+		}
+		field.SetInt(int64(n))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+
+	return nil
+}
+
+// validate returns an error listing every setting that is invalid, or nil if they all are fine
+func (s settings) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(s.Port > 0 && s.Port < 65536, "port %d is not a valid port", s.Port)
+	check(s.Session.Lifetime > 0, "session lifetime must be positive")
+
+	switch s.Database.Driver {
+	case "postgres":
+		check(s.Demo || (s.Database.Name != "" && s.Database.User != "" && s.Database.Password != ""),
+			"the postgres database needs a name, user and password (-dbname, -dbuser, -dbpass)")
+	case "sqlite":
+		check(s.Demo || s.Database.Name != "", "the sqlite database needs a file (-dbname)")
+	default:
+		check(false, "unknown database driver %q, expected postgres or sqlite", s.Database.Driver)
+	}
+	check(s.Database.Timeout > 0, "database timeout must be positive")
+
+	switch s.Mail.Mailer {
+	case "smtp":
+		_, err := mailer.NewSMTP(s.smtpConfig())
+		check(err == nil, "%v", err)
+	case "file":
+		check(s.Mail.Dir != "", "the file mailer needs a directory (-maildir)")
+	default:
+		check(false, "unknown mailer %q, expected smtp or file", s.Mail.Mailer)
+	}
+	check(s.Mail.From != "", "emails need a sender (-mailfrom)")
+
+	_, err := parseTimeOfDay(s.Property.CheckIn)
+	check(err == nil, "check-in time %q is not a time such as 15:00", s.Property.CheckIn)
+	_, err = parseTimeOfDay(s.Property.CheckOut)
+	check(err == nil, "check-out time %q is not a time such as 11:00", s.Property.CheckOut)
+	_, err = time.LoadLocation(s.Property.TimeZone)
+	check(err == nil, "unknown time zone %q", s.Property.TimeZone)
+
+	check(s.Login.Attempts >= 0 && s.Login.IPAttempts >= 0, "login attempts can't be negative")
+	check(s.Notifications.ReminderDays >= 0 && s.Notifications.ThankYouDays >= 0, "reminder and thank-you days can't be negative")
+	check(s.Mail.Interval >= 0 && s.Notifications.Interval >= 0 && s.ICalSync >= 0 && s.WebhookInterval >= 0,
+		"job intervals can't be negative")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+
+	return nil
+}
+
+// smtpConfig returns the settings of the SMTP server
+func (s settings) smtpConfig() mailer.SMTPConfig {
+	return mailer.SMTPConfig{
+		Host:           s.Mail.SMTP.Host,
+		Port:           s.Mail.SMTP.Port,
+		Username:       s.Mail.SMTP.User,
+		Password:       s.Mail.SMTP.Password,
+		TLS:            s.Mail.SMTP.TLS,
+		ConnectTimeout: s.Mail.SMTP.Timeout,
+		SendTimeout:    s.Mail.SMTP.Timeout,
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSettings loads the settings from args and env with a fresh flag set
+func testSettings(args []string, env map[string]string) (settings, error) {
+	fs := flag.NewFlagSet("bookings", flag.ContinueOnError)
+	fs.SetOutput(&strings.Builder{})
+
+	return loadSettings(fs, args, func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+}
+
+// writeConfig writes a config file with content and returns its path
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "bookings.yml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadSettings(t *testing.T) {
+	path := writeConfig(t, `
+port: 9000
+production: false
+database:
+  driver: postgres
+  name: bookings
+  user: postgres
+  password: from-file
+  timeout: 5s
+session:
+  lifetime: 12h
+mail:
+  from: bookings@example.com
+  smtp:
+    host: smtp.example.com
+    port: 587
+    tls: starttls
+`)
+
+	s, err := testSettings([]string{"-config", path, "-dbpass", "from-flag"}, map[string]string{
+		"BOOKINGS_PORT":        "9100",
+		"BOOKINGS_DB_PASSWORD": "from-env",
+		"BOOKINGS_SMTP_USER":   "mailer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"default", s.Database.Host, "localhost"},
+		{"file", s.Session.Lifetime, 12 * time.Hour},
+		{"file duration", s.Database.Timeout, 5 * time.Second},
+		{"file bool", s.Production, false},
+		{"file nested", s.Mail.SMTP.TLS, "starttls"},
+		{"env over file", s.Port, 9100},
+		{"env over default", s.Mail.SMTP.User, "mailer"},
+		{"flag over env", s.Database.Password, "from-flag"},
+	}
+	for _, e := range tests {
+		if e.got != e.expected {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, e.got)
+		}
+	}
+
+	// the config file can also be named in the environment
+	s, err = testSettings(nil, map[string]string{configEnv: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Port != 9000 || s.Database.Password != "from-file" {
+		t.Errorf("expected the settings of the file, got port %d and password %q", s.Port, s.Database.Password)
+	}
+}
+
+func TestLoadSettings_Example(t *testing.T) {
+	s, err := testSettings([]string{"-config", "bookings.yml.example", "-dbpass", "secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults, err := testSettings([]string{"-dbname", "bookings", "-dbuser", "postgres", "-dbpass", "secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != defaults {
+		t.Errorf("expected the example to show the defaults, got\n%+v\nexpected\n%+v", s, defaults)
+	}
+}
+
+func TestLoadSettings_Errors(t *testing.T) {
+	var tests = []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		config   string
+		expected []string
+	}{
+		{"missing database", nil, nil, "", []string{"the postgres database needs a name, user and password"}},
+		{"several problems", []string{"-demo", "-port", "0", "-dbdriver", "mysql", "-checkin", "3pm", "-smtptls", "ssl"}, nil, "",
+			[]string{"port 0", `unknown database driver "mysql"`, `check-in time "3pm"`, `unknown SMTP TLS mode "ssl"`}},
+		{"bad env", []string{"-demo"}, map[string]string{"BOOKINGS_SESSION_LIFETIME": "a day"}, "",
+			[]string{`invalid BOOKINGS_SESSION_LIFETIME "a day"`}},
+		{"misspelled key", []string{"-demo"}, nil, "prot: 9000\n", []string{"field prot not found"}},
+		{"bad value", []string{"-demo"}, nil, "session:\n  lifetime: forever\n", []string{"forever"}},
+		{"missing file", []string{"-demo", "-config", "does-not-exist.yml"}, nil, "", []string{"reading the config file"}},
+	}
+
+	for _, e := range tests {
+		args := e.args
+		if e.config != "" {
+			args = append(args, "-config", writeConfig(t, e.config))
+		}
+
+		_, err := testSettings(args, e.env)
+		if err == nil {
+			t.Errorf("%s: expected an error", e.name)
+			continue
+		}
+		for _, text := range e.expected {
+			if !strings.Contains(err.Error(), text) {
+				t.Errorf("%s: expected the error to mention %q, got %v", e.name, text, err)
+			}
+		}
+	}
+
+	if _, err := testSettings([]string{"-demo"}, nil); err != nil {
+		t.Errorf("expected the defaults to be valid for the demo, got %v", err)
+	}
+}
@@ -7,6 +7,10 @@ import (
 )
 
 func TestMain(m *testing.M) {
+	// templates and static files are looked up relative to the repository root, as when the server runs
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
 
 	os.Exit(m.Run())
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"github.com/454270186/Hotel-booking-web-application/internal/handler"
+	"time"
+)
+
+// syncCalendars syncs the external calendars of the rooms right away and then every interval
+func syncCalendars(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			handler.Repo.SyncICalFeeds(context.Background())
+			<-ticker.C
+		}
+	}()
+}
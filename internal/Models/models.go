@@ -1,6 +1,7 @@
 package Models
 
 import (
+	"strings"
 	"time"
 )
 
@@ -12,18 +13,135 @@ type User struct {
 	Email       string
 	Password    string
 	AccessLevel int
+	Active      bool
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
+
+	TOTPSecret   string // base32 secret of the user's authenticator app
+	TOTPEnabled  bool
+	TOTPLastStep int64 // time step of the last accepted code, so codes can't be replayed
+
+	LockedUntil time.Time // zero unless too many failed logins locked the user out
+}
+
+// Locked reports whether too many failed logins currently lock the user out
+func (u User) Locked() bool {
+	return time.Now().Before(u.LockedUntil)
+}
+
+// LoginAttempt is the login-attempts-table model, a failed login
+type LoginAttempt struct {
+	ID        int
+	Email     string // lower case
+	IPAddress string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// APIToken is the api-tokens-table model, a named token machine clients use the JSON API with.
+// Only the SHA-256 hash of the token is stored
+type APIToken struct {
+	ID         int
+	Name       string
+	TokenHash  string
+	Scopes     string // space separated
+	UserID     int    // the user who created the token
+	LastUsedAt time.Time
+	RevokedAt  time.Time // zero while the token works
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	User       User
+}
+
+// Revoked reports whether the token was revoked
+func (t APIToken) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+// Webhook is the webhooks-table model, an endpoint that is sent the reservation events it subscribes to.
+// Deliveries are signed with Secret, so the endpoint can tell they came from us
+type Webhook struct {
+	ID        int
+	Name      string
+	URL       string
+	Secret    string
+	Events    string // space separated
+	Active    bool   // events are only queued for, and sent to, active webhooks
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// WebhookDelivery is the webhook-deliveries-table model, an event sent, or still to be sent, to a webhook
+type WebhookDelivery struct {
+	ID        int
+	WebhookID int
+	Event     string
+	Payload   string // the JSON body, fixed when the event happened
+	Attempts  int
+	// NextAttemptAt is when the delivery is tried next, zero once it was delivered or given up
+	NextAttemptAt time.Time
+	LastAttemptAt time.Time
+	// ResponseStatus is the HTTP status the endpoint answered the last attempt with, 0 if it didn't answer
+	ResponseStatus int
+	LastError      string
+	DeliveredAt    time.Time // zero until an attempt succeeded
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Webhook        Webhook
+}
+
+// RecoveryCode is the recovery-codes-table model, a single use code for logging in without the authenticator app.
+// Only the SHA-256 hash of the code is stored
+type RecoveryCode struct {
+	ID        int
+	UserID    int
+	CodeHash  string
+	Used      bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// PasswordResetToken is the password-reset-tokens-table model. Only the SHA-256 hash of the emailed token is stored
+type PasswordResetToken struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+	Used      bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 // Room is the room-table model
 type Room struct {
-	ID        int
-	RoomName  string
+	ID               int
+	RoomName         string
+	Slug             string
+	Description      string
+	Capacity         int
+	BedConfiguration string
+	Amenities        string
+	BasePrice        int // nightly price in cents
+	Image            string
+	Active           bool
+	// ICalToken is the secret in the URL of the room's calendar feed, empty while the room has none
+	ICalToken string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// AmenityList returns the comma separated amenities of the room as a slice
+func (r Room) AmenityList() []string {
+	var amenities []string
+	for _, a := range strings.Split(r.Amenities, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			amenities = append(amenities, a)
+		}
+	}
+
+	return amenities
+}
+
 // Restriction is the restriction-table model
 type Restriction struct {
 	ID              int
@@ -32,20 +150,44 @@ type Restriction struct {
 	UpdatedAt       time.Time
 }
 
+// The IDs of the restrictions the migrations seed
+const (
+	// RestrictionReservation marks the nights of a reservation
+	RestrictionReservation = 1
+	// RestrictionOwnerBlock marks a night the owner blocked
+	RestrictionOwnerBlock = 2
+	// RestrictionExternal marks the nights of an event of an external calendar, such as a booking on another site
+	RestrictionExternal = 3
+)
+
 // Reservation is the reservation-table model
 type Reservation struct {
-	ID        int
-	FirstName string
-	LastName  string
-	Email     string
-	Phone     string
-	StartDate time.Time
-	EndDate   time.Time
-	RoomID    int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Room      Room
-	Processed int
+	ID         int
+	FirstName  string
+	LastName   string
+	Email      string
+	Phone      string
+	StartDate  time.Time
+	EndDate    time.Time
+	RoomID     int
+	TotalPrice int // in cents, fixed when the reservation is made
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Room       Room
+	Processed  int
+	// ConfirmationCode lets the guest look the reservation up together with their email
+	ConfirmationCode string
+	Cancelled        int
+}
+
+// ReservationChangeRequest is the reservation-change-requests-table model, new dates a guest asked for
+type ReservationChangeRequest struct {
+	ID            int
+	ReservationID int
+	StartDate     time.Time
+	EndDate       time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
 // RoomRestriction is the room-restriction-table model
@@ -56,17 +198,144 @@ type RoomRestriction struct {
 	RoomID        int
 	ReservationID int
 	RestrictionID int
+	// ICalFeedID is the external calendar an External restriction was synced from
+	ICalFeedID int
+	// ExternalUID identifies the event of the external calendar, so later syncs can update or remove it
+	ExternalUID string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Room        Room
+	Reservation Reservation
+	Restriction Restriction
+}
+
+// ICalFeed is an external calendar, such as the export of another booking site, whose events block a room.
+// It is fetched from URL, or parsed from Content when it was uploaded as a file
+type ICalFeed struct {
+	ID      int
+	RoomID  int
+	Name    string
+	URL     string
+	Content string
+	// LastSyncedAt is when the feed was last synced, successfully or not
+	LastSyncedAt time.Time
+	// LastError is why the last sync failed, empty when it succeeded
+	LastError string
+	// Blocks is how many events the last successful sync turned into blocks
+	Blocks int
+	// Skipped is how many events the last successful sync skipped because their nights were already taken
+	Skipped int
+	// Recurring is how many repeating events the last successful sync left out, as their repetitions aren't expanded
+	Recurring int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Room      Room
+}
+
+// Uploaded reports whether the feed was uploaded as a file rather than registered by its URL
+func (f ICalFeed) Uploaded() bool {
+	return f.URL == ""
+}
+
+// RatePlan holds the nightly rates of a room. BaseRate is the room's base price,
+// WeekendRate applies to Friday and Saturday nights when it is set
+type RatePlan struct {
+	ID            int
+	RoomID        int
+	BaseRate      int
+	WeekendRate   int
+	SeasonalRates []SeasonalRate
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// SeasonalRate is the seasonal-rates-table model, a nightly rate that overrides the rate plan
+// for the nights from StartDate up to, but not including, EndDate
+type SeasonalRate struct {
+	ID        int
+	RoomID    int
+	Name      string
+	StartDate time.Time
+	EndDate   time.Time
+	Rate      int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// The kinds of scheduled email about a reservation
+const (
+	// NotificationArrivalReminder reminds the guest of their stay some days before they arrive
+	NotificationArrivalReminder = "arrival_reminder"
+	// NotificationThankYou thanks the guest and asks for feedback some days after they left
+	NotificationThankYou = "thank_you"
+)
+
+// ReservationNotification is the reservation-notifications-table model, the record that a scheduled email of a
+// kind was queued for a reservation, so it is queued only once
+type ReservationNotification struct {
+	ID            int
+	ReservationID int
+	Kind          string
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
-	Room          Room
-	Reservation   Reservation
-	Restriction   Restriction
 }
 
 // MailData holds an email message
 type MailData struct {
+	To      string
+	From    string
+	Subject string
+	Content string // HTML
+	// PlainContent is the plain text alternative of Content
+	PlainContent string
+	// Template names the email template in templates/email that renders Content and PlainContent, with Data
+	Template string
+	Data     map[string]interface{}
+	// Attachments are sent with the email as files
+	Attachments []MailAttachment
+}
+
+// MailAttachment is a file attached to an email
+type MailAttachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// The statuses of a mail message
+const (
+	// MailPending is a message waiting for its next attempt
+	MailPending = "pending"
+	// MailSent is a message the mail server accepted
+	MailSent = "sent"
+	// MailFailed is a message that was given up after its last attempt failed, until staff resend it
+	MailFailed = "failed"
+)
+
+// MailMessage is the mail-messages-table model, an email in the outbox. It is written together with the change it
+// tells about and sent by the mail job, so a mail server that is down only delays it
+type MailMessage struct {
+	ID      int
 	To      string
 	From    string
 	Subject string
 	Content string
+	// PlainContent is the plain text alternative of Content
+	PlainContent string
+	Attachments  []MailAttachment
+	Status       string
+	Attempts     int
+	// NextAttemptAt is when a pending message is tried next
+	NextAttemptAt time.Time
+	LastAttemptAt time.Time
+	LastError     string
+	SentAt        time.Time // zero until an attempt succeeded
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Data returns the email of the message
+func (m MailMessage) Data() MailData {
+	return MailData{To: m.To, From: m.From, Subject: m.Subject, Content: m.Content, PlainContent: m.PlainContent,
+		Attachments: m.Attachments}
 }
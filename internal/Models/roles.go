@@ -0,0 +1,72 @@
+package Models
+
+// Role is what a user may do in the admin area. It is stored as users.access_level
+type Role int
+
+const (
+	RoleReadOnly  Role = 1
+	RoleFrontDesk Role = 2
+	RoleManager   Role = 3
+	RoleOwner     Role = 4
+)
+
+// Roles lists every role, from least to most privileged
+var Roles = []Role{RoleReadOnly, RoleFrontDesk, RoleManager, RoleOwner}
+
+// String returns the name of the role as shown in the admin area
+func (r Role) String() string {
+	switch r {
+	case RoleReadOnly:
+		return "Read-only"
+	case RoleFrontDesk:
+		return "Front desk"
+	case RoleManager:
+		return "Manager"
+	case RoleOwner:
+		return "Owner"
+	}
+
+	return "None"
+}
+
+// Permission is an action in the admin area that only some roles may perform
+type Permission string
+
+const (
+	PermViewReservations   Permission = "view_reservations"
+	PermEditReservations   Permission = "edit_reservations"
+	PermDeleteReservations Permission = "delete_reservations"
+	PermManageRooms        Permission = "manage_rooms"
+	PermManageUsers        Permission = "manage_users"
+	PermManageAPITokens    Permission = "manage_api_tokens"
+	PermManageWebhooks     Permission = "manage_webhooks"
+	PermManageMail         Permission = "manage_mail"
+)
+
+// permissionRoles holds the least privileged role with each permission, every role above it has it too
+var permissionRoles = map[Permission]Role{
+	PermViewReservations:   RoleReadOnly,
+	PermEditReservations:   RoleFrontDesk,
+	PermDeleteReservations: RoleManager,
+	PermManageRooms:        RoleManager,
+	PermManageUsers:        RoleOwner,
+	PermManageAPITokens:    RoleOwner,
+	PermManageWebhooks:     RoleOwner,
+	PermManageMail:         RoleOwner,
+}
+
+// Valid reports whether r is one of Roles
+func (r Role) Valid() bool {
+	return r >= RoleReadOnly && r <= RoleOwner
+}
+
+// Can reports whether the role has permission p
+func (r Role) Can(p Permission) bool {
+	min, ok := permissionRoles[p]
+	return ok && r.Valid() && r >= min
+}
+
+// Role returns the role of the user
+func (u User) Role() Role {
+	return Role(u.AccessLevel)
+}
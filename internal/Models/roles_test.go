@@ -0,0 +1,34 @@
+package Models
+
+import "testing"
+
+func TestRole_Can(t *testing.T) {
+	var tests = []struct {
+		role     Role
+		perm     Permission
+		expected bool
+	}{
+		{RoleReadOnly, PermViewReservations, true},
+		{RoleReadOnly, PermEditReservations, false},
+		{RoleFrontDesk, PermEditReservations, true},
+		{RoleFrontDesk, PermDeleteReservations, false},
+		{RoleManager, PermManageRooms, true},
+		{RoleManager, PermManageUsers, false},
+		{RoleOwner, PermManageUsers, true},
+		{RoleManager, PermManageAPITokens, false},
+		{RoleOwner, PermManageAPITokens, true},
+		{RoleManager, PermManageWebhooks, false},
+		{RoleOwner, PermManageWebhooks, true},
+		{RoleManager, PermManageMail, false},
+		{RoleOwner, PermManageMail, true},
+		{Role(0), PermViewReservations, false},
+		{Role(5), PermViewReservations, false},
+		{RoleOwner, Permission("unknown"), false},
+	}
+
+	for _, e := range tests {
+		if got := e.role.Can(e.perm); got != e.expected {
+			t.Errorf("%s can %s: expected %t but got %t", e.role, e.perm, e.expected, got)
+		}
+	}
+}
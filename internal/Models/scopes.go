@@ -0,0 +1,61 @@
+package Models
+
+import "strings"
+
+// Scope is what an API token may do with the JSON API
+type Scope string
+
+const (
+	ScopeAvailabilityRead  Scope = "availability:read"
+	ScopeReservationsRead  Scope = "reservations:read"
+	ScopeReservationsWrite Scope = "reservations:write"
+)
+
+// Scopes lists every scope
+var Scopes = []Scope{ScopeAvailabilityRead, ScopeReservationsRead, ScopeReservationsWrite}
+
+// Description returns what the scope allows, as shown in the admin area
+func (s Scope) Description() string {
+	switch s {
+	case ScopeAvailabilityRead:
+		return "List rooms and query availability"
+	case ScopeReservationsRead:
+		return "Show reservations by confirmation code"
+	case ScopeReservationsWrite:
+		return "Make and cancel reservations"
+	}
+
+	return ""
+}
+
+// Valid reports whether s is one of Scopes
+func (s Scope) Valid() bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScopeList returns the space separated scopes of the token as a slice
+func (t APIToken) ScopeList() []Scope {
+	var scopes []Scope
+	for _, s := range strings.Fields(t.Scopes) {
+		scopes = append(scopes, Scope(s))
+	}
+
+	return scopes
+}
+
+// HasScope reports whether the token grants scope s
+func (t APIToken) HasScope(s Scope) bool {
+	for _, scope := range t.ScopeList() {
+		if scope == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,17 @@
+package Models
+
+import "testing"
+
+func TestAPIToken_HasScope(t *testing.T) {
+	token := APIToken{Scopes: "availability:read reservations:write"}
+
+	if !token.HasScope(ScopeAvailabilityRead) || !token.HasScope(ScopeReservationsWrite) {
+		t.Error("expected the token to have its scopes")
+	}
+	if token.HasScope(ScopeReservationsRead) {
+		t.Error("expected the token not to have reservations:read")
+	}
+	if (APIToken{}).HasScope(ScopeAvailabilityRead) {
+		t.Error("expected a token without scopes to have none")
+	}
+}
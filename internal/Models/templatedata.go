@@ -14,4 +14,10 @@ type TemplateData struct {
 	Error           string
 	Form            *forms.Form
 	IsAuthenticated int
+	Role            Role
+}
+
+// Can reports whether the logged in user has permission p, so templates can hide what they can't do
+func (td *TemplateData) Can(p Permission) bool {
+	return td.Role.Can(p)
 }
@@ -0,0 +1,83 @@
+package Models
+
+import "strings"
+
+// WebhookEvent is a reservation lifecycle event webhooks subscribe to
+type WebhookEvent string
+
+const (
+	EventReservationCreated   WebhookEvent = "reservation.created"
+	EventReservationUpdated   WebhookEvent = "reservation.updated"
+	EventReservationProcessed WebhookEvent = "reservation.processed"
+	EventReservationCancelled WebhookEvent = "reservation.cancelled"
+	EventReservationDeleted   WebhookEvent = "reservation.deleted"
+)
+
+// WebhookEvents lists every webhook event
+var WebhookEvents = []WebhookEvent{
+	EventReservationCreated,
+	EventReservationUpdated,
+	EventReservationProcessed,
+	EventReservationCancelled,
+	EventReservationDeleted,
+}
+
+// Description returns when the event happens, as shown in the admin area
+func (e WebhookEvent) Description() string {
+	switch e {
+	case EventReservationCreated:
+		return "A guest or API client made a reservation"
+	case EventReservationUpdated:
+		return "Staff changed the guest details of a reservation"
+	case EventReservationProcessed:
+		return "Staff marked a reservation as processed"
+	case EventReservationCancelled:
+		return "A guest or API client cancelled a reservation"
+	case EventReservationDeleted:
+		return "Staff deleted a reservation"
+	}
+
+	return ""
+}
+
+// Valid reports whether e is one of WebhookEvents
+func (e WebhookEvent) Valid() bool {
+	for _, event := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EventList returns the space separated events of the webhook as a slice
+func (w Webhook) EventList() []WebhookEvent {
+	var events []WebhookEvent
+	for _, e := range strings.Fields(w.Events) {
+		events = append(events, WebhookEvent(e))
+	}
+
+	return events
+}
+
+// Subscribed reports whether the webhook is sent event e
+func (w Webhook) Subscribed(e WebhookEvent) bool {
+	for _, event := range w.EventList() {
+		if event == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Delivered reports whether the endpoint accepted the delivery
+func (d WebhookDelivery) Delivered() bool {
+	return !d.DeliveredAt.IsZero()
+}
+
+// Failed reports whether the delivery was given up after its last attempt failed
+func (d WebhookDelivery) Failed() bool {
+	return !d.Delivered() && d.NextAttemptAt.IsZero()
+}
@@ -0,0 +1,38 @@
+package Models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWebhook_Subscribed(t *testing.T) {
+	w := Webhook{Events: "reservation.created reservation.deleted"}
+
+	if !w.Subscribed(EventReservationCreated) || !w.Subscribed(EventReservationDeleted) {
+		t.Error("expected the webhook to be subscribed to its events")
+	}
+	if w.Subscribed(EventReservationUpdated) {
+		t.Error("expected the webhook not to be subscribed to reservation.updated")
+	}
+	if WebhookEvent("reservation.moved").Valid() {
+		t.Error("expected an unknown event to be invalid")
+	}
+}
+
+func TestWebhookDelivery_Status(t *testing.T) {
+	now := time.Now()
+
+	pending := WebhookDelivery{Attempts: 1, NextAttemptAt: now}
+	delivered := WebhookDelivery{Attempts: 2, DeliveredAt: now}
+	failed := WebhookDelivery{Attempts: 10}
+
+	if pending.Delivered() || pending.Failed() {
+		t.Error("expected a delivery with a next attempt to be pending")
+	}
+	if !delivered.Delivered() || delivered.Failed() {
+		t.Error("expected a delivered delivery to be delivered")
+	}
+	if failed.Delivered() || !failed.Failed() {
+		t.Error("expected a delivery without a next attempt to have failed")
+	}
+}
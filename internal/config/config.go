@@ -1,10 +1,12 @@
 package config
 
 import (
-	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/mailer"
 	"github.com/alexedwards/scs/v2"
 	"html/template"
 	"log"
+	texttemplate "text/template"
+	"time"
 )
 
 // AppConfig holds the application config
@@ -15,5 +17,45 @@ type AppConfig struct {
 	ErrorLog      *log.Logger
 	InProduction  bool
 	Session       *scs.SessionManager
-	MailChan      chan Models.MailData
+	DBTimeout     time.Duration
+	// CancellationDeadline is how long before arrival guests can still cancel or change a reservation
+	CancellationDeadline time.Duration
+	// LoginMaxAttempts is how many failed logins within LoginAttemptWindow lock an account, 0 never locks
+	LoginMaxAttempts int
+	// LoginMaxAttemptsPerIP is how many failed logins within LoginAttemptWindow block a client IP, 0 never blocks
+	LoginMaxAttemptsPerIP int
+	// LoginAttemptWindow is how long failed logins are counted, 0 turns off login throttling
+	LoginAttemptWindow time.Duration
+	// LoginLockout is how long a locked account stays locked
+	LoginLockout time.Duration
+	// LoginDelay is the wait after the first failed login of an account, it doubles with every further failure
+	LoginDelay time.Duration
+	// ICalSyncInterval is how often the external calendars of the rooms are synced, 0 only syncs them on demand
+	ICalSyncInterval time.Duration
+	// WebhookInterval is how often due webhook deliveries are sent, 0 doesn't send them
+	WebhookInterval time.Duration
+	// MailInterval is how often due mail of the outbox is sent, 0 doesn't send it
+	MailInterval time.Duration
+	// Mailer sends the emails of the outbox
+	Mailer mailer.Mailer
+	// MailFrom is the sender of the emails
+	MailFrom string
+	// OwnerEmail is where the notifications for the property owner, such as new reservations, are sent
+	OwnerEmail string
+	// MailTemplateCache holds the HTML email templates, MailTextTemplateCache their plain text alternatives
+	MailTemplateCache     map[string]*template.Template
+	MailTextTemplateCache map[string]*texttemplate.Template
+	// PropertyAddress is where the property is, as the location of the calendar invites of reservations
+	PropertyAddress string
+	// CheckInTime and CheckOutTime are the times of day, since midnight in TimeZone, when guests arrive and leave
+	CheckInTime  time.Duration
+	CheckOutTime time.Duration
+	// TimeZone is the time zone of the property
+	TimeZone *time.Location
+	// NotificationInterval is how often due arrival reminders and thank-you emails are queued, 0 doesn't queue them
+	NotificationInterval time.Duration
+	// ArrivalReminderDays is how many days before arrival guests are reminded of their stay, 0 doesn't remind them
+	ArrivalReminderDays int
+	// ThankYouDays is how many days after departure guests are thanked and asked for feedback, 0 doesn't thank them
+	ThankYouDays int
 }
@@ -2,11 +2,13 @@ package driver
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v5"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
 )
 
 // DB holds the database connection pool
@@ -20,6 +22,9 @@ const maxOpenDbConn = 10
 const maxIdleDbConn = 5
 const maxDbLifeTime = 5 * time.Minute
 
+// SQLite allows a single writer at a time, so all access goes through one connection
+const maxOpenSQLiteConn = 1
+
 // ConnectSQL creates database pool for Postgres
 func ConnectSQL(dsn string) (*DB, error) {
 	d, err := NewDatabase(dsn)
@@ -40,6 +45,25 @@ func ConnectSQL(dsn string) (*DB, error) {
 	return dbConn, nil
 }
 
+// ConnectSQLite creates database pool for a SQLite file
+func ConnectSQLite(path string) (*DB, error) {
+	d, err := NewSQLiteDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d.SetMaxOpenConns(maxOpenSQLiteConn)
+	d.SetMaxIdleConns(maxOpenSQLiteConn)
+
+	dbConn.SQL = d
+
+	err = testDb(d)
+	if err != nil {
+		return nil, err
+	}
+	return dbConn, nil
+}
+
 // testDb tries to ping database
 func testDb(d *sql.DB) error {
 	err := d.Ping()
@@ -63,3 +87,20 @@ func NewDatabase(dsn string) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// NewSQLiteDatabase opens the SQLite file at path, creating it if it does not exist
+func NewSQLiteDatabase(path string) (*sql.DB, error) {
+	// store times in a sortable format, so date ranges can be compared as in Postgres
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite", path)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
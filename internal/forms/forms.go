@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"github.com/asaskevich/govalidator"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+var slugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
 type Form struct {
 	url.Values
 	Errors errors
@@ -54,9 +58,66 @@ func (f *Form) MinLength(field string, length int) bool {
 	return true
 }
 
+// Matches checks that field has the same value as other, e.g. a password and its confirmation
+func (f *Form) Matches(field, other string) {
+	if f.Get(field) != f.Get(other) {
+		f.Errors.Add(field, "The values don't match.")
+	}
+}
+
 // IsEmail checks valid email address
 func (f *Form) IsEmail(field string) {
 	if !govalidator.IsEmail(f.Get(field)) {
 		f.Errors.Add(field, "Invalid email address.")
 	}
 }
+
+// IsSlug checks the field only has lowercase letters and digits, separated by single hyphens
+func (f *Form) IsSlug(field string) {
+	if !slugRegexp.MatchString(f.Get(field)) {
+		f.Errors.Add(field, "Use lowercase letters, digits and hyphens only.")
+	}
+}
+
+// IsInt checks the field is a whole number of at least min
+func (f *Form) IsInt(field string, min int) {
+	n, err := strconv.Atoi(f.Get(field))
+	if err != nil || n < min {
+		f.Errors.Add(field, fmt.Sprintf("Please enter a whole number of at least %d.", min))
+	}
+}
+
+// IsPrice checks the field is a non-negative amount with at most two decimals
+func (f *Form) IsPrice(field string) {
+	if _, err := ParsePrice(f.Get(field)); err != nil {
+		f.Errors.Add(field, "Please enter an amount such as 89 or 89.50.")
+	}
+}
+
+// ParsePrice converts an amount such as "89.5" into cents
+func ParsePrice(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || len(frac) > 2 {
+		return 0, fmt.Errorf("invalid price %q", s)
+	}
+
+	units, err := strconv.ParseUint(whole, 10, 31)
+	if err != nil {
+		return 0, err
+	}
+
+	cents := 0
+	if frac != "" {
+		c, err := strconv.ParseUint(frac, 10, 8)
+		if err != nil {
+			return 0, err
+		}
+		cents = int(c)
+		if len(frac) == 1 {
+			cents *= 10
+		}
+	}
+
+	return int(units)*100 + cents, nil
+}
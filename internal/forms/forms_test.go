@@ -75,6 +75,28 @@ func TestForm_MinLength(t *testing.T) {
 
 }
 
+func TestForm_Matches(t *testing.T) {
+	postData := url.Values{}
+	postData.Add("password", "secret")
+	postData.Add("same", "secret")
+	postData.Add("other", "Secret")
+
+	form := New(postData)
+	form.Matches("password", "same")
+	if !form.Valid() {
+		t.Error("the values are equal, this test should not fail")
+	}
+
+	form = New(postData)
+	form.Matches("password", "other")
+	if form.Valid() {
+		t.Error("the values differ, this test should fail")
+	}
+	if form.Errors.Get("password") == "" {
+		t.Error("the error should be on the first field")
+	}
+}
+
 func TestForm_IsEmail(t *testing.T) {
 	r := httptest.NewRequest("POST", "/", nil)
 	postData := url.Values{}
@@ -93,3 +115,67 @@ func TestForm_IsEmail(t *testing.T) {
 	}
 
 }
+
+func TestForm_IsSlug(t *testing.T) {
+	postData := url.Values{}
+	postData.Add("good", "majors-suite-2")
+	postData.Add("bad", "Major's Suite")
+
+	form := New(postData)
+	form.IsSlug("good")
+	if !form.Valid() {
+		t.Error("majors-suite-2 is a valid slug, should not fail")
+	}
+	form.IsSlug("bad")
+	if form.Valid() {
+		t.Error("Major's Suite is not a valid slug, should fail")
+	}
+}
+
+func TestForm_IsInt(t *testing.T) {
+	postData := url.Values{}
+	postData.Add("a", "2")
+	postData.Add("b", "0")
+	postData.Add("c", "two")
+
+	form := New(postData)
+	form.IsInt("a", 1)
+	if !form.Valid() {
+		t.Error("2 is at least 1, should not fail")
+	}
+	form.IsInt("b", 1)
+	if form.Errors.Get("b") == "" {
+		t.Error("0 is less than 1, should fail")
+	}
+	form.IsInt("c", 1)
+	if form.Errors.Get("c") == "" {
+		t.Error("two is not a number, should fail")
+	}
+}
+
+func TestParsePrice(t *testing.T) {
+	var tests = []struct {
+		price    string
+		expected int
+		ok       bool
+	}{
+		{"89", 8900, true},
+		{"89.5", 8950, true},
+		{"89.05", 8905, true},
+		{"0", 0, true},
+		{"89.123", 0, false},
+		{"-1", 0, false},
+		{".5", 0, false},
+		{"abc", 0, false},
+	}
+
+	for _, e := range tests {
+		cents, err := ParsePrice(e.price)
+		if (err == nil) != e.ok {
+			t.Errorf("%q: expected ok %t but got error %v", e.price, e.ok, err)
+		}
+		if e.ok && cents != e.expected {
+			t.Errorf("%q: expected %d cents but got %d", e.price, e.expected, cents)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package handler
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/forms"
+	"github.com/454270186/Hotel-booking-web-application/internal/helpers"
+	"github.com/454270186/Hotel-booking-web-application/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPISpec is the OpenAPI 3 document of the JSON endpoints, keep it in step with the handlers
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// apiDateLayout is the format of the dates in API requests and responses
+const apiDateLayout = "2006-01-02"
+
+// apiTouchInterval is how often the last use of an API token is recorded, rather than on every request
+const apiTouchInterval = time.Minute
+
+// apiMaxBodyBytes limits the size of API request bodies
+const apiMaxBodyBytes = 1 << 20
+
+// guestEmailHeader carries the email a reservation was made with when it is shown. It isn't a query
+// parameter, so it doesn't end up in access logs and proxy logs with the URL
+const guestEmailHeader = "X-Guest-Email"
+
+// apiError is the body of every API error response, wrapped in {"error": ...}
+type apiError struct {
+	Code    string              `json:"code"`
+	Message string              `json:"message"`
+	Fields  map[string][]string `json:"fields,omitempty"` // the invalid request fields and what is wrong with them
+}
+
+// apiRoom is a room as the API shows it
+type apiRoom struct {
+	ID               int      `json:"id"`
+	Name             string   `json:"name"`
+	Slug             string   `json:"slug"`
+	Description      string   `json:"description"`
+	Capacity         int      `json:"capacity"`
+	BedConfiguration string   `json:"bed_configuration"`
+	Amenities        []string `json:"amenities"`
+	BasePrice        int      `json:"base_price"` // nightly price in cents
+}
+
+// apiAvailableRoom is a room that is free for a stay, with the price of the whole stay
+type apiAvailableRoom struct {
+	apiRoom
+	TotalPrice int `json:"total_price"` // in cents
+}
+
+// apiAvailability is the response of an availability query
+type apiAvailability struct {
+	StartDate string             `json:"start_date"`
+	EndDate   string             `json:"end_date"`
+	Rooms     []apiAvailableRoom `json:"rooms"`
+}
+
+// apiReservationRequest is the body of a request to make a reservation
+type apiReservationRequest struct {
+	RoomID    int    `json:"room_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+}
+
+// apiCancelRequest is the body of a request to cancel a reservation, the email proves the guest made it
+type apiCancelRequest struct {
+	Email string `json:"email"`
+}
+
+// apiReservation is a reservation as the API shows it to the guest who made it
+type apiReservation struct {
+	ConfirmationCode string `json:"confirmation_code"`
+	RoomID           int    `json:"room_id"`
+	RoomName         string `json:"room_name"`
+	StartDate        string `json:"start_date"`
+	EndDate          string `json:"end_date"`
+	FirstName        string `json:"first_name"`
+	LastName         string `json:"last_name"`
+	Email            string `json:"email"`
+	Phone            string `json:"phone"`
+	TotalPrice       int    `json:"total_price"` // in cents
+	Cancelled        bool   `json:"cancelled"`
+	CanCancel        bool   `json:"can_cancel"` // false once the cancellation deadline has passed
+}
+
+// newAPIRoom converts room for an API response
+func newAPIRoom(room Models.Room) apiRoom {
+	amenities := room.AmenityList()
+	if amenities == nil {
+		amenities = []string{}
+	}
+
+	return apiRoom{
+		ID:               room.ID,
+		Name:             room.RoomName,
+		Slug:             room.Slug,
+		Description:      room.Description,
+		Capacity:         room.Capacity,
+		BedConfiguration: room.BedConfiguration,
+		Amenities:        amenities,
+		BasePrice:        room.BasePrice,
+	}
+}
+
+// newAPIReservation converts res for an API response
+func (m *Repository) newAPIReservation(res Models.Reservation) apiReservation {
+	return apiReservation{
+		ConfirmationCode: res.ConfirmationCode,
+		RoomID:           res.RoomID,
+		RoomName:         res.Room.RoomName,
+		StartDate:        res.StartDate.Format(apiDateLayout),
+		EndDate:          res.EndDate.Format(apiDateLayout),
+		FirstName:        res.FirstName,
+		LastName:         res.LastName,
+		Email:            res.Email,
+		Phone:            res.Phone,
+		TotalPrice:       res.TotalPrice,
+		Cancelled:        res.Cancelled != 0,
+		CanCancel:        m.canChangeReservation(res),
+	}
+}
+
+// writeJSON writes v as the JSON body of a response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.MarshalIndent(v, "", "     ")
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+// writeAPIError writes an API error response
+func writeAPIError(w http.ResponseWriter, status int, code, message string, fields map[string][]string) {
+	writeJSON(w, status, map[string]apiError{
+		"error": {Code: code, Message: message, Fields: fields},
+	})
+}
+
+// apiServerError logs err and writes an API error response that doesn't leak it
+func (m *Repository) apiServerError(w http.ResponseWriter, err error) {
+	m.App.ErrorLog.Println(fmt.Sprintf("%s\n%s", err.Error(), debug.Stack()))
+	writeAPIError(w, http.StatusInternalServerError, "internal_error", "Internal server error", nil)
+}
+
+// readJSON decodes the JSON body of r into v, writing an error response and returning false if it can't
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodyBytes))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("body must only contain a single JSON object")
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "Invalid JSON body: "+err.Error(), nil)
+		return false
+	}
+
+	return true
+}
+
+// apiStay validates the start_date and end_date fields of form, returning the parsed dates
+func apiStay(form *forms.Form) (time.Time, time.Time) {
+	form.Required("start_date", "end_date")
+
+	startDate, err := time.Parse(apiDateLayout, form.Get("start_date"))
+	if err != nil && form.Has("start_date") {
+		form.Errors.Add("start_date", "Use the format YYYY-MM-DD.")
+	}
+	endDate, err := time.Parse(apiDateLayout, form.Get("end_date"))
+	if err != nil && form.Has("end_date") {
+		form.Errors.Add("end_date", "Use the format YYYY-MM-DD.")
+	}
+
+	if form.Valid() {
+		today := time.Now().Truncate(24 * time.Hour)
+		if startDate.Before(today) {
+			form.Errors.Add("start_date", "Arrival can't be in the past.")
+		}
+		if !endDate.After(startDate) {
+			form.Errors.Add("end_date", "Departure must be after arrival.")
+		}
+	}
+
+	return startDate, endDate
+}
+
+// APISpec serves the OpenAPI document of the JSON endpoints
+func (m *Repository) APISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPISpec)
+}
+
+// RequireAPIToken only lets through API requests with the bearer token of an API token that has scope.
+// The session isn't looked at, so browsers can't be tricked into making API requests
+func (m *Repository) RequireAPIToken(scope Models.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw, ok := helpers.BearerToken(r)
+			if !ok {
+				m.APITokenRequired(w, r)
+				return
+			}
+
+			// deactivating a user revokes their tokens, the check of the user also covers tokens of users
+			// deactivated before that
+			t, err := m.DB.GetAPITokenByHash(r.Context(), helpers.HashToken(raw))
+			if errors.Is(err, sql.ErrNoRows) || (err == nil && (t.Revoked() || !t.User.Active)) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeAPIError(w, http.StatusUnauthorized, "unauthorized", "The API token is invalid or revoked", nil)
+				return
+			}
+			if err != nil {
+				m.apiServerError(w, err)
+				return
+			}
+
+			if !t.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+				writeAPIError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("The API token lacks the scope %s", scope), nil)
+				return
+			}
+
+			if time.Since(t.LastUsedAt) >= apiTouchInterval {
+				// the request doesn't depend on it, so a failure is only logged
+				if err := m.DB.TouchAPIToken(r.Context(), t.ID, time.Now()); err != nil {
+					m.App.ErrorLog.Println(err)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APITokenRequired answers API requests without a bearer token
+func (m *Repository) APITokenRequired(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeAPIError(w, http.StatusUnauthorized, "unauthorized", "An API token is required", nil)
+}
+
+// APINotFound answers requests for unknown API paths
+func (m *Repository) APINotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "not_found", "No such API endpoint", nil)
+}
+
+// APIMethodNotAllowed answers API requests with a method the path doesn't support
+func (m *Repository) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed", nil)
+}
+
+// APIRooms lists the active rooms
+func (m *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	out := []apiRoom{}
+	for _, room := range rooms {
+		if room.Active {
+			out = append(out, newAPIRoom(room))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]apiRoom{"rooms": out})
+}
+
+// APIAvailability lists the rooms that are free from start_date to end_date, optionally only the one with room_id
+func (m *Repository) APIAvailability(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(r.URL.Query())
+	startDate, endDate := apiStay(form)
+
+	roomID := 0
+	if form.Has("room_id") {
+		form.IsInt("room_id", 1)
+		roomID, _ = strconv.Atoi(form.Get("room_id"))
+	}
+
+	if !form.Valid() {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "The query is invalid", form.Errors)
+		return
+	}
+
+	rooms, err := m.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	resp := apiAvailability{
+		StartDate: startDate.Format(apiDateLayout),
+		EndDate:   endDate.Format(apiDateLayout),
+		Rooms:     []apiAvailableRoom{},
+	}
+	for _, room := range rooms {
+		if roomID != 0 && room.ID != roomID {
+			continue
+		}
+
+		quote, err := m.quoteStay(r.Context(), Models.Reservation{RoomID: room.ID, StartDate: startDate, EndDate: endDate})
+		if err != nil {
+			m.apiServerError(w, err)
+			return
+		}
+
+		resp.Rooms = append(resp.Rooms, apiAvailableRoom{apiRoom: newAPIRoom(room), TotalPrice: quote.Total})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// APICreateReservation makes a reservation, validated like the make-reservation form
+func (m *Repository) APICreateReservation(w http.ResponseWriter, r *http.Request) {
+	var req apiReservationRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	form := forms.New(url.Values{
+		"start_date": {req.StartDate},
+		"end_date":   {req.EndDate},
+		"first_name": {req.FirstName},
+		"last_name":  {req.LastName},
+		"email":      {req.Email},
+		"phone":      {req.Phone},
+	})
+	startDate, endDate := apiStay(form)
+	form.Required("first_name", "last_name", "email")
+	form.MinLength("first_name", 5)
+	form.IsEmail("email")
+
+	room, offered, err := m.offeredRoom(r.Context(), req.RoomID)
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+	if !offered {
+		form.Errors.Add("room_id", "There is no such room.")
+	}
+
+	if !form.Valid() {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "The reservation is invalid", form.Errors)
+		return
+	}
+
+	reservation := Models.Reservation{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Email:     req.Email,
+		Phone:     req.Phone,
+		StartDate: startDate,
+		EndDate:   endDate,
+		RoomID:    room.ID,
+		Room:      room,
+	}
+
+	quote, err := m.quoteStay(r.Context(), reservation)
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+	reservation.TotalPrice = quote.Total
+
+	reservation.ConfirmationCode, err = helpers.NewConfirmationCode()
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	mail, err := m.reservationMails(reservation)
+	if err == nil {
+		mail, err = m.renderMail(mail...)
+	}
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	err = m.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		id, err := repo.CreateReservation(r.Context(), reservation, mail...)
+		if err != nil {
+			return err
+		}
+		reservation.ID = id
+
+		return queueWebhooks(r.Context(), repo, Models.EventReservationCreated, reservation)
+	})
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		writeAPIError(w, http.StatusConflict, "room_unavailable", "The room is not available for these dates", nil)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/reservations/"+reservation.ConfirmationCode)
+	writeJSON(w, http.StatusCreated, m.newAPIReservation(reservation))
+}
+
+// APIReservation shows the reservation with the confirmation code in the URL, if it was made with the email
+// in the X-Guest-Email header
+func (m *Repository) APIReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.apiReservationByCode(w, r, r.Header.Get(guestEmailHeader))
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m.newAPIReservation(res))
+}
+
+// APICancelReservation cancels the reservation with the confirmation code in the URL, if it was made with the
+// email in the body and the cancellation deadline hasn't passed
+func (m *Repository) APICancelReservation(w http.ResponseWriter, r *http.Request) {
+	var req apiCancelRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	res, ok := m.apiReservationByCode(w, r, req.Email)
+	if !ok {
+		return
+	}
+
+	if !m.canChangeReservation(res) {
+		writeAPIError(w, http.StatusConflict, "cannot_cancel", "This reservation can no longer be cancelled online", nil)
+		return
+	}
+
+	res.Cancelled = 1
+	err := m.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		if err := repo.CancelReservation(r.Context(), res.ID); err != nil {
+			return err
+		}
+
+		return queueWebhooks(r.Context(), repo, Models.EventReservationCancelled, res)
+	})
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	m.sendCancellationMails(r.Context(), res)
+
+	writeJSON(w, http.StatusOK, m.newAPIReservation(res))
+}
+
+// apiReservationByCode looks the reservation with the confirmation code in the URL up, writing an error
+// response and returning false if there is none for email. Unknown codes and wrong emails look the same,
+// so codes can't be probed, and a client IP that got too many wrong is refused for a while
+func (m *Repository) apiReservationByCode(w http.ResponseWriter, r *http.Request, email string) (Models.Reservation, bool) {
+	code := strings.ToUpper(strings.TrimSpace(chi.URLParam(r, "code")))
+	email = strings.TrimSpace(email)
+	if email == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "The email is missing",
+			map[string][]string{"email": {"This field cannot be blank."}})
+		return Models.Reservation{}, false
+	}
+
+	ip := clientIP(r)
+	if m.lookups.count(ip, time.Now()) >= lookupMaxFailures {
+		writeAPIError(w, http.StatusTooManyRequests, "too_many_requests",
+			"Too many reservations were not found, try again later", nil)
+		return Models.Reservation{}, false
+	}
+
+	res, err := m.DB.GetReservationByCode(r.Context(), code, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.lookups.add(ip, time.Now())
+		writeAPIError(w, http.StatusNotFound, "not_found", "There is no reservation with this code and email", nil)
+		return Models.Reservation{}, false
+	}
+	if err != nil {
+		m.apiServerError(w, err)
+		return Models.Reservation{}, false
+	}
+
+	return res, true
+}
@@ -1,6 +1,9 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,12 +12,18 @@ import (
 	"github.com/454270186/Hotel-booking-web-application/internal/driver"
 	"github.com/454270186/Hotel-booking-web-application/internal/forms"
 	"github.com/454270186/Hotel-booking-web-application/internal/helpers"
+	"github.com/454270186/Hotel-booking-web-application/internal/ical"
+	"github.com/454270186/Hotel-booking-web-application/internal/pricing"
 	"github.com/454270186/Hotel-booking-web-application/internal/render"
 	"github.com/454270186/Hotel-booking-web-application/internal/repository"
 	"github.com/454270186/Hotel-booking-web-application/internal/repository/dbrepo"
+	"github.com/454270186/Hotel-booking-web-application/internal/totp"
 	"github.com/go-chi/chi/v5"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -25,21 +34,44 @@ var Repo *Repository
 type Repository struct {
 	App *config.AppConfig
 	DB  repository.DatabaseRepo
+
+	// lookups counts the failed reservation lookups of each client IP
+	lookups *failureCounter
 }
 
 // NewRepo creates a new repository
 func NewRepo(a *config.AppConfig, db *driver.DB) *Repository {
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewPostgresRepo(a, db.SQL),
+		App:     a,
+		DB:      dbrepo.NewPostgresRepo(a, db.SQL),
+		lookups: newFailureCounter(lookupWindow),
+	}
+}
+
+// NewSQLiteRepo creates a new repository backed by a SQLite database
+func NewSQLiteRepo(a *config.AppConfig, db *driver.DB) *Repository {
+	return &Repository{
+		App:     a,
+		DB:      dbrepo.NewSQLiteRepo(a, db.SQL),
+		lookups: newFailureCounter(lookupWindow),
 	}
 }
 
 // NewTestRepo creates a new repository for test
 func NewTestRepo(a *config.AppConfig) *Repository {
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewTestingRepo(a),
+		App:     a,
+		DB:      dbrepo.NewTestingRepo(a),
+		lookups: newFailureCounter(lookupWindow),
+	}
+}
+
+// NewMemoryRepo creates a new repository backed by an in-memory database
+func NewMemoryRepo(a *config.AppConfig) *Repository {
+	return &Repository{
+		App:     a,
+		DB:      dbrepo.NewMemoryRepo(a),
+		lookups: newFailureCounter(lookupWindow),
 	}
 }
 
@@ -63,16 +95,30 @@ func (m *Repository) About(w http.ResponseWriter, r *http.Request) {
 func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 	res, ok := m.App.Session.Get(r.Context(), "reservation").(Models.Reservation)
 	if !ok {
-		helpers.ServeError(w, errors.New("cannot get reservation from Session"))
+		m.App.Session.Put(r.Context(), "error", "Cannot get reservation from session")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
 
 	// populate room name
-	room, err := m.DB.GetRoomByID(res.RoomID)
+	room, err := m.DB.GetRoomByID(r.Context(), res.RoomID)
 	if err != nil {
 		helpers.ServeError(w, err)
+		return
 	}
 	res.Room.RoomName = room.RoomName
+
+	quote, err := m.quoteStay(r.Context(), res)
+	if errors.Is(err, pricing.ErrInvalidStay) {
+		m.App.Session.Put(r.Context(), "error", "Please choose a departure date after the arrival date")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	res.TotalPrice = quote.Total
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	// parse time-object to string
@@ -84,6 +130,7 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 
 	data := make(map[string]interface{})
 	data["reservation"] = res
+	data["quote"] = quote
 	// initialize empty data and form-data to make-reservation page
 	// so that it can display blank in every input when first time get in this page
 	_ = render.Template(w, r, "make-reservation.page.html", &Models.TemplateData{
@@ -96,7 +143,9 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	reservation, ok := m.App.Session.Get(r.Context(), "reservation").(Models.Reservation)
 	if !ok {
-		helpers.ServeError(w, errors.New("cannot get reservation from Session"))
+		m.App.Session.Put(r.Context(), "error", "Cannot get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
 	}
 	err := r.ParseForm() // 获得表单post的数据
 	if err != nil {
@@ -124,6 +173,14 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	roomID, err := strconv.Atoi(r.Form.Get("room_id"))
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "invalid data!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// the room_id is posted by the client, so it may name a room that can't be booked
+	room, offered, err := m.offeredRoom(r.Context(), roomID)
+	if err != nil {
+		helpers.ServeError(w, err)
 		return
 	}
 
@@ -133,10 +190,24 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	reservation.Email = r.Form.Get("email")
 	reservation.Phone = r.Form.Get("phone")
 	reservation.RoomID = roomID
+	reservation.Room = room
 
 	// store the data posted by form
 	form := forms.New(r.PostForm)
 
+	// price the stay again, the rates may have changed since the form was shown
+	var quote pricing.Quote
+	if offered {
+		quote, err = m.quoteStay(r.Context(), reservation)
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+		reservation.TotalPrice = quote.Total
+	} else {
+		form.Errors.Add("room_id", "There is no such room.")
+	}
+
 	// Backend validation
 	form.Required("first_name", "last_name", "email") // check input is blank or not
 	form.MinLength("first_name", 5)                   // specific validation for the first_name
@@ -145,6 +216,7 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	if !form.Valid() {
 		data := make(map[string]interface{})
 		data["reservation"] = reservation // store the reservation-data and pass it to template
+		data["quote"] = quote
 
 		stringMap := make(map[string]string)
 		stringMap["start_date"] = sd
@@ -160,54 +232,51 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// if form is valid, insert data into database
-	newReservationID, err := m.DB.InsertReservation(reservation)
+	reservation.ConfirmationCode, err = helpers.NewConfirmationCode()
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	restriction := Models.RoomRestriction{
-		StartDate:     reservation.StartDate,
-		EndDate:       reservation.EndDate,
-		RoomID:        roomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1,
+	// if form is valid, insert the reservation, its room restriction, the mail and the webhooks about it into database.
+	// The room is checked again, because someone else may have booked it in the meantime
+	mail, err := m.reservationMails(reservation)
+	if err == nil {
+		mail, err = m.renderMail(mail...)
 	}
-	err = m.DB.InsertRoomRestriction(restriction)
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	// send notifications by email - first to guest
-	htmlMSG := fmt.Sprintf(`
-		<strong>Reservation Confirmation</strong><br>
-		Dear %s:<br>
-		This is confirm your reservation from %s to %s.
-`, reservation.FirstName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
+	err = m.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		id, err := repo.CreateReservation(r.Context(), reservation, mail...)
+		if err != nil {
+			return err
+		}
+		reservation.ID = id
 
-	msg := Models.MailData{
-		To:      reservation.Email,
-		From:    "me@here.com",
-		Subject: "Reservation Confirmation",
-		Content: htmlMSG,
-	}
-	m.App.MailChan <- msg
+		return queueWebhooks(r.Context(), repo, Models.EventReservationCreated, reservation)
+	})
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		data := make(map[string]interface{})
+		data["reservation"] = reservation
 
-	// send notifications by email - second to property owner
-	htmlMSGForOwner := fmt.Sprintf(`
-	<strong>Reservation Confirmation</strong><br>
-	You have a reservation of %s from %s to %s.
-`, reservation.Room.RoomName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
+		stringMap := make(map[string]string)
+		stringMap["start_date"] = sd
+		stringMap["end_date"] = ed
 
-	msgToOwner := Models.MailData{
-		To:      "Owner@ow.com",
-		From:    "me@here.com",
-		Subject: "Reservation Notification",
-		Content: htmlMSGForOwner,
+		w.WriteHeader(http.StatusConflict)
+		_ = render.Template(w, r, "reservation-unavailable.page.html", &Models.TemplateData{
+			Data:      data,
+			StringMap: stringMap,
+		})
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
 	}
-	m.App.MailChan <- msgToOwner
 
 	// if all input is validated, store the input in Session which is for reservation-summary page to use
 	m.App.Session.Put(r.Context(), "reservation", reservation)
@@ -217,14 +286,119 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "reservation-summary", http.StatusSeeOther)
 }
 
-// Generals renders the room page
+// reservationMails returns the mail notifying the guest and the property owner of a new reservation. The guest's
+// confirmation has the stay attached as a calendar invite
+func (m *Repository) reservationMails(reservation Models.Reservation) ([]Models.MailData, error) {
+	data := map[string]interface{}{"reservation": reservation}
+
+	invite, err := m.stayInvite(reservation)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Models.MailData{
+		{
+			To:          reservation.Email,
+			Subject:     "Reservation Confirmation",
+			Template:    "reservation-confirmation",
+			Data:        data,
+			Attachments: []Models.MailAttachment{invite},
+		},
+		{
+			To:       m.App.OwnerEmail,
+			Subject:  "Reservation Notification",
+			Template: "reservation-notification",
+			Data:     data,
+		},
+	}, nil
+}
+
+// absoluteURL returns path as an absolute URL on the host r was sent to, for links that leave the site,
+// such as those in emails
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, path)
+}
+
+// offeredRoom returns the room with id and whether guests can book it, which they can't if the room doesn't
+// exist or is inactive
+func (m *Repository) offeredRoom(ctx context.Context, id int) (Models.Room, bool, error) {
+	room, err := m.DB.GetRoomByID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Models.Room{}, false, nil
+	}
+	if err != nil {
+		return Models.Room{}, false, err
+	}
+
+	return room, room.Active, nil
+}
+
+// quoteStay prices the stay of res with the current rate plan of its room
+func (m *Repository) quoteStay(ctx context.Context, res Models.Reservation) (pricing.Quote, error) {
+	plan, err := m.DB.GetRatePlan(ctx, res.RoomID)
+	if err != nil {
+		return pricing.Quote{}, err
+	}
+
+	return pricing.Calculate(plan, res.StartDate, res.EndDate)
+}
+
+// Generals redirects the old General's Quarters URL to its room page
 func (m *Repository) Generals(w http.ResponseWriter, r *http.Request) {
-	_ = render.Template(w, r, "generals.page.html", &Models.TemplateData{})
+	http.Redirect(w, r, "/rooms/generals-quarters", http.StatusMovedPermanently)
 }
 
-// Majors renders the room page
+// Majors redirects the old Major's Suite URL to its room page
 func (m *Repository) Majors(w http.ResponseWriter, r *http.Request) {
-	_ = render.Template(w, r, "majors.page.html", &Models.TemplateData{})
+	http.Redirect(w, r, "/rooms/majors-suite", http.StatusMovedPermanently)
+}
+
+// Rooms renders the list of active rooms
+func (m *Repository) Rooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	var active []Models.Room
+	for _, room := range rooms {
+		if room.Active {
+			active = append(active, room)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = active
+
+	_ = render.Template(w, r, "rooms.page.html", &Models.TemplateData{
+		Data: data,
+	})
+}
+
+// Room renders the page of the active room with the slug in the URL
+func (m *Repository) Room(w http.ResponseWriter, r *http.Request) {
+	room, err := m.DB.GetRoomBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !room.Active) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+
+	_ = render.Template(w, r, "room.page.html", &Models.TemplateData{
+		Data: data,
+	})
 }
 
 // Availability renders the Book Now page
@@ -234,6 +408,12 @@ func (m *Repository) Availability(w http.ResponseWriter, r *http.Request) {
 
 // PostAvailability handle the post from form in search-availability page
 func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
 	start := r.Form.Get("start")
 	end := r.Form.Get("end")
 
@@ -250,9 +430,10 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rooms, err := m.DB.SearchAvailabilityForAllRooms(startDate, endDate)
+	rooms, err := m.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
 	if err != nil {
 		helpers.ServeError(w, err)
+		return
 	}
 
 	// if not room is available
@@ -288,6 +469,15 @@ type jsonResponse struct {
 
 // AvailabilityJSON handle request to Availability and send JSON response
 func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeAvailabilityJSON(w, jsonResponse{
+			OK:      false,
+			Message: "Internal server error",
+		})
+		return
+	}
+
 	sd := r.Form.Get("start")
 	ed := r.Form.Get("end")
 
@@ -298,10 +488,16 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 
 	roomID, err := strconv.Atoi(r.Form.Get("room_id"))
 	if err != nil {
-		helpers.ServeError(w, err)
+		writeAvailabilityJSON(w, jsonResponse{
+			OK:        false,
+			Message:   "Invalid room id",
+			StartDate: sd,
+			EndDate:   ed,
+		})
+		return
 	}
 
-	isAvailable, _ := m.DB.SearchAvailabilityByDateByRoomID(startDate, endDate, roomID)
+	isAvailable, _ := m.DB.SearchAvailabilityByDateByRoomID(r.Context(), startDate, endDate, roomID)
 	resp := jsonResponse{
 		OK:        isAvailable,
 		Message:   "",
@@ -310,6 +506,11 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		RoomID:    strconv.Itoa(roomID),
 	}
 
+	writeAvailabilityJSON(w, resp)
+}
+
+// writeAvailabilityJSON writes resp as the JSON body of the response
+func writeAvailabilityJSON(w http.ResponseWriter, resp jsonResponse) {
 	out, err := json.MarshalIndent(resp, "", "     ")
 	if err != nil {
 		helpers.ServeError(w, err)
@@ -353,6 +554,239 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// MyReservation renders the page where guests look up their reservation
+func (m *Repository) MyReservation(w http.ResponseWriter, r *http.Request) {
+	_ = render.Template(w, r, "my-reservation.page.html", &Models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostMyReservation looks a reservation up by its confirmation code and the guest's email
+func (m *Repository) PostMyReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code", "email")
+
+	// codes can't be guessed by trying them one after the other
+	ip := clientIP(r)
+	if m.lookups.count(ip, time.Now()) >= lookupMaxFailures {
+		form.Errors.Add("code", "Too many reservations were not found, please try again later.")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_ = render.Template(w, r, "my-reservation.page.html", &Models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	if form.Valid() {
+		code := strings.ToUpper(strings.TrimSpace(form.Get("code")))
+		email := strings.TrimSpace(form.Get("email"))
+
+		res, err := m.DB.GetReservationByCode(r.Context(), code, email)
+		if err == nil {
+			// remember the reservation, so the guest does not need to enter the code again to change it
+			_ = m.App.Session.RenewToken(r.Context())
+			m.App.Session.Put(r.Context(), "my_reservation_id", res.ID)
+			http.Redirect(w, r, "/my-reservation/details", http.StatusSeeOther)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			helpers.ServeError(w, err)
+			return
+		}
+
+		m.lookups.add(ip, time.Now())
+		form.Errors.Add("code", "We could not find a reservation with this code and email address.")
+	}
+
+	_ = render.Template(w, r, "my-reservation.page.html", &Models.TemplateData{
+		Form: form,
+	})
+}
+
+// MyReservationDetails shows the reservation the guest looked up
+func (m *Repository) MyReservationDetails(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.myReservation(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderMyReservation(w, r, res, forms.New(nil))
+}
+
+// PostCancelMyReservation cancels the reservation the guest looked up and frees the room
+func (m *Repository) PostCancelMyReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.myReservation(w, r)
+	if !ok {
+		return
+	}
+
+	if !m.canChangeReservation(res) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be cancelled online, please contact us")
+		http.Redirect(w, r, "/my-reservation/details", http.StatusSeeOther)
+		return
+	}
+
+	res.Cancelled = 1
+	err := m.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		if err := repo.CancelReservation(r.Context(), res.ID); err != nil {
+			return err
+		}
+
+		return queueWebhooks(r.Context(), repo, Models.EventReservationCancelled, res)
+	})
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.sendCancellationMails(r.Context(), res)
+
+	m.App.Session.Put(r.Context(), "flash", "Your reservation has been cancelled")
+	http.Redirect(w, r, "/my-reservation/details", http.StatusSeeOther)
+}
+
+// sendCancellationMails notifies the guest and the property owner that the guest cancelled res
+func (m *Repository) sendCancellationMails(ctx context.Context, res Models.Reservation) {
+	data := map[string]interface{}{"reservation": res}
+
+	m.queueMail(ctx,
+		Models.MailData{
+			To:       res.Email,
+			Subject:  "Reservation Cancelled",
+			Template: "reservation-cancelled",
+			Data:     data,
+		},
+		Models.MailData{
+			To:       m.App.OwnerEmail,
+			Subject:  "Reservation Cancelled",
+			Template: "cancellation-notification",
+			Data:     data,
+		},
+	)
+}
+
+// PostChangeMyReservation records new dates the guest asked for, for the owner to confirm
+func (m *Repository) PostChangeMyReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.myReservation(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	if !m.canChangeReservation(res) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be changed online, please contact us")
+		http.Redirect(w, r, "/my-reservation/details", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("start_date", "end_date")
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, form.Get("start_date"))
+	if err != nil {
+		form.Errors.Add("start_date", "Invalid date.")
+	} else if time.Until(startDate) < m.App.CancellationDeadline {
+		form.Errors.Add("start_date", "This arrival date is too soon to book online.")
+	}
+	endDate, err := time.Parse(layout, form.Get("end_date"))
+	if err != nil {
+		form.Errors.Add("end_date", "Invalid date.")
+	} else if !endDate.After(startDate) {
+		form.Errors.Add("end_date", "Departure must be after arrival.")
+	}
+
+	if !form.Valid() {
+		m.renderMyReservation(w, r, res, form)
+		return
+	}
+
+	err = m.DB.InsertChangeRequest(r.Context(), Models.ReservationChangeRequest{
+		ReservationID: res.ID,
+		StartDate:     startDate,
+		EndDate:       endDate,
+	})
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.queueMail(r.Context(), Models.MailData{
+		To:       m.App.OwnerEmail,
+		Subject:  "Reservation Change Requested",
+		Template: "change-requested",
+		Data: map[string]interface{}{
+			"reservation": res,
+			"change":      Models.ReservationChangeRequest{StartDate: startDate, EndDate: endDate},
+		},
+	})
+
+	m.App.Session.Put(r.Context(), "flash", "Your request has been sent, we will confirm the new dates by email")
+	http.Redirect(w, r, "/my-reservation/details", http.StatusSeeOther)
+}
+
+// myReservation returns the reservation the guest looked up, redirecting them to the look up page if there is none
+func (m *Repository) myReservation(w http.ResponseWriter, r *http.Request) (Models.Reservation, bool) {
+	id, ok := m.App.Session.Get(r.Context(), "my_reservation_id").(int)
+	if !ok {
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return Models.Reservation{}, false
+	}
+
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Remove(r.Context(), "my_reservation_id")
+		m.App.Session.Put(r.Context(), "error", "This reservation no longer exists")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return Models.Reservation{}, false
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return Models.Reservation{}, false
+	}
+
+	return res, true
+}
+
+// canChangeReservation reports whether the guest can still cancel or change res online
+func (m *Repository) canChangeReservation(res Models.Reservation) bool {
+	return res.Cancelled == 0 && time.Until(res.StartDate) >= m.App.CancellationDeadline
+}
+
+// renderMyReservation renders the reservation the guest looked up
+func (m *Repository) renderMyReservation(w http.ResponseWriter, r *http.Request, res Models.Reservation, form *forms.Form) {
+	changeRequests, err := m.DB.GetChangeRequestsForReservation(r.Context(), res.ID)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["change_requests"] = changeRequests
+	data["can_change"] = m.canChangeReservation(res)
+
+	stringMap := make(map[string]string)
+	stringMap["deadline"] = res.StartDate.Add(-m.App.CancellationDeadline).Format("2006-01-02 15:04")
+
+	_ = render.Template(w, r, "my-reservation-details.page.html", &Models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      form,
+	})
+}
+
 // ChooseRoom takes URL parameter of room_id, and pass it to make_reservation page
 func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 	// using Chi helper function
@@ -367,6 +801,18 @@ func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 		helpers.ServeError(w, errors.New("Cannot get reservation from Session"))
 		return
 	}
+
+	_, offered, err := m.offeredRoom(r.Context(), roomID)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	if !offered {
+		m.App.Session.Put(r.Context(), "error", "There is no such room.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
 	res.RoomID = roomID                                // update room id
 	m.App.Session.Put(r.Context(), "reservation", res) // put it back into Session
 
@@ -384,12 +830,23 @@ func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 	ed := r.URL.Query().Get("e")
 
 	layout := "2006-01-02"
-	startDate, _ := time.Parse(layout, sd)
-	endDate, _ := time.Parse(layout, ed)
+	startDate, startErr := time.Parse(layout, sd)
+	endDate, endErr := time.Parse(layout, ed)
+	if startErr != nil || endErr != nil || !endDate.After(startDate) {
+		m.App.Session.Put(r.Context(), "error", "Please choose valid arrival and departure dates")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 
-	room, err := m.DB.GetRoomByID(roomID)
+	room, offered, err := m.offeredRoom(r.Context(), roomID)
 	if err != nil {
 		helpers.ServeError(w, err)
+		return
+	}
+	if !offered {
+		m.App.Session.Put(r.Context(), "error", "There is no such room.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
 	}
 
 	res.RoomID = roomID
@@ -430,18 +887,354 @@ func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, _, err := m.DB.Authenticate(email, password)
-	if err != nil {
-		log.Println(err)
+	// failed logins are counted per account and per client IP
+	attemptEmail := strings.ToLower(email)
+	ip := clientIP(r)
 
-		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
-		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+	known, err := m.DB.GetUserByEmail(r.Context(), email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		helpers.ServeError(w, err)
 		return
 	}
 
-	m.App.Session.Put(r.Context(), "user_id", id) // the key "user_id" is used to authenticate
-	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	throttled, failures, err := m.loginThrottled(r.Context(), attemptEmail, ip, known)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	if throttled {
+		m.App.Session.Put(r.Context(), "error", "Too many failed logins, please try again later")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	id, _, err := m.DB.Authenticate(r.Context(), email, password)
+	if err != nil {
+		log.Println(err)
+
+		err = m.loginFailed(r.Context(), attemptEmail, ip, known, failures+1)
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	u, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	// the password is right, but the user isn't logged in until the second factor is too
+	if u.TOTPEnabled {
+		m.App.Session.Put(r.Context(), "pending_user_id", u.ID)
+		m.App.Session.Put(r.Context(), "pending_since", time.Now().Unix())
+		m.App.Session.Put(r.Context(), "pending_attempts", 0)
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	required, err := m.twoFactorRequired(r.Context(), u)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	err = m.logIn(r, u)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	if required {
+		// the admin area stays locked until two-factor authentication is set up
+		m.App.Session.Put(r.Context(), "two_factor_setup", true)
+		m.App.Session.Put(r.Context(), "warning", "Your role requires two-factor authentication, set it up to continue")
+		http.Redirect(w, r, "/admin/profile", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// clientIP returns the IP address of the client, proxy headers are not trusted as anyone can set them
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// loginThrottled reports whether a login for email from ip has to be refused without checking the password,
+// and returns the failed logins of email that still count
+func (m *Repository) loginThrottled(ctx context.Context, email, ip string, u Models.User) (bool, int, error) {
+	if u.Locked() {
+		return true, 0, nil
+	}
+
+	if m.App.LoginAttemptWindow <= 0 {
+		return false, 0, nil
+	}
+
+	attempts, err := m.DB.GetLoginAttempts(ctx, email, ip, time.Now().Add(-m.App.LoginAttemptWindow))
+	if err != nil {
+		return false, 0, err
+	}
+
+	var failures, fromIP int
+	var last time.Time
+	for _, a := range attempts {
+		if a.IPAddress == ip {
+			fromIP++
+		}
+		if a.Email == email {
+			failures++
+			last = a.CreatedAt
+		}
+	}
+
+	if m.App.LoginMaxAttemptsPerIP > 0 && fromIP >= m.App.LoginMaxAttemptsPerIP {
+		return true, failures, nil
+	}
+
+	// every failure doubles the wait before the next try, up to the whole window
+	if failures > 0 && m.App.LoginDelay > 0 {
+		if time.Since(last) < retryDelay(m.App.LoginDelay, m.App.LoginAttemptWindow, failures) {
+			return true, failures, nil
+		}
+	}
+
+	return false, failures, nil
+}
+
+// loginFailed records a failed login and locks the account once it failed too often
+func (m *Repository) loginFailed(ctx context.Context, email, ip string, u Models.User, failures int) error {
+	if m.App.LoginAttemptWindow <= 0 {
+		return nil
+	}
+
+	err := m.DB.InsertLoginAttempt(ctx, Models.LoginAttempt{
+		Email:     email,
+		IPAddress: ip,
+	})
+	if err != nil {
+		return err
+	}
+
+	// only active users can be locked, unknown emails are just slowed down
+	if u.ID == 0 || !u.Active || m.App.LoginMaxAttempts <= 0 || failures < m.App.LoginMaxAttempts {
+		return nil
+	}
+
+	until := time.Now().Add(m.App.LoginLockout)
+	err = m.DB.LockUser(ctx, u.ID, until)
+	if err != nil {
+		return err
+	}
+
+	m.queueMail(ctx, Models.MailData{
+		To:       u.Email,
+		Subject:  "Account Locked",
+		Template: "account-locked",
+		Data: map[string]interface{}{
+			"user":     u,
+			"failures": failures,
+			"until":    until,
+		},
+	})
+
+	return nil
+}
+
+// logIn stores the user in the session, after all factors are checked. Only then are the failed logins of the
+// account forgiven
+func (m *Repository) logIn(r *http.Request, u Models.User) error {
+	err := m.DB.ClearLoginAttempts(r.Context(), strings.ToLower(u.Email))
+	if err != nil {
+		return err
+	}
+
+	m.App.Session.Put(r.Context(), "user_id", u.ID) // the key "user_id" is used to authenticate
+	m.App.Session.Put(r.Context(), "access_level", u.AccessLevel)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+
+	return nil
+}
+
+// twoFactorRequired reports whether the access level of u requires two-factor authentication
+func (m *Repository) twoFactorRequired(ctx context.Context, u Models.User) (bool, error) {
+	levels, err := m.DB.GetTwoFactorLevels(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, level := range levels {
+		if level == u.AccessLevel {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+const (
+	// pendingLoginTTL is how long a user has to enter the second factor after the password
+	pendingLoginTTL = 5 * time.Minute
+	// maxTwoFactorAttempts is how many wrong codes end a pending login
+	maxTwoFactorAttempts = 5
+	// recoveryCodeCount is how many recovery codes a user gets
+	recoveryCodeCount = 10
+	// totpIssuer names the site in authenticator apps
+	totpIssuer = "Bookings"
+)
+
+// TwoFactor renders the page for entering the second factor of a pending login
+func (m *Repository) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	if _, ok := m.pendingUser(w, r); !ok {
+		return
+	}
+
+	render.Template(w, r, "two-factor.page.html", &Models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostTwoFactor checks the authenticator or recovery code of a pending login and logs the user in
+func (m *Repository) PostTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	u, ok := m.pendingUser(w, r)
+	if !ok {
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	if !form.Valid() {
+		render.Template(w, r, "two-factor.page.html", &Models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	// wrong codes count as failed logins, or the code could be guessed by entering the password again and again
+	attemptEmail := strings.ToLower(u.Email)
+	ip := clientIP(r)
+
+	throttled, failures, err := m.loginThrottled(r.Context(), attemptEmail, ip, u)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	if throttled {
+		m.App.Session.Put(r.Context(), "error", "Too many failed logins, please try again later")
+		if u.Locked() {
+			m.clearPendingLogin(r)
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	valid, recoveryCode, err := m.checkSecondFactor(r.Context(), u, form.Get("code"))
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	if !valid {
+		err = m.loginFailed(r.Context(), attemptEmail, ip, u, failures+1)
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+
+		attempts := m.App.Session.GetInt(r.Context(), "pending_attempts") + 1
+		if attempts >= maxTwoFactorAttempts {
+			m.clearPendingLogin(r)
+			m.App.Session.Put(r.Context(), "error", "Too many invalid codes, log in again")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+
+		m.App.Session.Put(r.Context(), "pending_attempts", attempts)
+		m.App.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.clearPendingLogin(r)
+	_ = m.App.Session.RenewToken(r.Context())
+	err = m.logIn(r, u)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	if recoveryCode {
+		left, err := m.DB.CountRecoveryCodes(r.Context(), u.ID)
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+		m.App.Session.Put(r.Context(), "warning", fmt.Sprintf("Logged in with a recovery code, %d left", left))
+		http.Redirect(w, r, "/admin/profile", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// pendingUser returns the user of the pending login, or redirects to the login page if there is none
+func (m *Repository) pendingUser(w http.ResponseWriter, r *http.Request) (Models.User, bool) {
+	id := m.App.Session.GetInt(r.Context(), "pending_user_id")
+	since := time.Unix(m.App.Session.GetInt64(r.Context(), "pending_since"), 0)
+
+	if id == 0 || time.Since(since) > pendingLoginTTL {
+		m.clearPendingLogin(r)
+		m.App.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return Models.User{}, false
+	}
+
+	u, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return u, false
+	}
+
+	return u, true
+}
+
+// clearPendingLogin removes a pending login from the session
+func (m *Repository) clearPendingLogin(r *http.Request) {
+	m.App.Session.Remove(r.Context(), "pending_user_id")
+	m.App.Session.Remove(r.Context(), "pending_since")
+	m.App.Session.Remove(r.Context(), "pending_attempts")
+}
+
+// checkSecondFactor checks code as an authenticator code of u, or failing that as one of u's recovery codes,
+// which is used up. It reports whether code was valid and whether it was a recovery code
+func (m *Repository) checkSecondFactor(ctx context.Context, u Models.User, code string) (bool, bool, error) {
+	if step, ok := totp.Validate(u.TOTPSecret, code, time.Now()); ok {
+		// a code can only be used once, even within its period
+		fresh, err := m.DB.UseTOTPStep(ctx, u.ID, step)
+		return fresh, false, err
+	}
+
+	used, err := m.DB.UseRecoveryCode(ctx, u.ID, helpers.HashToken(helpers.NormalizeRecoveryCode(code)))
+
+	return used, used, err
 }
 
 // Logout logs user out
@@ -452,321 +1245,2000 @@ func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 }
 
-// AdminDashboard shows the admin dashboard
-func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "admin-dashboard.page.html", &Models.TemplateData{})
+// passwordResetTTL is how long a password reset link stays valid
+const passwordResetTTL = time.Hour
+
+// ForgotPassword renders the page for requesting a password reset link
+func (m *Repository) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "forgot-password.page.html", &Models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostForgotPassword emails a password reset link to the user with the posted email, if there is one
+func (m *Repository) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "forgot-password.page.html", &Models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	u, err := m.DB.GetUserByEmail(r.Context(), form.Get("email"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	if err == nil && u.Active {
+		token, err := helpers.NewToken()
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+
+		err = m.DB.InsertPasswordResetToken(r.Context(), Models.PasswordResetToken{
+			UserID:    u.ID,
+			TokenHash: helpers.HashToken(token),
+			ExpiresAt: time.Now().Add(passwordResetTTL),
+		})
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+
+		m.queueMail(r.Context(), Models.MailData{
+			To:       u.Email,
+			Subject:  "Password Reset",
+			Template: "password-reset",
+			Data: map[string]interface{}{
+				"user":      u,
+				"reset_url": absoluteURL(r, "/user/reset-password?token="+url.QueryEscape(token)),
+				"ttl":       passwordResetTTL,
+			},
+		})
+	}
+
+	// the same message either way, so the form can't be used to find out who has an account
+	m.App.Session.Put(r.Context(), "flash", "If the email belongs to an account, a link to reset its password is on its way")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// ResetPassword renders the form for choosing a new password with the token of a reset link
+func (m *Repository) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	t, err := m.DB.GetPasswordResetToken(r.Context(), helpers.HashToken(token))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (t.Used || time.Now().After(t.ExpiresAt))) {
+		m.App.Session.Put(r.Context(), "error", "This password reset link is invalid or has expired")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.renderResetPassword(w, r, token, forms.New(nil))
+}
+
+// PostResetPassword sets the posted password for the user of a password reset token
+func (m *Repository) PostResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("password")
+	form.MinLength("password", minPasswordLength)
+	form.Matches("password_confirm", "password")
+	if !form.Valid() {
+		m.renderResetPassword(w, r, form.Get("token"), form)
+		return
+	}
+
+	err = m.DB.ResetPassword(r.Context(), helpers.HashToken(form.Get("token")), form.Get("password"))
+	if errors.Is(err, repository.ErrInvalidResetToken) {
+		m.App.Session.Put(r.Context(), "error", "This password reset link is invalid or has expired")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Password changed, you can log in with it now")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// renderResetPassword renders the form for choosing a new password
+func (m *Repository) renderResetPassword(w http.ResponseWriter, r *http.Request, token string, form *forms.Form) {
+	stringMap := make(map[string]string)
+	stringMap["token"] = token
+
+	render.Template(w, r, "reset-password.page.html", &Models.TemplateData{
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
+
+// AdminDashboard shows the admin dashboard
+func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "admin-dashboard.page.html", &Models.TemplateData{})
+}
+
+// AdminNewReservations shows all new reservations in admin tool
+func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.AllNewReservations(r.Context())
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	render.Template(w, r, "admin-new-reservations.page.html", &Models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminAllReservations shows all reservations in admin tool
+func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.AllReservations(r.Context())
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	render.Template(w, r, "admin-all-reservations.page.html", &Models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminShowReservation shows the reservation detail
+func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	src := exploded[3]
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+	stringMap["month"] = month
+	stringMap["year"] = year
+
+	// get reservation from database
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	changeRequests, err := m.DB.GetChangeRequestsForReservation(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["change_requests"] = changeRequests
+
+	render.Template(w, r, "admin-reservations-show.page.html", &Models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      forms.New(nil),
+	})
+}
+
+// AdminPostShowReservation handles the post for reservation updates
+func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	src := exploded[3]
+
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	// update reservation
+	res.FirstName = r.Form.Get("first_name")
+	res.LastName = r.Form.Get("last_name")
+	res.Email = r.Form.Get("email")
+	res.Phone = r.Form.Get("phone")
+
+	err = m.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		if err := repo.UpdateReservation(r.Context(), res); err != nil {
+			return err
+		}
+
+		return queueWebhooks(r.Context(), repo, Models.EventReservationUpdated, res)
+	})
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	month := r.Form.Get("month")
+	year := r.Form.Get("year")
+
+	m.App.Session.Put(r.Context(), "flash", "Changes Saved")
+
+	if year == "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+
+}
+
+// AdminReservationsCalendar displays the reservations calendar
+func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Request) {
+	// assume that there is no month/year specified
+	now := time.Now()
+
+	if r.URL.Query().Get("y") != "" {
+		year, _ := strconv.Atoi(r.URL.Query().Get("y"))
+		month, _ := strconv.Atoi(r.URL.Query().Get("m"))
+		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	data := make(map[string]interface{})
+	data["now"] = now
+
+	next := now.AddDate(0, 1, 0)
+	last := now.AddDate(0, -1, 0)
+
+	nextMonth := next.Format("01")
+	nextMonthYear := next.Format("2006")
+
+	lastMonth := last.Format("01")
+	lastMonthYear := last.Format("2006")
+
+	stringMap := make(map[string]string)
+	stringMap["next_month"] = nextMonth
+	stringMap["next_month_year"] = nextMonthYear
+	stringMap["last_month"] = lastMonth
+	stringMap["last_month_year"] = lastMonthYear
+
+	stringMap["this_month"] = now.Format("01")
+	stringMap["this_month_year"] = now.Format("2006")
+
+	// get the first and last days of the month
+	currentYear, currentMonth, _ := now.Date()
+	currentLocation := now.Location()
+	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
+	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+
+	intMap := make(map[string]int)
+	intMap["days_in_month"] = lastOfMonth.Day()
+
+	// get all rooms from database
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	data["rooms"] = rooms
+
+	for _, room := range rooms {
+		reservationMap := make(map[string]int)
+		blockMap := make(map[string]int)
+		externalMap := make(map[string]int)
+
+		// init these maps
+		for d := firstOfMonth; d.After(lastOfMonth) == false; d = d.AddDate(0, 0, 1) {
+			reservationMap[d.Format("2006-01-2")] = 0
+			blockMap[d.Format("2006-01-2")] = 0
+			externalMap[d.Format("2006-01-2")] = 0
+		}
+
+		// get all restrictions for the current room
+		restrictions, err := m.DB.GetRestrictionsForRoomByDate(r.Context(), room.ID, firstOfMonth, lastOfMonth)
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+
+		// loop over resrtictions and distribute them in either reservation, external block or block
+		for _, y := range restrictions {
+			if y.ReservationID > 0 {
+				// it's a reservation
+				for d := y.StartDate; d.After(y.EndDate) == false; d = d.AddDate(0, 0, 1) {
+					reservationMap[d.Format("2006-01-2")] = y.ReservationID
+				}
+			} else if y.RestrictionID == Models.RestrictionExternal {
+				// it's synced from an external calendar, which is where it has to change
+				for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+					externalMap[d.Format("2006-01-2")] = y.ICalFeedID
+				}
+			} else {
+				// it's a block
+				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
+			}
+		}
+
+		data[fmt.Sprintf("reservation_map_%d", room.ID)] = reservationMap
+		data[fmt.Sprintf("block_map_%d", room.ID)] = blockMap
+		data[fmt.Sprintf("external_map_%d", room.ID)] = externalMap
+
+		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", room.ID), blockMap)
+	}
+
+	render.Template(w, r, "admin-reservations-calendar.page.html", &Models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		IntMap:    intMap,
+	})
+}
+
+// AdminProcessReservation marks a reservation as processed
+func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	src := chi.URLParam(r, "src")
+
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	res.Processed = 1
+	err = m.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		if err := repo.UpdateProcessedForReservation(r.Context(), id, 1); err != nil {
+			return err
+		}
+
+		return queueWebhooks(r.Context(), repo, Models.EventReservationProcessed, res)
+	})
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation marked as Processed")
+	if year == "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+
+}
+
+// AdminProcessReservation marks a reservation as processed
+func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	src := chi.URLParam(r, "src")
+
+	// the webhooks are sent the reservation as it was before it is gone
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	err = m.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		if err := repo.DeleteReservation(r.Context(), id); err != nil {
+			return err
+		}
+
+		return queueWebhooks(r.Context(), repo, Models.EventReservationDeleted, res)
+	})
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation Deleted")
+	if year == "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
+
+// AdminPostReservationsCalendar handles post of reservation calendar
+func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	month, _ := strconv.Atoi(r.Form.Get("m"))
+	year, _ := strconv.Atoi(r.Form.Get("y"))
+
+	// process blocks
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+
+	// apply all block changes in one transaction, so a failure leaves the calendar as it was
+	err = m.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		for _, room := range rooms {
+			// Get the block map from the Session. Loop through the entire map, if we have an entry in the map
+			// that does not exist in our posted data, and if the resrtiction id > 0, then it is the block we need to
+			// remove
+			// a room added after the calendar was loaded has no block map, and so no blocks to remove
+			curMap, _ := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", room.ID)).(map[string]int)
+			for name, value := range curMap {
+				// ok will be false if the value is not in the map
+				if val, ok := curMap[name]; ok {
+					// only pay attention to value > 0, and that are not in the form post
+					// the rest are just placeholder for days without blocks
+					if val > 0 {
+						if !form.Has(fmt.Sprintf("remove_block_%d_%s", room.ID, name)) {
+							// delete the resrtiction by id
+							log.Println("remove block for room", room.ID)
+							err := repo.DeleteBlockForRoom(r.Context(), value)
+							if err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+		}
+
+		// now handle the new blocks
+		for name, _ := range r.PostForm {
+			if strings.HasPrefix(name, "add_block") {
+				exploded := strings.Split(name, "_")
+				roomID, _ := strconv.Atoi(exploded[2])
+				t, _ := time.Parse("2006-01-2", exploded[3])
+
+				// insert a new block
+				log.Println("insert block for room id", roomID, "for date", exploded[3])
+				err := repo.InsertBlockForRoom(r.Context(), roomID, t)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "A new block overlaps a reservation, no changes were saved")
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes Saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+}
+
+// AdminRooms shows all rooms in admin tool
+func (m *Repository) AdminRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.Template(w, r, "admin-rooms.page.html", &Models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewRoom shows the form for adding a room
+func (m *Repository) AdminNewRoom(w http.ResponseWriter, r *http.Request) {
+	room := Models.Room{
+		Capacity: 2,
+		Active:   true,
+	}
+
+	m.renderRoomForm(w, r, room, forms.New(nil), render.FormatPrice(room.BasePrice))
+}
+
+// AdminPostNewRoom handles the post for adding a room
+func (m *Repository) AdminPostNewRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	room, form, err := m.roomFromForm(r, Models.Room{})
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	if !form.Valid() {
+		m.renderRoomForm(w, r, room, form, form.Get("base_price"))
+		return
+	}
+
+	room.ICalToken, err = helpers.NewToken()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	_, err = m.DB.InsertRoom(r.Context(), room)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room Added")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminShowRoom shows the form for editing a room
+func (m *Repository) AdminShowRoom(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.renderRoomForm(w, r, room, forms.New(nil), render.FormatPrice(room.BasePrice))
+}
+
+// AdminPostShowRoom handles the post for room updates
+func (m *Repository) AdminPostShowRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	room, form, err := m.roomFromForm(r, room)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	if !form.Valid() {
+		m.renderRoomForm(w, r, room, form, form.Get("base_price"))
+		return
+	}
+
+	err = m.DB.UpdateRoom(r.Context(), room)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes Saved")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminDeleteRoom deletes a room, unless it has reservations
+func (m *Repository) AdminDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.DeleteRoom(r.Context(), id)
+	if errors.Is(err, repository.ErrRoomInUse) {
+		m.App.Session.Put(r.Context(), "error", "This room has reservations, deactivate it instead")
+		http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", id), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room Deleted")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminNewRoomICalToken gives a room a new calendar feed URL, so whoever has the old one can no longer read it
+func (m *Repository) AdminNewRoomICalToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	token, err := helpers.NewToken()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	err = m.DB.SetRoomICalToken(r.Context(), id, token)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "New Calendar Feed URL Created")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", id), http.StatusSeeOther)
+}
+
+// AdminRoomRates shows the rate plan of a room
+func (m *Repository) AdminRoomRates(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	plan, err := m.DB.GetRatePlan(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["base_price"] = render.FormatPrice(plan.BaseRate)
+	if plan.WeekendRate > 0 {
+		stringMap["weekend_rate"] = render.FormatPrice(plan.WeekendRate)
+	}
+
+	m.renderRoomRates(w, r, plan, forms.New(nil), stringMap)
+}
+
+// AdminPostRoomRates handles the post of the base and weekend rate of a room
+func (m *Repository) AdminPostRoomRates(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	plan, err := m.DB.GetRatePlan(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("base_price")
+	form.IsPrice("base_price")
+	// leaving the weekend rate empty charges the base price on weekends too
+	if form.Has("weekend_rate") {
+		form.IsPrice("weekend_rate")
+	}
+
+	if !form.Valid() {
+		stringMap := make(map[string]string)
+		stringMap["base_price"] = form.Get("base_price")
+		stringMap["weekend_rate"] = form.Get("weekend_rate")
+		m.renderRoomRates(w, r, plan, form, stringMap)
+		return
+	}
+
+	plan.BaseRate, _ = forms.ParsePrice(form.Get("base_price"))
+	plan.WeekendRate = 0
+	if form.Has("weekend_rate") {
+		plan.WeekendRate, _ = forms.ParsePrice(form.Get("weekend_rate"))
+	}
+
+	err = m.DB.UpdateRatePlan(r.Context(), plan)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Rates Saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/rates", id), http.StatusSeeOther)
+}
+
+// AdminPostSeasonalRate handles the post of a new seasonal rate of a room
+func (m *Repository) AdminPostSeasonalRate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "start_date", "end_date", "rate")
+	form.IsPrice("rate")
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, form.Get("start_date"))
+	if err != nil {
+		form.Errors.Add("start_date", "Invalid date.")
+	}
+	endDate, err := time.Parse(layout, form.Get("end_date"))
+	if err != nil {
+		form.Errors.Add("end_date", "Invalid date.")
+	} else if !endDate.After(startDate) {
+		form.Errors.Add("end_date", "The season must end after it starts.")
+	}
+
+	if !form.Valid() {
+		plan, err := m.DB.GetRatePlan(r.Context(), id)
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+
+		stringMap := make(map[string]string)
+		stringMap["base_price"] = render.FormatPrice(plan.BaseRate)
+		if plan.WeekendRate > 0 {
+			stringMap["weekend_rate"] = render.FormatPrice(plan.WeekendRate)
+		}
+		m.renderRoomRates(w, r, plan, form, stringMap)
+		return
+	}
+
+	rate, _ := forms.ParsePrice(form.Get("rate"))
+	err = m.DB.InsertSeasonalRate(r.Context(), Models.SeasonalRate{
+		RoomID:    id,
+		Name:      form.Get("name"),
+		StartDate: startDate,
+		EndDate:   endDate,
+		Rate:      rate,
+	})
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Seasonal Rate Added")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/rates", id), http.StatusSeeOther)
+}
+
+// AdminDeleteSeasonalRate deletes a seasonal rate
+func (m *Repository) AdminDeleteSeasonalRate(w http.ResponseWriter, r *http.Request) {
+	roomID, _ := strconv.Atoi(chi.URLParam(r, "room"))
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.DeleteSeasonalRate(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Seasonal Rate Deleted")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/rates", roomID), http.StatusSeeOther)
+}
+
+// renderRoomRates renders the rate plan page of a room
+func (m *Repository) renderRoomRates(w http.ResponseWriter, r *http.Request, plan Models.RatePlan, form *forms.Form, stringMap map[string]string) {
+	room, err := m.DB.GetRoomByID(r.Context(), plan.RoomID)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["plan"] = plan
+
+	render.Template(w, r, "admin-room-rates.page.html", &Models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      form,
+	})
+}
+
+// AdminRoomCalendars shows the external calendars that block a room
+func (m *Repository) AdminRoomCalendars(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	m.renderRoomCalendars(w, r, id, forms.New(nil))
+}
+
+// AdminPostRoomCalendar adds an external calendar to a room, by its URL or as an uploaded file, and syncs it
+func (m *Repository) AdminPostRoomCalendar(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(icalMaxFeedBytes)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+
+	feed := Models.ICalFeed{
+		RoomID: id,
+		Name:   form.Get("name"),
+		URL:    strings.TrimSpace(form.Get("url")),
+	}
+	content, uploaded := uploadedICal(r, form)
+	switch {
+	case feed.URL != "" && uploaded:
+		form.Errors.Add("url", "Enter a URL or upload a file, not both.")
+	case feed.URL != "":
+		u, err := url.Parse(feed.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "webcal") {
+			form.Errors.Add("url", "Enter the http, https or webcal URL of the calendar.")
+		}
+	case uploaded:
+		feed.Content = content
+	case form.Errors.Get("file") == "":
+		form.Errors.Add("url", "Enter the URL of the calendar or upload its file.")
+	}
+
+	if !form.Valid() {
+		m.renderRoomCalendars(w, r, id, form)
+		return
+	}
+
+	feed.ID, err = m.DB.InsertICalFeed(r.Context(), feed)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.flashICalSync(r, feed, "Calendar Added")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/calendars", id), http.StatusSeeOther)
+}
+
+// AdminPostRoomCalendarFile replaces the file of an uploaded external calendar and syncs it
+func (m *Repository) AdminPostRoomCalendarFile(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(icalMaxFeedBytes)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	roomID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	feedID, _ := strconv.Atoi(chi.URLParam(r, "feed"))
+
+	feed, err := m.DB.GetICalFeedByID(r.Context(), feedID)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	content, uploaded := uploadedICal(r, form)
+	if !uploaded {
+		if msg := form.Errors.Get("file"); msg != "" {
+			m.App.Session.Put(r.Context(), "error", msg)
+		} else {
+			m.App.Session.Put(r.Context(), "error", "Choose the new file of the calendar.")
+		}
+		http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/calendars", roomID), http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.UpdateICalFeedContent(r.Context(), feed.ID, content)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	feed.Content = content
+
+	m.flashICalSync(r, feed, "Calendar Updated")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/calendars", roomID), http.StatusSeeOther)
+}
+
+// AdminSyncRoomCalendar syncs an external calendar now rather than waiting for the sync job
+func (m *Repository) AdminSyncRoomCalendar(w http.ResponseWriter, r *http.Request) {
+	roomID, _ := strconv.Atoi(chi.URLParam(r, "room"))
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	feed, err := m.DB.GetICalFeedByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.flashICalSync(r, feed, "Calendar Synced")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/calendars", roomID), http.StatusSeeOther)
+}
+
+// AdminDeleteRoomCalendar deletes an external calendar, freeing the nights it blocked
+func (m *Repository) AdminDeleteRoomCalendar(w http.ResponseWriter, r *http.Request) {
+	roomID, _ := strconv.Atoi(chi.URLParam(r, "room"))
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.DeleteICalFeed(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Calendar Deleted")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/calendars", roomID), http.StatusSeeOther)
+}
+
+// flashICalSync syncs an external calendar and tells the user how it went, prefixed by done
+func (m *Repository) flashICalSync(r *http.Request, feed Models.ICalFeed, done string) {
+	feed, err := m.syncICalFeed(r.Context(), feed)
+	switch {
+	case err != nil:
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("%s, but syncing it failed: %v", done, err))
+	case feed.Skipped > 0 || feed.Recurring > 0:
+		var warnings []string
+		if feed.Skipped > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d events were skipped as their nights are already taken", feed.Skipped))
+		}
+		if feed.Recurring > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d repeating events were left out, block their nights by hand",
+				feed.Recurring))
+		}
+		m.App.Session.Put(r.Context(), "warning", done+", "+strings.Join(warnings, " and "))
+	default:
+		m.App.Session.Put(r.Context(), "flash", done)
+	}
+}
+
+// uploadedICal returns the calendar uploaded in the "file" field, if there is one. A file that is too large or
+// not a calendar is reported on form
+func uploadedICal(r *http.Request, form *forms.Form) (string, bool) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	b, err := io.ReadAll(io.LimitReader(file, icalMaxFeedBytes+1))
+	if err != nil || len(b) > icalMaxFeedBytes {
+		form.Errors.Add("file", fmt.Sprintf("Upload a calendar of at most %d MB.", icalMaxFeedBytes>>20))
+		return "", false
+	}
+	if _, err := ical.Parse(bytes.NewReader(b)); err != nil {
+		form.Errors.Add("file", fmt.Sprintf("The file is not a valid calendar: %v.", err))
+		return "", false
+	}
+
+	return string(b), true
+}
+
+// renderRoomCalendars shows the external calendars of a room with the form for adding one
+func (m *Repository) renderRoomCalendars(w http.ResponseWriter, r *http.Request, roomID int, form *forms.Form) {
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	feeds, err := m.DB.GetICalFeedsForRoom(r.Context(), roomID)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["feeds"] = feeds
+
+	render.Template(w, r, "admin-room-calendars.page.html", &Models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// roomFromForm validates the posted room form and applies it to room
+func (m *Repository) roomFromForm(r *http.Request, room Models.Room) (Models.Room, *forms.Form, error) {
+	form := forms.New(r.PostForm)
+	form.Required("room_name", "slug", "capacity", "base_price")
+	form.IsSlug("slug")
+	form.IsInt("capacity", 1)
+	form.IsPrice("base_price")
+
+	room.RoomName = form.Get("room_name")
+	room.Slug = form.Get("slug")
+	room.Description = form.Get("description")
+	room.Capacity, _ = strconv.Atoi(form.Get("capacity"))
+	room.BedConfiguration = form.Get("bed_configuration")
+	room.Amenities = form.Get("amenities")
+	room.BasePrice, _ = forms.ParsePrice(form.Get("base_price"))
+	room.Image = form.Get("image")
+	room.Active = form.Has("active")
+
+	// slugs are unique, so check here rather than fail on the database constraint
+	other, err := m.DB.GetRoomBySlug(r.Context(), room.Slug)
+	if err == nil && other.ID != room.ID {
+		form.Errors.Add("slug", "Another room already uses this slug.")
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return room, form, err
+	}
+
+	return room, form, nil
+}
+
+// renderRoomForm renders the add and edit room form
+func (m *Repository) renderRoomForm(w http.ResponseWriter, r *http.Request, room Models.Room, form *forms.Form, basePrice string) {
+	data := make(map[string]interface{})
+	data["room"] = room
+
+	stringMap := make(map[string]string)
+	stringMap["base_price"] = basePrice
+	if room.ICalToken != "" {
+		stringMap["ical_url"] = icalURL(r, room)
+	}
+
+	render.Template(w, r, "admin-room-show.page.html", &Models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      form,
+	})
+}
+
+// AdminUsers shows all staff users
+func (m *Repository) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := m.DB.AllUsers(r.Context())
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	levels, err := m.DB.GetTwoFactorLevels(r.Context())
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	twoFactorRoles := make(map[Models.Role]bool)
+	for _, level := range levels {
+		twoFactorRoles[Models.Role(level)] = true
+	}
+
+	data := make(map[string]interface{})
+	data["users"] = users
+	data["roles"] = Models.Roles
+	data["two_factor_roles"] = twoFactorRoles
+
+	render.Template(w, r, "admin-users.page.html", &Models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewUser shows the form for inviting a staff user
+func (m *Repository) AdminNewUser(w http.ResponseWriter, r *http.Request) {
+	u := Models.User{
+		AccessLevel: int(Models.RoleFrontDesk),
+		Active:      true,
+	}
+
+	m.renderUserForm(w, r, u, forms.New(nil))
+}
+
+// AdminPostNewUser handles the post for inviting a staff user, who is sent an email about their account
+func (m *Repository) AdminPostNewUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	u, form, err := m.userFromForm(r, Models.User{Active: true})
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	form.Required("password")
+	form.MinLength("password", minPasswordLength)
+	form.Matches("password_confirm", "password")
+	if !form.Valid() {
+		m.renderUserForm(w, r, u, form)
+		return
+	}
+
+	u.Password = form.Get("password")
+	_, err = m.DB.InsertUser(r.Context(), u)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	// the password is handed over in person, it is never sent by email
+	m.queueMail(r.Context(), Models.MailData{
+		To:       u.Email,
+		Subject:  "Your Staff Account",
+		Template: "staff-invitation",
+		Data: map[string]interface{}{
+			"user":      u,
+			"login_url": absoluteURL(r, "/user/login"),
+		},
+	})
+
+	m.App.Session.Put(r.Context(), "flash", "User Invited")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminShowUser shows the form for editing a staff user
+func (m *Repository) AdminShowUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	u, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.renderUserForm(w, r, u, forms.New(nil))
+}
+
+// AdminPostShowUser handles the post for staff user updates
+func (m *Repository) AdminPostShowUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	u, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	accessLevel := u.AccessLevel
+
+	u, form, err := m.userFromForm(r, u)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	// otherwise the last owner could lock everyone out of user management
+	if u.ID == m.App.Session.GetInt(r.Context(), "user_id") && u.AccessLevel != accessLevel {
+		form.Errors.Add("access_level", "You can't change your own role.")
+	}
+	if !form.Valid() {
+		m.renderUserForm(w, r, u, form)
+		return
+	}
+
+	err = m.DB.UpdateUser(r.Context(), u)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes Saved")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminPostUserPassword handles the post for resetting the password of a staff user
+func (m *Repository) AdminPostUserPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	u, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("password")
+	form.MinLength("password", minPasswordLength)
+	form.Matches("password_confirm", "password")
+	if !form.Valid() {
+		m.renderUserForm(w, r, u, form)
+		return
+	}
+
+	err = m.DB.UpdatePassword(r.Context(), u.ID, form.Get("password"))
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Password Changed")
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", u.ID), http.StatusSeeOther)
+}
+
+// AdminDeactivateUser stops a staff user from logging in
+func (m *Repository) AdminDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := m.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if u.ID == m.App.Session.GetInt(r.Context(), "user_id") {
+		m.App.Session.Put(r.Context(), "error", "You can't deactivate yourself")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", u.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := m.DB.DeactivateUser(r.Context(), u.ID)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "User Deactivated")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// minPasswordLength is the shortest password staff users may have
+const minPasswordLength = 8
+
+// userFromForm validates the posted user form and applies it to u
+func (m *Repository) userFromForm(r *http.Request, u Models.User) (Models.User, *forms.Form, error) {
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "access_level")
+	form.IsEmail("email")
+
+	u.FirstName = form.Get("first_name")
+	u.LastName = form.Get("last_name")
+	u.Email = form.Get("email")
+	u.AccessLevel, _ = strconv.Atoi(form.Get("access_level"))
+	if !u.Role().Valid() {
+		form.Errors.Add("access_level", "Please choose a role.")
+	}
+
+	// emails are unique, so check here rather than fail on the database constraint
+	other, err := m.DB.GetUserByEmail(r.Context(), u.Email)
+	if err == nil && other.ID != u.ID {
+		form.Errors.Add("email", "Another user already uses this email.")
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return u, form, err
+	}
+
+	return u, form, nil
+}
+
+// renderUserForm renders the invite and edit user form
+func (m *Repository) renderUserForm(w http.ResponseWriter, r *http.Request, u Models.User, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["user"] = u
+	data["roles"] = Models.Roles
+
+	render.Template(w, r, "admin-user-show.page.html", &Models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// AdminProfile shows the two-factor authentication settings of the logged in user
+func (m *Repository) AdminProfile(w http.ResponseWriter, r *http.Request) {
+	u, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.renderProfile(w, r, u, forms.New(nil))
+}
+
+// AdminPostEnableTwoFactor turns on two-factor authentication for the logged in user, once a code
+// from their authenticator app shows it was set up with the secret on the profile page
+func (m *Repository) AdminPostEnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	u, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	secret := m.App.Session.GetString(r.Context(), "totp_setup_secret")
+	if u.TOTPEnabled || secret == "" {
+		http.Redirect(w, r, "/admin/profile", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	step, ok := totp.Validate(secret, form.Get("code"), time.Now())
+	if form.Has("code") && !ok {
+		form.Errors.Add("code", "This code doesn't match, check the time on your device and try again.")
+	}
+	if !form.Valid() {
+		m.renderProfile(w, r, u, form)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	err = m.DB.EnableTwoFactor(r.Context(), u.ID, secret, hashes)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	if _, err = m.DB.UseTOTPStep(r.Context(), u.ID, step); err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Remove(r.Context(), "totp_setup_secret")
+	m.App.Session.Remove(r.Context(), "two_factor_setup")
+	// shown once on the profile page, only their hashes are stored
+	m.App.Session.Put(r.Context(), "recovery_codes", strings.Join(codes, " "))
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication enabled")
+	http.Redirect(w, r, "/admin/profile", http.StatusSeeOther)
+}
+
+// AdminPostDisableTwoFactor turns off two-factor authentication for the logged in user, unless their role requires it
+func (m *Repository) AdminPostDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	u, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	required, err := m.twoFactorRequired(r.Context(), u)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	if required {
+		m.App.Session.Put(r.Context(), "error", "Your role requires two-factor authentication")
+		http.Redirect(w, r, "/admin/profile", http.StatusSeeOther)
+		return
+	}
+
+	// someone at an unlocked computer shouldn't be able to turn it off
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	if form.Has("code") {
+		valid, _, err := m.checkSecondFactor(r.Context(), u, form.Get("code"))
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+		if !valid {
+			form.Errors.Add("code", "Invalid code")
+		}
+	}
+	if !form.Valid() {
+		m.renderProfile(w, r, u, form)
+		return
+	}
+
+	err = m.DB.DisableTwoFactor(r.Context(), u.ID)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication disabled")
+	http.Redirect(w, r, "/admin/profile", http.StatusSeeOther)
+}
+
+// AdminPostRecoveryCodes replaces the recovery codes of the logged in user
+func (m *Repository) AdminPostRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	id := m.App.Session.GetInt(r.Context(), "user_id")
+
+	u, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+	if !u.TOTPEnabled {
+		http.Redirect(w, r, "/admin/profile", http.StatusSeeOther)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	err = m.DB.ReplaceRecoveryCodes(r.Context(), u.ID, hashes)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "recovery_codes", strings.Join(codes, " "))
+	m.App.Session.Put(r.Context(), "flash", "New recovery codes generated")
+	http.Redirect(w, r, "/admin/profile", http.StatusSeeOther)
+}
+
+// AdminDisableUserTwoFactor turns off two-factor authentication for a staff user who lost their device
+// and recovery codes. If their role requires it, they have to set it up again on their next login
+func (m *Repository) AdminDisableUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u, ok := m.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.DB.DisableTwoFactor(r.Context(), u.ID)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication reset")
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", u.ID), http.StatusSeeOther)
+}
+
+// userFromURL returns the user with the id in the URL, or answers 404 if there is none
+func (m *Repository) userFromURL(w http.ResponseWriter, r *http.Request) (Models.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return Models.User{}, false
+	}
+
+	u, err := m.DB.GetUserByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return u, false
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return u, false
+	}
+
+	return u, true
+}
+
+// AdminUnlockUser lifts the lock of a user that failed to log in too often
+func (m *Repository) AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := m.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.DB.UnlockUser(r.Context(), u.ID)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "User unlocked")
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", u.ID), http.StatusSeeOther)
+}
+
+// AdminAPITokens lists the API tokens, with the form to create one
+func (m *Repository) AdminAPITokens(w http.ResponseWriter, r *http.Request) {
+	m.renderAPITokens(w, r, forms.New(nil))
+}
+
+// AdminPostAPIToken creates an API token and shows it once, only its hash is stored
+func (m *Repository) AdminPostAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+
+	var scopes []string
+	for _, s := range r.PostForm["scopes"] {
+		if !Models.Scope(s).Valid() {
+			form.Errors.Add("scopes", "Unknown scope.")
+			break
+		}
+		scopes = append(scopes, s)
+	}
+	if len(scopes) == 0 {
+		form.Errors.Add("scopes", "Choose at least one scope.")
+	}
+
+	if !form.Valid() {
+		m.renderAPITokens(w, r, form)
+		return
+	}
+
+	token, err := helpers.NewToken()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	_, err = m.DB.InsertAPIToken(r.Context(), Models.APIToken{
+		Name:      strings.TrimSpace(form.Get("name")),
+		TokenHash: helpers.HashToken(token),
+		Scopes:    strings.Join(scopes, " "),
+		UserID:    m.App.Session.GetInt(r.Context(), "user_id"),
+	})
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "api_token", token)
+	m.App.Session.Put(r.Context(), "flash", "API token created")
+	http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
 }
 
-// AdminNewReservations shows all new reservations in admin tool
-func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllNewReservations()
+// AdminRevokeAPIToken stops an API token from working
+func (m *Repository) AdminRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.RevokeAPIToken(r.Context(), id)
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	data := make(map[string]interface{})
-	data["reservations"] = reservations
-
-	render.Template(w, r, "admin-new-reservations.page.html", &Models.TemplateData{
-		Data: data,
-	})
+	m.App.Session.Put(r.Context(), "flash", "API token revoked")
+	http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
 }
 
-// AdminAllReservations shows all reservations in admin tool
-func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
+// renderAPITokens renders the API tokens page
+func (m *Repository) renderAPITokens(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	tokens, err := m.DB.AllAPITokens(r.Context())
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
+
 	data := make(map[string]interface{})
-	data["reservations"] = reservations
+	data["tokens"] = tokens
+	data["scopes"] = Models.Scopes
+	// a new token is only shown once, right after it was created
+	if token := m.App.Session.PopString(r.Context(), "api_token"); token != "" {
+		data["new_token"] = token
+	}
 
-	render.Template(w, r, "admin-all-reservations.page.html", &Models.TemplateData{
+	render.Template(w, r, "admin-api-tokens.page.html", &Models.TemplateData{
 		Data: data,
+		Form: form,
 	})
 }
 
-// AdminShowReservation shows the reservation detail
-func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
-	exploded := strings.Split(r.RequestURI, "/")
+// webhookLogSize is how many of the latest deliveries the page of a webhook shows
+const webhookLogSize = 50
 
-	id, err := strconv.Atoi(exploded[4])
+// AdminWebhooks lists the webhooks, with the form to add one
+func (m *Repository) AdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	m.renderWebhooks(w, r, forms.New(nil))
+}
+
+// AdminPostWebhook adds a webhook with a new signing secret
+func (m *Repository) AdminPostWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	src := exploded[3]
-	stringMap := make(map[string]string)
-	stringMap["src"] = src
+	hook, form := webhookFromForm(r, Models.Webhook{Active: true})
+	if !form.Valid() {
+		m.renderWebhooks(w, r, form)
+		return
+	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
-	stringMap["month"] = month
-	stringMap["year"] = year
+	hook.Secret, err = helpers.NewToken()
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
 
-	// get reservation from database
-	res, err := m.DB.GetReservationByID(id)
+	id, err := m.DB.InsertWebhook(r.Context(), hook)
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	data := make(map[string]interface{})
-	data["reservation"] = res
+	m.App.Session.Put(r.Context(), "flash", "Webhook added, verify its deliveries with the signing secret below")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", id), http.StatusSeeOther)
+}
 
-	render.Template(w, r, "admin-reservations-show.page.html", &Models.TemplateData{
-		StringMap: stringMap,
-		Data:      data,
-		Form:      forms.New(nil),
-	})
+// AdminShowWebhook shows a webhook with its signing secret and latest deliveries
+func (m *Repository) AdminShowWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, ok := m.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderWebhook(w, r, hook, forms.New(nil))
 }
 
-// AdminPostShowReservation handles the post for reservation updates
-func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
+// AdminPostShowWebhook handles the post for webhook updates
+func (m *Repository) AdminPostShowWebhook(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	exploded := strings.Split(r.RequestURI, "/")
-	id, err := strconv.Atoi(exploded[4])
+	hook, ok := m.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	hook, form := webhookFromForm(r, hook)
+	hook.Active = form.Has("active")
+	if !form.Valid() {
+		m.renderWebhook(w, r, hook, form)
+		return
+	}
+
+	err = m.DB.UpdateWebhook(r.Context(), hook)
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
-	src := exploded[3]
 
-	res, err := m.DB.GetReservationByID(id)
+	m.App.Session.Put(r.Context(), "flash", "Changes Saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", hook.ID), http.StatusSeeOther)
+}
+
+// AdminNewWebhookSecret replaces the signing secret of a webhook, for when the old one leaked
+func (m *Repository) AdminNewWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	hook, ok := m.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := helpers.NewToken()
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
+	hook.Secret = secret
 
-	// update reservation
-	res.FirstName = r.Form.Get("first_name")
-	res.LastName = r.Form.Get("last_name")
-	res.Email = r.Form.Get("email")
-	res.Phone = r.Form.Get("phone")
-
-	err = m.DB.UpdateReservation(res)
+	err = m.DB.UpdateWebhook(r.Context(), hook)
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	month := r.Form.Get("month")
-	year := r.Form.Get("year")
+	m.App.Session.Put(r.Context(), "flash", "New signing secret created, the endpoint has to verify deliveries with it")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", hook.ID), http.StatusSeeOther)
+}
 
-	m.App.Session.Put(r.Context(), "flash", "Changes Saved")
+// AdminDeleteWebhook deletes a webhook, with its deliveries
+func (m *Repository) AdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
 
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	err := m.DB.DeleteWebhook(r.Context(), id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
 	}
 
+	m.App.Session.Put(r.Context(), "flash", "Webhook deleted")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
 }
 
-// AdminReservationsCalendar displays the reservations calendar
-func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Request) {
-	// assume that there is no month/year specified
-	now := time.Now()
+// AdminRetryWebhookDelivery makes a delivery that failed or still waits for its next attempt due right away
+func (m *Repository) AdminRetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	webhookID, _ := strconv.Atoi(chi.URLParam(r, "webhook"))
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
 
-	if r.URL.Query().Get("y") != "" {
-		year, _ := strconv.Atoi(r.URL.Query().Get("y"))
-		month, _ := strconv.Atoi(r.URL.Query().Get("m"))
-		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	err := m.DB.RetryWebhookDelivery(r.Context(), webhookID, id)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
 	}
 
-	data := make(map[string]interface{})
-	data["now"] = now
-
-	next := now.AddDate(0, 1, 0)
-	last := now.AddDate(0, -1, 0)
+	m.App.Session.Put(r.Context(), "flash", "The delivery will be retried shortly")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", webhookID), http.StatusSeeOther)
+}
 
-	nextMonth := next.Format("01")
-	nextMonthYear := next.Format("2006")
+// webhookFromURL returns the webhook whose id is in the URL, answering 404 and returning false if there is none
+func (m *Repository) webhookFromURL(w http.ResponseWriter, r *http.Request) (Models.Webhook, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return Models.Webhook{}, false
+	}
 
-	lastMonth := last.Format("01")
-	lastMonthYear := last.Format("2006")
+	hook, err := m.DB.GetWebhookByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return hook, false
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return hook, false
+	}
 
-	stringMap := make(map[string]string)
-	stringMap["next_month"] = nextMonth
-	stringMap["next_month_year"] = nextMonthYear
-	stringMap["last_month"] = lastMonth
-	stringMap["last_month_year"] = lastMonthYear
+	return hook, true
+}
 
-	stringMap["this_month"] = now.Format("01")
-	stringMap["this_month_year"] = now.Format("2006")
+// webhookFromForm validates the posted webhook form and applies it to hook
+func webhookFromForm(r *http.Request, hook Models.Webhook) (Models.Webhook, *forms.Form) {
+	form := forms.New(r.PostForm)
+	form.Required("name", "url")
+
+	hook.Name = strings.TrimSpace(form.Get("name"))
+	hook.URL = strings.TrimSpace(form.Get("url"))
+	if form.Has("url") {
+		u, err := url.Parse(hook.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			form.Errors.Add("url", "Enter the http or https URL of the endpoint.")
+		}
+	}
 
-	// get the first and last days of the month
-	currentYear, currentMonth, _ := now.Date()
-	currentLocation := now.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
-	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+	var events []string
+	for _, e := range r.PostForm["events"] {
+		if !Models.WebhookEvent(e).Valid() {
+			form.Errors.Add("events", "Unknown event.")
+			break
+		}
+		events = append(events, e)
+	}
+	if len(events) == 0 {
+		form.Errors.Add("events", "Choose at least one event.")
+	}
+	hook.Events = strings.Join(events, " ")
 
-	intMap := make(map[string]int)
-	intMap["days_in_month"] = lastOfMonth.Day()
+	return hook, form
+}
 
-	// get all rooms from database
-	rooms, err := m.DB.AllRooms()
+// renderWebhooks renders the webhooks page
+func (m *Repository) renderWebhooks(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	webhooks, err := m.DB.AllWebhooks(r.Context())
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
-	data["rooms"] = rooms
-
-	for _, room := range rooms {
-		reservationMap := make(map[string]int)
-		blockMap := make(map[string]int)
-
-		// init these two map
-		for d := firstOfMonth; d.After(lastOfMonth) == false; d = d.AddDate(0, 0, 1) {
-			reservationMap[d.Format("2006-01-2")] = 0
-			blockMap[d.Format("2006-01-2")] = 0
-		}
 
-		// get all restrictions for the current room
-		restrictions, err := m.DB.GetRestrictionsForRoomByDate(room.ID, firstOfMonth, lastOfMonth)
-		if err != nil {
-			helpers.ServeError(w, err)
-			return
-		}
-
-		// loop over resrtictions and distribute them in either reservation or block
-		for _, y := range restrictions {
-			if y.ReservationID > 0 {
-				// it's a reservation
-				for d := y.StartDate; d.After(y.EndDate) == false; d = d.AddDate(0, 0, 1) {
-					reservationMap[d.Format("2006-01-2")] = y.ReservationID
-				}
-			} else {
-				// it's a block
-				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
-			}
-		}
+	data := make(map[string]interface{})
+	data["webhooks"] = webhooks
+	data["events"] = Models.WebhookEvents
 
-		data[fmt.Sprintf("reservation_map_%d", room.ID)] = reservationMap
-		data[fmt.Sprintf("block_map_%d", room.ID)] = blockMap
+	render.Template(w, r, "admin-webhooks.page.html", &Models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
 
-		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", room.ID), blockMap)
+// renderWebhook renders the page of a webhook
+func (m *Repository) renderWebhook(w http.ResponseWriter, r *http.Request, hook Models.Webhook, form *forms.Form) {
+	deliveries, err := m.DB.GetWebhookDeliveries(r.Context(), hook.ID, webhookLogSize)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
 	}
 
-	render.Template(w, r, "admin-reservations-calendar.page.html", &Models.TemplateData{
-		StringMap: stringMap,
-		Data:      data,
-		IntMap:    intMap,
+	data := make(map[string]interface{})
+	data["webhook"] = hook
+	data["deliveries"] = deliveries
+	data["events"] = Models.WebhookEvents
+
+	render.Template(w, r, "admin-webhook-show.page.html", &Models.TemplateData{
+		Data: data,
+		Form: form,
 	})
 }
 
-// AdminProcessReservation marks a reservation as processed
-func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
-	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
-	src := chi.URLParam(r, "src")
+// failedMailLogSize is how many of the latest failed messages the mail page shows
+const failedMailLogSize = 100
 
-	err := m.DB.UpdateProcessedForReservation(id, 1)
+// AdminFailedMail lists the messages of the outbox that were given up, and those still being retried
+func (m *Repository) AdminFailedMail(w http.ResponseWriter, r *http.Request) {
+	failed, err := m.DB.GetMailMessages(r.Context(), Models.MailFailed, failedMailLogSize)
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
+	pending, err := m.DB.GetMailMessages(r.Context(), Models.MailPending, failedMailLogSize)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
 
-	m.App.Session.Put(r.Context(), "flash", "Reservation marked as Processed")
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	// messages that were never tried yet are just waiting for the next run of the mail job
+	var retrying []Models.MailMessage
+	for _, msg := range pending {
+		if msg.Attempts > 0 {
+			retrying = append(retrying, msg)
+		}
 	}
 
+	data := make(map[string]interface{})
+	data["failed"] = failed
+	data["retrying"] = retrying
+
+	render.Template(w, r, "admin-mail.page.html", &Models.TemplateData{
+		Data: data,
+	})
 }
 
-// AdminProcessReservation marks a reservation as processed
-func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+// AdminResendMail makes a failed message pending again, so the mail job sends it shortly
+func (m *Repository) AdminResendMail(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
-	src := chi.URLParam(r, "src")
 
-	err := m.DB.DeleteReservation(id)
+	err := m.DB.ResendMail(r.Context(), id)
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
-
-	m.App.Session.Put(r.Context(), "flash", "Reservation Deleted")
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
-	}
+	m.App.Session.Put(r.Context(), "flash", "The email will be resent shortly")
+	http.Redirect(w, r, "/admin/mail", http.StatusSeeOther)
 }
 
-// AdminPostReservationsCalendar handles post of reservation calendar
-func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *http.Request) {
+// AdminPostTwoFactorLevels handles the post of the roles that must use two-factor authentication
+func (m *Repository) AdminPostTwoFactorLevels(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		helpers.ServeError(w, err)
+		return
 	}
 
-	month, _ := strconv.Atoi(r.Form.Get("m"))
-	year, _ := strconv.Atoi(r.Form.Get("y"))
+	var levels []int
+	for _, role := range Models.Roles {
+		if r.PostForm.Get(fmt.Sprintf("require_%d", role)) != "" {
+			levels = append(levels, int(role))
+		}
+	}
 
-	// process blocks
-	rooms, err := m.DB.AllRooms()
+	err = m.DB.UpdateTwoFactorLevels(r.Context(), levels)
 	if err != nil {
 		helpers.ServeError(w, err)
 		return
 	}
 
-	form := forms.New(r.PostForm)
+	m.App.Session.Put(r.Context(), "flash", "Changes Saved")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
 
-	for _, room := range rooms {
-		// Get the block map from the Session. Loop through the entire map, if we have an entry in the map
-		// that does not exist in our posted data, and if the resrtiction id > 0, then it is the block we need to
-		// remove
-		curMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", room.ID)).(map[string]int)
-		for name, value := range curMap {
-			// ok will be false if the value is not in the map
-			if val, ok := curMap[name]; ok {
-				// only pay attention to value > 0, and that are not in the form post
-				// the rest are just placeholder for days without blocks
-				if val > 0 {
-					if !form.Has(fmt.Sprintf("remove_block_%d_%s", room.ID, name)) {
-						// delete the resrtiction by id
-						log.Println("remove block for room", room.ID)
-						err := m.DB.DeleteBlockForRoom(value)
-						if err != nil {
-							log.Println(err)
-						}
-					}
-				}
-			}
+// newRecoveryCodes returns a new set of recovery codes along with the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := helpers.NewRecoveryCode()
+		if err != nil {
+			return nil, nil, err
 		}
+		codes = append(codes, code)
+		hashes = append(hashes, helpers.HashToken(helpers.NormalizeRecoveryCode(code)))
+	}
+
+	return codes, hashes, nil
+}
+
+// renderProfile renders the two-factor authentication settings of u, with a new secret to enrol if it is off
+func (m *Repository) renderProfile(w http.ResponseWriter, r *http.Request, u Models.User, form *forms.Form) {
+	required, err := m.twoFactorRequired(r.Context(), u)
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
 	}
 
-	// now handle the new blocks
-	for name, _ := range r.PostForm {
-		if strings.HasPrefix(name, "add_block") {
-			exploded := strings.Split(name, "_")
-			roomID, _ := strconv.Atoi(exploded[2])
-			t, _ := time.Parse("2006-01-2", exploded[3])
+	data := make(map[string]interface{})
+	data["user"] = u
+	data["required"] = required
+
+	stringMap := make(map[string]string)
 
-			// insert a new block
-			log.Println("insert block for room id", roomID, "for date", exploded[3])
-			err := m.DB.InsertBlockForRoom(roomID, t)
+	if u.TOTPEnabled {
+		left, err := m.DB.CountRecoveryCodes(r.Context(), u.ID)
+		if err != nil {
+			helpers.ServeError(w, err)
+			return
+		}
+		data["recovery_codes_left"] = left
+		if codes := m.App.Session.PopString(r.Context(), "recovery_codes"); codes != "" {
+			data["recovery_codes"] = strings.Fields(codes)
+		}
+	} else {
+		// the secret is kept in the session until a code confirms the app was set up with it
+		secret := m.App.Session.GetString(r.Context(), "totp_setup_secret")
+		if secret == "" {
+			secret, err = totp.NewSecret()
 			if err != nil {
-				log.Println(err)
+				helpers.ServeError(w, err)
+				return
 			}
+			m.App.Session.Put(r.Context(), "totp_setup_secret", secret)
 		}
+		stringMap["secret"] = secret
+		stringMap["uri"] = totp.URI(totpIssuer, u.Email, secret)
 	}
 
-	m.App.Session.Put(r.Context(), "flash", "Changes Saved")
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+	render.Template(w, r, "admin-profile.page.html", &Models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      form,
+	})
 }
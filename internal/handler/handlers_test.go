@@ -1,10 +1,16 @@
 package handler
 
 import (
+	"context"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/go-chi/chi/v5"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 type postData struct {
@@ -25,8 +31,23 @@ var theTests = []struct {
 	{"gq", "/generals-quarters", "GET", []postData{}, http.StatusOK},
 	{"ms", "/majors-suite", "GET", []postData{}, http.StatusOK},
 	{"ms", "/majors-suite", "GET", []postData{}, http.StatusOK},
+	{"rooms", "/rooms", "GET", []postData{}, http.StatusOK},
+	{"room", "/rooms/generals-quarters", "GET", []postData{}, http.StatusOK},
+	{"missing room", "/rooms/no-such-room", "GET", []postData{}, http.StatusNotFound},
+	{"room calendar feed", "/ical/feed-token.ics", "GET", []postData{}, http.StatusOK},
+	{"unknown calendar feed", "/ical/nope.ics", "GET", []postData{}, http.StatusNotFound},
 	{"sa", "/search-availability", "GET", []postData{}, http.StatusOK},
 	{"contact", "/contact", "GET", []postData{}, http.StatusOK},
+	{"my reservation", "/my-reservation", "GET", []postData{}, http.StatusOK},
+	{"look up unknown code", "/my-reservation", "POST", []postData{
+		{key: "code", value: "ZZZZ234567"},
+		{key: "email", value: "sc21ey@leeds.ac.uk"},
+	}, http.StatusOK},
+	{"forgot password", "/user/forgot-password", "GET", []postData{}, http.StatusOK},
+	{"forgot password post", "/user/forgot-password", "POST", []postData{
+		{key: "email", value: "me@me.com"},
+	}, http.StatusOK},
+	{"reset password with unknown token", "/user/reset-password?token=nope", "GET", []postData{}, http.StatusOK},
 	{"mr", "/make-reservation", "GET", []postData{}, http.StatusOK},
 	{"post-search-avail", "/search-availability", "POST", []postData{
 		{key: "start", value: "2020-01-01"},
@@ -64,7 +85,7 @@ func TestHandlers(t *testing.T) {
 			values := url.Values{}
 			for _, x := range e.params {
 				// add post data
-				values.Add(testServer.URL+e.url, x.value)
+				values.Add(x.key, x.value)
 			}
 			resp, err := testServer.Client().PostForm(testServer.URL+e.url, values)
 			if err != nil {
@@ -78,3 +99,209 @@ func TestHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestRepository_PostReservation(t *testing.T) {
+	_ = getRoutes()
+
+	var tests = []struct {
+		name               string
+		roomID             string
+		expectedStatusCode int
+	}{
+		{"available", "1", http.StatusSeeOther},
+		{"booked in the meantime", "2", http.StatusConflict},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("first_name", "Erfei")
+		postedData.Add("last_name", "Yu")
+		postedData.Add("email", "sc21ey@leeds.ac.uk")
+		postedData.Add("phone", "555-555-5555")
+		postedData.Add("room_id", e.roomID)
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(getCtx(req))
+
+		start, _ := time.Parse("2006-01-02", "2050-01-01")
+		end, _ := time.Parse("2006-01-02", "2050-01-02")
+		session.Put(req.Context(), "reservation", Models.Reservation{StartDate: start, EndDate: end})
+
+		rr := httptest.NewRecorder()
+		Repo.PostReservation(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminPostNewRoom(t *testing.T) {
+	_ = getRoutes()
+
+	var tests = []struct {
+		name               string
+		slug               string
+		basePrice          string
+		expectedStatusCode int
+	}{
+		{"valid", "honeymoon-suite", "149.50", http.StatusSeeOther},
+		{"slug taken", "majors-suite", "149.50", http.StatusOK},
+		{"invalid slug", "Honeymoon Suite", "149.50", http.StatusOK},
+		{"invalid price", "honeymoon-suite", "lots", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("room_name", "Honeymoon Suite")
+		postedData.Add("slug", e.slug)
+		postedData.Add("capacity", "2")
+		postedData.Add("base_price", e.basePrice)
+		postedData.Add("active", "1")
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/new", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(getCtx(req))
+
+		rr := httptest.NewRecorder()
+		Repo.AdminPostNewRoom(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminPostNewUser(t *testing.T) {
+	_ = getRoutes()
+
+	var tests = []struct {
+		name               string
+		email              string
+		accessLevel        string
+		password           string
+		expectedStatusCode int
+	}{
+		{"valid", "desk@here.com", "2", "password", http.StatusSeeOther},
+		{"email taken", "me@me.com", "2", "password", http.StatusOK},
+		{"invalid email", "desk", "2", "password", http.StatusOK},
+		{"invalid role", "desk@here.com", "7", "password", http.StatusOK},
+		{"short password", "desk@here.com", "2", "pass", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("first_name", "Front")
+		postedData.Add("last_name", "Desk")
+		postedData.Add("email", e.email)
+		postedData.Add("access_level", e.accessLevel)
+		postedData.Add("password", e.password)
+		postedData.Add("password_confirm", e.password)
+
+		req, _ := http.NewRequest("POST", "/admin/users/new", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(getCtx(req))
+
+		rr := httptest.NewRecorder()
+		Repo.AdminPostNewUser(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminPostSeasonalRate(t *testing.T) {
+	_ = getRoutes()
+
+	var tests = []struct {
+		name               string
+		startDate          string
+		endDate            string
+		expectedStatusCode int
+	}{
+		{"valid", "2050-12-23", "2050-12-27", http.StatusSeeOther},
+		{"ends before it starts", "2050-12-27", "2050-12-23", http.StatusOK},
+		{"invalid date", "christmas", "2050-12-27", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("name", "Christmas")
+		postedData.Add("start_date", e.startDate)
+		postedData.Add("end_date", e.endDate)
+		postedData.Add("rate", "200")
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/1/seasonal-rates", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", "1")
+		req = req.WithContext(context.WithValue(getCtx(req), chi.RouteCtxKey, rctx))
+
+		rr := httptest.NewRecorder()
+		Repo.AdminPostSeasonalRate(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminPostReservationsCalendar(t *testing.T) {
+	_ = getRoutes()
+	repo := NewMemoryRepo(&app)
+
+	req, _ := http.NewRequest("POST", "/admin/reservations-calendar", strings.NewReader("y=2050&m=1&add_block_1_2050-01-2=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(getCtx(req))
+
+	// the calendar was loaded with the seeded rooms, then a room was added before it was saved
+	session.Put(req.Context(), "block_map_1", map[string]int{"2050-01-1": 0})
+	session.Put(req.Context(), "block_map_2", map[string]int{"2050-01-1": 0})
+	_, err := repo.DB.InsertRoom(req.Context(), Models.Room{RoomName: "Honeymoon Suite", Slug: "honeymoon-suite", Capacity: 2, Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	repo.AdminPostReservationsCalendar(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected %d but got %d", http.StatusSeeOther, rr.Code)
+	}
+	restrictions, err := repo.DB.GetRestrictionsForRoomByDate(req.Context(), 1,
+		time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2050, 1, 31, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restrictions) != 1 {
+		t.Errorf("expected the new block to be saved, got %d restrictions", len(restrictions))
+	}
+}
+
+func TestRepository_ReservationInvalidStay(t *testing.T) {
+	_ = getRoutes()
+
+	req, _ := http.NewRequest("GET", "/make-reservation", nil)
+	req = req.WithContext(getCtx(req))
+	// a reservation in the session without dates, as a tampered or stale session may have
+	session.Put(req.Context(), "reservation", Models.Reservation{RoomID: 1})
+
+	rr := httptest.NewRecorder()
+	Repo.Reservation(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/search-availability" {
+		t.Errorf("expected a redirect to /search-availability, got %d to %s", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+// getCtx loads a new session into the request context
+func getCtx(req *http.Request) context.Context {
+	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
+	if err != nil {
+		log.Println(err)
+	}
+
+	return ctx
+}
@@ -0,0 +1,261 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/helpers"
+	"github.com/454270186/Hotel-booking-web-application/internal/ical"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// icalProdID names this application in the calendar feeds
+	icalProdID = "-//Bookings and Reservations//Room Calendar//EN"
+	// icalMonthsBack is how many months of past stays the calendar feeds keep
+	icalMonthsBack = 1
+	// icalYearsAhead is how far ahead the calendar feeds reach
+	icalYearsAhead = 2
+	// icalFetchTimeout limits how long fetching an external calendar may take
+	icalFetchTimeout = 30 * time.Second
+	// icalMaxFeedBytes limits the size of external calendars, fetched or uploaded
+	icalMaxFeedBytes = 5 << 20
+)
+
+// icalClient fetches external calendars
+var icalClient = &http.Client{Timeout: icalFetchTimeout}
+
+// RoomICal serves the calendar feed of the room whose secret token is in the URL. It has an event for every
+// reservation and owner block, whose UID stays the same while the reservation or block exists
+func (m *Repository) RoomICal(w http.ResponseWriter, r *http.Request) {
+	room, err := m.DB.GetRoomByICalToken(r.Context(), chi.URLParam(r, "token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	today := time.Now().Truncate(24 * time.Hour)
+	restrictions, err := m.DB.GetRestrictionsForRoomByDate(r.Context(), room.ID,
+		today.AddDate(0, -icalMonthsBack, 0), today.AddDate(icalYearsAhead, 0, 0))
+	if err != nil {
+		helpers.ServeError(w, err)
+		return
+	}
+
+	// the host is part of the UIDs so they are unique across calendars, subscribers always use the same one
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	cal := ical.Calendar{
+		ProdID: icalProdID,
+		Name:   room.RoomName,
+	}
+	for _, rr := range restrictions {
+		e := ical.Event{
+			Start:    rr.StartDate,
+			End:      rr.EndDate,
+			Modified: rr.UpdatedAt,
+		}
+		if e.Modified.IsZero() {
+			e.Modified = time.Now()
+		}
+
+		// reservation UIDs come from the reservation rather than its restriction, so they survive it being replaced
+		switch rr.RestrictionID {
+		case Models.RestrictionReservation:
+			e.UID = fmt.Sprintf("reservation-%d@%s", rr.ReservationID, host)
+			e.Summary = "Reserved"
+		case Models.RestrictionOwnerBlock:
+			e.UID = fmt.Sprintf("block-%d@%s", rr.ID, host)
+			e.Summary = "Blocked"
+		default:
+			continue
+		}
+		cal.Events = append(cal.Events, e)
+	}
+
+	w.Header().Set("Content-Type", ical.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.ics"`, room.Slug))
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := cal.Encode(w); err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+}
+
+// stayInvite returns the calendar invite of the stay of res, from check-in on its first day to check-out on its
+// last day at the property
+func (m *Repository) stayInvite(res Models.Reservation) (Models.MailAttachment, error) {
+	loc := m.timeZone()
+	at := func(day time.Time, t time.Duration) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), int(t/time.Hour), int(t%time.Hour/time.Minute), 0, 0, loc)
+	}
+
+	// UIDs need a domain, the one the mail comes from stands for the property
+	domain := "localhost"
+	if _, d, ok := strings.Cut(strings.TrimSuffix(m.App.MailFrom, ">"), "@"); ok && d != "" {
+		domain = d
+	}
+
+	cal := ical.Calendar{
+		ProdID: icalProdID,
+		Events: []ical.Event{{
+			UID:         fmt.Sprintf("reservation-%s@%s", res.ConfirmationCode, domain),
+			Start:       at(res.StartDate, m.App.CheckInTime),
+			End:         at(res.EndDate, m.App.CheckOutTime),
+			Summary:     "Stay at " + res.Room.RoomName,
+			Description: "Confirmation code " + res.ConfirmationCode,
+			Location:    m.App.PropertyAddress,
+			Timed:       true,
+			Modified:    time.Now(),
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := cal.Encode(&buf); err != nil {
+		return Models.MailAttachment{}, err
+	}
+
+	return Models.MailAttachment{Name: "reservation.ics", ContentType: ical.ContentType, Data: buf.Bytes()}, nil
+}
+
+// icalURL returns the absolute URL of a room's calendar feed, for pasting into calendar apps
+func icalURL(r *http.Request, room Models.Room) string {
+	return absoluteURL(r, fmt.Sprintf("/ical/%s.ics", room.ICalToken))
+}
+
+// SyncICalFeeds syncs every external calendar, as the sync job does
+func (m *Repository) SyncICalFeeds(ctx context.Context) {
+	feeds, err := m.DB.AllICalFeeds(ctx)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		return
+	}
+
+	for _, f := range feeds {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := m.syncICalFeed(ctx, f); err != nil {
+			m.App.ErrorLog.Printf("syncing calendar %d of %s: %v", f.ID, f.Room.RoomName, err)
+		}
+	}
+}
+
+// syncICalFeed turns the events of an external calendar into blocks of its room and records how it went.
+// When the calendar can't be read its blocks are kept, so a site being down doesn't free the nights
+func (m *Repository) syncICalFeed(ctx context.Context, f Models.ICalFeed) (Models.ICalFeed, error) {
+	var blocks []Models.RoomRestriction
+	var skipped, recurring int
+
+	events, err := readICalFeed(ctx, f)
+	if err == nil {
+		blocks, recurring = externalBlocks(events, time.Now())
+		skipped, err = m.DB.SyncExternalBlocks(ctx, f, blocks)
+	}
+
+	f.LastSyncedAt = time.Now()
+	f.LastError = ""
+	if err != nil {
+		f.LastError = err.Error()
+	} else {
+		f.Blocks = len(blocks) - skipped
+		f.Skipped = skipped
+		f.Recurring = recurring
+	}
+
+	if statusErr := m.DB.UpdateICalFeedStatus(ctx, f); statusErr != nil && err == nil {
+		err = statusErr
+	}
+
+	return f, err
+}
+
+// readICalFeed returns the events of an external calendar, fetching it unless it was uploaded
+func readICalFeed(ctx context.Context, f Models.ICalFeed) ([]ical.Event, error) {
+	if f.Uploaded() {
+		return ical.Parse(strings.NewReader(f.Content))
+	}
+
+	// webcal is how calendar sites link feeds for subscribing, it is plain http(s)
+	u := f.URL
+	if strings.HasPrefix(strings.ToLower(u), "webcal://") {
+		u = "https://" + u[len("webcal://"):]
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/calendar")
+
+	resp, err := icalClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the calendar returned %s", resp.Status)
+	}
+
+	// a cut off calendar would drop the blocks of its last events, so refuse it whole
+	b, err := io.ReadAll(io.LimitReader(resp.Body, icalMaxFeedBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > icalMaxFeedBytes {
+		return nil, fmt.Errorf("the calendar is larger than %d MB", icalMaxFeedBytes>>20)
+	}
+
+	return ical.Parse(bytes.NewReader(b))
+}
+
+// externalBlocks returns the blocks for the events of an external calendar that have not ended by now, and the
+// number of recurring events it left out. Blocking only their first occurrence would leave the others bookable,
+// so they are reported for the manager to block by hand instead. Events without a UID, or repeating one, are
+// told apart by their dates
+func externalBlocks(events []ical.Event, now time.Time) ([]Models.RoomRestriction, int) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	var blocks []Models.RoomRestriction
+	var recurring int
+	seen := make(map[string]bool)
+	for _, e := range events {
+		if e.Recurring {
+			recurring++
+			continue
+		}
+		if !e.End.After(today) {
+			continue
+		}
+
+		uid := e.UID
+		if uid == "" || seen[uid] {
+			uid = fmt.Sprintf("%s/%s-%s", uid, e.Start.Format(apiDateLayout), e.End.Format(apiDateLayout))
+		}
+		seen[uid] = true
+
+		blocks = append(blocks, Models.RoomRestriction{
+			StartDate:     e.Start,
+			EndDate:       e.End,
+			RestrictionID: Models.RestrictionExternal,
+			ExternalUID:   uid,
+		})
+	}
+
+	return blocks, recurring
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/mailer"
+	"github.com/454270186/Hotel-booking-web-application/internal/render"
+	"time"
+)
+
+const (
+	// mailMaxAttempts is how often a message is tried before it is marked failed
+	mailMaxAttempts = 8
+	// a message that couldn't be sent is tried again after mailRetryDelay, and at least every mailMaxRetryDelay
+	mailRetryDelay    = time.Minute
+	mailMaxRetryDelay = 2 * time.Hour
+	// mailBatchSize is how many due messages one run of the mail job sends
+	mailBatchSize = 50
+)
+
+// renderMail renders the templates of msgs, which are sent from the configured sender unless they say otherwise
+func (m *Repository) renderMail(msgs ...Models.MailData) ([]Models.MailData, error) {
+	rendered := make([]Models.MailData, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.From == "" {
+			msg.From = m.App.MailFrom
+		}
+		if msg.Template != "" {
+			var err error
+			msg, err = render.Mail(msg)
+			if err != nil {
+				return nil, fmt.Errorf("rendering email %s: %w", msg.Template, err)
+			}
+		}
+		rendered = append(rendered, msg)
+	}
+
+	return rendered, nil
+}
+
+// queueMail renders msgs and adds them to the outbox for the mail job to send. The change they tell about
+// already happened, so a failure is only logged
+func (m *Repository) queueMail(ctx context.Context, msgs ...Models.MailData) {
+	msgs, err := m.renderMail(msgs...)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		return
+	}
+
+	for _, msg := range msgs {
+		if err := m.DB.QueueMail(ctx, msg); err != nil {
+			m.App.ErrorLog.Printf("queueing %q to %s: %v", msg.Subject, msg.To, err)
+		}
+	}
+}
+
+// SendMail sends the messages of the outbox that are due with the configured mailer, as the mail job does
+func (m *Repository) SendMail(ctx context.Context) {
+	messages, err := m.DB.GetDueMail(ctx, time.Now(), mailBatchSize)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		return
+	}
+
+	for _, msg := range messages {
+		if ctx.Err() != nil {
+			return
+		}
+
+		msg = sendMailMessage(msg, m.App.Mailer, time.Now())
+		if msg.Status == Models.MailFailed {
+			m.App.ErrorLog.Printf("giving up %q to %s: %s", msg.Subject, msg.To, msg.LastError)
+		}
+		if err := m.DB.UpdateMailMessage(ctx, msg); err != nil {
+			m.App.ErrorLog.Printf("recording mail %d: %v", msg.ID, err)
+		}
+	}
+}
+
+// sendMailMessage sends msg with sender at now and returns msg with the outcome of the attempt. After
+// mailMaxAttempts attempts the message is marked failed and left for an owner to resend
+func sendMailMessage(msg Models.MailMessage, sender mailer.Mailer, now time.Time) Models.MailMessage {
+	msg.Attempts++
+	msg.LastAttemptAt = now
+	msg.LastError = ""
+
+	err := sender.Send(msg.Data())
+	if err == nil {
+		msg.Status = Models.MailSent
+		msg.SentAt = now
+		msg.NextAttemptAt = time.Time{}
+		return msg
+	}
+
+	msg.LastError = err.Error()
+	if msg.Attempts >= mailMaxAttempts {
+		msg.Status = Models.MailFailed
+		msg.NextAttemptAt = time.Time{}
+	} else {
+		msg.NextAttemptAt = now.Add(retryDelay(mailRetryDelay, mailMaxRetryDelay, msg.Attempts))
+	}
+
+	return msg
+}
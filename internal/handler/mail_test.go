@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"errors"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/mailer"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSendMailMessage(t *testing.T) {
+	send := mailer.NewMemory()
+
+	now := time.Unix(1700000000, 0)
+	msg := Models.MailMessage{
+		ID:      3,
+		To:      "guest@example.com",
+		From:    "me@here.com",
+		Subject: "Reservation Confirmation",
+		Content: "<strong>Reservation Confirmation</strong>",
+		Status:  Models.MailPending,
+	}
+
+	got := sendMailMessage(msg, send, now)
+	if got.Status != Models.MailSent || !got.SentAt.Equal(now) || got.Attempts != 1 || !got.NextAttemptAt.IsZero() {
+		t.Errorf("expected the message to be sent, got %+v", got)
+	}
+	if sent := send.Messages(); len(sent) != 1 || !reflect.DeepEqual(sent[0], msg.Data()) {
+		t.Errorf("expected the message to be sent once, got %+v", send.Messages())
+	}
+
+	send.Fail(errors.New("connection refused"))
+	got = sendMailMessage(msg, send, now)
+	if got.Status != Models.MailPending || !got.NextAttemptAt.Equal(now.Add(mailRetryDelay)) || got.LastError != "connection refused" {
+		t.Errorf("expected the message to be retried, got %+v", got)
+	}
+
+	msg.Attempts = mailMaxAttempts - 1
+	got = sendMailMessage(msg, send, now)
+	if got.Status != Models.MailFailed || !got.NextAttemptAt.IsZero() || got.Attempts != mailMaxAttempts {
+		t.Errorf("expected the message to be given up, got %+v", got)
+	}
+}
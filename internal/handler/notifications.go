@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"time"
+)
+
+// notificationLookbackDays is how many days late a thank-you email is still sent, so the job catches up after it
+// was down without mailing the guests of long ago
+const notificationLookbackDays = 7
+
+// SendNotifications queues the arrival reminders and thank-you emails that are due, as the notification job does.
+// Every email is recorded with the reservation it is about, so it is queued once even across restarts
+func (m *Repository) SendNotifications(ctx context.Context) {
+	m.sendNotifications(ctx, time.Now())
+}
+
+// sendNotifications queues the arrival reminders and thank-you emails that are due at now
+func (m *Repository) sendNotifications(ctx context.Context, now time.Time) {
+	today := m.day(now)
+
+	if days := m.App.ArrivalReminderDays; days > 0 {
+		reservations, err := m.DB.GetArrivalsToRemind(ctx, today, today.AddDate(0, 0, days))
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+
+		for _, res := range reservations {
+			// guests who booked after the reminder was due got their confirmation recently enough
+			var mail []Models.MailData
+			if m.day(res.CreatedAt).Before(res.StartDate.AddDate(0, 0, -days)) {
+				mail = append(mail, Models.MailData{
+					To:       res.Email,
+					Subject:  "Your Stay Is Coming Up",
+					Template: "arrival-reminder",
+					Data: map[string]interface{}{
+						"reservation": res,
+						"check_in":    timeOfDay(m.App.CheckInTime),
+						"check_out":   timeOfDay(m.App.CheckOutTime),
+						"address":     m.App.PropertyAddress,
+					},
+				})
+			}
+			m.notify(ctx, res, Models.NotificationArrivalReminder, mail...)
+		}
+	}
+
+	if days := m.App.ThankYouDays; days > 0 {
+		due := today.AddDate(0, 0, -days)
+		reservations, err := m.DB.GetDeparturesToThank(ctx, due.AddDate(0, 0, -notificationLookbackDays), due)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+
+		for _, res := range reservations {
+			m.notify(ctx, res, Models.NotificationThankYou, Models.MailData{
+				To:       res.Email,
+				Subject:  "Thank You for Staying With Us",
+				Template: "thank-you",
+				Data:     map[string]interface{}{"reservation": res},
+			})
+		}
+	}
+}
+
+// notify renders mail and records the notification of kind for res together with it
+func (m *Repository) notify(ctx context.Context, res Models.Reservation, kind string, mail ...Models.MailData) {
+	mail, err := m.renderMail(mail...)
+	if err == nil {
+		_, err = m.DB.RecordNotification(ctx, res.ID, kind, mail...)
+	}
+	if err != nil {
+		m.App.ErrorLog.Printf("recording %s of reservation %d: %v", kind, res.ID, err)
+	}
+}
+
+// timeZone returns the time zone of the property
+func (m *Repository) timeZone() *time.Location {
+	if m.App.TimeZone == nil {
+		return time.Local
+	}
+
+	return m.App.TimeZone
+}
+
+// day returns the date of t at the property, as midnight UTC like the dates of reservations
+func (m *Repository) day(t time.Time) time.Time {
+	t = t.In(m.timeZone())
+
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// timeOfDay formats a time since midnight, such as the check-in time, as 15:04
+func timeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
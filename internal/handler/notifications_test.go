@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendNotifications(t *testing.T) {
+	_ = getRoutes()
+	repo := NewMemoryRepo(&app)
+	app.ArrivalReminderDays = 3
+	app.ThankYouDays = 1
+	app.CheckInTime = 15 * time.Hour
+	app.CheckOutTime = 11 * time.Hour
+	app.TimeZone = time.UTC
+	t.Cleanup(func() {
+		app.ArrivalReminderDays = 0
+		app.ThankYouDays = 0
+		app.CheckInTime = 0
+		app.CheckOutTime = 0
+		app.TimeZone = nil
+	})
+	ctx := context.Background()
+
+	today := repo.day(time.Now())
+	book := func(roomID, startIn, nights int, code string) Models.Reservation {
+		res := Models.Reservation{
+			FirstName:        "Guest",
+			LastName:         "Smith",
+			Email:            "guest@example.com",
+			StartDate:        today.AddDate(0, 0, startIn),
+			EndDate:          today.AddDate(0, 0, startIn+nights),
+			RoomID:           roomID,
+			ConfirmationCode: code,
+		}
+		id, err := repo.DB.CreateReservation(ctx, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = repo.DB.GetReservationByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	queued := func() []Models.MailMessage {
+		mail, err := repo.DB.GetMailMessages(ctx, Models.MailPending, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mail
+	}
+
+	far := book(1, 10, 2, "FAR123")
+	soon := book(2, 2, 2, "SOON12")
+	cancelled := book(1, 20, 2, "GONE12")
+	if err := repo.DB.CancelReservation(ctx, cancelled.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	book(2, -20, 2, "OLD123")
+
+	// the stay starting soon was booked after its reminder was due, so it only gets its confirmation, and stays
+	// that ended long ago aren't thanked
+	repo.sendNotifications(ctx, time.Now())
+	if mail := queued(); len(mail) != 0 {
+		t.Fatalf("expected no reminder for a late booking, got %+v", mail)
+	}
+
+	// a week later the far stay is due for its reminder and the guest of the soon one is thanked, once however
+	// often the job runs
+	now := time.Now().AddDate(0, 0, 7)
+	repo.sendNotifications(ctx, now)
+	repo.sendNotifications(ctx, now)
+	mail := queued()
+	if len(mail) != 2 || mail[1].Subject != "Your Stay Is Coming Up" || mail[0].Subject != "Thank You for Staying With Us" {
+		t.Fatalf("expected a reminder and a thank-you email, got %+v", mail)
+	}
+	if !strings.Contains(mail[1].PlainContent, "Check-in is from 15:00") || !strings.Contains(mail[1].PlainContent, far.ConfirmationCode) {
+		t.Errorf("unexpected reminder %q", mail[1].PlainContent)
+	}
+	if !strings.Contains(mail[0].PlainContent, soon.Room.RoomName) {
+		t.Errorf("unexpected thank-you email %q", mail[0].PlainContent)
+	}
+
+	// cancelled stays aren't reminded
+	repo.sendNotifications(ctx, time.Now().AddDate(0, 0, 18))
+	if mail := queued(); len(mail) != 3 || mail[0].Subject != "Thank You for Staying With Us" {
+		t.Fatalf("expected only the thank-you email of the far stay, got %+v", mail)
+	}
+}
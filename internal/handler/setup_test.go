@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/454270186/Hotel-booking-web-application/internal/Models"
 	"github.com/454270186/Hotel-booking-web-application/internal/config"
+	"github.com/454270186/Hotel-booking-web-application/internal/helpers"
 	"github.com/454270186/Hotel-booking-web-application/internal/render"
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-chi/chi/v5"
@@ -15,12 +16,20 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	texttemplate "text/template"
 	"time"
 )
 
 var app config.AppConfig
 var session *scs.SessionManager
 var pathToTemplates = "./../../templates"
+var functions = template.FuncMap{
+	"humanDate":   render.HumanDate,
+	"formatDate":  render.FormatDate,
+	"iterate":     render.Iterate,
+	"formatPrice": render.FormatPrice,
+}
 
 func getRoutes() http.Handler {
 	// What I am to store in Session
@@ -46,8 +55,14 @@ func getRoutes() http.Handler {
 	}
 
 	app.TemplateCache = tc
+
+	app.MailTemplateCache, app.MailTextTemplateCache, err = CreateTestMailTemplateCache()
+	if err != nil {
+		log.Fatal(err)
+	}
 	app.UseCache = true // do not use the Template cache, render from disk
 	render.NewRenderer(&app)
+	helpers.NewHelpers(&app)
 
 	// New and set repository for handler
 	var repo *Repository
@@ -67,6 +82,9 @@ func getRoutes() http.Handler {
 	mux.Get("/about", Repo.About)
 	mux.Get("/generals-quarters", Repo.Generals)
 	mux.Get("/majors-suite", Repo.Majors)
+	mux.Get("/rooms", Repo.Rooms)
+	mux.Get("/rooms/{slug}", Repo.Room)
+	mux.Get("/ical/{token}.ics", Repo.RoomICal)
 
 	mux.Get("/search-availability", Repo.Availability)
 	mux.Post("/search-availability", Repo.PostAvailability)
@@ -78,6 +96,16 @@ func getRoutes() http.Handler {
 	mux.Post("/make-reservation", Repo.PostReservation)
 	mux.Get("/reservation-summary", Repo.ReservationSummary)
 
+	mux.Get("/my-reservation", Repo.MyReservation)
+	mux.Post("/my-reservation", Repo.PostMyReservation)
+	mux.Get("/my-reservation/details", Repo.MyReservationDetails)
+
+	mux.Get("/user/login", Repo.ShowLogin)
+	mux.Get("/user/forgot-password", Repo.ForgotPassword)
+	mux.Post("/user/forgot-password", Repo.PostForgotPassword)
+	mux.Get("/user/reset-password", Repo.ResetPassword)
+	mux.Post("/user/reset-password", Repo.PostResetPassword)
+
 	// 处理静态文件，让网页可以访问到static文件夹里的文件
 	// 这一步非常重要！！
 	fileServer := http.FileServer(http.Dir("./static"))
@@ -117,7 +145,7 @@ func CreateTestTemplateCache() (map[string]*template.Template, error) {
 	// range through all files ending with *.page.html
 	for _, page := range pages {
 		name := filepath.Base(page) // get name like "*.page.html"
-		ts, err := template.New(name).ParseFiles(page)
+		ts, err := template.New(name).Funcs(functions).ParseFiles(page)
 		if err != nil {
 			return myCache, err
 		}
@@ -142,3 +170,37 @@ func CreateTestTemplateCache() (map[string]*template.Template, error) {
 	return myCache, nil
 
 }
+
+// CreateTestMailTemplateCache creates the caches of the email templates as maps keyed by template name
+func CreateTestMailTemplateCache() (map[string]*template.Template, map[string]*texttemplate.Template, error) {
+	htmlCache := map[string]*template.Template{}
+	textCache := map[string]*texttemplate.Template{}
+
+	pages, err := filepath.Glob(fmt.Sprintf("%s/email/*.mail.html", pathToTemplates))
+	if err != nil {
+		return htmlCache, textCache, err
+	}
+
+	for _, page := range pages {
+		name := strings.TrimSuffix(filepath.Base(page), ".mail.html")
+
+		ts, err := template.New(filepath.Base(page)).Funcs(functions).ParseFiles(page)
+		if err != nil {
+			return htmlCache, textCache, err
+		}
+		ts, err = ts.ParseGlob(fmt.Sprintf("%s/email/*.layout.html", pathToTemplates))
+		if err != nil {
+			return htmlCache, textCache, err
+		}
+		htmlCache[name] = ts
+
+		text := strings.TrimSuffix(page, ".html") + ".txt"
+		tt, err := texttemplate.New(filepath.Base(text)).Funcs(texttemplate.FuncMap(functions)).ParseFiles(text)
+		if err != nil {
+			return htmlCache, textCache, err
+		}
+		textCache[name] = tt
+	}
+
+	return htmlCache, textCache, nil
+}
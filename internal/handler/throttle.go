@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// lookupMaxFailures is how many reservation lookups a client IP may get wrong within lookupWindow
+	lookupMaxFailures = 10
+	// lookupWindow is how long a failed reservation lookup counts
+	lookupWindow = 15 * time.Minute
+)
+
+// failureCounter counts the recent failures of each client, so guessing can be slowed down. It lives in memory,
+// so the counts start over when the application restarts. It is safe for concurrent use
+type failureCounter struct {
+	mu       sync.Mutex
+	window   time.Duration
+	failures map[string][]time.Time
+}
+
+// newFailureCounter returns a counter of the failures within window
+func newFailureCounter(window time.Duration) *failureCounter {
+	return &failureCounter{
+		window:   window,
+		failures: map[string][]time.Time{},
+	}
+}
+
+// count returns how many failures of key still count at now
+func (c *failureCounter) count(key string, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.prune(key, now))
+}
+
+// add records a failure of key at now
+func (c *failureCounter) add(key string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures[key] = append(c.prune(key, now), now)
+}
+
+// prune forgets the failures of key that no longer count and returns the others. c.mu must be held
+func (c *failureCounter) prune(key string, now time.Time) []time.Time {
+	failures := c.failures[key]
+	for len(failures) > 0 && now.Sub(failures[0]) >= c.window {
+		failures = failures[1:]
+	}
+
+	if len(failures) == 0 {
+		delete(c.failures, key)
+		return nil
+	}
+	c.failures[key] = failures
+
+	return failures
+}
+
+// retryDelay returns how long to wait after the attempts-th failure in a row: base after the first, doubling with
+// every further one, but never more than max
+func retryDelay(base, max time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	return delay
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureCounter(t *testing.T) {
+	c := newFailureCounter(time.Minute)
+	now := time.Unix(1700000000, 0)
+
+	c.add("10.0.0.1", now)
+	c.add("10.0.0.1", now.Add(30*time.Second))
+	c.add("10.0.0.2", now)
+
+	var tests = []struct {
+		name     string
+		key      string
+		at       time.Time
+		expected int
+	}{
+		{"both", "10.0.0.1", now.Add(59 * time.Second), 2},
+		{"other key", "10.0.0.2", now, 1},
+		{"first expired", "10.0.0.1", now.Add(time.Minute), 1},
+		{"all expired", "10.0.0.1", now.Add(2 * time.Minute), 0},
+		{"unknown", "10.0.0.3", now, 0},
+	}
+
+	for _, e := range tests {
+		if got := c.count(e.key, e.at); got != e.expected {
+			t.Errorf("%s: expected %d failures but got %d", e.name, e.expected, got)
+		}
+	}
+
+	if len(c.failures) != 1 {
+		t.Errorf("expected the keys without failures to be forgotten, got %v", c.failures)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	var tests = []struct {
+		name     string
+		base     time.Duration
+		max      time.Duration
+		attempts int
+		expected time.Duration
+	}{
+		{"first mail", mailRetryDelay, mailMaxRetryDelay, 1, time.Minute},
+		{"second mail", mailRetryDelay, mailMaxRetryDelay, 2, 2 * time.Minute},
+		{"fifth mail", mailRetryDelay, mailMaxRetryDelay, 5, 16 * time.Minute},
+		{"last mail", mailRetryDelay, mailMaxRetryDelay, 8, mailMaxRetryDelay},
+		{"first webhook", webhookRetryDelay, webhookMaxRetryDelay, 1, 30 * time.Second},
+		{"fifth webhook", webhookRetryDelay, webhookMaxRetryDelay, 5, 8 * time.Minute},
+		{"twelfth webhook", webhookRetryDelay, webhookMaxRetryDelay, 12, webhookMaxRetryDelay},
+		{"many logins", time.Second, 15 * time.Minute, 100, 15 * time.Minute},
+	}
+
+	for _, e := range tests {
+		if got := retryDelay(e.base, e.max, e.attempts); got != e.expected {
+			t.Errorf("%s: after %d attempts expected %s but got %s", e.name, e.attempts, e.expected, got)
+		}
+	}
+}
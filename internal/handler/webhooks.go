@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/repository"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookTimeout limits how long an endpoint may take to answer a delivery
+	webhookTimeout = 10 * time.Second
+	// webhookMaxAttempts is how often a delivery is tried before it is given up
+	webhookMaxAttempts = 10
+	// webhookRetryDelay and webhookMaxRetryDelay are the first and the longest wait before a failed delivery
+	// is tried again
+	webhookRetryDelay    = 30 * time.Second
+	webhookMaxRetryDelay = 6 * time.Hour
+	// webhookBatchSize is how many due deliveries one run of the delivery job sends
+	webhookBatchSize = 50
+	// webhookMaxErrorBytes is how much of the answer of a failed attempt is kept for the delivery log
+	webhookMaxErrorBytes = 512
+
+	// webhookSignatureHeader carries the timestamp and signature of a delivery, as t=<unix time>,v1=<hex HMAC>
+	webhookSignatureHeader = "X-Webhook-Signature"
+	// webhookEventHeader carries the event of a delivery
+	webhookEventHeader = "X-Webhook-Event"
+	// webhookDeliveryHeader carries the ID of a delivery, which stays the same when it is retried
+	webhookDeliveryHeader = "X-Webhook-Delivery"
+)
+
+// webhookClient sends webhook deliveries
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookPayload is the JSON body of a webhook delivery
+type webhookPayload struct {
+	Event       Models.WebhookEvent `json:"event"`
+	CreatedAt   time.Time           `json:"created_at"`
+	Reservation webhookReservation  `json:"reservation"`
+}
+
+// webhookReservation is a reservation as webhooks are sent it
+type webhookReservation struct {
+	ID               int    `json:"id"`
+	ConfirmationCode string `json:"confirmation_code"`
+	RoomID           int    `json:"room_id"`
+	RoomName         string `json:"room_name"`
+	StartDate        string `json:"start_date"`
+	EndDate          string `json:"end_date"`
+	FirstName        string `json:"first_name"`
+	LastName         string `json:"last_name"`
+	Email            string `json:"email"`
+	Phone            string `json:"phone"`
+	TotalPrice       int    `json:"total_price"` // in cents
+	Processed        bool   `json:"processed"`
+	Cancelled        bool   `json:"cancelled"`
+}
+
+// queueWebhooks queues event for the webhooks subscribed to it, with res as it is now. repo is the one of the
+// transaction that makes the change, so the deliveries are queued if and only if the change is committed
+func queueWebhooks(ctx context.Context, repo repository.DatabaseRepo, event Models.WebhookEvent, res Models.Reservation) error {
+	payload, err := json.Marshal(webhookPayload{
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Reservation: webhookReservation{
+			ID:               res.ID,
+			ConfirmationCode: res.ConfirmationCode,
+			RoomID:           res.RoomID,
+			RoomName:         res.Room.RoomName,
+			StartDate:        res.StartDate.Format(apiDateLayout),
+			EndDate:          res.EndDate.Format(apiDateLayout),
+			FirstName:        res.FirstName,
+			LastName:         res.LastName,
+			Email:            res.Email,
+			Phone:            res.Phone,
+			TotalPrice:       res.TotalPrice,
+			Processed:        res.Processed != 0,
+			Cancelled:        res.Cancelled != 0,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return repo.QueueWebhookEvent(ctx, event, string(payload))
+}
+
+// DeliverWebhooks sends the webhook deliveries that are due, as the delivery job does
+func (m *Repository) DeliverWebhooks(ctx context.Context) {
+	deliveries, err := m.DB.GetDueWebhookDeliveries(ctx, time.Now(), webhookBatchSize)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		return
+	}
+
+	for _, d := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+
+		d = deliverWebhook(ctx, d, time.Now())
+		if err := m.DB.UpdateWebhookDelivery(ctx, d); err != nil {
+			m.App.ErrorLog.Printf("recording delivery %d to %s: %v", d.ID, d.Webhook.Name, err)
+		}
+	}
+}
+
+// deliverWebhook makes an attempt of d at now and returns d with its outcome. A delivery that failed
+// webhookMaxAttempts times is given up, it can still be retried from the webhook's page
+func deliverWebhook(ctx context.Context, d Models.WebhookDelivery, now time.Time) Models.WebhookDelivery {
+	d.Attempts++
+	d.LastAttemptAt = now
+	d.ResponseStatus = 0
+	d.LastError = ""
+
+	err := postWebhook(ctx, &d, now)
+	if err == nil {
+		d.DeliveredAt = now
+		d.NextAttemptAt = time.Time{}
+		return d
+	}
+
+	d.LastError = err.Error()
+	if d.Attempts >= webhookMaxAttempts {
+		d.NextAttemptAt = time.Time{}
+	} else {
+		d.NextAttemptAt = now.Add(retryDelay(webhookRetryDelay, webhookMaxRetryDelay, d.Attempts))
+	}
+
+	return d
+}
+
+// postWebhook posts the signed payload of d to its webhook, recording the status it answered with in d.
+// Any 2xx answer counts as delivered
+func postWebhook(ctx context.Context, d *Models.WebhookDelivery, now time.Time) error {
+	body := []byte(d.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", d.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bookings-Webhooks/1.0")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.Itoa(d.ID))
+	req.Header.Set(webhookSignatureHeader, signWebhook(d.Webhook.Secret, now, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	d.ResponseStatus = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		answer, _ := io.ReadAll(io.LimitReader(resp.Body, webhookMaxErrorBytes))
+		if text := strings.TrimSpace(string(answer)); text != "" {
+			return fmt.Errorf("the endpoint answered %s: %s", resp.Status, text)
+		}
+		return fmt.Errorf("the endpoint answered %s", resp.Status)
+	}
+
+	// read the rest so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, webhookMaxErrorBytes))
+
+	return nil
+}
+
+// signWebhook returns the signature header of a delivery of body signed at t with secret. The HMAC-SHA256 is
+// taken of the unix time, a dot and the body, so receivers can reject old deliveries that were replayed
+func signWebhook(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
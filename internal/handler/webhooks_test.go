@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	got := signWebhook("whsec", time.Unix(1700000000, 0), []byte(`{"event":"reservation.created"}`))
+	expected := "t=1700000000,v1=61949c1ccec91769ecc8e01765d0737a710287fdb908db68ad245274eebe6e69"
+
+	if got != expected {
+		t.Errorf("expected %s but got %s", expected, got)
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	status := http.StatusNoContent
+	var body []byte
+	var header http.Header
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		header = r.Header
+		w.WriteHeader(status)
+		if status >= 300 {
+			_, _ = io.WriteString(w, "try later")
+		}
+	}))
+	defer endpoint.Close()
+
+	now := time.Unix(1700000000, 0)
+	d := Models.WebhookDelivery{
+		ID:      7,
+		Event:   string(Models.EventReservationCreated),
+		Payload: `{"event":"reservation.created"}`,
+		Webhook: Models.Webhook{URL: endpoint.URL, Secret: "whsec"},
+	}
+
+	got := deliverWebhook(context.Background(), d, now)
+	if !got.Delivered() || got.Attempts != 1 || got.ResponseStatus != http.StatusNoContent || got.LastError != "" {
+		t.Errorf("expected the delivery to be delivered, got %+v", got)
+	}
+	if string(body) != d.Payload || header.Get(webhookDeliveryHeader) != "7" || header.Get(webhookEventHeader) != d.Event {
+		t.Errorf("unexpected request %q with headers %v", body, header)
+	}
+	if header.Get(webhookSignatureHeader) != signWebhook("whsec", now, body) {
+		t.Errorf("unexpected signature %s", header.Get(webhookSignatureHeader))
+	}
+
+	status = http.StatusServiceUnavailable
+	got = deliverWebhook(context.Background(), d, now)
+	if got.Delivered() || got.Failed() || !got.NextAttemptAt.Equal(now.Add(webhookRetryDelay)) {
+		t.Errorf("expected the delivery to be retried, got %+v", got)
+	}
+	if got.ResponseStatus != http.StatusServiceUnavailable || got.LastError != "the endpoint answered 503 Service Unavailable: try later" {
+		t.Errorf("unexpected outcome %d %q", got.ResponseStatus, got.LastError)
+	}
+
+	d.Attempts = webhookMaxAttempts - 1
+	got = deliverWebhook(context.Background(), d, now)
+	if !got.Failed() {
+		t.Errorf("expected the delivery to be given up after %d attempts, got %+v", webhookMaxAttempts, got)
+	}
+}
@@ -1,10 +1,15 @@
 package helpers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"github.com/454270186/Hotel-booking-web-application/internal/config"
 	"net/http"
 	"runtime/debug"
+	"strings"
 )
 
 var app *config.AppConfig
@@ -25,7 +30,72 @@ func ServeError(w http.ResponseWriter, err error) {
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
+// BearerToken returns the token of an "Authorization: Bearer" request header
+func BearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	token = strings.TrimSpace(token)
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+
+	return token, true
+}
+
 func IsAuthenticated(r *http.Request) bool {
 	isExist := app.Session.Exists(r.Context(), "user_id")
 	return isExist
 }
+
+// confirmationCodeAlphabet leaves out 0, 1, I and O, which are easily confused when read out
+const confirmationCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// NewConfirmationCode returns a random 10 character code for a guest to look their reservation up with
+func NewConfirmationCode() (string, error) {
+	return randomCode(10)
+}
+
+// NewRecoveryCode returns a random two factor recovery code, formatted as two groups of 5 characters
+func NewRecoveryCode() (string, error) {
+	code, err := randomCode(10)
+	if err != nil {
+		return "", err
+	}
+
+	return code[:5] + "-" + code[5:], nil
+}
+
+// NormalizeRecoveryCode undoes the formatting of a typed recovery code, so it can be hashed and compared
+func NormalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// randomCode returns n random characters of confirmationCodeAlphabet
+func randomCode(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	// the alphabet has 32 characters, so every byte maps to one without bias
+	for i := range b {
+		b[i] = confirmationCodeAlphabet[int(b[i])%len(confirmationCodeAlphabet)]
+	}
+
+	return string(b), nil
+}
+
+// NewToken returns a random, URL safe token for links sent by email
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash of token, which is stored instead of the token itself
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
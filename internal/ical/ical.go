@@ -0,0 +1,124 @@
+// Package ical reads and writes iCalendar (RFC 5545) feeds of all-day events, as used by calendar apps and OTAs,
+// and writes the timed events of calendar invites
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// ContentType is the media type of an iCalendar feed
+	ContentType = "text/calendar; charset=utf-8"
+	// dateLayout is the layout of DATE values
+	dateLayout = "20060102"
+	// dateTimeLayout is the layout of DATE-TIME values in UTC
+	dateTimeLayout = "20060102T150405Z"
+	// maxLineOctets is the longest a content line may be before it has to be folded
+	maxLineOctets = 75
+)
+
+// Event is an all-day event, unless it is Timed. End is exclusive, so a stay ends on its check-out day
+type Event struct {
+	// UID identifies the event across versions of the feed, so clients update and remove it instead of duplicating it
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	Location    string
+	// Timed makes Start and End times, such as check-in and check-out, instead of days. Parse never sets it
+	Timed bool
+	// Modified is when the event last changed
+	Modified time.Time
+	// Recurring marks an event that repeats with an RRULE or RDATE. Parse doesn't expand the repetitions,
+	// so Start and End are only its first occurrence
+	Recurring bool
+}
+
+// Calendar is a feed of events
+type Calendar struct {
+	// ProdID names the product that made the feed
+	ProdID string
+	// Name is the name calendar apps show for the feed
+	Name   string
+	Events []Event
+}
+
+// Encode writes the calendar to w
+func (c Calendar) Encode(w io.Writer) error {
+	b := bufio.NewWriter(w)
+
+	line := func(name, value string) {
+		writeLine(b, name+":"+value)
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", escape(c.ProdID))
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	if c.Name != "" {
+		line("X-WR-CALNAME", escape(c.Name))
+	}
+
+	for _, e := range c.Events {
+		line("BEGIN", "VEVENT")
+		line("UID", escape(e.UID))
+		line("DTSTAMP", e.Modified.UTC().Format(dateTimeLayout))
+		line("LAST-MODIFIED", e.Modified.UTC().Format(dateTimeLayout))
+		if e.Timed {
+			line("DTSTART", e.Start.UTC().Format(dateTimeLayout))
+			line("DTEND", e.End.UTC().Format(dateTimeLayout))
+		} else {
+			line("DTSTART;VALUE=DATE", e.Start.Format(dateLayout))
+			line("DTEND;VALUE=DATE", e.End.Format(dateLayout))
+		}
+		line("SUMMARY", escape(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION", escape(e.Description))
+		}
+		if e.Location != "" {
+			line("LOCATION", escape(e.Location))
+		}
+		line("TRANSP", "OPAQUE")
+		line("END", "VEVENT")
+	}
+
+	line("END", "VCALENDAR")
+
+	return b.Flush()
+}
+
+// escape escapes a TEXT value
+func escape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(s)
+}
+
+// writeLine writes a content line ended by CRLF, folding it after every 75 octets without splitting a character
+func writeLine(w *bufio.Writer, s string) {
+	limit := maxLineOctets
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		_, _ = w.WriteString(s[:cut])
+		_, _ = w.WriteString("\r\n ")
+		s = s[cut:]
+		// the space that starts a continuation line counts towards its length
+		limit = maxLineOctets - 1
+	}
+	_, _ = w.WriteString(s)
+	_, _ = w.WriteString("\r\n")
+}
@@ -0,0 +1,225 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendar_Encode(t *testing.T) {
+	date := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+
+	c := Calendar{
+		ProdID: "-//Test//Bookings//EN",
+		Name:   "General's Quarters",
+		Events: []Event{
+			{
+				UID:         "reservation-1@example.com",
+				Start:       date("2050-01-01"),
+				End:         date("2050-01-03"),
+				Summary:     "Reserved",
+				Description: "Smith, John; 2 nights\nlate arrival",
+				Modified:    time.Date(2049, 12, 1, 10, 30, 0, 0, time.FixedZone("", 3600)),
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := c.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	expected := []string{
+		"BEGIN:VCALENDAR\r\n",
+		"VERSION:2.0\r\n",
+		"X-WR-CALNAME:General's Quarters\r\n",
+		"UID:reservation-1@example.com\r\n",
+		"DTSTAMP:20491201T093000Z\r\n",
+		"DTSTART;VALUE=DATE:20500101\r\n",
+		"DTEND;VALUE=DATE:20500103\r\n",
+		`DESCRIPTION:Smith\, John\; 2 nights\nlate arrival` + "\r\n",
+		"END:VEVENT\r\nEND:VCALENDAR\r\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("expected the feed to contain %q, got\n%s", e, out)
+		}
+	}
+	if strings.Count(out, "BEGIN:VEVENT") != 1 {
+		t.Errorf("expected one event, got\n%s", out)
+	}
+}
+
+func TestCalendar_EncodeTimed(t *testing.T) {
+	zone := time.FixedZone("", -5*3600)
+	c := Calendar{Events: []Event{{
+		UID:      "reservation-ABC123@example.com",
+		Start:    time.Date(2050, 1, 1, 15, 0, 0, 0, zone),
+		End:      time.Date(2050, 1, 3, 11, 0, 0, 0, zone),
+		Summary:  "Stay at General's Quarters",
+		Location: "1 Main Street, Springfield",
+		Timed:    true,
+		Modified: time.Date(2049, 12, 1, 10, 30, 0, 0, time.UTC),
+	}}}
+
+	var buf bytes.Buffer
+	if err := c.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, e := range []string{"DTSTART:20500101T200000Z\r\n", "DTEND:20500103T160000Z\r\n", `LOCATION:1 Main Street\, Springfield` + "\r\n"} {
+		if !strings.Contains(out, e) {
+			t.Errorf("expected the invite to contain %q, got\n%s", e, out)
+		}
+	}
+	if strings.Contains(out, "VALUE=DATE") {
+		t.Errorf("expected times rather than days, got\n%s", out)
+	}
+}
+
+func TestWriteLine_Folding(t *testing.T) {
+	long := "SUMMARY:" + strings.Repeat("ä", 100)
+
+	var buf bytes.Buffer
+	c := Calendar{Events: []Event{{Summary: strings.TrimPrefix(long, "SUMMARY:")}}}
+	if err := c.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var unfolded string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Errorf("line of %d octets: %q", len(line), line)
+		}
+		if strings.HasPrefix(line, " ") {
+			unfolded += line[1:]
+		} else {
+			unfolded += "\n" + line
+		}
+	}
+
+	if !strings.Contains(unfolded, "\n"+long+"\n") {
+		t.Errorf("expected the summary to unfold to the original, got %q", unfolded)
+	}
+}
+
+func TestParse(t *testing.T) {
+	feed := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Other Site//EN",
+		"BEGIN:VEVENT",
+		"UID:booking-1@other.example",
+		"DTSTART;VALUE=DATE:20500101",
+		"DTEND;VALUE=DATE:20500104",
+		"SUMMARY:Reserved\\, paid",
+		"DESCRIPTION:a long description that was folded",
+		"  onto a second line",
+		"BEGIN:VALARM",
+		"UID:not-the-event",
+		"TRIGGER:-PT15M",
+		"END:VALARM",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:booking-2@other.example",
+		"STATUS:CANCELLED",
+		"DTSTART;VALUE=DATE:20500110",
+		"DTEND;VALUE=DATE:20500112",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:booking-3@other.example",
+		`DTSTART;TZID="America/New_York":20500201T150000`,
+		"DTEND;TZID=America/New_York:20500203T110000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:booking-4@other.example",
+		"DTSTART:20500301T220000Z",
+		"DURATION:P2D",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:booking-5@other.example",
+		"DTSTART;VALUE=DATE:20500401",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:weekends@other.example",
+		"DTSTART;VALUE=DATE:20500506",
+		"DTEND;VALUE=DATE:20500508",
+		"RRULE:FREQ=WEEKLY;COUNT=4",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:festival@other.example",
+		"DTSTART;VALUE=DATE:20500601",
+		"RDATE;VALUE=DATE:20510601",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	events, err := Parse(strings.NewReader(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		uid, start, end string
+		recurring       bool
+	}{
+		{"booking-1@other.example", "20500101", "20500104", false},
+		{"booking-3@other.example", "20500201", "20500203", false},
+		{"booking-4@other.example", "20500301", "20500303", false},
+		{"booking-5@other.example", "20500401", "20500402", false},
+		{"weekends@other.example", "20500506", "20500508", true},
+		{"festival@other.example", "20500601", "20500602", true},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+	for i, e := range expected {
+		got := events[i]
+		if got.UID != e.uid || got.Start.Format(dateLayout) != e.start || got.End.Format(dateLayout) != e.end {
+			t.Errorf("expected %s from %s to %s, got %s from %s to %s", e.uid, e.start, e.end,
+				got.UID, got.Start.Format(dateLayout), got.End.Format(dateLayout))
+		}
+		if got.Recurring != e.recurring {
+			t.Errorf("expected %s to be recurring %v, got %v", e.uid, e.recurring, got.Recurring)
+		}
+	}
+	if events[0].Summary != "Reserved, paid" || events[0].Description != "a long description that was folded onto a second line" {
+		t.Errorf("unexpected text %q and %q", events[0].Summary, events[0].Description)
+	}
+
+	if _, err := Parse(strings.NewReader("<html>not found</html>")); err != ErrNotCalendar {
+		t.Errorf("expected ErrNotCalendar for HTML, got %v", err)
+	}
+	if _, err := Parse(strings.NewReader("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART:tomorrow\r\nEND:VEVENT\r\nEND:VCALENDAR")); err == nil {
+		t.Error("expected an invalid date to fail")
+	}
+}
+
+func TestParse_RoundTrip(t *testing.T) {
+	c := Calendar{Events: []Event{{
+		UID:      "block-7@example.com",
+		Start:    time.Date(2050, 5, 1, 0, 0, 0, 0, time.UTC),
+		End:      time.Date(2050, 5, 2, 0, 0, 0, 0, time.UTC),
+		Summary:  strings.Repeat("Blocked; ", 20),
+		Modified: time.Date(2050, 4, 1, 12, 0, 0, 0, time.UTC),
+	}}}
+
+	var buf bytes.Buffer
+	if err := c.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	events, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0] != c.Events[0] {
+		t.Errorf("expected %+v back, got %+v", c.Events, events)
+	}
+}
@@ -0,0 +1,285 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotCalendar is returned by Parse for input that has no VCALENDAR
+var ErrNotCalendar = errors.New("not an iCalendar file")
+
+// durationRegexp matches the DURATION values Parse understands, such as P2D, P1W or PT36H
+var durationRegexp = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// property is a content line split into its name, parameters and value
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// Parse reads the VEVENTs of an iCalendar file as all-day events. An event that starts or ends at a time of day
+// covers the days it starts on up to the day it ends on, as a stay does. Cancelled events are left out, and
+// repeating events are marked Recurring rather than expanded
+func Parse(r io.Reader) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	var props []property
+	inCalendar, inEvent := false, false
+	// depth counts the components nested in an event, such as VALARM, whose properties are not the event's
+	depth := 0
+
+	for n, line := range lines {
+		p, ok := parseLine(line)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case p.name == "BEGIN" && strings.EqualFold(p.value, "VCALENDAR"):
+			inCalendar = true
+		case p.name == "BEGIN" && strings.EqualFold(p.value, "VEVENT") && !inEvent:
+			inEvent, depth, props = true, 0, nil
+		case p.name == "BEGIN" && inEvent:
+			depth++
+		case p.name == "END" && inEvent && depth > 0:
+			depth--
+		case p.name == "END" && strings.EqualFold(p.value, "VEVENT") && inEvent:
+			inEvent = false
+			e, keep, err := newEvent(props)
+			if err != nil {
+				return nil, fmt.Errorf("event ending on line %d: %w", n+1, err)
+			}
+			if keep {
+				events = append(events, e)
+			}
+		case inEvent && depth == 0:
+			props = append(props, p)
+		}
+	}
+
+	if !inCalendar {
+		return nil, ErrNotCalendar
+	}
+
+	return events, nil
+}
+
+// unfold reads the content lines of r, joining folded lines
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+// parseLine splits a content line at the first colon outside a quoted parameter value
+func parseLine(line string) (property, bool) {
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 1 {
+		return property{}, false
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	p := property{
+		name:   strings.ToUpper(parts[0]),
+		params: make(map[string]string),
+		value:  line[colon+1:],
+	}
+	for _, param := range parts[1:] {
+		if key, value, ok := strings.Cut(param, "="); ok {
+			p.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+		}
+	}
+
+	return p, true
+}
+
+// newEvent makes an all-day event of the properties of a VEVENT, and reports whether it should be kept
+func newEvent(props []property) (Event, bool, error) {
+	var e Event
+	var start, end *property
+	var duration string
+
+	for i, p := range props {
+		switch p.name {
+		case "UID":
+			e.UID = p.value
+		case "SUMMARY":
+			e.Summary = unescape(p.value)
+		case "DESCRIPTION":
+			e.Description = unescape(p.value)
+		case "LOCATION":
+			e.Location = unescape(p.value)
+		case "DTSTART":
+			start = &props[i]
+		case "DTEND":
+			end = &props[i]
+		case "DURATION":
+			duration = p.value
+		case "RRULE", "RDATE":
+			e.Recurring = true
+		case "STATUS":
+			if strings.EqualFold(p.value, "CANCELLED") {
+				return e, false, nil
+			}
+		case "LAST-MODIFIED":
+			e.Modified, _ = time.Parse(dateTimeLayout, p.value)
+		case "DTSTAMP":
+			if e.Modified.IsZero() {
+				e.Modified, _ = time.Parse(dateTimeLayout, p.value)
+			}
+		}
+	}
+
+	if start == nil {
+		return e, false, errors.New("no DTSTART")
+	}
+	startAt, allDay, err := parseTime(*start)
+	if err != nil {
+		return e, false, err
+	}
+
+	endAt := startAt
+	switch {
+	case end != nil:
+		endAt, _, err = parseTime(*end)
+		if err != nil {
+			return e, false, err
+		}
+	case duration != "":
+		d, err := parseDuration(duration)
+		if err != nil {
+			return e, false, err
+		}
+		endAt = startAt.Add(d)
+	case allDay:
+		// an all-day event without an end lasts one day
+		endAt = startAt.AddDate(0, 0, 1)
+	}
+
+	e.Start = day(startAt)
+	e.End = day(endAt)
+	if !e.End.After(e.Start) {
+		e.End = e.Start.AddDate(0, 0, 1)
+	}
+
+	return e, true, nil
+}
+
+// parseTime parses a DATE or DATE-TIME value and reports whether it was a DATE. Times keep their TZID,
+// floating times and unknown zones are read as UTC
+func parseTime(p property) (time.Time, bool, error) {
+	value := strings.TrimSpace(p.value)
+
+	if strings.EqualFold(p.params["VALUE"], "DATE") || len(value) == len(dateLayout) {
+		t, err := time.Parse(dateLayout, value)
+		if err != nil {
+			return t, false, fmt.Errorf("invalid date %q in %s", value, p.name)
+		}
+		return t, true, nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(dateTimeLayout, value)
+		if err != nil {
+			return t, false, fmt.Errorf("invalid time %q in %s", value, p.name)
+		}
+		return t, false, nil
+	}
+
+	loc := time.UTC
+	if tzid := p.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	if err != nil {
+		return t, false, fmt.Errorf("invalid time %q in %s", value, p.name)
+	}
+
+	return t, false, nil
+}
+
+// parseDuration parses a DURATION value
+func parseDuration(s string) (time.Duration, error) {
+	m := durationRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+
+	var d time.Duration
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	for i, unit := range units {
+		if m[i+2] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i+2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+
+	return d, nil
+}
+
+// day returns the date of t in its own zone, as midnight UTC
+func day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// unescape undoes escape
+func unescape(s string) string {
+	var b strings.Builder
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped && (c == 'n' || c == 'N'):
+			b.WriteRune('\n')
+			escaped = false
+		case escaped:
+			b.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"os"
+	"time"
+)
+
+// File writes every email to an .eml file in a directory, where mail clients can open it
+type File struct {
+	dir string
+}
+
+// NewFile returns a mailer writing to dir, which is created if it doesn't exist
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &File{dir: dir}, nil
+}
+
+// Send writes msg to a new file, named so the files sort in the order they were written
+func (f *File) Send(msg Models.MailData) error {
+	email := newEmail(msg)
+	if err := email.GetError(); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(f.dir, time.Now().UTC().Format("20060102T150405.000000000")+"-*.eml")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(email.GetMessage())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,31 @@
+// Package mailer hands emails to an SMTP server or, for development and tests, writes them to files or memory
+package mailer
+
+import (
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Mailer sends emails
+type Mailer interface {
+	// Send sends msg, returning an error if it could not be handed over
+	Send(msg Models.MailData) error
+}
+
+// newEmail builds the email of msg, with Content as the alternative to PlainContent when there is one, and its
+// attachments
+func newEmail(msg Models.MailData) *mail.Email {
+	email := mail.NewMSG()
+	email.SetFrom(msg.From).AddTo(msg.To).SetSubject(msg.Subject)
+	if msg.PlainContent != "" {
+		email.SetBody(mail.TextPlain, msg.PlainContent)
+		email.AddAlternative(mail.TextHTML, msg.Content)
+	} else {
+		email.SetBody(mail.TextHTML, msg.Content)
+	}
+	for _, a := range msg.Attachments {
+		email.Attach(&mail.File{Name: a.Name, MimeType: a.ContentType, Data: a.Data})
+	}
+
+	return email
+}
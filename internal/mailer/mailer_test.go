@@ -0,0 +1,183 @@
+package mailer
+
+import (
+	"bufio"
+	"errors"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMessage = Models.MailData{
+	To:           "guest@example.com",
+	From:         "bookings@example.com",
+	Subject:      "Reservation Confirmation",
+	Content:      "<p>Dear John,</p>",
+	PlainContent: "Dear John,\n",
+	Attachments: []Models.MailAttachment{
+		{Name: "reservation.ics", ContentType: "text/calendar; charset=utf-8", Data: []byte("BEGIN:VCALENDAR\r\n")},
+	},
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+
+	if err := m.Send(testMessage); err != nil {
+		t.Fatal(err)
+	}
+	m.Fail(errors.New("connection refused"))
+	if err := m.Send(testMessage); err == nil || err.Error() != "connection refused" {
+		t.Errorf("expected the failure, got %v", err)
+	}
+	if sent := m.Messages(); len(sent) != 1 || sent[0].Subject != testMessage.Subject {
+		t.Errorf("expected one message, got %+v", sent)
+	}
+
+	m.Reset()
+	if sent := m.Messages(); len(sent) != 0 {
+		t.Errorf("expected no messages after a reset, got %+v", sent)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	f, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := f.Send(testMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected two files, got %v", files)
+	}
+
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{"Subject: Reservation Confirmation", "To: <guest@example.com>", "text/plain", "text/html", "Dear John,",
+		`filename="reservation.ics"`, "text/calendar"} {
+		if !strings.Contains(string(content), e) {
+			t.Errorf("expected the file to contain %q, got\n%s", e, content)
+		}
+	}
+}
+
+func TestNewSMTP(t *testing.T) {
+	var tests = []struct {
+		name   string
+		config SMTPConfig
+		valid  bool
+	}{
+		{"plain", SMTPConfig{Host: "localhost", Port: 1025}, true},
+		{"starttls", SMTPConfig{Host: "smtp.example.com", Port: 587, TLS: TLSStartTLS}, true},
+		{"tls", SMTPConfig{Host: "smtp.example.com", Port: 465, TLS: TLSImplicit}, true},
+		{"unknown-tls", SMTPConfig{Host: "smtp.example.com", Port: 465, TLS: "ssl"}, false},
+		{"no-host", SMTPConfig{Port: 25}, false},
+		{"no-port", SMTPConfig{Host: "localhost"}, false},
+	}
+
+	for _, e := range tests {
+		_, err := NewSMTP(e.config)
+		if e.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", e.name, err)
+		}
+		if !e.valid && err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+}
+
+func TestSMTP_Send(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string, 1)
+	go serveSMTP(l, received)
+
+	s, err := NewSMTP(SMTPConfig{
+		Host:           "127.0.0.1",
+		Port:           l.Addr().(*net.TCPAddr).Port,
+		ConnectTimeout: 5 * time.Second,
+		SendTimeout:    5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		if !strings.Contains(data, "Subject: Reservation Confirmation") || !strings.Contains(data, "Dear John,") {
+			t.Errorf("unexpected message\n%s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server received no message")
+	}
+}
+
+// serveSMTP answers one SMTP session on l just enough to take a message, which it sends to received
+func serveSMTP(l net.Listener, received chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		_, _ = conn.Write([]byte(s + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case command == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			received <- data.String()
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
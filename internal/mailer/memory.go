@@ -0,0 +1,55 @@
+package mailer
+
+import (
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"sync"
+)
+
+// Memory keeps the emails it is sent, so tests can look at them. It is safe for concurrent use
+type Memory struct {
+	mu       sync.Mutex
+	messages []Models.MailData
+	err      error
+}
+
+// NewMemory returns an empty in-memory mailer
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Send keeps msg, unless the mailer was told to fail
+func (m *Memory) Send(msg Models.MailData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.messages = append(m.messages, msg)
+
+	return nil
+}
+
+// Messages returns the emails sent so far, oldest first
+func (m *Memory) Messages() []Models.MailData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Models.MailData(nil), m.messages...)
+}
+
+// Reset forgets the emails sent so far
+func (m *Memory) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = nil
+}
+
+// Fail makes Send return err, like a mail server that is down, until it is called with nil
+func (m *Memory) Fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.err = err
+}
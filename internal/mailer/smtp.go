@@ -0,0 +1,87 @@
+package mailer
+
+import (
+	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	mail "github.com/xhit/go-simple-mail/v2"
+	"time"
+)
+
+// The TLS modes of an SMTP server
+const (
+	// TLSNone sends in plain text, as local test servers like MailHog expect
+	TLSNone = "none"
+	// TLSStartTLS upgrades the connection with STARTTLS, usually on port 587
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects with TLS from the start, usually on port 465
+	TLSImplicit = "tls"
+)
+
+// SMTPConfig holds the settings of an SMTP server
+type SMTPConfig struct {
+	Host string
+	Port int
+	// Username and Password are only sent when Username is set
+	Username string
+	Password string
+	// TLS is one of TLSNone, TLSStartTLS and TLSImplicit
+	TLS            string
+	ConnectTimeout time.Duration
+	SendTimeout    time.Duration
+}
+
+// SMTP sends emails through an SMTP server, with a new connection for every email
+type SMTP struct {
+	config     SMTPConfig
+	encryption mail.Encryption
+}
+
+// NewSMTP returns a mailer sending through the server of config
+func NewSMTP(config SMTPConfig) (*SMTP, error) {
+	s := &SMTP{config: config}
+
+	switch config.TLS {
+	case TLSNone, "":
+		s.encryption = mail.EncryptionNone
+	case TLSStartTLS:
+		s.encryption = mail.EncryptionSTARTTLS
+	case TLSImplicit:
+		s.encryption = mail.EncryptionSSLTLS
+	default:
+		return nil, fmt.Errorf("unknown SMTP TLS mode %q, expected %s, %s or %s", config.TLS, TLSNone, TLSStartTLS, TLSImplicit)
+	}
+	if config.Host == "" || config.Port <= 0 {
+		return nil, fmt.Errorf("invalid SMTP server %s:%d", config.Host, config.Port)
+	}
+
+	return s, nil
+}
+
+// Send sends msg through the server
+func (s *SMTP) Send(msg Models.MailData) error {
+	server := mail.NewSMTPClient()
+	server.Host = s.config.Host
+	server.Port = s.config.Port
+	server.Encryption = s.encryption
+	server.KeepAlive = false
+	if s.config.ConnectTimeout > 0 {
+		server.ConnectTimeout = s.config.ConnectTimeout
+	}
+	if s.config.SendTimeout > 0 {
+		server.SendTimeout = s.config.SendTimeout
+	}
+	if s.config.Username != "" {
+		server.Authentication = mail.AuthPlain
+		server.Username = s.config.Username
+		server.Password = s.config.Password
+	} else {
+		server.Authentication = mail.AuthNone
+	}
+
+	client, err := server.Connect()
+	if err != nil {
+		return err
+	}
+
+	return newEmail(msg).Send(client)
+}
@@ -0,0 +1,60 @@
+package pricing
+
+import (
+	"errors"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"time"
+)
+
+// ErrInvalidStay is returned for a stay that does not last at least one night
+var ErrInvalidStay = errors.New("departure must be after arrival")
+
+// Night is the price of a single night of a stay
+type Night struct {
+	Date time.Time
+	Rate int    // in cents
+	Name string // the rate the night was priced at, e.g. "Weekend"
+}
+
+// Quote is the per-night price breakdown of a stay
+type Quote struct {
+	Nights []Night
+	Total  int // in cents
+}
+
+// Calculate prices every night from start up to, but not including, end with plan.
+// A seasonal rate covering the night wins over the weekend rate, which wins over the base rate
+func Calculate(plan Models.RatePlan, start, end time.Time) (Quote, error) {
+	var q Quote
+
+	if !end.After(start) {
+		return q, ErrInvalidStay
+	}
+
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		night := priceNight(plan, d)
+		q.Nights = append(q.Nights, night)
+		q.Total += night.Rate
+	}
+
+	return q, nil
+}
+
+func priceNight(plan Models.RatePlan, d time.Time) Night {
+	for _, s := range plan.SeasonalRates {
+		if !d.Before(s.StartDate) && d.Before(s.EndDate) {
+			return Night{Date: d, Rate: s.Rate, Name: s.Name}
+		}
+	}
+
+	if IsWeekendNight(d) && plan.WeekendRate > 0 {
+		return Night{Date: d, Rate: plan.WeekendRate, Name: "Weekend"}
+	}
+
+	return Night{Date: d, Rate: plan.BaseRate, Name: "Standard"}
+}
+
+// IsWeekendNight reports whether the night starting on d is a Friday or Saturday night
+func IsWeekendNight(d time.Time) bool {
+	return d.Weekday() == time.Friday || d.Weekday() == time.Saturday
+}
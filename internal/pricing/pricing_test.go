@@ -0,0 +1,71 @@
+package pricing
+
+import (
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+var plan = Models.RatePlan{
+	BaseRate:    10000,
+	WeekendRate: 12000,
+	SeasonalRates: []Models.SeasonalRate{
+		{Name: "Christmas", StartDate: date("2050-12-23"), EndDate: date("2050-12-27"), Rate: 20000},
+	},
+}
+
+func TestCalculate(t *testing.T) {
+	var tests = []struct {
+		name     string
+		start    string
+		end      string
+		expected []int
+	}{
+		// 2050-12-14 is a Wednesday
+		{"weekdays", "2050-12-14", "2050-12-16", []int{10000, 10000}},
+		{"friday and saturday nights", "2050-12-16", "2050-12-19", []int{12000, 12000, 10000}},
+		{"into a season", "2050-12-21", "2050-12-25", []int{10000, 10000, 20000, 20000}},
+		{"season ends on departure day", "2050-12-26", "2050-12-28", []int{20000, 10000}},
+	}
+
+	for _, e := range tests {
+		q, err := Calculate(plan, date(e.start), date(e.end))
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+
+		if len(q.Nights) != len(e.expected) {
+			t.Fatalf("%s: expected %d nights but got %d", e.name, len(e.expected), len(q.Nights))
+		}
+
+		total := 0
+		for i, rate := range e.expected {
+			if q.Nights[i].Rate != rate {
+				t.Errorf("%s: night %d expected %d but got %d", e.name, i, rate, q.Nights[i].Rate)
+			}
+			total += rate
+		}
+		if q.Total != total {
+			t.Errorf("%s: expected total %d but got %d", e.name, total, q.Total)
+		}
+	}
+}
+
+func TestCalculate_NoWeekendRate(t *testing.T) {
+	q, _ := Calculate(Models.RatePlan{BaseRate: 10000}, date("2050-12-16"), date("2050-12-17"))
+	if q.Total != 10000 {
+		t.Errorf("expected the base rate on a friday without a weekend rate, got %d", q.Total)
+	}
+}
+
+func TestCalculate_InvalidStay(t *testing.T) {
+	_, err := Calculate(plan, date("2050-12-16"), date("2050-12-16"))
+	if err != ErrInvalidStay {
+		t.Errorf("expected ErrInvalidStay, got %v", err)
+	}
+}
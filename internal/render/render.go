@@ -10,13 +10,16 @@ import (
 	"html/template"
 	"net/http"
 	"path/filepath"
+	"strings"
+	texttemplate "text/template"
 	"time"
 )
 
 var functions = template.FuncMap{
-	"humanDate":  HumanDate,
-	"formatDate": FormatDate,
-	"iterate":    Iterate,
+	"humanDate":   HumanDate,
+	"formatDate":  FormatDate,
+	"iterate":     Iterate,
+	"formatPrice": FormatPrice,
 }
 var app *config.AppConfig
 var pathToTemplates = "./templates"
@@ -40,6 +43,11 @@ func FormatDate(t time.Time, f string) string {
 	return t.Format(f)
 }
 
+// FormatPrice returns an amount in cents as dollars, e.g. 8950 as 89.50
+func FormatPrice(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
 // NewRenderer sets the config for the template package
 func NewRenderer(a *config.AppConfig) {
 	app = a
@@ -56,6 +64,7 @@ func AddDefaultData(td *Models.TemplateData, r *http.Request) *Models.TemplateDa
 	td.Warning = app.Session.PopString(r.Context(), "warning")
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticated = 1
+		td.Role = Models.Role(app.Session.GetInt(r.Context(), "access_level"))
 	}
 	return td
 }
@@ -133,6 +142,75 @@ func CreateTemplateCache() (map[string]*template.Template, error) {
 
 }
 
+// Mail renders the email template of msg into its Content and PlainContent. The HTML comes from
+// email/<template>.mail.html with the email layouts, the plain text from email/<template>.mail.txt
+func Mail(msg Models.MailData) (Models.MailData, error) {
+	htmlCache, textCache := app.MailTemplateCache, app.MailTextTemplateCache
+	if !app.UseCache {
+		var err error
+		htmlCache, textCache, err = CreateMailTemplateCache()
+		if err != nil {
+			return msg, err
+		}
+	}
+
+	h, ok := htmlCache[msg.Template]
+	if !ok {
+		return msg, fmt.Errorf("could not get email template %q from templates cache", msg.Template)
+	}
+	t, ok := textCache[msg.Template]
+	if !ok {
+		return msg, fmt.Errorf("could not get plain text email template %q from templates cache", msg.Template)
+	}
+
+	var html, text bytes.Buffer
+	if err := h.Execute(&html, msg); err != nil {
+		return msg, err
+	}
+	if err := t.Execute(&text, msg); err != nil {
+		return msg, err
+	}
+	msg.Content = html.String()
+	msg.PlainContent = strings.TrimSpace(text.String()) + "\n"
+
+	return msg, nil
+}
+
+// CreateMailTemplateCache creates the caches of the email templates as maps keyed by template name,
+// one of the HTML templates and one of their plain text alternatives
+func CreateMailTemplateCache() (map[string]*template.Template, map[string]*texttemplate.Template, error) {
+	htmlCache := map[string]*template.Template{}
+	textCache := map[string]*texttemplate.Template{}
+
+	pages, err := filepath.Glob(fmt.Sprintf("%s/email/*.mail.html", pathToTemplates))
+	if err != nil {
+		return htmlCache, textCache, err
+	}
+
+	for _, page := range pages {
+		name := strings.TrimSuffix(filepath.Base(page), ".mail.html")
+
+		ts, err := template.New(filepath.Base(page)).Funcs(functions).ParseFiles(page)
+		if err != nil {
+			return htmlCache, textCache, err
+		}
+		ts, err = ts.ParseGlob(fmt.Sprintf("%s/email/*.layout.html", pathToTemplates))
+		if err != nil {
+			return htmlCache, textCache, err
+		}
+		htmlCache[name] = ts
+
+		text := strings.TrimSuffix(page, ".html") + ".txt"
+		tt, err := texttemplate.New(filepath.Base(text)).Funcs(texttemplate.FuncMap(functions)).ParseFiles(text)
+		if err != nil {
+			return htmlCache, textCache, err
+		}
+		textCache[name] = tt
+	}
+
+	return htmlCache, textCache, nil
+}
+
 /*
 	RenderTemplate() is not very efficient. Everytime users load this page, template.ParseFiles()
 parse files from the disk, with increment of the number of files, efficiency will become lower
@@ -3,7 +3,9 @@ package render
 import (
 	"github.com/454270186/Hotel-booking-web-application/internal/Models"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAddDefaultData(t *testing.T) {
@@ -47,6 +49,46 @@ func TestRenderTemplate(t *testing.T) {
 	}
 }
 
+func TestMail(t *testing.T) {
+	pathToTemplates = "./../../templates"
+	app.UseCache = false
+
+	res := Models.Reservation{
+		FirstName:        "John",
+		StartDate:        time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:          time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		TotalPrice:       17900,
+		ConfirmationCode: "ABCD2345",
+		Room:             Models.Room{RoomName: "General's Quarters"},
+	}
+	msg, err := Mail(Models.MailData{
+		Subject:  "Reservation Confirmation",
+		Template: "reservation-confirmation",
+		Data:     map[string]interface{}{"reservation": res},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []string{"<title>Reservation Confirmation</title>", "General&#39;s Quarters", "2050-01-03", "$179.00", "<strong>ABCD2345</strong>"} {
+		if !strings.Contains(msg.Content, e) {
+			t.Errorf("expected the HTML to contain %q, got\n%s", e, msg.Content)
+		}
+	}
+	for _, e := range []string{"Dear John,", "General's Quarters from 2050-01-01", "confirmation code is ABCD2345."} {
+		if !strings.Contains(msg.PlainContent, e) {
+			t.Errorf("expected the plain text to contain %q, got\n%s", e, msg.PlainContent)
+		}
+	}
+	if strings.Contains(msg.PlainContent, "<") {
+		t.Errorf("expected the plain text to have no markup, got\n%s", msg.PlainContent)
+	}
+
+	if _, err := Mail(Models.MailData{Template: "dont-exist"}); err == nil {
+		t.Error("rendered an email template that does not exist")
+	}
+}
+
 func getSession() (*http.Request, error) {
 	r, err := http.NewRequest("GET", "/some-url", nil)
 	if err != nil {
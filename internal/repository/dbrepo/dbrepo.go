@@ -1,14 +1,313 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
 	"github.com/454270186/Hotel-booking-web-application/internal/config"
 	"github.com/454270186/Hotel-booking-web-application/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+	"sync"
+	"time"
 )
 
-type postgresDBRepo struct {
+// defaultDBTimeout bounds a repository call when AppConfig.DBTimeout is not set
+const defaultDBTimeout = 3 * time.Second
+
+// queryTimeout derives the context a single repository call runs with from the caller's context,
+// so the query is cancelled when either the caller gives up or the configured timeout passes
+func queryTimeout(ctx context.Context, a *config.AppConfig) (context.Context, context.CancelFunc) {
+	timeout := defaultDBTimeout
+	if a != nil && a.DBTimeout > 0 {
+		timeout = a.DBTimeout
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// dbConn is satisfied by both *sql.DB and *sql.Tx, so the same repository methods
+// can run either directly against the pool or inside a transaction
+type dbConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// roomColumns lists the rooms columns in the order scanRoom reads them
+const roomColumns = `id, room_name, slug, description, capacity, bed_configuration, amenities,
+	base_price, image, active, ical_token, created_at, updated_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRoom reads a room selected with roomColumns
+func scanRoom(row rowScanner) (Models.Room, error) {
+	var room Models.Room
+	err := row.Scan(
+		&room.ID,
+		&room.RoomName,
+		&room.Slug,
+		&room.Description,
+		&room.Capacity,
+		&room.BedConfiguration,
+		&room.Amenities,
+		&room.BasePrice,
+		&room.Image,
+		&room.Active,
+		&room.ICalToken,
+		&room.CreatedAt,
+		&room.UpdatedAt,
+	)
+
+	return room, err
+}
+
+// apiTokenColumns lists the api_tokens columns, and the name and state of the user who created the token, in
+// the order scanAPIToken reads them. Queries select from api_tokens t joined with users u
+const apiTokenColumns = `t.id, t.name, t.token_hash, t.scopes, t.user_id, t.last_used_at, t.revoked_at,
+	t.created_at, t.updated_at, u.first_name, u.last_name, u.active`
+
+// scanAPIToken reads an API token selected with apiTokenColumns
+func scanAPIToken(row rowScanner) (Models.APIToken, error) {
+	var t Models.APIToken
+	var lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&t.ID,
+		&t.Name,
+		&t.TokenHash,
+		&t.Scopes,
+		&t.UserID,
+		&lastUsedAt,
+		&revokedAt,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+		&t.User.FirstName,
+		&t.User.LastName,
+		&t.User.Active,
+	)
+	t.LastUsedAt = lastUsedAt.Time
+	t.RevokedAt = revokedAt.Time
+	t.User.ID = t.UserID
+
+	return t, err
+}
+
+// icalFeedColumns lists the ical_feeds columns, and the name of the room, in the order scanICalFeed reads them.
+// Queries select from ical_feeds f joined with rooms r
+const icalFeedColumns = `f.id, f.room_id, f.name, f.url, f.content, f.last_synced_at, f.last_error, f.blocks,
+	f.skipped, f.recurring, f.created_at, f.updated_at, r.room_name`
+
+// scanICalFeed reads an external calendar selected with icalFeedColumns
+func scanICalFeed(row rowScanner) (Models.ICalFeed, error) {
+	var f Models.ICalFeed
+	var lastSyncedAt sql.NullTime
+	err := row.Scan(
+		&f.ID,
+		&f.RoomID,
+		&f.Name,
+		&f.URL,
+		&f.Content,
+		&lastSyncedAt,
+		&f.LastError,
+		&f.Blocks,
+		&f.Skipped,
+		&f.Recurring,
+		&f.CreatedAt,
+		&f.UpdatedAt,
+		&f.Room.RoomName,
+	)
+	f.LastSyncedAt = lastSyncedAt.Time
+	f.Room.ID = f.RoomID
+
+	return f, err
+}
+
+// webhookColumns lists the webhooks columns in the order scanWebhook reads them
+const webhookColumns = `id, name, url, secret, events, active, created_at, updated_at`
+
+// scanWebhook reads a webhook selected with webhookColumns
+func scanWebhook(row rowScanner) (Models.Webhook, error) {
+	var w Models.Webhook
+	err := row.Scan(
+		&w.ID,
+		&w.Name,
+		&w.URL,
+		&w.Secret,
+		&w.Events,
+		&w.Active,
+		&w.CreatedAt,
+		&w.UpdatedAt,
+	)
+
+	return w, err
+}
+
+// webhookDeliveryColumns lists the webhook_deliveries columns, and the webhook's name, URL and secret, in the
+// order scanWebhookDelivery reads them. Queries select from webhook_deliveries d joined with webhooks w
+const webhookDeliveryColumns = `d.id, d.webhook_id, d.event, d.payload, d.attempts, d.next_attempt_at,
+	d.last_attempt_at, d.response_status, d.last_error, d.delivered_at, d.created_at, d.updated_at,
+	w.name, w.url, w.secret`
+
+// scanWebhookDelivery reads a webhook delivery selected with webhookDeliveryColumns
+func scanWebhookDelivery(row rowScanner) (Models.WebhookDelivery, error) {
+	var d Models.WebhookDelivery
+	var nextAttemptAt, lastAttemptAt, deliveredAt sql.NullTime
+	err := row.Scan(
+		&d.ID,
+		&d.WebhookID,
+		&d.Event,
+		&d.Payload,
+		&d.Attempts,
+		&nextAttemptAt,
+		&lastAttemptAt,
+		&d.ResponseStatus,
+		&d.LastError,
+		&deliveredAt,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+		&d.Webhook.Name,
+		&d.Webhook.URL,
+		&d.Webhook.Secret,
+	)
+	d.NextAttemptAt = nextAttemptAt.Time
+	d.LastAttemptAt = lastAttemptAt.Time
+	d.DeliveredAt = deliveredAt.Time
+	d.Webhook.ID = d.WebhookID
+
+	return d, err
+}
+
+// mailMessageColumns lists the mail_messages columns in the order scanMailMessage reads them
+const mailMessageColumns = `id, to_address, from_address, subject, content, plain_content, attachments, status,
+	attempts, next_attempt_at, last_attempt_at, last_error, sent_at, created_at, updated_at`
+
+// scanMailMessage reads a mail message selected with mailMessageColumns
+func scanMailMessage(row rowScanner) (Models.MailMessage, error) {
+	var msg Models.MailMessage
+	var attachments string
+	var nextAttemptAt, lastAttemptAt, sentAt sql.NullTime
+	err := row.Scan(
+		&msg.ID,
+		&msg.To,
+		&msg.From,
+		&msg.Subject,
+		&msg.Content,
+		&msg.PlainContent,
+		&attachments,
+		&msg.Status,
+		&msg.Attempts,
+		&nextAttemptAt,
+		&lastAttemptAt,
+		&msg.LastError,
+		&sentAt,
+		&msg.CreatedAt,
+		&msg.UpdatedAt,
+	)
+	msg.NextAttemptAt = nextAttemptAt.Time
+	msg.LastAttemptAt = lastAttemptAt.Time
+	msg.SentAt = sentAt.Time
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Attachments, err = decodeAttachments(attachments)
+
+	return msg, err
+}
+
+// encodeAttachments stores the attachments of a mail message as JSON, or as the empty string if there are none
+func encodeAttachments(attachments []Models.MailAttachment) (string, error) {
+	if len(attachments) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(attachments)
+
+	return string(b), err
+}
+
+// decodeAttachments reads attachments stored by encodeAttachments
+func decodeAttachments(s string) ([]Models.MailAttachment, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var attachments []Models.MailAttachment
+	err := json.Unmarshal([]byte(s), &attachments)
+
+	return attachments, err
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// sameNights reports whether two restrictions cover the same nights
+func sameNights(a, b Models.RoomRestriction) bool {
+	return a.StartDate.Equal(b.StartDate) && a.EndDate.Equal(b.EndDate)
+}
+
+// userColumns lists the users columns in the order scanUser reads them
+const userColumns = `id, first_name, last_name, email, password, access_level, active, created_at, updated_at,
+	totp_secret, totp_enabled, totp_last_step, locked_until`
+
+// scanUser reads a user selected with userColumns
+func scanUser(row rowScanner) (Models.User, error) {
+	var u Models.User
+	var lockedUntil sql.NullTime
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.Password,
+		&u.AccessLevel,
+		&u.Active,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.TOTPLastStep,
+		&lockedUntil,
+	)
+	u.LockedUntil = lockedUntil.Time
+
+	return u, err
+}
+
+// passwordCost is the bcrypt cost new password hashes are generated with
+const passwordCost = 12
+
+// hashPassword returns the bcrypt hash of password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// sqlDBRepo runs the repository on Postgres or SQLite, with dialect making up for the differences
+type sqlDBRepo struct {
 	App *config.AppConfig
-	DB  *sql.DB
+	DB  dbConn
+
+	dialect dialect
+}
+
+// dialect rewrites the queries of sqlDBRepo, which are written for Postgres, for the database it runs on
+type dialect interface {
+	// rebind rewrites a query
+	rebind(query string) string
+	// convertArgs rewrites the arguments of a query
+	convertArgs(args []interface{}) []interface{}
+	// isOverlapError reports whether err was raised by the room_restrictions_no_overlap constraint
+	isOverlapError(err error) bool
 }
 
 type testDBRepo struct {
@@ -16,10 +315,102 @@ type testDBRepo struct {
 	DB  *sql.DB
 }
 
+// memoryDBRepo keeps every table in maps guarded by mu, so it is safe for concurrent use.
+// A repo handed to a WithTx callback shares the tables and runs with mu already held
+type memoryDBRepo struct {
+	App *config.AppConfig
+
+	mu *sync.RWMutex
+	*memoryTables
+	inTx bool
+}
+
+// memoryTables holds the rows of the in-memory database
+type memoryTables struct {
+	rooms             map[int]Models.Room
+	restrictions      map[int]Models.Restriction
+	reservations      map[int]Models.Reservation
+	roomRestrictions  map[int]Models.RoomRestriction
+	users             map[int]Models.User
+	ratePlans         map[int]Models.RatePlan // keyed by room ID
+	seasonalRates     map[int]Models.SeasonalRate
+	changeRequests    map[int]Models.ReservationChangeRequest
+	resetTokens       map[int]Models.PasswordResetToken
+	recoveryCodes     map[int]Models.RecoveryCode
+	twoFactorLevels   map[int]bool // keyed by access level
+	loginAttempts     map[int]Models.LoginAttempt
+	apiTokens         map[int]Models.APIToken
+	icalFeeds         map[int]Models.ICalFeed
+	webhooks          map[int]Models.Webhook
+	webhookDeliveries map[int]Models.WebhookDelivery
+	mailMessages      map[int]Models.MailMessage
+	notifications     map[int]Models.ReservationNotification
+
+	lastUserID            int
+	lastRoomID            int
+	lastReservationID     int
+	lastRoomRestrictionID int
+	lastRatePlanID        int
+	lastSeasonalRateID    int
+	lastChangeRequestID   int
+	lastResetTokenID      int
+	lastRecoveryCodeID    int
+	lastLoginAttemptID    int
+	lastAPITokenID        int
+	lastICalFeedID        int
+	lastWebhookID         int
+	lastWebhookDeliveryID int
+	lastMailMessageID     int
+	lastNotificationID    int
+}
+
+// clone returns a copy of the tables that WithTx restores on rollback
+func (t *memoryTables) clone() memoryTables {
+	c := *t
+	c.rooms = copyMap(t.rooms)
+	c.restrictions = copyMap(t.restrictions)
+	c.reservations = copyMap(t.reservations)
+	c.roomRestrictions = copyMap(t.roomRestrictions)
+	c.users = copyMap(t.users)
+	c.ratePlans = copyMap(t.ratePlans)
+	c.seasonalRates = copyMap(t.seasonalRates)
+	c.changeRequests = copyMap(t.changeRequests)
+	c.resetTokens = copyMap(t.resetTokens)
+	c.recoveryCodes = copyMap(t.recoveryCodes)
+	c.twoFactorLevels = copyMap(t.twoFactorLevels)
+	c.loginAttempts = copyMap(t.loginAttempts)
+	c.apiTokens = copyMap(t.apiTokens)
+	c.icalFeeds = copyMap(t.icalFeeds)
+	c.webhooks = copyMap(t.webhooks)
+	c.webhookDeliveries = copyMap(t.webhookDeliveries)
+	c.mailMessages = copyMap(t.mailMessages)
+	c.notifications = copyMap(t.notifications)
+
+	return c
+}
+
+func copyMap[V any](m map[int]V) map[int]V {
+	c := make(map[int]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
+
 func NewPostgresRepo(a *config.AppConfig, conn *sql.DB) repository.DatabaseRepo {
-	return &postgresDBRepo{
-		App: a,
-		DB:  conn,
+	return &sqlDBRepo{
+		App:     a,
+		DB:      conn,
+		dialect: postgresDialect{},
+	}
+}
+
+func NewSQLiteRepo(a *config.AppConfig, conn *sql.DB) repository.DatabaseRepo {
+	return &sqlDBRepo{
+		App:     a,
+		DB:      conn,
+		dialect: newSQLiteDialect(),
 	}
 }
 
@@ -28,3 +419,89 @@ func NewTestingRepo(a *config.AppConfig) repository.DatabaseRepo {
 		App: a,
 	}
 }
+
+// roomDescription is the description the seed migrations give both rooms
+const roomDescription = "Your home away from home, set on the majestic waters of the Atlantic Ocean, " +
+	"this will be a vacation to remember."
+
+// NewMemoryRepo returns an in-memory repository seeded with the same rows as the seed migrations
+func NewMemoryRepo(a *config.AppConfig) repository.DatabaseRepo {
+	seeded := time.Date(2023, 1, 18, 0, 0, 0, 0, time.UTC)
+	ratesSeeded := time.Date(2023, 2, 13, 0, 0, 0, 0, time.UTC)
+
+	return &memoryDBRepo{
+		App: a,
+		mu:  &sync.RWMutex{},
+		memoryTables: &memoryTables{
+			rooms: map[int]Models.Room{
+				1: {
+					ID:               1,
+					RoomName:         "General's Quarters",
+					Slug:             "generals-quarters",
+					Description:      roomDescription,
+					Capacity:         2,
+					BedConfiguration: "1 Queen",
+					Amenities:        "Ocean view, Wi-Fi, Coffee maker",
+					BasePrice:        8900,
+					Image:            "/static/images/generals-quarters.png",
+					Active:           true,
+					CreatedAt:        seeded,
+					UpdatedAt:        seeded,
+				},
+				2: {
+					ID:               2,
+					RoomName:         "Major's Suite",
+					Slug:             "majors-suite",
+					Description:      roomDescription,
+					Capacity:         4,
+					BedConfiguration: "1 King, 1 Sofa bed",
+					Amenities:        "Ocean view, Balcony, Wi-Fi, Bathtub",
+					BasePrice:        12900,
+					Image:            "/static/images/marjors-suite.png",
+					Active:           true,
+					CreatedAt:        seeded,
+					UpdatedAt:        seeded,
+				},
+			},
+			lastRoomID: 2,
+			restrictions: map[int]Models.Restriction{
+				1: {ID: 1, RestrictionName: "Reservation", CreatedAt: seeded, UpdatedAt: seeded},
+				2: {ID: 2, RestrictionName: "Owner Block", CreatedAt: seeded, UpdatedAt: seeded},
+				3: {ID: 3, RestrictionName: "External", CreatedAt: seeded, UpdatedAt: seeded},
+			},
+			ratePlans: map[int]Models.RatePlan{
+				1: {ID: 1, RoomID: 1, WeekendRate: 10900, CreatedAt: ratesSeeded, UpdatedAt: ratesSeeded},
+				2: {ID: 2, RoomID: 2, WeekendRate: 15900, CreatedAt: ratesSeeded, UpdatedAt: ratesSeeded},
+			},
+			seasonalRates:     map[int]Models.SeasonalRate{},
+			lastRatePlanID:    2,
+			reservations:      map[int]Models.Reservation{},
+			changeRequests:    map[int]Models.ReservationChangeRequest{},
+			resetTokens:       map[int]Models.PasswordResetToken{},
+			recoveryCodes:     map[int]Models.RecoveryCode{},
+			twoFactorLevels:   map[int]bool{},
+			loginAttempts:     map[int]Models.LoginAttempt{},
+			apiTokens:         map[int]Models.APIToken{},
+			icalFeeds:         map[int]Models.ICalFeed{},
+			webhooks:          map[int]Models.Webhook{},
+			webhookDeliveries: map[int]Models.WebhookDelivery{},
+			mailMessages:      map[int]Models.MailMessage{},
+			notifications:     map[int]Models.ReservationNotification{},
+			roomRestrictions:  map[int]Models.RoomRestriction{},
+			users: map[int]Models.User{
+				1: {
+					ID:          1,
+					FirstName:   "Erfei",
+					LastName:    "Yu",
+					Email:       "me@me.com",
+					Password:    "$2a$12$o9gGQbVFE3WpRuZLgmWpgeHSbHzPabZ4vRp3H4m0RYtwdFJMtdku.",
+					AccessLevel: 4,
+					Active:      true,
+					CreatedAt:   seeded,
+					UpdatedAt:   seeded,
+				},
+			},
+			lastUserID: 1,
+		},
+	}
+}
@@ -0,0 +1,63 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/config"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	ctx, cancel := queryTimeout(context.Background(), &config.AppConfig{DBTimeout: time.Minute})
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > time.Minute {
+		t.Error("query context should use the configured timeout")
+	}
+
+	ctx, cancel = queryTimeout(context.Background(), &config.AppConfig{})
+	defer cancel()
+
+	deadline, _ = ctx.Deadline()
+	if time.Until(deadline) > defaultDBTimeout {
+		t.Error("query context should fall back to the default timeout")
+	}
+
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel = queryTimeout(parent, &config.AppConfig{})
+	defer cancel()
+
+	cancelParent()
+	if ctx.Err() == nil {
+		t.Error("cancelling the request context should cancel the query context")
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	attachments := []Models.MailAttachment{
+		{Name: "reservation.ics", ContentType: "text/calendar; charset=utf-8", Data: []byte("BEGIN:VCALENDAR\r\n")},
+		{Name: "photo.jpg", ContentType: "image/jpeg", Data: []byte{0xff, 0xd8, 0x00}},
+	}
+
+	s, err := encodeAttachments(attachments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeAttachments(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, attachments) {
+		t.Errorf("expected %+v back, got %+v", attachments, got)
+	}
+
+	if s, _ := encodeAttachments(nil); s != "" {
+		t.Errorf("expected no attachments to be stored as the empty string, got %q", s)
+	}
+	if got, err := decodeAttachments(""); got != nil || err != nil {
+		t.Errorf("expected no attachments, got %+v and %v", got, err)
+	}
+}
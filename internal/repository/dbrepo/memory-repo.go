@@ -0,0 +1,1776 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// overlaps reports whether [start, end) intersects a stored [startDate, endDate) range,
+// using the same comparison as the postgres queries: start < end_date and end > start_date
+func overlaps(start, end, startDate, endDate time.Time) bool {
+	return start.Before(endDate) && end.After(startDate)
+}
+
+// WithTx runs fn against a repository bound to a transaction. The whole in-memory database is locked
+// while fn runs, and every change fn made is undone if it returns an error
+func (m *memoryDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := m.memoryTables.clone()
+	err := fn(&memoryDBRepo{
+		App:          m.App,
+		mu:           m.mu,
+		memoryTables: m.memoryTables,
+		inTx:         true,
+	})
+	if err != nil {
+		*m.memoryTables = snapshot
+		return err
+	}
+
+	return nil
+}
+
+// lock takes the write lock, unless m runs inside WithTx which already holds it
+func (m *memoryDBRepo) lock() func() {
+	if m.inTx {
+		return func() {}
+	}
+
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+// rlock takes the read lock, unless m runs inside WithTx which already holds the write lock
+func (m *memoryDBRepo) rlock() func() {
+	if m.inTx {
+		return func() {}
+	}
+
+	m.mu.RLock()
+	return m.mu.RUnlock
+}
+
+// InsertReservation inserts a reservation into memory
+func (m *memoryDBRepo) InsertReservation(ctx context.Context, res Models.Reservation) (int, error) {
+	defer m.lock()()
+
+	return m.insertReservation(res), nil
+}
+
+// InsertRoomRestriction inserts a room restriction into memory
+func (m *memoryDBRepo) InsertRoomRestriction(ctx context.Context, r Models.RoomRestriction) error {
+	defer m.lock()()
+
+	return m.insertRoomRestriction(r)
+}
+
+// CreateReservation inserts a reservation, its room restriction and the mail about it atomically, after checking
+// the room is still available. It returns repository.ErrRoomUnavailable if the dates are taken
+func (m *memoryDBRepo) CreateReservation(ctx context.Context, res Models.Reservation, mail ...Models.MailData) (int, error) {
+	var newID int
+
+	err := m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		available, err := repo.SearchAvailabilityByDateByRoomID(ctx, res.StartDate, res.EndDate, res.RoomID)
+		if err != nil {
+			return err
+		}
+		if !available {
+			return repository.ErrRoomUnavailable
+		}
+
+		newID, err = repo.InsertReservation(ctx, res)
+		if err != nil {
+			return err
+		}
+
+		err = repo.InsertRoomRestriction(ctx, Models.RoomRestriction{
+			StartDate:     res.StartDate,
+			EndDate:       res.EndDate,
+			RoomID:        res.RoomID,
+			ReservationID: newID,
+			RestrictionID: 1,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range mail {
+			if err := repo.QueueMail(ctx, msg); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// SearchAvailabilityByDate returns true if availability exists for roomID and false if no availability
+func (m *memoryDBRepo) SearchAvailabilityByDateByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
+	defer m.rlock()()
+
+	return m.isAvailable(roomID, start, end), nil
+}
+
+// SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
+func (m *memoryDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]Models.Room, error) {
+	defer m.rlock()()
+
+	booked := make(map[int]bool)
+	for _, r := range m.roomRestrictions {
+		if overlaps(start, end, r.StartDate, r.EndDate) {
+			booked[r.RoomID] = true
+		}
+	}
+
+	var rooms []Models.Room
+	for _, room := range m.sortedRooms() {
+		if room.Active && !booked[room.ID] {
+			rooms = append(rooms, room)
+		}
+	}
+
+	return rooms, nil
+}
+
+// GetRoomByID gets a room by given id
+func (m *memoryDBRepo) GetRoomByID(ctx context.Context, id int) (Models.Room, error) {
+	defer m.rlock()()
+
+	room, ok := m.rooms[id]
+	if !ok {
+		return Models.Room{}, sql.ErrNoRows
+	}
+
+	return room, nil
+}
+
+// AllUsers returns a slice of all users, active or not
+func (m *memoryDBRepo) AllUsers(ctx context.Context) ([]Models.User, error) {
+	defer m.rlock()()
+
+	var users []Models.User
+	for _, u := range m.users {
+		users = append(users, u)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastName != users[j].LastName {
+			return users[i].LastName < users[j].LastName
+		}
+		return users[i].FirstName < users[j].FirstName
+	})
+
+	return users, nil
+}
+
+// GetUserByID returns the user by given ID
+func (m *memoryDBRepo) GetUserByID(ctx context.Context, id int) (Models.User, error) {
+	defer m.rlock()()
+
+	u, ok := m.users[id]
+	if !ok {
+		return Models.User{}, sql.ErrNoRows
+	}
+
+	return u, nil
+}
+
+// GetUserByEmail returns the user with the given email, ignoring case
+func (m *memoryDBRepo) GetUserByEmail(ctx context.Context, email string) (Models.User, error) {
+	defer m.rlock()()
+
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+
+	return Models.User{}, sql.ErrNoRows
+}
+
+// InsertUser inserts an active user with the plain text password u.Password and returns its ID
+func (m *memoryDBRepo) InsertUser(ctx context.Context, u Models.User) (int, error) {
+	hash, err := hashPassword(u.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	defer m.lock()()
+
+	if m.emailTaken(u.Email, 0) {
+		return 0, errors.New("user email already exists")
+	}
+
+	m.lastUserID++
+	u.ID = m.lastUserID
+	u.Password = hash
+	u.Active = true
+	u.CreatedAt = time.Now()
+	u.UpdatedAt = time.Now()
+	m.users[u.ID] = u
+
+	return u.ID, nil
+}
+
+// UpdateUser updates the name, email and access level of a user in memory
+func (m *memoryDBRepo) UpdateUser(ctx context.Context, u Models.User) error {
+	defer m.lock()()
+
+	stored, ok := m.users[u.ID]
+	if !ok {
+		return nil
+	}
+	if m.emailTaken(u.Email, u.ID) {
+		return errors.New("user email already exists")
+	}
+
+	stored.FirstName = u.FirstName
+	stored.LastName = u.LastName
+	stored.Email = u.Email
+	stored.AccessLevel = u.AccessLevel
+	stored.UpdatedAt = time.Now()
+	m.users[u.ID] = stored
+
+	return nil
+}
+
+// UpdatePassword replaces the password of a user with the bcrypt hash of password
+func (m *memoryDBRepo) UpdatePassword(ctx context.Context, id int, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	defer m.lock()()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil
+	}
+
+	u.Password = hash
+	u.UpdatedAt = time.Now()
+	m.users[id] = u
+
+	return nil
+}
+
+// DeactivateUser stops a user from logging in and revokes the API tokens they created. The user is kept, so
+// it can still be seen in the admin area
+func (m *memoryDBRepo) DeactivateUser(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil
+	}
+
+	u.Active = false
+	u.UpdatedAt = time.Now()
+	m.users[id] = u
+
+	for tokenID, t := range m.apiTokens {
+		if t.UserID == id && !t.Revoked() {
+			t.RevokedAt = time.Now()
+			t.UpdatedAt = time.Now()
+			m.apiTokens[tokenID] = t
+		}
+	}
+
+	return nil
+}
+
+// InsertPasswordResetToken stores the hash of a password reset token
+func (m *memoryDBRepo) InsertPasswordResetToken(ctx context.Context, t Models.PasswordResetToken) error {
+	defer m.lock()()
+
+	if _, ok := m.users[t.UserID]; !ok {
+		return errors.New("user does not exist")
+	}
+
+	m.lastResetTokenID++
+	t.ID = m.lastResetTokenID
+	t.Used = false
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = time.Now()
+	m.resetTokens[t.ID] = t
+
+	return nil
+}
+
+// GetPasswordResetToken returns the password reset token with the given hash
+func (m *memoryDBRepo) GetPasswordResetToken(ctx context.Context, tokenHash string) (Models.PasswordResetToken, error) {
+	defer m.rlock()()
+
+	for _, t := range m.resetTokens {
+		if t.TokenHash == tokenHash {
+			return t, nil
+		}
+	}
+
+	return Models.PasswordResetToken{}, sql.ErrNoRows
+}
+
+// ResetPassword uses up the password reset token with the given hash and sets the password of its user.
+// Every other token of the user is used up too. It returns repository.ErrInvalidResetToken if the token
+// is unknown, expired or was already used
+func (m *memoryDBRepo) ResetPassword(ctx context.Context, tokenHash, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	defer m.lock()()
+
+	userID := 0
+	for _, t := range m.resetTokens {
+		if t.TokenHash == tokenHash && !t.Used && t.ExpiresAt.After(time.Now()) {
+			userID = t.UserID
+		}
+	}
+	u, ok := m.users[userID]
+	if !ok {
+		return repository.ErrInvalidResetToken
+	}
+
+	for id, t := range m.resetTokens {
+		if t.UserID == userID && !t.Used {
+			t.Used = true
+			t.UpdatedAt = time.Now()
+			m.resetTokens[id] = t
+		}
+	}
+
+	u.Password = hash
+	u.UpdatedAt = time.Now()
+	m.users[userID] = u
+
+	return nil
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user with the given TOTP secret,
+// replacing any recovery codes the user had with the given ones
+func (m *memoryDBRepo) EnableTwoFactor(ctx context.Context, userID int, secret string, recoveryCodeHashes []string) error {
+	defer m.lock()()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return nil
+	}
+
+	u.TOTPSecret = secret
+	u.TOTPEnabled = true
+	u.TOTPLastStep = 0
+	u.UpdatedAt = time.Now()
+	m.users[userID] = u
+	m.replaceRecoveryCodes(userID, recoveryCodeHashes)
+
+	return nil
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user and deletes the user's recovery codes
+func (m *memoryDBRepo) DisableTwoFactor(ctx context.Context, userID int) error {
+	defer m.lock()()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return nil
+	}
+
+	u.TOTPSecret = ""
+	u.TOTPEnabled = false
+	u.TOTPLastStep = 0
+	u.UpdatedAt = time.Now()
+	m.users[userID] = u
+	m.replaceRecoveryCodes(userID, nil)
+
+	return nil
+}
+
+// UseTOTPStep records that the code of a time step was used by a user. It returns false if a code
+// of the same or a later step was already used, in which case the code must be rejected
+func (m *memoryDBRepo) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	defer m.lock()()
+
+	u, ok := m.users[userID]
+	if !ok || u.TOTPLastStep >= step {
+		return false, nil
+	}
+
+	u.TOTPLastStep = step
+	m.users[userID] = u
+
+	return true, nil
+}
+
+// ReplaceRecoveryCodes deletes the recovery codes of a user and stores the given hashes instead
+func (m *memoryDBRepo) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	defer m.lock()()
+
+	m.replaceRecoveryCodes(userID, codeHashes)
+
+	return nil
+}
+
+// UseRecoveryCode uses up the unused recovery code of a user with the given hash, reporting whether there was one
+func (m *memoryDBRepo) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	defer m.lock()()
+
+	for id, c := range m.recoveryCodes {
+		if c.UserID == userID && c.CodeHash == codeHash && !c.Used {
+			c.Used = true
+			c.UpdatedAt = time.Now()
+			m.recoveryCodes[id] = c
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of a user
+func (m *memoryDBRepo) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	defer m.rlock()()
+
+	n := 0
+	for _, c := range m.recoveryCodes {
+		if c.UserID == userID && !c.Used {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// GetTwoFactorLevels returns the access levels whose users must use two-factor authentication
+func (m *memoryDBRepo) GetTwoFactorLevels(ctx context.Context) ([]int, error) {
+	defer m.rlock()()
+
+	var levels []int
+	for level := range m.twoFactorLevels {
+		levels = append(levels, level)
+	}
+	sort.Ints(levels)
+
+	return levels, nil
+}
+
+// UpdateTwoFactorLevels sets the access levels whose users must use two-factor authentication
+func (m *memoryDBRepo) UpdateTwoFactorLevels(ctx context.Context, levels []int) error {
+	defer m.lock()()
+
+	m.twoFactorLevels = make(map[int]bool)
+	for _, level := range levels {
+		m.twoFactorLevels[level] = true
+	}
+
+	return nil
+}
+
+// InsertLoginAttempt records a failed login
+func (m *memoryDBRepo) InsertLoginAttempt(ctx context.Context, a Models.LoginAttempt) error {
+	defer m.lock()()
+
+	m.lastLoginAttemptID++
+	a.ID = m.lastLoginAttemptID
+	a.CreatedAt = time.Now()
+	a.UpdatedAt = time.Now()
+	m.loginAttempts[a.ID] = a
+
+	return nil
+}
+
+// GetLoginAttempts returns the failed logins for email or from ip since the given time, oldest first
+func (m *memoryDBRepo) GetLoginAttempts(ctx context.Context, email, ip string, since time.Time) ([]Models.LoginAttempt, error) {
+	defer m.rlock()()
+
+	var attempts []Models.LoginAttempt
+	for _, a := range m.loginAttempts {
+		if (a.Email == email || a.IPAddress == ip) && a.CreatedAt.After(since) {
+			attempts = append(attempts, a)
+		}
+	}
+
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i].ID < attempts[j].ID
+	})
+
+	return attempts, nil
+}
+
+// ClearLoginAttempts forgets the failed logins for email
+func (m *memoryDBRepo) ClearLoginAttempts(ctx context.Context, email string) error {
+	defer m.lock()()
+
+	m.clearLoginAttempts(email)
+
+	return nil
+}
+
+// LockUser stops a user from logging in until the given time
+func (m *memoryDBRepo) LockUser(ctx context.Context, id int, until time.Time) error {
+	defer m.lock()()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil
+	}
+
+	u.LockedUntil = until
+	u.UpdatedAt = time.Now()
+	m.users[id] = u
+
+	return nil
+}
+
+// UnlockUser lifts the lock of a user and forgets the failed logins that led to it
+func (m *memoryDBRepo) UnlockUser(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil
+	}
+
+	u.LockedUntil = time.Time{}
+	u.UpdatedAt = time.Now()
+	m.users[id] = u
+	m.clearLoginAttempts(strings.ToLower(u.Email))
+
+	return nil
+}
+
+// Authenticate authenticates a user
+func (m *memoryDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	defer m.rlock()()
+
+	for _, u := range m.users {
+		// deactivated users are treated as if they didn't exist
+		if !strings.EqualFold(u.Email, email) || !u.Active {
+			continue
+		}
+
+		err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(testPassword))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return 0, "", errors.New("incorrect password")
+		} else if err != nil {
+			return 0, "", err
+		}
+
+		return u.ID, u.Password, nil
+	}
+
+	return 0, "", sql.ErrNoRows
+}
+
+// AllAPITokens returns every API token, newest first
+func (m *memoryDBRepo) AllAPITokens(ctx context.Context) ([]Models.APIToken, error) {
+	defer m.rlock()()
+
+	var tokens []Models.APIToken
+	for _, t := range m.apiTokens {
+		tokens = append(tokens, m.withUser(t))
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID > tokens[j].ID
+	})
+
+	return tokens, nil
+}
+
+// InsertAPIToken inserts an API token, t.TokenHash must already be hashed
+func (m *memoryDBRepo) InsertAPIToken(ctx context.Context, t Models.APIToken) (int, error) {
+	defer m.lock()()
+
+	if _, ok := m.users[t.UserID]; !ok {
+		return 0, errors.New("user does not exist")
+	}
+	for _, other := range m.apiTokens {
+		if other.TokenHash == t.TokenHash {
+			return 0, errors.New("token hash already exists")
+		}
+	}
+
+	m.lastAPITokenID++
+	t.ID = m.lastAPITokenID
+	t.LastUsedAt = time.Time{}
+	t.RevokedAt = time.Time{}
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = time.Now()
+	m.apiTokens[t.ID] = t
+
+	return t.ID, nil
+}
+
+// GetAPITokenByHash returns the API token with the given hash, revoked or not
+func (m *memoryDBRepo) GetAPITokenByHash(ctx context.Context, tokenHash string) (Models.APIToken, error) {
+	defer m.rlock()()
+
+	for _, t := range m.apiTokens {
+		if t.TokenHash == tokenHash {
+			return m.withUser(t), nil
+		}
+	}
+
+	return Models.APIToken{}, sql.ErrNoRows
+}
+
+// TouchAPIToken records when an API token was last used
+func (m *memoryDBRepo) TouchAPIToken(ctx context.Context, id int, usedAt time.Time) error {
+	defer m.lock()()
+
+	t, ok := m.apiTokens[id]
+	if !ok {
+		return nil
+	}
+
+	t.LastUsedAt = usedAt
+	m.apiTokens[id] = t
+
+	return nil
+}
+
+// RevokeAPIToken stops an API token from working, for good
+func (m *memoryDBRepo) RevokeAPIToken(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	t, ok := m.apiTokens[id]
+	if !ok || t.Revoked() {
+		return nil
+	}
+
+	t.RevokedAt = time.Now()
+	t.UpdatedAt = time.Now()
+	m.apiTokens[id] = t
+
+	return nil
+}
+
+// AllReservations returns a slice of all reservations
+func (m *memoryDBRepo) AllReservations(ctx context.Context) ([]Models.Reservation, error) {
+	defer m.rlock()()
+
+	return m.reservationsWhere(func(res Models.Reservation) bool {
+		return true
+	}), nil
+}
+
+// AllNewReservations returns the reservations that are neither processed nor cancelled
+func (m *memoryDBRepo) AllNewReservations(ctx context.Context) ([]Models.Reservation, error) {
+	defer m.rlock()()
+
+	return m.reservationsWhere(func(res Models.Reservation) bool {
+		return res.Processed == 0 && res.Cancelled == 0
+	}), nil
+}
+
+// GetReservationByID returns reservation by given ID
+func (m *memoryDBRepo) GetReservationByID(ctx context.Context, id int) (Models.Reservation, error) {
+	defer m.rlock()()
+
+	res, ok := m.reservations[id]
+	if !ok {
+		return Models.Reservation{}, sql.ErrNoRows
+	}
+
+	return m.withRoom(res), nil
+}
+
+// UpdateReservation updates a reservation in memory
+func (m *memoryDBRepo) UpdateReservation(ctx context.Context, res Models.Reservation) error {
+	defer m.lock()()
+
+	stored, ok := m.reservations[res.ID]
+	if !ok {
+		return nil
+	}
+
+	stored.FirstName = res.FirstName
+	stored.LastName = res.LastName
+	stored.Email = res.Email
+	stored.Phone = res.Phone
+	stored.UpdatedAt = time.Now()
+	m.reservations[res.ID] = stored
+
+	return nil
+}
+
+// DeleteReservation deletes a reservation by given ID, and its room restrictions with it
+func (m *memoryDBRepo) DeleteReservation(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	delete(m.reservations, id)
+	for rrID, r := range m.roomRestrictions {
+		if r.ReservationID == id {
+			delete(m.roomRestrictions, rrID)
+		}
+	}
+	for crID, cr := range m.changeRequests {
+		if cr.ReservationID == id {
+			delete(m.changeRequests, crID)
+		}
+	}
+	for nID, n := range m.notifications {
+		if n.ReservationID == id {
+			delete(m.notifications, nID)
+		}
+	}
+
+	return nil
+}
+
+// GetReservationByCode returns the reservation with the confirmation code, if it was made with email
+func (m *memoryDBRepo) GetReservationByCode(ctx context.Context, code, email string) (Models.Reservation, error) {
+	defer m.rlock()()
+
+	for _, res := range m.reservations {
+		if res.ConfirmationCode == code && strings.EqualFold(res.Email, email) {
+			return m.withRoom(res), nil
+		}
+	}
+
+	return Models.Reservation{}, sql.ErrNoRows
+}
+
+// CancelReservation marks a reservation as cancelled and frees its room restrictions
+func (m *memoryDBRepo) CancelReservation(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	res, ok := m.reservations[id]
+	if !ok {
+		return nil
+	}
+
+	res.Cancelled = 1
+	res.UpdatedAt = time.Now()
+	m.reservations[id] = res
+	for rrID, r := range m.roomRestrictions {
+		if r.ReservationID == id {
+			delete(m.roomRestrictions, rrID)
+		}
+	}
+
+	return nil
+}
+
+// InsertChangeRequest inserts a request for new dates of a reservation
+func (m *memoryDBRepo) InsertChangeRequest(ctx context.Context, cr Models.ReservationChangeRequest) error {
+	defer m.lock()()
+
+	if _, ok := m.reservations[cr.ReservationID]; !ok {
+		return errors.New("reservation does not exist")
+	}
+
+	m.lastChangeRequestID++
+	cr.ID = m.lastChangeRequestID
+	cr.CreatedAt = time.Now()
+	cr.UpdatedAt = time.Now()
+	m.changeRequests[cr.ID] = cr
+
+	return nil
+}
+
+// GetChangeRequestsForReservation returns the change requests of a reservation, oldest first
+func (m *memoryDBRepo) GetChangeRequestsForReservation(ctx context.Context, reservationID int) ([]Models.ReservationChangeRequest, error) {
+	defer m.rlock()()
+
+	var requests []Models.ReservationChangeRequest
+	for _, cr := range m.changeRequests {
+		if cr.ReservationID == reservationID {
+			requests = append(requests, cr)
+		}
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].ID < requests[j].ID
+	})
+
+	return requests, nil
+}
+
+// UpdateProcessedForReservation updates processed for a reservation by ID
+func (m *memoryDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int) error {
+	defer m.lock()()
+
+	res, ok := m.reservations[id]
+	if !ok {
+		return nil
+	}
+
+	res.Processed = processed
+	m.reservations[id] = res
+
+	return nil
+}
+
+// AllRooms returns a slice of all rooms
+func (m *memoryDBRepo) AllRooms(ctx context.Context) ([]Models.Room, error) {
+	defer m.rlock()()
+
+	return m.sortedRooms(), nil
+}
+
+// GetRoomBySlug gets a room by its slug
+func (m *memoryDBRepo) GetRoomBySlug(ctx context.Context, slug string) (Models.Room, error) {
+	defer m.rlock()()
+
+	for _, room := range m.rooms {
+		if room.Slug == slug {
+			return room, nil
+		}
+	}
+
+	return Models.Room{}, sql.ErrNoRows
+}
+
+// GetRoomByICalToken gets the room whose calendar feed has the secret token
+func (m *memoryDBRepo) GetRoomByICalToken(ctx context.Context, token string) (Models.Room, error) {
+	defer m.rlock()()
+
+	for _, room := range m.rooms {
+		if token != "" && room.ICalToken == token {
+			return room, nil
+		}
+	}
+
+	return Models.Room{}, sql.ErrNoRows
+}
+
+// SetRoomICalToken sets the secret token of a room's calendar feed
+func (m *memoryDBRepo) SetRoomICalToken(ctx context.Context, id int, token string) error {
+	defer m.lock()()
+
+	room, ok := m.rooms[id]
+	if !ok {
+		return nil
+	}
+	room.ICalToken = token
+	room.UpdatedAt = time.Now()
+	m.rooms[id] = room
+
+	return nil
+}
+
+// InsertRoom inserts a room and returns its ID
+func (m *memoryDBRepo) InsertRoom(ctx context.Context, room Models.Room) (int, error) {
+	defer m.lock()()
+
+	if m.slugTaken(room.Slug, 0) {
+		return 0, errors.New("room slug already exists")
+	}
+
+	m.lastRoomID++
+	room.ID = m.lastRoomID
+	room.CreatedAt = time.Now()
+	room.UpdatedAt = time.Now()
+	m.rooms[room.ID] = room
+
+	return room.ID, nil
+}
+
+// UpdateRoom updates a room
+func (m *memoryDBRepo) UpdateRoom(ctx context.Context, room Models.Room) error {
+	defer m.lock()()
+
+	old, ok := m.rooms[room.ID]
+	if !ok {
+		return nil
+	}
+	if m.slugTaken(room.Slug, room.ID) {
+		return errors.New("room slug already exists")
+	}
+
+	room.ICalToken = old.ICalToken
+	room.CreatedAt = old.CreatedAt
+	room.UpdatedAt = time.Now()
+	m.rooms[room.ID] = room
+
+	return nil
+}
+
+// DeleteRoom deletes a room and its blocks by given ID. It returns repository.ErrRoomInUse
+// if the room has reservations
+func (m *memoryDBRepo) DeleteRoom(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	if _, ok := m.rooms[id]; !ok {
+		return sql.ErrNoRows
+	}
+	for _, res := range m.reservations {
+		if res.RoomID == id {
+			return repository.ErrRoomInUse
+		}
+	}
+
+	delete(m.rooms, id)
+	delete(m.ratePlans, id)
+	for rrID, r := range m.roomRestrictions {
+		if r.RoomID == id {
+			delete(m.roomRestrictions, rrID)
+		}
+	}
+	for sID, s := range m.seasonalRates {
+		if s.RoomID == id {
+			delete(m.seasonalRates, sID)
+		}
+	}
+	for fID, f := range m.icalFeeds {
+		if f.RoomID == id {
+			delete(m.icalFeeds, fID)
+		}
+	}
+
+	return nil
+}
+
+// GetRestrictionsForRoomByDate returns restrictions for a room by date range
+func (m *memoryDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]Models.RoomRestriction, error) {
+	defer m.rlock()()
+
+	var roomRestrictions []Models.RoomRestriction
+	for _, r := range m.roomRestrictions {
+		if r.RoomID == roomID && overlaps(start, end, r.StartDate, r.EndDate) {
+			roomRestrictions = append(roomRestrictions, Models.RoomRestriction{
+				ID:            r.ID,
+				ReservationID: r.ReservationID,
+				RestrictionID: r.RestrictionID,
+				RoomID:        r.RoomID,
+				StartDate:     r.StartDate,
+				EndDate:       r.EndDate,
+				ICalFeedID:    r.ICalFeedID,
+				ExternalUID:   r.ExternalUID,
+				CreatedAt:     r.CreatedAt,
+				UpdatedAt:     r.UpdatedAt,
+			})
+		}
+	}
+
+	sort.Slice(roomRestrictions, func(i, j int) bool {
+		return roomRestrictions[i].ID < roomRestrictions[j].ID
+	})
+
+	return roomRestrictions, nil
+}
+
+// InsertBlockForRoom inserts a room restriction
+func (m *memoryDBRepo) InsertBlockForRoom(ctx context.Context, id int, startDate time.Time) error {
+	return m.InsertRoomRestriction(ctx, Models.RoomRestriction{
+		StartDate:     startDate,
+		EndDate:       startDate.AddDate(0, 0, 1),
+		RoomID:        id,
+		RestrictionID: 2,
+	})
+}
+
+// DeleteBlockForRoom deletes a room restriction
+func (m *memoryDBRepo) DeleteBlockForRoom(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	delete(m.roomRestrictions, id)
+
+	return nil
+}
+
+// AllICalFeeds returns every external calendar, ordered by room
+func (m *memoryDBRepo) AllICalFeeds(ctx context.Context) ([]Models.ICalFeed, error) {
+	defer m.rlock()()
+
+	var feeds []Models.ICalFeed
+	for _, f := range m.icalFeeds {
+		feeds = append(feeds, m.withFeedRoom(f))
+	}
+
+	sort.Slice(feeds, func(i, j int) bool {
+		if feeds[i].Room.RoomName != feeds[j].Room.RoomName {
+			return feeds[i].Room.RoomName < feeds[j].Room.RoomName
+		}
+		return feeds[i].ID < feeds[j].ID
+	})
+
+	return feeds, nil
+}
+
+// GetICalFeedsForRoom returns the external calendars of a room
+func (m *memoryDBRepo) GetICalFeedsForRoom(ctx context.Context, roomID int) ([]Models.ICalFeed, error) {
+	defer m.rlock()()
+
+	var feeds []Models.ICalFeed
+	for _, f := range m.icalFeeds {
+		if f.RoomID == roomID {
+			feeds = append(feeds, m.withFeedRoom(f))
+		}
+	}
+
+	sort.Slice(feeds, func(i, j int) bool {
+		return feeds[i].ID < feeds[j].ID
+	})
+
+	return feeds, nil
+}
+
+// GetICalFeedByID returns an external calendar by id
+func (m *memoryDBRepo) GetICalFeedByID(ctx context.Context, id int) (Models.ICalFeed, error) {
+	defer m.rlock()()
+
+	f, ok := m.icalFeeds[id]
+	if !ok {
+		return Models.ICalFeed{}, sql.ErrNoRows
+	}
+
+	return m.withFeedRoom(f), nil
+}
+
+// InsertICalFeed inserts an external calendar and returns its ID
+func (m *memoryDBRepo) InsertICalFeed(ctx context.Context, f Models.ICalFeed) (int, error) {
+	defer m.lock()()
+
+	if _, ok := m.rooms[f.RoomID]; !ok {
+		return 0, errors.New("room does not exist")
+	}
+
+	m.lastICalFeedID++
+	f.ID = m.lastICalFeedID
+	f.Room = Models.Room{}
+	f.CreatedAt = time.Now()
+	f.UpdatedAt = time.Now()
+	m.icalFeeds[f.ID] = f
+
+	return f.ID, nil
+}
+
+// UpdateICalFeedContent replaces the file of an uploaded external calendar
+func (m *memoryDBRepo) UpdateICalFeedContent(ctx context.Context, id int, content string) error {
+	defer m.lock()()
+
+	f, ok := m.icalFeeds[id]
+	if !ok {
+		return nil
+	}
+	f.Content = content
+	f.UpdatedAt = time.Now()
+	m.icalFeeds[id] = f
+
+	return nil
+}
+
+// UpdateICalFeedStatus records the outcome of the last sync of an external calendar
+func (m *memoryDBRepo) UpdateICalFeedStatus(ctx context.Context, f Models.ICalFeed) error {
+	defer m.lock()()
+
+	old, ok := m.icalFeeds[f.ID]
+	if !ok {
+		return nil
+	}
+	old.LastSyncedAt = f.LastSyncedAt
+	old.LastError = f.LastError
+	old.Blocks = f.Blocks
+	old.Skipped = f.Skipped
+	old.Recurring = f.Recurring
+	m.icalFeeds[f.ID] = old
+
+	return nil
+}
+
+// DeleteICalFeed deletes an external calendar and its blocks
+func (m *memoryDBRepo) DeleteICalFeed(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	delete(m.icalFeeds, id)
+	for rrID, r := range m.roomRestrictions {
+		if r.ICalFeedID == id {
+			delete(m.roomRestrictions, rrID)
+		}
+	}
+
+	return nil
+}
+
+// SyncExternalBlocks makes the External restrictions of an external calendar match blocks, keyed by their
+// ExternalUID. A new or moved block whose nights are already taken is skipped, and the number of skipped
+// blocks is returned
+func (m *memoryDBRepo) SyncExternalBlocks(ctx context.Context, f Models.ICalFeed, blocks []Models.RoomRestriction) (int, error) {
+	var skipped int
+
+	err := m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*memoryDBRepo)
+
+		wanted := make(map[string]Models.RoomRestriction)
+		for _, b := range blocks {
+			wanted[b.ExternalUID] = b
+		}
+
+		// remove what is gone or moved first, so moved blocks don't collide with their old nights
+		existing := make(map[string]Models.RoomRestriction)
+		for id, r := range tx.roomRestrictions {
+			if r.ICalFeedID != f.ID {
+				continue
+			}
+			if b, ok := wanted[r.ExternalUID]; ok && sameNights(b, r) {
+				existing[r.ExternalUID] = r
+				continue
+			}
+			delete(tx.roomRestrictions, id)
+		}
+
+		for _, b := range blocks {
+			if _, ok := existing[b.ExternalUID]; ok {
+				continue
+			}
+			if !tx.isAvailable(f.RoomID, b.StartDate, b.EndDate) {
+				skipped++
+				continue
+			}
+
+			err := tx.insertRoomRestriction(Models.RoomRestriction{
+				StartDate:     b.StartDate,
+				EndDate:       b.EndDate,
+				RoomID:        f.RoomID,
+				RestrictionID: Models.RestrictionExternal,
+				ICalFeedID:    f.ID,
+				ExternalUID:   b.ExternalUID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return skipped, nil
+}
+
+// AllWebhooks returns every webhook, ordered by name
+func (m *memoryDBRepo) AllWebhooks(ctx context.Context) ([]Models.Webhook, error) {
+	defer m.rlock()()
+
+	var webhooks []Models.Webhook
+	for _, w := range m.webhooks {
+		webhooks = append(webhooks, w)
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool {
+		if webhooks[i].Name != webhooks[j].Name {
+			return webhooks[i].Name < webhooks[j].Name
+		}
+		return webhooks[i].ID < webhooks[j].ID
+	})
+
+	return webhooks, nil
+}
+
+// GetWebhookByID returns a webhook by id
+func (m *memoryDBRepo) GetWebhookByID(ctx context.Context, id int) (Models.Webhook, error) {
+	defer m.rlock()()
+
+	w, ok := m.webhooks[id]
+	if !ok {
+		return Models.Webhook{}, sql.ErrNoRows
+	}
+
+	return w, nil
+}
+
+// InsertWebhook inserts a webhook and returns its ID
+func (m *memoryDBRepo) InsertWebhook(ctx context.Context, w Models.Webhook) (int, error) {
+	defer m.lock()()
+
+	m.lastWebhookID++
+	w.ID = m.lastWebhookID
+	w.CreatedAt = time.Now()
+	w.UpdatedAt = time.Now()
+	m.webhooks[w.ID] = w
+
+	return w.ID, nil
+}
+
+// UpdateWebhook updates a webhook
+func (m *memoryDBRepo) UpdateWebhook(ctx context.Context, w Models.Webhook) error {
+	defer m.lock()()
+
+	old, ok := m.webhooks[w.ID]
+	if !ok {
+		return nil
+	}
+	w.CreatedAt = old.CreatedAt
+	w.UpdatedAt = time.Now()
+	m.webhooks[w.ID] = w
+
+	return nil
+}
+
+// DeleteWebhook deletes a webhook and its deliveries
+func (m *memoryDBRepo) DeleteWebhook(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	delete(m.webhooks, id)
+	for dID, d := range m.webhookDeliveries {
+		if d.WebhookID == id {
+			delete(m.webhookDeliveries, dID)
+		}
+	}
+
+	return nil
+}
+
+// QueueWebhookEvent queues a delivery of payload to every active webhook subscribed to event, due right away
+func (m *memoryDBRepo) QueueWebhookEvent(ctx context.Context, event Models.WebhookEvent, payload string) error {
+	defer m.lock()()
+
+	for _, w := range m.webhooks {
+		if !w.Active || !w.Subscribed(event) {
+			continue
+		}
+
+		m.lastWebhookDeliveryID++
+		m.webhookDeliveries[m.lastWebhookDeliveryID] = Models.WebhookDelivery{
+			ID:            m.lastWebhookDeliveryID,
+			WebhookID:     w.ID,
+			Event:         string(event),
+			Payload:       payload,
+			NextAttemptAt: time.Now(),
+			CreatedAt:     time.Now(),
+			UpdatedAt:     time.Now(),
+		}
+	}
+
+	return nil
+}
+
+// GetDueWebhookDeliveries returns up to limit deliveries to active webhooks whose next attempt is due at now,
+// the longest due first
+func (m *memoryDBRepo) GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]Models.WebhookDelivery, error) {
+	defer m.rlock()()
+
+	var deliveries []Models.WebhookDelivery
+	for _, d := range m.webhookDeliveries {
+		if d.NextAttemptAt.IsZero() || d.NextAttemptAt.After(now) || !m.webhooks[d.WebhookID].Active {
+			continue
+		}
+		deliveries = append(deliveries, m.withWebhook(d))
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].NextAttemptAt.Equal(deliveries[j].NextAttemptAt) {
+			return deliveries[i].NextAttemptAt.Before(deliveries[j].NextAttemptAt)
+		}
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+// GetWebhookDeliveries returns the last limit deliveries of a webhook, newest first
+func (m *memoryDBRepo) GetWebhookDeliveries(ctx context.Context, webhookID, limit int) ([]Models.WebhookDelivery, error) {
+	defer m.rlock()()
+
+	var deliveries []Models.WebhookDelivery
+	for _, d := range m.webhookDeliveries {
+		if d.WebhookID == webhookID {
+			deliveries = append(deliveries, m.withWebhook(d))
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID > deliveries[j].ID
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+// UpdateWebhookDelivery records an attempt of a webhook delivery
+func (m *memoryDBRepo) UpdateWebhookDelivery(ctx context.Context, d Models.WebhookDelivery) error {
+	defer m.lock()()
+
+	old, ok := m.webhookDeliveries[d.ID]
+	if !ok {
+		return nil
+	}
+	old.Attempts = d.Attempts
+	old.NextAttemptAt = d.NextAttemptAt
+	old.LastAttemptAt = d.LastAttemptAt
+	old.ResponseStatus = d.ResponseStatus
+	old.LastError = d.LastError
+	old.DeliveredAt = d.DeliveredAt
+	old.UpdatedAt = time.Now()
+	m.webhookDeliveries[d.ID] = old
+
+	return nil
+}
+
+// RetryWebhookDelivery makes a delivery of a webhook that wasn't delivered due right away, once more
+func (m *memoryDBRepo) RetryWebhookDelivery(ctx context.Context, webhookID, id int) error {
+	defer m.lock()()
+
+	d, ok := m.webhookDeliveries[id]
+	if !ok || d.WebhookID != webhookID || d.Delivered() {
+		return nil
+	}
+	d.NextAttemptAt = time.Now()
+	d.UpdatedAt = time.Now()
+	m.webhookDeliveries[id] = d
+
+	return nil
+}
+
+// QueueMail adds msg to the outbox, due right away
+func (m *memoryDBRepo) QueueMail(ctx context.Context, msg Models.MailData) error {
+	defer m.lock()()
+
+	m.lastMailMessageID++
+	m.mailMessages[m.lastMailMessageID] = Models.MailMessage{
+		ID:            m.lastMailMessageID,
+		To:            msg.To,
+		From:          msg.From,
+		Subject:       msg.Subject,
+		Content:       msg.Content,
+		PlainContent:  msg.PlainContent,
+		Attachments:   msg.Attachments,
+		Status:        Models.MailPending,
+		NextAttemptAt: time.Now(),
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+
+	return nil
+}
+
+// GetDueMail returns up to limit pending messages whose next attempt is due at now, the longest due first
+func (m *memoryDBRepo) GetDueMail(ctx context.Context, now time.Time, limit int) ([]Models.MailMessage, error) {
+	defer m.rlock()()
+
+	var messages []Models.MailMessage
+	for _, msg := range m.mailMessages {
+		if msg.Status == Models.MailPending && !msg.NextAttemptAt.After(now) {
+			messages = append(messages, msg)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].NextAttemptAt.Equal(messages[j].NextAttemptAt) {
+			return messages[i].NextAttemptAt.Before(messages[j].NextAttemptAt)
+		}
+		return messages[i].ID < messages[j].ID
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+// GetMailMessages returns the last limit messages with status, newest first
+func (m *memoryDBRepo) GetMailMessages(ctx context.Context, status string, limit int) ([]Models.MailMessage, error) {
+	defer m.rlock()()
+
+	var messages []Models.MailMessage
+	for _, msg := range m.mailMessages {
+		if msg.Status == status {
+			messages = append(messages, msg)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID > messages[j].ID
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+// UpdateMailMessage records an attempt of a mail message
+func (m *memoryDBRepo) UpdateMailMessage(ctx context.Context, msg Models.MailMessage) error {
+	defer m.lock()()
+
+	old, ok := m.mailMessages[msg.ID]
+	if !ok {
+		return nil
+	}
+	old.Status = msg.Status
+	old.Attempts = msg.Attempts
+	old.NextAttemptAt = msg.NextAttemptAt
+	old.LastAttemptAt = msg.LastAttemptAt
+	old.LastError = msg.LastError
+	old.SentAt = msg.SentAt
+	old.UpdatedAt = time.Now()
+	m.mailMessages[msg.ID] = old
+
+	return nil
+}
+
+// ResendMail makes a failed message pending again, due right away, with a fresh set of attempts
+func (m *memoryDBRepo) ResendMail(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	msg, ok := m.mailMessages[id]
+	if !ok || msg.Status != Models.MailFailed {
+		return nil
+	}
+	msg.Status = Models.MailPending
+	msg.Attempts = 0
+	msg.NextAttemptAt = time.Now()
+	msg.UpdatedAt = time.Now()
+	m.mailMessages[id] = msg
+
+	return nil
+}
+
+// GetArrivalsToRemind returns the reservations that weren't cancelled and start between from and to, whose guests
+// weren't reminded yet
+func (m *memoryDBRepo) GetArrivalsToRemind(ctx context.Context, from, to time.Time) ([]Models.Reservation, error) {
+	defer m.rlock()()
+
+	return m.reservationsWhere(func(res Models.Reservation) bool {
+		return res.Cancelled == 0 && !res.StartDate.Before(from) && !res.StartDate.After(to) &&
+			!m.notified(res.ID, Models.NotificationArrivalReminder)
+	}), nil
+}
+
+// GetDeparturesToThank returns the reservations that weren't cancelled and end between from and to, whose guests
+// weren't thanked yet
+func (m *memoryDBRepo) GetDeparturesToThank(ctx context.Context, from, to time.Time) ([]Models.Reservation, error) {
+	defer m.rlock()()
+
+	reservations := m.reservationsWhere(func(res Models.Reservation) bool {
+		return res.Cancelled == 0 && !res.EndDate.Before(from) && !res.EndDate.After(to) &&
+			!m.notified(res.ID, Models.NotificationThankYou)
+	})
+	sort.SliceStable(reservations, func(i, j int) bool {
+		return reservations[i].EndDate.Before(reservations[j].EndDate)
+	})
+
+	return reservations, nil
+}
+
+// RecordNotification records that the email of kind was queued for a reservation and queues mail atomically.
+// It reports false, queueing nothing, if the notification was recorded before
+func (m *memoryDBRepo) RecordNotification(ctx context.Context, reservationID int, kind string, mail ...Models.MailData) (bool, error) {
+	recorded := false
+
+	err := m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*memoryDBRepo)
+
+		if _, ok := tx.reservations[reservationID]; !ok {
+			return errors.New("reservation does not exist")
+		}
+		if tx.notified(reservationID, kind) {
+			return nil
+		}
+
+		tx.lastNotificationID++
+		tx.notifications[tx.lastNotificationID] = Models.ReservationNotification{
+			ID:            tx.lastNotificationID,
+			ReservationID: reservationID,
+			Kind:          kind,
+			CreatedAt:     time.Now(),
+			UpdatedAt:     time.Now(),
+		}
+		recorded = true
+
+		for _, msg := range mail {
+			if err := repo.QueueMail(ctx, msg); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return recorded, nil
+}
+
+// notified reports whether the notification of kind was recorded for a reservation; callers must hold the lock
+func (m *memoryDBRepo) notified(reservationID int, kind string) bool {
+	for _, n := range m.notifications {
+		if n.ReservationID == reservationID && n.Kind == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAvailable reports whether no restriction of roomID overlaps [start, end); callers must hold the lock
+func (m *memoryDBRepo) isAvailable(roomID int, start, end time.Time) bool {
+	for _, r := range m.roomRestrictions {
+		if r.RoomID == roomID && overlaps(start, end, r.StartDate, r.EndDate) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// insertReservation stores res under a new id and returns it; callers must hold the lock
+func (m *memoryDBRepo) insertReservation(res Models.Reservation) int {
+	m.lastReservationID++
+	res.ID = m.lastReservationID
+	res.Room = Models.Room{}
+	res.CreatedAt = time.Now()
+	res.UpdatedAt = time.Now()
+	m.reservations[res.ID] = res
+
+	return res.ID
+}
+
+// insertRoomRestriction checks the same foreign keys and overlap constraint as the database
+// before storing r; callers must hold the lock
+func (m *memoryDBRepo) insertRoomRestriction(r Models.RoomRestriction) error {
+	if _, ok := m.rooms[r.RoomID]; !ok {
+		return errors.New("room does not exist")
+	}
+	if _, ok := m.restrictions[r.RestrictionID]; !ok {
+		return errors.New("restriction does not exist")
+	}
+	if r.ReservationID > 0 {
+		if _, ok := m.reservations[r.ReservationID]; !ok {
+			return errors.New("reservation does not exist")
+		}
+	}
+	if !m.isAvailable(r.RoomID, r.StartDate, r.EndDate) {
+		return repository.ErrRoomUnavailable
+	}
+
+	m.lastRoomRestrictionID++
+	r.ID = m.lastRoomRestrictionID
+	r.CreatedAt = time.Now()
+	r.UpdatedAt = time.Now()
+	m.roomRestrictions[r.ID] = r
+
+	return nil
+}
+
+// sortedRooms returns all rooms ordered by room name; callers must hold the lock
+func (m *memoryDBRepo) sortedRooms() []Models.Room {
+	var rooms []Models.Room
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomName < rooms[j].RoomName
+	})
+
+	return rooms
+}
+
+// GetRatePlan returns the rate plan of a room, with its seasonal rates ordered by start date.
+// A room without a rate plan gets a plan charging its base price every night
+func (m *memoryDBRepo) GetRatePlan(ctx context.Context, roomID int) (Models.RatePlan, error) {
+	defer m.rlock()()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return Models.RatePlan{}, sql.ErrNoRows
+	}
+
+	plan := m.ratePlans[roomID]
+	plan.RoomID = roomID
+	plan.BaseRate = room.BasePrice
+	plan.SeasonalRates = nil
+	for _, s := range m.seasonalRates {
+		if s.RoomID == roomID {
+			plan.SeasonalRates = append(plan.SeasonalRates, s)
+		}
+	}
+
+	sort.Slice(plan.SeasonalRates, func(i, j int) bool {
+		return plan.SeasonalRates[i].StartDate.Before(plan.SeasonalRates[j].StartDate)
+	})
+
+	return plan, nil
+}
+
+// UpdateRatePlan saves the base and weekend rate of a room
+func (m *memoryDBRepo) UpdateRatePlan(ctx context.Context, plan Models.RatePlan) error {
+	defer m.lock()()
+
+	room, ok := m.rooms[plan.RoomID]
+	if !ok {
+		return errors.New("room does not exist")
+	}
+	room.BasePrice = plan.BaseRate
+	room.UpdatedAt = time.Now()
+	m.rooms[room.ID] = room
+
+	old, ok := m.ratePlans[plan.RoomID]
+	if ok {
+		old.WeekendRate = plan.WeekendRate
+		old.UpdatedAt = time.Now()
+		m.ratePlans[plan.RoomID] = old
+		return nil
+	}
+
+	m.lastRatePlanID++
+	m.ratePlans[plan.RoomID] = Models.RatePlan{
+		ID:          m.lastRatePlanID,
+		RoomID:      plan.RoomID,
+		WeekendRate: plan.WeekendRate,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	return nil
+}
+
+// InsertSeasonalRate inserts a seasonal rate for a room
+func (m *memoryDBRepo) InsertSeasonalRate(ctx context.Context, s Models.SeasonalRate) error {
+	defer m.lock()()
+
+	if _, ok := m.rooms[s.RoomID]; !ok {
+		return errors.New("room does not exist")
+	}
+
+	m.lastSeasonalRateID++
+	s.ID = m.lastSeasonalRateID
+	s.CreatedAt = time.Now()
+	s.UpdatedAt = time.Now()
+	m.seasonalRates[s.ID] = s
+
+	return nil
+}
+
+// DeleteSeasonalRate deletes a seasonal rate by given ID
+func (m *memoryDBRepo) DeleteSeasonalRate(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	delete(m.seasonalRates, id)
+
+	return nil
+}
+
+// slugTaken reports whether a room other than exceptID already uses slug; callers must hold the lock
+func (m *memoryDBRepo) slugTaken(slug string, exceptID int) bool {
+	for _, room := range m.rooms {
+		if room.Slug == slug && room.ID != exceptID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replaceRecoveryCodes deletes the recovery codes of a user and stores codeHashes instead; callers must hold the lock
+func (m *memoryDBRepo) replaceRecoveryCodes(userID int, codeHashes []string) {
+	for id, c := range m.recoveryCodes {
+		if c.UserID == userID {
+			delete(m.recoveryCodes, id)
+		}
+	}
+
+	for _, hash := range codeHashes {
+		m.lastRecoveryCodeID++
+		m.recoveryCodes[m.lastRecoveryCodeID] = Models.RecoveryCode{
+			ID:        m.lastRecoveryCodeID,
+			UserID:    userID,
+			CodeHash:  hash,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+	}
+}
+
+// clearLoginAttempts forgets the failed logins for email; callers must hold the lock
+func (m *memoryDBRepo) clearLoginAttempts(email string) {
+	for id, a := range m.loginAttempts {
+		if a.Email == email {
+			delete(m.loginAttempts, id)
+		}
+	}
+}
+
+// emailTaken reports whether a user other than exceptID has the email; callers must hold the lock
+func (m *memoryDBRepo) emailTaken(email string, exceptID int) bool {
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) && u.ID != exceptID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reservationsWhere returns the matching reservations ordered by start date; callers must hold the lock
+func (m *memoryDBRepo) reservationsWhere(match func(res Models.Reservation) bool) []Models.Reservation {
+	var reservations []Models.Reservation
+	for _, res := range m.reservations {
+		if match(res) {
+			reservations = append(reservations, m.withRoom(res))
+		}
+	}
+
+	sort.Slice(reservations, func(i, j int) bool {
+		if reservations[i].StartDate.Equal(reservations[j].StartDate) {
+			return reservations[i].ID < reservations[j].ID
+		}
+		return reservations[i].StartDate.Before(reservations[j].StartDate)
+	})
+
+	return reservations
+}
+
+// withUser fills in the name of the user who created t, like the join of the database repos; callers must hold the lock
+func (m *memoryDBRepo) withUser(t Models.APIToken) Models.APIToken {
+	u := m.users[t.UserID]
+	t.User = Models.User{ID: u.ID, FirstName: u.FirstName, LastName: u.LastName, Active: u.Active}
+
+	return t
+}
+
+// withFeedRoom populates the joined room of an external calendar; callers must hold the lock
+func (m *memoryDBRepo) withFeedRoom(f Models.ICalFeed) Models.ICalFeed {
+	room := m.rooms[f.RoomID]
+	f.Room = Models.Room{ID: room.ID, RoomName: room.RoomName}
+
+	return f
+}
+
+// withWebhook fills in the name, URL and secret of the webhook of d, like the join of the database repos;
+// callers must hold the lock
+func (m *memoryDBRepo) withWebhook(d Models.WebhookDelivery) Models.WebhookDelivery {
+	w := m.webhooks[d.WebhookID]
+	d.Webhook = Models.Webhook{ID: w.ID, Name: w.Name, URL: w.URL, Secret: w.Secret}
+
+	return d
+}
+
+// withRoom populates the joined room of a reservation; callers must hold the lock
+func (m *memoryDBRepo) withRoom(res Models.Reservation) Models.Reservation {
+	room := m.rooms[res.RoomID]
+	res.Room = Models.Room{ID: room.ID, RoomName: room.RoomName}
+
+	return res
+}
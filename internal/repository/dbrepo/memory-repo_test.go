@@ -0,0 +1,271 @@
+package dbrepo
+
+import (
+	"context"
+	"errors"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/config"
+	"github.com/454270186/Hotel-booking-web-application/internal/repository"
+	"sync"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func TestMemoryRepo_Availability(t *testing.T) {
+	repo := NewMemoryRepo(&config.AppConfig{})
+
+	id, err := repo.InsertReservation(context.Background(), Models.Reservation{
+		FirstName: "Erfei",
+		StartDate: date("2050-01-10"),
+		EndDate:   date("2050-01-12"),
+		RoomID:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.InsertRoomRestriction(context.Background(), Models.RoomRestriction{
+		StartDate:     date("2050-01-10"),
+		EndDate:       date("2050-01-12"),
+		RoomID:        1,
+		ReservationID: id,
+		RestrictionID: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		start    string
+		end      string
+		expected bool
+	}{
+		{"before", "2050-01-08", "2050-01-10", true},
+		{"after", "2050-01-12", "2050-01-14", true},
+		{"overlap start", "2050-01-09", "2050-01-11", false},
+		{"overlap end", "2050-01-11", "2050-01-13", false},
+		{"inside", "2050-01-10", "2050-01-11", false},
+		{"around", "2050-01-01", "2050-01-20", false},
+	}
+
+	for _, e := range tests {
+		ok, err := repo.SearchAvailabilityByDateByRoomID(context.Background(), date(e.start), date(e.end), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != e.expected {
+			t.Errorf("for %s, expected availability %t but got %t", e.name, e.expected, ok)
+		}
+	}
+
+	err = repo.DeleteReservation(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restrictions, _ := repo.GetRestrictionsForRoomByDate(context.Background(), 1, date("2050-01-01"), date("2050-02-01"))
+	if len(restrictions) != 0 {
+		t.Error("deleting a reservation should delete its room restrictions")
+	}
+}
+
+func TestMemoryRepo_Concurrent(t *testing.T) {
+	repo := NewMemoryRepo(&config.AppConfig{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := date("2050-01-01").AddDate(0, 0, i)
+			_ = repo.InsertBlockForRoom(context.Background(), 2, start)
+			_, _ = repo.SearchAvailabilityForAllRooms(context.Background(), start, start.AddDate(0, 0, 1))
+		}(i)
+	}
+	wg.Wait()
+
+	restrictions, _ := repo.GetRestrictionsForRoomByDate(context.Background(), 2, date("2050-01-01"), date("2050-03-01"))
+	if len(restrictions) != 50 {
+		t.Errorf("expected 50 blocks, got %d", len(restrictions))
+	}
+}
+
+func TestMemoryRepo_WithTx(t *testing.T) {
+	repo := NewMemoryRepo(&config.AppConfig{})
+	ctx := context.Background()
+
+	err := repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		if err := tx.InsertBlockForRoom(ctx, 1, date("2050-01-01")); err != nil {
+			return err
+		}
+		// the second block overlaps the first, so the whole transaction rolls back
+		return tx.InsertBlockForRoom(ctx, 1, date("2050-01-01"))
+	})
+	if !errors.Is(err, repository.ErrRoomUnavailable) {
+		t.Fatalf("expected ErrRoomUnavailable, got %v", err)
+	}
+
+	restrictions, _ := repo.GetRestrictionsForRoomByDate(ctx, 1, date("2050-01-01"), date("2050-02-01"))
+	if len(restrictions) != 0 {
+		t.Error("rolled back transaction should not leave any blocks")
+	}
+
+	err = repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		if err := tx.InsertBlockForRoom(ctx, 1, date("2050-01-01")); err != nil {
+			return err
+		}
+		return tx.InsertBlockForRoom(ctx, 1, date("2050-01-02"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restrictions, _ = repo.GetRestrictionsForRoomByDate(ctx, 1, date("2050-01-01"), date("2050-02-01"))
+	if len(restrictions) != 2 {
+		t.Errorf("committed transaction should leave 2 blocks, got %d", len(restrictions))
+	}
+}
+
+func TestMemoryRepo_Rooms(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepo(&config.AppConfig{})
+
+	id, err := repo.InsertRoom(ctx, Models.Room{RoomName: "Honeymoon Suite", Slug: "honeymoon-suite", Active: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.InsertRoom(ctx, Models.Room{RoomName: "Copy", Slug: "honeymoon-suite"}); err == nil {
+		t.Error("expected a duplicate slug to be rejected")
+	}
+
+	room, err := repo.GetRoomBySlug(ctx, "honeymoon-suite")
+	if err != nil || room.ID != id {
+		t.Fatalf("expected room %d by slug, got %d and %v", id, room.ID, err)
+	}
+
+	if _, err := repo.GetRoomByICalToken(ctx, ""); err == nil {
+		t.Error("expected no room for an empty calendar feed token")
+	}
+	if err := repo.SetRoomICalToken(ctx, id, "feed"); err != nil {
+		t.Fatal(err)
+	}
+	room.RoomName = "Bridal Suite"
+	if err := repo.UpdateRoom(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+	if room, err := repo.GetRoomByICalToken(ctx, "feed"); err != nil || room.ID != id {
+		t.Errorf("expected an update to keep the calendar feed token, got room %d and %v", room.ID, err)
+	}
+
+	rooms, _ := repo.SearchAvailabilityForAllRooms(ctx, date("2050-01-10"), date("2050-01-12"))
+	for _, r := range rooms {
+		if r.ID == id {
+			t.Error("inactive rooms should not be offered")
+		}
+	}
+
+	_, err = repo.CreateReservation(ctx, Models.Reservation{
+		StartDate: date("2050-01-10"),
+		EndDate:   date("2050-01-12"),
+		RoomID:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteRoom(ctx, 1); !errors.Is(err, repository.ErrRoomInUse) {
+		t.Errorf("expected ErrRoomInUse deleting a booked room, got %v", err)
+	}
+	if err := repo.DeleteRoom(ctx, id); err != nil {
+		t.Errorf("expected deleting an unused room to succeed, got %v", err)
+	}
+}
+
+func TestMemoryRepo_Users(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepo(&config.AppConfig{})
+
+	id, err := repo.InsertUser(ctx, Models.User{FirstName: "Front", LastName: "Desk", Email: "desk@here.com", Password: "secret123", AccessLevel: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.InsertUser(ctx, Models.User{Email: "Desk@Here.com", Password: "secret123"}); err == nil {
+		t.Error("expected a duplicate email to be rejected")
+	}
+
+	if got, _, err := repo.Authenticate(ctx, "desk@here.com", "secret123"); err != nil || got != id {
+		t.Fatalf("expected user %d to log in, got %d and %v", id, got, err)
+	}
+
+	if err := repo.UpdatePassword(ctx, id, "newsecret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Authenticate(ctx, "desk@here.com", "secret123"); err == nil {
+		t.Error("the old password should no longer work")
+	}
+
+	if err := repo.DeactivateUser(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Authenticate(ctx, "desk@here.com", "newsecret"); err == nil {
+		t.Error("deactivated users should not be able to log in")
+	}
+
+	users, err := repo.AllUsers(ctx)
+	if err != nil || len(users) != 2 {
+		t.Fatalf("expected 2 users, got %d and %v", len(users), err)
+	}
+	if users[0].ID != id || users[0].Active {
+		t.Errorf("expected the deactivated user %d first by last name, got %+v", id, users[0])
+	}
+}
+
+func TestMemoryRepo_LoginAttempts(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepo(&config.AppConfig{})
+	since := time.Now().Add(-time.Minute)
+
+	for _, a := range []Models.LoginAttempt{
+		{Email: "me@me.com", IPAddress: "10.0.0.1"},
+		{Email: "me@me.com", IPAddress: "10.0.0.2"},
+		{Email: "other@here.com", IPAddress: "10.0.0.1"},
+		{Email: "other@here.com", IPAddress: "10.0.0.3"},
+	} {
+		if err := repo.InsertLoginAttempt(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attempts, err := repo.GetLoginAttempts(ctx, "me@me.com", "10.0.0.1", since)
+	if err != nil || len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts by email or IP, got %d and %v", len(attempts), err)
+	}
+	if attempts, _ := repo.GetLoginAttempts(ctx, "me@me.com", "10.0.0.1", time.Now()); len(attempts) != 0 {
+		t.Errorf("expected no attempts after now, got %d", len(attempts))
+	}
+
+	if err := repo.LockUser(ctx, 1, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := repo.GetUserByID(ctx, 1); !u.Locked() {
+		t.Fatal("expected the user to be locked")
+	}
+
+	if err := repo.UnlockUser(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := repo.GetUserByID(ctx, 1); u.Locked() {
+		t.Error("expected the user to be unlocked")
+	}
+	attempts, _ = repo.GetLoginAttempts(ctx, "me@me.com", "10.0.0.2", since)
+	if len(attempts) != 0 {
+		t.Errorf("expected unlocking to forget the attempts of the user, got %d", len(attempts))
+	}
+	attempts, _ = repo.GetLoginAttempts(ctx, "other@here.com", "", since)
+	if len(attempts) != 2 {
+		t.Errorf("expected the attempts of other emails to stay, got %d", len(attempts))
+	}
+}
@@ -1,531 +1,26 @@
 package dbrepo
 
 import (
-	"context"
 	"errors"
-	"github.com/454270186/Hotel-booking-web-application/internal/Models"
-	"golang.org/x/crypto/bcrypt"
-	"log"
-	"time"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
-func (m *postgresDBRepo) AllUsers() bool {
-	return true
-}
-
-// InsertReservation inserts a reservation into database
-func (m *postgresDBRepo) InsertReservation(res Models.Reservation) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var newID int
-	stmt := `insert into reservations (first_name, last_name, email, phone, start_date, end_date,
-			room_id, created_at, updated_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id;`
-
-	err := m.DB.QueryRowContext(ctx, stmt,
-		res.FirstName,
-		res.LastName,
-		res.Email,
-		res.Phone,
-		res.StartDate,
-		res.EndDate,
-		res.RoomID,
-		time.Now(),
-		time.Now(),
-	).Scan(&newID)
-	if err != nil {
-		return 0, err
-	}
-
-	return newID, nil
-}
-
-// InsertRoomRestriction inserts a room restriction into database
-func (m *postgresDBRepo) InsertRoomRestriction(r Models.RoomRestriction) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	stmt := `insert into room_restrictions (start_date, end_date, room_id, reservation_id, 
-            created_at, updated_at, restriction_id)
-            values 
-			($1, $2, $3, $4, $5, $6, $7);`
-
-	_, err := m.DB.ExecContext(ctx, stmt,
-		r.StartDate,
-		r.EndDate,
-		r.RoomID,
-		r.ReservationID,
-		time.Now(),
-		time.Now(),
-		r.RestrictionID,
-	)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// SearchAvailabilityByDate returns true if availability exists for roomID and false if no availability
-func (m *postgresDBRepo) SearchAvailabilityByDateByRoomID(start, end time.Time, roomID int) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var numRows int
-
-	query := `select count(id) from room_restrictions where room_id = $1 and $2 < end_date and $3 > start_date;`
-	row := m.DB.QueryRowContext(ctx, query, roomID, start, end)
-	err := row.Scan(&numRows)
-	if err != nil {
-		return false, err
-	}
-
-	if numRows == 0 {
-		return true, nil
-	}
-
-	return false, nil
-}
-
-// SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
-func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]Models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var rooms []Models.Room
-
-	query := `select
-			    r.id, r.room_name
-			from
-			    rooms r
-			where r.id not in (select rr.room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date);`
-
-	rows, err := m.DB.QueryContext(ctx, query, start, end)
-	if err != nil {
-		return nil, err
-	}
-
-	for rows.Next() {
-		var room Models.Room
-		err := rows.Scan(
-			&room.ID,
-			&room.RoomName,
-		)
-		if err != nil {
-			return rooms, err
-		}
-
-		rooms = append(rooms, room)
-	}
-	// if there is an error to scan rows, catch it
-	if err := rows.Err(); err != nil {
-		return rooms, err
-	}
-
-	return rooms, nil
-}
-
-// GetRoomByID gets a room by given id
-func (m *postgresDBRepo) GetRoomByID(id int) (Models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `select id, room_name, created_at, updated_at from rooms where id = $1`
-
-	var room Models.Room
-	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(
-		&room.ID,
-		&room.RoomName,
-		&room.CreatedAt,
-		&room.UpdatedAt,
-	)
-	if err != nil {
-		return room, err
-	}
-
-	return room, nil
-}
-
-// GetUserByID returns the user by given ID
-func (m *postgresDBRepo) GetUserByID(id int) (Models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at
-              from users where id = $1;`
-
-	var u Models.User
-	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(
-		&u.ID,
-		&u.FirstName,
-		&u.LastName,
-		&u.Email,
-		&u.Password,
-		&u.AccessLevel,
-		&u.CreatedAt,
-		&u.UpdatedAt,
-	)
-	if err != nil {
-		return u, err
-	}
-
-	return u, nil
-}
-
-// UpdateUser updates a user in database
-func (m *postgresDBRepo) UpdateUser(u Models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5;`
-
-	_, err := m.DB.ExecContext(ctx, query,
-		u.FirstName,
-		u.LastName,
-		u.Email,
-		u.AccessLevel,
-		time.Now(),
-	)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// Authenticate authenticates a user
-func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var id int
-	var hashedPassword string
-
-	query := `select id, password from users where email = $1;`
-
-	row := m.DB.QueryRowContext(ctx, query, email)
-	err := row.Scan(&id, &hashedPassword)
-	if err != nil {
-		return 0, "", err
-	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, "", errors.New("incorrect password")
-	} else if err != nil {
-		return 0, "", err
-	}
-
-	return id, hashedPassword, nil
-}
-
-// AllReservations returns a slice of all reservations
-func (m *postgresDBRepo) AllReservations() ([]Models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var reservations []Models.Reservation
-
-	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
-		r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		order by r.start_date asc
-`
-
-	rows, err := m.DB.QueryContext(ctx, query)
-	if err != nil {
-		return reservations, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var i Models.Reservation
-		err := rows.Scan(
-			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Email,
-			&i.Phone,
-			&i.StartDate,
-			&i.EndDate,
-			&i.RoomID,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-			&i.Processed,
-			&i.Room.ID,
-			&i.Room.RoomName,
-		)
-		if err != nil {
-			return reservations, err
-		}
+// pgExclusionViolation is the SQLSTATE raised when room_restrictions_no_overlap rejects a row
+const pgExclusionViolation = "23P01"
 
-		reservations = append(reservations, i)
-	}
-	if err = rows.Err(); err != nil {
-		return reservations, err
-	}
+// postgresDialect runs the queries of sqlDBRepo as they are written
+type postgresDialect struct{}
 
-	return reservations, nil
+func (postgresDialect) rebind(query string) string {
+	return query
 }
 
-// AllNewReservations returns all new reservations
-func (m *postgresDBRepo) AllNewReservations() ([]Models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var reservations []Models.Reservation
-
-	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
-		r.end_date, r.room_id, r.created_at, r.updated_at, 
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		where processed = 0
-		order by r.start_date asc
-`
-
-	rows, err := m.DB.QueryContext(ctx, query)
-	if err != nil {
-		return reservations, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var i Models.Reservation
-		err := rows.Scan(
-			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Email,
-			&i.Phone,
-			&i.StartDate,
-			&i.EndDate,
-			&i.RoomID,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-			&i.Room.ID,
-			&i.Room.RoomName,
-		)
-		if err != nil {
-			return reservations, err
-		}
-
-		reservations = append(reservations, i)
-	}
-	if err = rows.Err(); err != nil {
-		return reservations, err
-	}
-
-	return reservations, nil
-}
-
-// GetReservationByID returns reservation by given ID
-func (m *postgresDBRepo) GetReservationByID(id int) (Models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var res Models.Reservation
-
-	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
-		r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		where r.id = $1;
-`
-
-	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(
-		&res.ID,
-		&res.FirstName,
-		&res.LastName,
-		&res.Email,
-		&res.Phone,
-		&res.StartDate,
-		&res.EndDate,
-		&res.RoomID,
-		&res.CreatedAt,
-		&res.UpdatedAt,
-		&res.Processed,
-		&res.Room.ID,
-		&res.Room.RoomName,
-	)
-	if err != nil {
-		return res, err
-	}
-
-	return res, nil
-}
-
-// UpdateReservation updates a reservation in database
-func (m *postgresDBRepo) UpdateReservation(res Models.Reservation) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `update reservations set first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5
-              where id = $6`
-
-	_, err := m.DB.ExecContext(ctx, query,
-		res.FirstName,
-		res.LastName,
-		res.Email,
-		res.Phone,
-		time.Now(),
-		res.ID,
-	)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// DeleteReservation deletes a reservation by given ID
-func (m *postgresDBRepo) DeleteReservation(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `delete from reservations where id = $1;`
-
-	_, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// UpdateProcessedForReservation updates processed for a reservation by ID
-func (m *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `update reservations set processed = $1 where id = $2;`
-
-	_, err := m.DB.ExecContext(ctx, query, processed, id)
-	if err != nil {
-		return err
-	}
-
-	return nil
-
-}
-
-// AllRooms returns a slice of all rooms
-func (m *postgresDBRepo) AllRooms() ([]Models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var rooms []Models.Room
-
-	query := `select id, room_name, created_at, updated_at from rooms order by room_name;`
-
-	rows, err := m.DB.QueryContext(ctx, query)
-	if err != nil {
-		return rooms, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var room Models.Room
-		err = rows.Scan(
-			&room.ID,
-			&room.RoomName,
-			&room.CreatedAt,
-			&room.UpdatedAt,
-		)
-		if err != nil {
-			return rooms, err
-		}
-		rooms = append(rooms, room)
-	}
-
-	if err = rows.Err(); err != nil {
-		return rooms, err
-	}
-
-	return rooms, nil
-}
-
-// GetRestrictionsForRoomByDate returns restrictions for a room by date range
-func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]Models.RoomRestriction, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var roomRestrictions []Models.RoomRestriction
-
-	query := `
-		select id, coalesce(reservation_id, 0) , restriction_id, room_id, start_date, end_date
-		from room_restrictions where $1 < end_date and $2 > start_date
-		and room_id = $3;
-`
-	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var r Models.RoomRestriction
-		err = rows.Scan(
-			&r.ID,
-			&r.ReservationID,
-			&r.RestrictionID,
-			&r.RoomID,
-			&r.StartDate,
-			&r.EndDate,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		roomRestrictions = append(roomRestrictions, r)
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return roomRestrictions, nil
+func (postgresDialect) convertArgs(args []interface{}) []interface{} {
+	return args
 }
 
-// InsertBlockForRoom inserts a room restriction
-func (m *postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, 
-                  created_at, updated_at) values ($1, $2, $3, $4, $5, $6);`
-
-	_, err := m.DB.ExecContext(ctx, query, startDate, startDate.AddDate(0, 0, 1),
-		id, 2, time.Now(), time.Now())
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	return nil
-}
-
-// DeleteBlockForRoom deletes a room restriction
-func (m *postgresDBRepo) DeleteBlockForRoom(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `delete from room_restrictions where id = $1;`
-
-	_, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	return nil
+// isOverlapError reports whether err was raised by the room_restrictions_no_overlap constraint
+func (postgresDialect) isOverlapError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgExclusionViolation
 }
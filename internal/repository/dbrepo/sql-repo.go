@@ -0,0 +1,2098 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"time"
+)
+
+// The queries of sqlDBRepo are written for Postgres, with $n placeholders, and go through exec, query and
+// queryRow, which rewrite them and their arguments for the database the repository runs on
+
+// exec runs a statement that returns no rows
+func (m *sqlDBRepo) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return m.DB.ExecContext(ctx, m.dialect.rebind(query), m.dialect.convertArgs(args)...)
+}
+
+// query runs a query that returns rows
+func (m *sqlDBRepo) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return m.DB.QueryContext(ctx, m.dialect.rebind(query), m.dialect.convertArgs(args)...)
+}
+
+// queryRow runs a query that returns at most one row
+func (m *sqlDBRepo) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return m.DB.QueryRowContext(ctx, m.dialect.rebind(query), m.dialect.convertArgs(args)...)
+}
+
+// WithTx runs fn against a repository bound to a new transaction, committing it if fn returns nil
+// and rolling it back otherwise. Called on a repository already bound to a transaction, fn joins it
+func (m *sqlDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	db, ok := m.DB.(*sql.DB)
+	if !ok {
+		return fn(m)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(&sqlDBRepo{
+		App:     m.App,
+		DB:      tx,
+		dialect: m.dialect,
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertReservation inserts a reservation into database
+func (m *sqlDBRepo) InsertReservation(ctx context.Context, res Models.Reservation) (int, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into reservations (first_name, last_name, email, phone, start_date, end_date,
+			room_id, total_price, confirmation_code, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id;`
+
+	err := m.queryRow(ctx, stmt,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		res.StartDate,
+		res.EndDate,
+		res.RoomID,
+		res.TotalPrice,
+		res.ConfirmationCode,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// InsertRoomRestriction inserts a room restriction into database
+func (m *sqlDBRepo) InsertRoomRestriction(ctx context.Context, r Models.RoomRestriction) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `insert into room_restrictions (start_date, end_date, room_id, reservation_id, 
+            created_at, updated_at, restriction_id)
+            values 
+			($1, $2, $3, $4, $5, $6, $7);`
+
+	_, err := m.exec(ctx, stmt,
+		r.StartDate,
+		r.EndDate,
+		r.RoomID,
+		r.ReservationID,
+		time.Now(),
+		time.Now(),
+		r.RestrictionID,
+	)
+	if m.dialect.isOverlapError(err) {
+		return repository.ErrRoomUnavailable
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CreateReservation inserts a reservation, its room restriction and the mail about it in one transaction, after
+// checking the room is still available. It returns repository.ErrRoomUnavailable if the dates are taken
+func (m *sqlDBRepo) CreateReservation(ctx context.Context, res Models.Reservation, mail ...Models.MailData) (int, error) {
+	var newID int
+
+	err := m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		available, err := repo.SearchAvailabilityByDateByRoomID(ctx, res.StartDate, res.EndDate, res.RoomID)
+		if err != nil {
+			return err
+		}
+		if !available {
+			return repository.ErrRoomUnavailable
+		}
+
+		newID, err = repo.InsertReservation(ctx, res)
+		if err != nil {
+			return err
+		}
+
+		// the overlap constraint still catches a booking that committed after the check above
+		err = repo.InsertRoomRestriction(ctx, Models.RoomRestriction{
+			StartDate:     res.StartDate,
+			EndDate:       res.EndDate,
+			RoomID:        res.RoomID,
+			ReservationID: newID,
+			RestrictionID: 1,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range mail {
+			if err := repo.QueueMail(ctx, msg); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// SearchAvailabilityByDate returns true if availability exists for roomID and false if no availability
+func (m *sqlDBRepo) SearchAvailabilityByDateByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var numRows int
+
+	query := `select count(id) from room_restrictions where room_id = $1 and $2 < end_date and $3 > start_date;`
+	row := m.queryRow(ctx, query, roomID, start, end)
+	err := row.Scan(&numRows)
+	if err != nil {
+		return false, err
+	}
+
+	if numRows == 0 {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
+func (m *sqlDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]Models.Room, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var rooms []Models.Room
+
+	query := `select
+			    ` + roomColumns + `
+			from
+			    rooms r
+			where r.active = true and r.id not in (select rr.room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date);`
+
+	rows, err := m.query(ctx, query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+
+		rooms = append(rooms, room)
+	}
+	// if there is an error to scan rows, catch it
+	if err := rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	return rooms, nil
+}
+
+// GetRoomByID gets a room by given id
+func (m *sqlDBRepo) GetRoomByID(ctx context.Context, id int) (Models.Room, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + roomColumns + ` from rooms where id = $1`
+
+	return scanRoom(m.queryRow(ctx, query, id))
+}
+
+// AllUsers returns a slice of all users, active or not
+func (m *sqlDBRepo) AllUsers(ctx context.Context) ([]Models.User, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var users []Models.User
+
+	query := `select ` + userColumns + ` from users order by last_name, first_name;`
+
+	rows, err := m.query(ctx, query)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
+
+// GetUserByID returns the user by given ID
+func (m *sqlDBRepo) GetUserByID(ctx context.Context, id int) (Models.User, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + userColumns + ` from users where id = $1;`
+
+	return scanUser(m.queryRow(ctx, query, id))
+}
+
+// GetUserByEmail returns the user with the given email, ignoring case
+func (m *sqlDBRepo) GetUserByEmail(ctx context.Context, email string) (Models.User, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + userColumns + ` from users where lower(email) = lower($1);`
+
+	return scanUser(m.queryRow(ctx, query, email))
+}
+
+// InsertUser inserts an active user with the plain text password u.Password and returns its ID
+func (m *sqlDBRepo) InsertUser(ctx context.Context, u Models.User) (int, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	hash, err := hashPassword(u.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into users (first_name, last_name, email, password, access_level, active, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, true, $6, $7) returning id;`
+
+	err = m.queryRow(ctx, stmt,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		hash,
+		u.AccessLevel,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateUser updates the name, email and access level of a user in database
+func (m *sqlDBRepo) UpdateUser(ctx context.Context, u Models.User) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5
+              where id = $6;`
+
+	_, err := m.exec(ctx, query,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		u.AccessLevel,
+		time.Now(),
+		u.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdatePassword replaces the password of a user with the bcrypt hash of password
+func (m *sqlDBRepo) UpdatePassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	query := `update users set password = $1, updated_at = $2 where id = $3;`
+
+	_, err = m.exec(ctx, query, hash, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeactivateUser stops a user from logging in and revokes the API tokens they created. The user is kept, so
+// it can still be seen in the admin area
+func (m *sqlDBRepo) DeactivateUser(ctx context.Context, id int) error {
+	return m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		_, err := tx.exec(ctx, `update users set active = false, updated_at = $1 where id = $2;`, time.Now(), id)
+		if err != nil {
+			return err
+		}
+
+		// the API tokens the user created would otherwise outlive their account
+		_, err = tx.exec(ctx, `update api_tokens set revoked_at = $1, updated_at = $2
+			where user_id = $3 and revoked_at is null;`, time.Now(), time.Now(), id)
+
+		return err
+	})
+}
+
+// InsertPasswordResetToken stores the hash of a password reset token
+func (m *sqlDBRepo) InsertPasswordResetToken(ctx context.Context, t Models.PasswordResetToken) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `insert into password_reset_tokens (user_id, token_hash, expires_at, used, created_at, updated_at)
+		values ($1, $2, $3, false, $4, $5);`
+
+	_, err := m.exec(ctx, stmt,
+		t.UserID,
+		t.TokenHash,
+		t.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetPasswordResetToken returns the password reset token with the given hash
+func (m *sqlDBRepo) GetPasswordResetToken(ctx context.Context, tokenHash string) (Models.PasswordResetToken, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select id, user_id, token_hash, expires_at, used, created_at, updated_at
+		from password_reset_tokens where token_hash = $1;`
+
+	var t Models.PasswordResetToken
+	err := m.queryRow(ctx, query, tokenHash).Scan(
+		&t.ID,
+		&t.UserID,
+		&t.TokenHash,
+		&t.ExpiresAt,
+		&t.Used,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+
+	return t, err
+}
+
+// ResetPassword uses up the password reset token with the given hash and sets the password of its user.
+// Every other token of the user is used up too. It returns repository.ErrInvalidResetToken if the token
+// is unknown, expired or was already used
+func (m *sqlDBRepo) ResetPassword(ctx context.Context, tokenHash, password string) error {
+	return m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		var userID int
+		err := tx.queryRow(ctx, `update password_reset_tokens set used = true, updated_at = $1
+			where token_hash = $2 and used = false and expires_at > $3 returning user_id;`,
+			time.Now(), tokenHash, time.Now()).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return repository.ErrInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.exec(ctx, `update password_reset_tokens set used = true, updated_at = $1
+			where user_id = $2 and used = false;`, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		return tx.UpdatePassword(ctx, userID, password)
+	})
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user with the given TOTP secret,
+// replacing any recovery codes the user had with the given ones
+func (m *sqlDBRepo) EnableTwoFactor(ctx context.Context, userID int, secret string, recoveryCodeHashes []string) error {
+	return m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		_, err := tx.exec(ctx, `update users set totp_secret = $1, totp_enabled = true, totp_last_step = 0,
+			updated_at = $2 where id = $3;`, secret, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		return tx.ReplaceRecoveryCodes(ctx, userID, recoveryCodeHashes)
+	})
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user and deletes the user's recovery codes
+func (m *sqlDBRepo) DisableTwoFactor(ctx context.Context, userID int) error {
+	return m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		_, err := tx.exec(ctx, `update users set totp_secret = '', totp_enabled = false, totp_last_step = 0,
+			updated_at = $1 where id = $2;`, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.exec(ctx, `delete from recovery_codes where user_id = $1;`, userID)
+		return err
+	})
+}
+
+// UseTOTPStep records that the code of a time step was used by a user. It returns false if a code
+// of the same or a later step was already used, in which case the code must be rejected
+func (m *sqlDBRepo) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	result, err := m.exec(ctx, `update users set totp_last_step = $1 where id = $2 and totp_last_step < $3;`,
+		step, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// ReplaceRecoveryCodes deletes the recovery codes of a user and stores the given hashes instead
+func (m *sqlDBRepo) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	return m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		_, err := tx.exec(ctx, `delete from recovery_codes where user_id = $1;`, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range codeHashes {
+			_, err = tx.exec(ctx, `insert into recovery_codes (user_id, code_hash, used, created_at, updated_at)
+				values ($1, $2, false, $3, $4);`, userID, hash, time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// UseRecoveryCode uses up the unused recovery code of a user with the given hash, reporting whether there was one
+func (m *sqlDBRepo) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	result, err := m.exec(ctx, `update recovery_codes set used = true, updated_at = $1
+		where user_id = $2 and code_hash = $3 and used = false;`, time.Now(), userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of a user
+func (m *sqlDBRepo) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var n int
+	err := m.queryRow(ctx, `select count(id) from recovery_codes where user_id = $1 and used = false;`,
+		userID).Scan(&n)
+
+	return n, err
+}
+
+// GetTwoFactorLevels returns the access levels whose users must use two-factor authentication
+func (m *sqlDBRepo) GetTwoFactorLevels(ctx context.Context) ([]int, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var levels []int
+
+	rows, err := m.query(ctx, `select access_level from two_factor_requirements order by access_level;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var level int
+		if err := rows.Scan(&level); err != nil {
+			return levels, err
+		}
+		levels = append(levels, level)
+	}
+
+	if err = rows.Err(); err != nil {
+		return levels, err
+	}
+
+	return levels, nil
+}
+
+// UpdateTwoFactorLevels sets the access levels whose users must use two-factor authentication
+func (m *sqlDBRepo) UpdateTwoFactorLevels(ctx context.Context, levels []int) error {
+	return m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		_, err := tx.exec(ctx, `delete from two_factor_requirements;`)
+		if err != nil {
+			return err
+		}
+
+		for _, level := range levels {
+			_, err = tx.exec(ctx, `insert into two_factor_requirements (access_level, created_at, updated_at)
+				values ($1, $2, $3);`, level, time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// InsertLoginAttempt records a failed login
+func (m *sqlDBRepo) InsertLoginAttempt(ctx context.Context, a Models.LoginAttempt) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `insert into login_attempts (email, ip_address, created_at, updated_at) values ($1, $2, $3, $4);`
+
+	_, err := m.exec(ctx, stmt, a.Email, a.IPAddress, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetLoginAttempts returns the failed logins for email or from ip since the given time, oldest first
+func (m *sqlDBRepo) GetLoginAttempts(ctx context.Context, email, ip string, since time.Time) ([]Models.LoginAttempt, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var attempts []Models.LoginAttempt
+
+	query := `select id, email, ip_address, created_at, updated_at from login_attempts
+		where (email = $1 or ip_address = $2) and created_at > $3 order by created_at;`
+
+	rows, err := m.query(ctx, query, email, ip, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Models.LoginAttempt
+		err = rows.Scan(
+			&a.ID,
+			&a.Email,
+			&a.IPAddress,
+			&a.CreatedAt,
+			&a.UpdatedAt,
+		)
+		if err != nil {
+			return attempts, err
+		}
+		attempts = append(attempts, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return attempts, err
+	}
+
+	return attempts, nil
+}
+
+// ClearLoginAttempts forgets the failed logins for email
+func (m *sqlDBRepo) ClearLoginAttempts(ctx context.Context, email string) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	_, err := m.exec(ctx, `delete from login_attempts where email = $1;`, email)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LockUser stops a user from logging in until the given time
+func (m *sqlDBRepo) LockUser(ctx context.Context, id int, until time.Time) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	_, err := m.exec(ctx, `update users set locked_until = $1, updated_at = $2 where id = $3;`,
+		until, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UnlockUser lifts the lock of a user and forgets the failed logins that led to it
+func (m *sqlDBRepo) UnlockUser(ctx context.Context, id int) error {
+	return m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		_, err := tx.exec(ctx, `update users set locked_until = null, updated_at = $1 where id = $2;`,
+			time.Now(), id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.exec(ctx, `delete from login_attempts
+			where email = (select lower(email) from users where id = $1);`, id)
+		return err
+	})
+}
+
+// Authenticate authenticates a user
+func (m *sqlDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+
+	// deactivated users are treated as if they didn't exist
+	query := `select id, password from users where lower(email) = lower($1) and active = true;`
+
+	row := m.queryRow(ctx, query, email)
+	err := row.Scan(&id, &hashedPassword)
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, "", errors.New("incorrect password")
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	return id, hashedPassword, nil
+}
+
+// AllAPITokens returns every API token, newest first
+func (m *sqlDBRepo) AllAPITokens(ctx context.Context) ([]Models.APIToken, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var tokens []Models.APIToken
+
+	query := `select ` + apiTokenColumns + ` from api_tokens t join users u on (u.id = t.user_id)
+		order by t.created_at desc, t.id desc;`
+
+	rows, err := m.query(ctx, query)
+	if err != nil {
+		return tokens, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return tokens, err
+		}
+		tokens = append(tokens, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return tokens, err
+	}
+
+	return tokens, nil
+}
+
+// InsertAPIToken inserts an API token, t.TokenHash must already be hashed
+func (m *sqlDBRepo) InsertAPIToken(ctx context.Context, t Models.APIToken) (int, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into api_tokens (name, token_hash, scopes, user_id, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6) returning id;`
+
+	err := m.queryRow(ctx, stmt,
+		t.Name,
+		t.TokenHash,
+		t.Scopes,
+		t.UserID,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetAPITokenByHash returns the API token with the given hash, revoked or not
+func (m *sqlDBRepo) GetAPITokenByHash(ctx context.Context, tokenHash string) (Models.APIToken, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + apiTokenColumns + ` from api_tokens t join users u on (u.id = t.user_id)
+		where t.token_hash = $1;`
+
+	return scanAPIToken(m.queryRow(ctx, query, tokenHash))
+}
+
+// TouchAPIToken records when an API token was last used
+func (m *sqlDBRepo) TouchAPIToken(ctx context.Context, id int, usedAt time.Time) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	_, err := m.exec(ctx, `update api_tokens set last_used_at = $1 where id = $2;`, usedAt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeAPIToken stops an API token from working, for good
+func (m *sqlDBRepo) RevokeAPIToken(ctx context.Context, id int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `update api_tokens set revoked_at = $1, updated_at = $2 where id = $3 and revoked_at is null;`
+
+	_, err := m.exec(ctx, stmt, time.Now(), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AllReservations returns a slice of all reservations
+func (m *sqlDBRepo) AllReservations(ctx context.Context) ([]Models.Reservation, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var reservations []Models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
+		r.end_date, r.room_id, r.total_price, r.created_at, r.updated_at, r.processed,
+		r.confirmation_code, r.cancelled,
+		rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		order by r.start_date asc
+`
+
+	rows, err := m.query(ctx, query)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i Models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.TotalPrice,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&i.ConfirmationCode,
+			&i.Cancelled,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+
+		reservations = append(reservations, i)
+	}
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// AllNewReservations returns the reservations that are neither processed nor cancelled
+func (m *sqlDBRepo) AllNewReservations(ctx context.Context) ([]Models.Reservation, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var reservations []Models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
+		r.end_date, r.room_id, r.total_price, r.created_at, r.updated_at,
+		r.confirmation_code, r.cancelled,
+		rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where processed = 0 and cancelled = 0
+		order by r.start_date asc
+`
+
+	rows, err := m.query(ctx, query)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i Models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.TotalPrice,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.ConfirmationCode,
+			&i.Cancelled,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+
+		reservations = append(reservations, i)
+	}
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// GetReservationByID returns reservation by given ID
+func (m *sqlDBRepo) GetReservationByID(ctx context.Context, id int) (Models.Reservation, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var res Models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
+		r.end_date, r.room_id, r.total_price, r.created_at, r.updated_at, r.processed,
+		r.confirmation_code, r.cancelled,
+		rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.id = $1;
+`
+
+	row := m.queryRow(ctx, query, id)
+	err := row.Scan(
+		&res.ID,
+		&res.FirstName,
+		&res.LastName,
+		&res.Email,
+		&res.Phone,
+		&res.StartDate,
+		&res.EndDate,
+		&res.RoomID,
+		&res.TotalPrice,
+		&res.CreatedAt,
+		&res.UpdatedAt,
+		&res.Processed,
+		&res.ConfirmationCode,
+		&res.Cancelled,
+		&res.Room.ID,
+		&res.Room.RoomName,
+	)
+	if err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// UpdateReservation updates a reservation in database
+func (m *sqlDBRepo) UpdateReservation(ctx context.Context, res Models.Reservation) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `update reservations set first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5
+              where id = $6`
+
+	_, err := m.exec(ctx, query,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		time.Now(),
+		res.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteReservation deletes a reservation by given ID
+func (m *sqlDBRepo) DeleteReservation(ctx context.Context, id int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `delete from reservations where id = $1;`
+
+	_, err := m.exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetReservationByCode returns the reservation with the confirmation code, if it was made with email
+func (m *sqlDBRepo) GetReservationByCode(ctx context.Context, code, email string) (Models.Reservation, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var id int
+
+	query := `select id from reservations where confirmation_code = $1 and lower(email) = lower($2);`
+
+	err := m.queryRow(ctx, query, code, email).Scan(&id)
+	if err != nil {
+		return Models.Reservation{}, err
+	}
+
+	return m.GetReservationByID(ctx, id)
+}
+
+// CancelReservation marks a reservation as cancelled and frees its room restrictions
+func (m *sqlDBRepo) CancelReservation(ctx context.Context, id int) error {
+	return m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		_, err := tx.exec(ctx, `update reservations set cancelled = 1, updated_at = $1 where id = $2;`,
+			time.Now(), id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.exec(ctx, `delete from room_restrictions where reservation_id = $1;`, id)
+		return err
+	})
+}
+
+// InsertChangeRequest inserts a request for new dates of a reservation
+func (m *sqlDBRepo) InsertChangeRequest(ctx context.Context, cr Models.ReservationChangeRequest) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `insert into reservation_change_requests (reservation_id, start_date, end_date, created_at, updated_at)
+		values ($1, $2, $3, $4, $5);`
+
+	_, err := m.exec(ctx, stmt,
+		cr.ReservationID,
+		cr.StartDate,
+		cr.EndDate,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetChangeRequestsForReservation returns the change requests of a reservation, oldest first
+func (m *sqlDBRepo) GetChangeRequestsForReservation(ctx context.Context, reservationID int) ([]Models.ReservationChangeRequest, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var requests []Models.ReservationChangeRequest
+
+	query := `select id, reservation_id, start_date, end_date, created_at, updated_at
+		from reservation_change_requests where reservation_id = $1 order by created_at;`
+
+	rows, err := m.query(ctx, query, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cr Models.ReservationChangeRequest
+		err = rows.Scan(
+			&cr.ID,
+			&cr.ReservationID,
+			&cr.StartDate,
+			&cr.EndDate,
+			&cr.CreatedAt,
+			&cr.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, cr)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// UpdateProcessedForReservation updates processed for a reservation by ID
+func (m *sqlDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `update reservations set processed = $1 where id = $2;`
+
+	_, err := m.exec(ctx, query, processed, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// AllRooms returns a slice of all rooms
+func (m *sqlDBRepo) AllRooms(ctx context.Context) ([]Models.Room, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var rooms []Models.Room
+
+	query := `select ` + roomColumns + ` from rooms order by room_name;`
+
+	rows, err := m.query(ctx, query)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+		rooms = append(rooms, room)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	return rooms, nil
+}
+
+// GetRoomBySlug gets a room by its slug
+func (m *sqlDBRepo) GetRoomBySlug(ctx context.Context, slug string) (Models.Room, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + roomColumns + ` from rooms where slug = $1`
+
+	return scanRoom(m.queryRow(ctx, query, slug))
+}
+
+// GetRoomByICalToken gets the room whose calendar feed has the secret token
+func (m *sqlDBRepo) GetRoomByICalToken(ctx context.Context, token string) (Models.Room, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + roomColumns + ` from rooms where ical_token = $1 and ical_token <> ''`
+
+	return scanRoom(m.queryRow(ctx, query, token))
+}
+
+// SetRoomICalToken sets the secret token of a room's calendar feed, so the old feed URL stops working
+func (m *sqlDBRepo) SetRoomICalToken(ctx context.Context, id int, token string) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	_, err := m.exec(ctx, `update rooms set ical_token = $1, updated_at = $2 where id = $3;`,
+		token, time.Now(), id)
+
+	return err
+}
+
+// InsertRoom inserts a room into database and returns its ID
+func (m *sqlDBRepo) InsertRoom(ctx context.Context, room Models.Room) (int, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into rooms (room_name, slug, description, capacity, bed_configuration, amenities,
+			base_price, image, active, ical_token, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id;`
+
+	err := m.queryRow(ctx, stmt,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.Capacity,
+		room.BedConfiguration,
+		room.Amenities,
+		room.BasePrice,
+		room.Image,
+		room.Active,
+		room.ICalToken,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateRoom updates a room in database
+func (m *sqlDBRepo) UpdateRoom(ctx context.Context, room Models.Room) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `update rooms set room_name = $1, slug = $2, description = $3, capacity = $4,
+              bed_configuration = $5, amenities = $6, base_price = $7, image = $8, active = $9,
+              updated_at = $10 where id = $11;`
+
+	_, err := m.exec(ctx, query,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.Capacity,
+		room.BedConfiguration,
+		room.Amenities,
+		room.BasePrice,
+		room.Image,
+		room.Active,
+		time.Now(),
+		room.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteRoom deletes a room and its blocks by given ID. It returns repository.ErrRoomInUse
+// if the room has reservations, which should be kept and the room deactivated instead
+func (m *sqlDBRepo) DeleteRoom(ctx context.Context, id int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `delete from rooms where id = $1 and not exists (select 1 from reservations where room_id = $2);`
+
+	result, err := m.exec(ctx, query, id, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := m.GetRoomByID(ctx, id); err != nil {
+			return err
+		}
+		return repository.ErrRoomInUse
+	}
+
+	return nil
+}
+
+// GetRestrictionsForRoomByDate returns restrictions for a room by date range
+func (m *sqlDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]Models.RoomRestriction, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var roomRestrictions []Models.RoomRestriction
+
+	query := `
+		select id, coalesce(reservation_id, 0) , restriction_id, room_id, start_date, end_date,
+		coalesce(ical_feed_id, 0), external_uid, created_at, updated_at
+		from room_restrictions where $1 < end_date and $2 > start_date
+		and room_id = $3;
+`
+	rows, err := m.query(ctx, query, start, end, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Models.RoomRestriction
+		err = rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.ICalFeedID,
+			&r.ExternalUID,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		roomRestrictions = append(roomRestrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roomRestrictions, nil
+}
+
+// InsertBlockForRoom inserts a room restriction
+func (m *sqlDBRepo) InsertBlockForRoom(ctx context.Context, id int, startDate time.Time) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, 
+                  created_at, updated_at) values ($1, $2, $3, $4, $5, $6);`
+
+	_, err := m.exec(ctx, query, startDate, startDate.AddDate(0, 0, 1),
+		id, 2, time.Now(), time.Now())
+	if m.dialect.isOverlapError(err) {
+		return repository.ErrRoomUnavailable
+	}
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteBlockForRoom deletes a room restriction
+func (m *sqlDBRepo) DeleteBlockForRoom(ctx context.Context, id int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `delete from room_restrictions where id = $1;`
+
+	_, err := m.exec(ctx, query, id)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// AllICalFeeds returns every external calendar, ordered by room
+func (m *sqlDBRepo) AllICalFeeds(ctx context.Context) ([]Models.ICalFeed, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + icalFeedColumns + ` from ical_feeds f join rooms r on (r.id = f.room_id)
+		order by r.room_name, f.id;`
+
+	return m.queryICalFeeds(ctx, query)
+}
+
+// GetICalFeedsForRoom returns the external calendars of a room
+func (m *sqlDBRepo) GetICalFeedsForRoom(ctx context.Context, roomID int) ([]Models.ICalFeed, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + icalFeedColumns + ` from ical_feeds f join rooms r on (r.id = f.room_id)
+		where f.room_id = $1 order by f.id;`
+
+	return m.queryICalFeeds(ctx, query, roomID)
+}
+
+// queryICalFeeds returns the external calendars selected by query
+func (m *sqlDBRepo) queryICalFeeds(ctx context.Context, query string, args ...interface{}) ([]Models.ICalFeed, error) {
+	var feeds []Models.ICalFeed
+
+	rows, err := m.query(ctx, query, args...)
+	if err != nil {
+		return feeds, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f, err := scanICalFeed(rows)
+		if err != nil {
+			return feeds, err
+		}
+		feeds = append(feeds, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return feeds, err
+	}
+
+	return feeds, nil
+}
+
+// GetICalFeedByID returns an external calendar by id
+func (m *sqlDBRepo) GetICalFeedByID(ctx context.Context, id int) (Models.ICalFeed, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + icalFeedColumns + ` from ical_feeds f join rooms r on (r.id = f.room_id)
+		where f.id = $1;`
+
+	return scanICalFeed(m.queryRow(ctx, query, id))
+}
+
+// InsertICalFeed inserts an external calendar and returns its ID
+func (m *sqlDBRepo) InsertICalFeed(ctx context.Context, f Models.ICalFeed) (int, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into ical_feeds (room_id, name, url, content, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6) returning id;`
+
+	err := m.queryRow(ctx, stmt,
+		f.RoomID,
+		f.Name,
+		f.URL,
+		f.Content,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateICalFeedContent replaces the file of an uploaded external calendar
+func (m *sqlDBRepo) UpdateICalFeedContent(ctx context.Context, id int, content string) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	_, err := m.exec(ctx, `update ical_feeds set content = $1, updated_at = $2 where id = $3;`,
+		content, time.Now(), id)
+
+	return err
+}
+
+// UpdateICalFeedStatus records the outcome of the last sync of an external calendar
+func (m *sqlDBRepo) UpdateICalFeedStatus(ctx context.Context, f Models.ICalFeed) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `update ical_feeds set last_synced_at = $1, last_error = $2, blocks = $3, skipped = $4, recurring = $5
+		where id = $6;`
+
+	_, err := m.exec(ctx, stmt, f.LastSyncedAt, f.LastError, f.Blocks, f.Skipped, f.Recurring, f.ID)
+
+	return err
+}
+
+// DeleteICalFeed deletes an external calendar, its blocks go with it
+func (m *sqlDBRepo) DeleteICalFeed(ctx context.Context, id int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	_, err := m.exec(ctx, `delete from ical_feeds where id = $1;`, id)
+
+	return err
+}
+
+// SyncExternalBlocks makes the External restrictions of an external calendar match blocks, keyed by their
+// ExternalUID, in one transaction. Blocks whose dates are unchanged are kept as they are. A new or moved block
+// whose nights are already taken is skipped, and the number of skipped blocks is returned
+func (m *sqlDBRepo) SyncExternalBlocks(ctx context.Context, f Models.ICalFeed, blocks []Models.RoomRestriction) (int, error) {
+	var skipped int
+
+	err := m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		rows, err := tx.query(ctx, `select id, external_uid, start_date, end_date
+			from room_restrictions where ical_feed_id = $1;`, f.ID)
+		if err != nil {
+			return err
+		}
+		existing := make(map[string]Models.RoomRestriction)
+		for rows.Next() {
+			var r Models.RoomRestriction
+			if err := rows.Scan(&r.ID, &r.ExternalUID, &r.StartDate, &r.EndDate); err != nil {
+				rows.Close()
+				return err
+			}
+			existing[r.ExternalUID] = r
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		wanted := make(map[string]Models.RoomRestriction)
+		for _, b := range blocks {
+			wanted[b.ExternalUID] = b
+		}
+
+		// remove what is gone or moved first, so moved blocks don't collide with their old nights
+		for uid, old := range existing {
+			if b, ok := wanted[uid]; ok && sameNights(b, old) {
+				continue
+			}
+			if _, err := tx.exec(ctx, `delete from room_restrictions where id = $1;`, old.ID); err != nil {
+				return err
+			}
+		}
+
+		for _, b := range blocks {
+			if old, ok := existing[b.ExternalUID]; ok && sameNights(b, old) {
+				continue
+			}
+
+			available, err := tx.SearchAvailabilityByDateByRoomID(ctx, b.StartDate, b.EndDate, f.RoomID)
+			if err != nil {
+				return err
+			}
+			if !available {
+				skipped++
+				continue
+			}
+
+			stmt := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, ical_feed_id,
+				external_uid, created_at, updated_at) values ($1, $2, $3, $4, $5, $6, $7, $8);`
+			_, err = tx.exec(ctx, stmt, b.StartDate, b.EndDate, f.RoomID, Models.RestrictionExternal,
+				f.ID, b.ExternalUID, time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return skipped, nil
+}
+
+// GetRatePlan returns the rate plan of a room, with its seasonal rates ordered by start date.
+// A room without a rate_plans row gets a plan charging its base price every night
+func (m *sqlDBRepo) GetRatePlan(ctx context.Context, roomID int) (Models.RatePlan, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	plan := Models.RatePlan{RoomID: roomID}
+
+	query := `select coalesce(p.id, 0), r.base_price, coalesce(p.weekend_rate, 0)
+		from rooms r left join rate_plans p on (p.room_id = r.id)
+		where r.id = $1;`
+
+	err := m.queryRow(ctx, query, roomID).Scan(
+		&plan.ID,
+		&plan.BaseRate,
+		&plan.WeekendRate,
+	)
+	if err != nil {
+		return plan, err
+	}
+
+	query = `select id, room_id, name, start_date, end_date, rate, created_at, updated_at
+		from seasonal_rates where room_id = $1 order by start_date;`
+
+	rows, err := m.query(ctx, query, roomID)
+	if err != nil {
+		return plan, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Models.SeasonalRate
+		err = rows.Scan(
+			&s.ID,
+			&s.RoomID,
+			&s.Name,
+			&s.StartDate,
+			&s.EndDate,
+			&s.Rate,
+			&s.CreatedAt,
+			&s.UpdatedAt,
+		)
+		if err != nil {
+			return plan, err
+		}
+		plan.SeasonalRates = append(plan.SeasonalRates, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return plan, err
+	}
+
+	return plan, nil
+}
+
+// UpdateRatePlan saves the base and weekend rate of a room
+func (m *sqlDBRepo) UpdateRatePlan(ctx context.Context, plan Models.RatePlan) error {
+	return m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		ctx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		_, err := tx.exec(ctx, `update rooms set base_price = $1, updated_at = $2 where id = $3;`,
+			plan.BaseRate, time.Now(), plan.RoomID)
+		if err != nil {
+			return err
+		}
+
+		stmt := `insert into rate_plans (room_id, weekend_rate, created_at, updated_at) values ($1, $2, $3, $4)
+			on conflict (room_id) do update set weekend_rate = excluded.weekend_rate, updated_at = excluded.updated_at;`
+
+		_, err = tx.exec(ctx, stmt, plan.RoomID, plan.WeekendRate, time.Now(), time.Now())
+		return err
+	})
+}
+
+// InsertSeasonalRate inserts a seasonal rate for a room
+func (m *sqlDBRepo) InsertSeasonalRate(ctx context.Context, s Models.SeasonalRate) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `insert into seasonal_rates (room_id, name, start_date, end_date, rate, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7);`
+
+	_, err := m.exec(ctx, stmt,
+		s.RoomID,
+		s.Name,
+		s.StartDate,
+		s.EndDate,
+		s.Rate,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteSeasonalRate deletes a seasonal rate by given ID
+func (m *sqlDBRepo) DeleteSeasonalRate(ctx context.Context, id int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `delete from seasonal_rates where id = $1;`
+
+	_, err := m.exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AllWebhooks returns every webhook, ordered by name
+func (m *sqlDBRepo) AllWebhooks(ctx context.Context) ([]Models.Webhook, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var webhooks []Models.Webhook
+
+	rows, err := m.query(ctx, `select `+webhookColumns+` from webhooks order by name, id;`)
+	if err != nil {
+		return webhooks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return webhooks, err
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return webhooks, err
+	}
+
+	return webhooks, nil
+}
+
+// GetWebhookByID returns a webhook by id
+func (m *sqlDBRepo) GetWebhookByID(ctx context.Context, id int) (Models.Webhook, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	return scanWebhook(m.queryRow(ctx, `select `+webhookColumns+` from webhooks where id = $1;`, id))
+}
+
+// InsertWebhook inserts a webhook and returns its ID
+func (m *sqlDBRepo) InsertWebhook(ctx context.Context, w Models.Webhook) (int, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into webhooks (name, url, secret, events, active, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id;`
+
+	err := m.queryRow(ctx, stmt,
+		w.Name,
+		w.URL,
+		w.Secret,
+		w.Events,
+		w.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateWebhook updates a webhook
+func (m *sqlDBRepo) UpdateWebhook(ctx context.Context, w Models.Webhook) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `update webhooks set name = $1, url = $2, secret = $3, events = $4, active = $5, updated_at = $6
+		where id = $7;`
+
+	_, err := m.exec(ctx, stmt, w.Name, w.URL, w.Secret, w.Events, w.Active, time.Now(), w.ID)
+
+	return err
+}
+
+// DeleteWebhook deletes a webhook, its deliveries go with it
+func (m *sqlDBRepo) DeleteWebhook(ctx context.Context, id int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	_, err := m.exec(ctx, `delete from webhooks where id = $1;`, id)
+
+	return err
+}
+
+// QueueWebhookEvent queues a delivery of payload to every active webhook subscribed to event, due right away.
+// The parameters are cast, as Postgres can't infer their types from the select; SQLite drops the casts
+func (m *sqlDBRepo) QueueWebhookEvent(ctx context.Context, event Models.WebhookEvent, payload string) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `insert into webhook_deliveries (webhook_id, event, payload, next_attempt_at, created_at, updated_at)
+		select id, $1::varchar, $2::text, $3::timestamp, $4::timestamp, $5::timestamp from webhooks
+		where active and ' ' || events || ' ' like '% ' || $6 || ' %';`
+
+	_, err := m.exec(ctx, stmt, string(event), payload, time.Now(), time.Now(), time.Now(), string(event))
+
+	return err
+}
+
+// GetDueWebhookDeliveries returns up to limit deliveries to active webhooks whose next attempt is due at now,
+// the longest due first
+func (m *sqlDBRepo) GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]Models.WebhookDelivery, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + webhookDeliveryColumns + ` from webhook_deliveries d join webhooks w on (w.id = d.webhook_id)
+		where d.next_attempt_at <= $1 and w.active order by d.next_attempt_at, d.id limit $2;`
+
+	return m.queryWebhookDeliveries(ctx, query, now, limit)
+}
+
+// GetWebhookDeliveries returns the last limit deliveries of a webhook, newest first
+func (m *sqlDBRepo) GetWebhookDeliveries(ctx context.Context, webhookID, limit int) ([]Models.WebhookDelivery, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + webhookDeliveryColumns + ` from webhook_deliveries d join webhooks w on (w.id = d.webhook_id)
+		where d.webhook_id = $1 order by d.id desc limit $2;`
+
+	return m.queryWebhookDeliveries(ctx, query, webhookID, limit)
+}
+
+// queryWebhookDeliveries returns the webhook deliveries selected by query
+func (m *sqlDBRepo) queryWebhookDeliveries(ctx context.Context, query string, args ...interface{}) ([]Models.WebhookDelivery, error) {
+	var deliveries []Models.WebhookDelivery
+
+	rows, err := m.query(ctx, query, args...)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return deliveries, err
+	}
+
+	return deliveries, nil
+}
+
+// UpdateWebhookDelivery records an attempt of a webhook delivery
+func (m *sqlDBRepo) UpdateWebhookDelivery(ctx context.Context, d Models.WebhookDelivery) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set attempts = $1, next_attempt_at = $2, last_attempt_at = $3,
+		response_status = $4, last_error = $5, delivered_at = $6, updated_at = $7 where id = $8;`
+
+	_, err := m.exec(ctx, stmt,
+		d.Attempts,
+		nullTime(d.NextAttemptAt),
+		nullTime(d.LastAttemptAt),
+		d.ResponseStatus,
+		d.LastError,
+		nullTime(d.DeliveredAt),
+		time.Now(),
+		d.ID,
+	)
+
+	return err
+}
+
+// RetryWebhookDelivery makes a delivery of a webhook that wasn't delivered due right away, once more
+func (m *sqlDBRepo) RetryWebhookDelivery(ctx context.Context, webhookID, id int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set next_attempt_at = $1, updated_at = $2
+		where id = $3 and webhook_id = $4 and delivered_at is null;`
+
+	_, err := m.exec(ctx, stmt, time.Now(), time.Now(), id, webhookID)
+
+	return err
+}
+
+// QueueMail adds msg to the outbox, due right away
+func (m *sqlDBRepo) QueueMail(ctx context.Context, msg Models.MailData) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	attachments, err := encodeAttachments(msg.Attachments)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into mail_messages (to_address, from_address, subject, content, plain_content, attachments,
+		status, next_attempt_at, created_at, updated_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`
+
+	_, err = m.exec(ctx, stmt,
+		msg.To,
+		msg.From,
+		msg.Subject,
+		msg.Content,
+		msg.PlainContent,
+		attachments,
+		Models.MailPending,
+		time.Now(),
+		time.Now(),
+		time.Now(),
+	)
+
+	return err
+}
+
+// GetDueMail returns up to limit pending messages whose next attempt is due at now, the longest due first
+func (m *sqlDBRepo) GetDueMail(ctx context.Context, now time.Time, limit int) ([]Models.MailMessage, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + mailMessageColumns + ` from mail_messages
+		where status = $1 and next_attempt_at <= $2 order by next_attempt_at, id limit $3;`
+
+	return m.queryMailMessages(ctx, query, Models.MailPending, now, limit)
+}
+
+// GetMailMessages returns the last limit messages with status, newest first
+func (m *sqlDBRepo) GetMailMessages(ctx context.Context, status string, limit int) ([]Models.MailMessage, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `select ` + mailMessageColumns + ` from mail_messages where status = $1 order by id desc limit $2;`
+
+	return m.queryMailMessages(ctx, query, status, limit)
+}
+
+// queryMailMessages returns the mail messages selected by query
+func (m *sqlDBRepo) queryMailMessages(ctx context.Context, query string, args ...interface{}) ([]Models.MailMessage, error) {
+	var messages []Models.MailMessage
+
+	rows, err := m.query(ctx, query, args...)
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanMailMessage(rows)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return messages, err
+	}
+
+	return messages, nil
+}
+
+// UpdateMailMessage records an attempt of a mail message
+func (m *sqlDBRepo) UpdateMailMessage(ctx context.Context, msg Models.MailMessage) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `update mail_messages set status = $1, attempts = $2, next_attempt_at = $3, last_attempt_at = $4,
+		last_error = $5, sent_at = $6, updated_at = $7 where id = $8;`
+
+	_, err := m.exec(ctx, stmt,
+		msg.Status,
+		msg.Attempts,
+		nullTime(msg.NextAttemptAt),
+		nullTime(msg.LastAttemptAt),
+		msg.LastError,
+		nullTime(msg.SentAt),
+		time.Now(),
+		msg.ID,
+	)
+
+	return err
+}
+
+// ResendMail makes a failed message pending again, due right away, with a fresh set of attempts
+func (m *sqlDBRepo) ResendMail(ctx context.Context, id int) error {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	stmt := `update mail_messages set status = $1, attempts = 0, next_attempt_at = $2, updated_at = $3
+		where id = $4 and status = $5;`
+
+	_, err := m.exec(ctx, stmt, Models.MailPending, time.Now(), time.Now(), id, Models.MailFailed)
+
+	return err
+}
+
+// GetArrivalsToRemind returns the reservations that weren't cancelled and start between from and to, whose guests
+// weren't reminded yet
+func (m *sqlDBRepo) GetArrivalsToRemind(ctx context.Context, from, to time.Time) ([]Models.Reservation, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
+		r.end_date, r.room_id, r.total_price, r.created_at, r.updated_at,
+		r.confirmation_code, r.cancelled,
+		rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.cancelled = 0 and r.start_date >= $1 and r.start_date <= $2 and not exists (
+			select 1 from reservation_notifications n where n.reservation_id = r.id and n.kind = $3)
+		order by r.start_date, r.id
+`
+
+	return m.queryReservationsToNotify(ctx, query, from, to, Models.NotificationArrivalReminder)
+}
+
+// GetDeparturesToThank returns the reservations that weren't cancelled and end between from and to, whose guests
+// weren't thanked yet
+func (m *sqlDBRepo) GetDeparturesToThank(ctx context.Context, from, to time.Time) ([]Models.Reservation, error) {
+	ctx, cancel := queryTimeout(ctx, m.App)
+	defer cancel()
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
+		r.end_date, r.room_id, r.total_price, r.created_at, r.updated_at,
+		r.confirmation_code, r.cancelled,
+		rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.cancelled = 0 and r.end_date >= $1 and r.end_date <= $2 and not exists (
+			select 1 from reservation_notifications n where n.reservation_id = r.id and n.kind = $3)
+		order by r.end_date, r.id
+`
+
+	return m.queryReservationsToNotify(ctx, query, from, to, Models.NotificationThankYou)
+}
+
+// queryReservationsToNotify returns the reservations selected by query
+func (m *sqlDBRepo) queryReservationsToNotify(ctx context.Context, query string, args ...interface{}) ([]Models.Reservation, error) {
+	var reservations []Models.Reservation
+
+	rows, err := m.query(ctx, query, args...)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i Models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.TotalPrice,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.ConfirmationCode,
+			&i.Cancelled,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+
+		reservations = append(reservations, i)
+	}
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// RecordNotification records that the email of kind was queued for a reservation and queues mail in one
+// transaction. It reports false, queueing nothing, if the notification was recorded before
+func (m *sqlDBRepo) RecordNotification(ctx context.Context, reservationID int, kind string, mail ...Models.MailData) (bool, error) {
+	recorded := false
+
+	err := m.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		tx := repo.(*sqlDBRepo)
+
+		queryCtx, cancel := queryTimeout(ctx, m.App)
+		defer cancel()
+
+		stmt := `insert into reservation_notifications (reservation_id, kind, created_at, updated_at)
+			values ($1, $2, $3, $4) on conflict (reservation_id, kind) do nothing;`
+
+		result, err := tx.exec(queryCtx, stmt, reservationID, kind, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		recorded = true
+
+		for _, msg := range mail {
+			if err := repo.QueueMail(ctx, msg); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return recorded, nil
+}
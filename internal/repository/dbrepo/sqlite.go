@@ -0,0 +1,66 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// sqlitePlaceholder matches a $n placeholder, which SQLite takes as ?n
+	sqlitePlaceholder = regexp.MustCompile(`\$(\d+)`)
+	// sqliteCast matches a Postgres cast such as ::timestamp, which SQLite doesn't need
+	sqliteCast = regexp.MustCompile(`::\w+`)
+)
+
+// sqliteDialect rewrites the queries of sqlDBRepo for SQLite. Rewritten queries are cached, as the same
+// few queries run over and over
+type sqliteDialect struct {
+	queries *sync.Map
+}
+
+// newSQLiteDialect returns a dialect with an empty query cache
+func newSQLiteDialect() sqliteDialect {
+	return sqliteDialect{queries: &sync.Map{}}
+}
+
+func (d sqliteDialect) rebind(query string) string {
+	if q, ok := d.queries.Load(query); ok {
+		return q.(string)
+	}
+
+	q := sqlitePlaceholder.ReplaceAllString(sqliteCast.ReplaceAllString(query, ""), "?$1")
+	d.queries.Store(query, q)
+
+	return q
+}
+
+// convertArgs drops the time zone of times, keeping their wall clock as the timestamp and date columns of
+// Postgres do. SQLite keeps times as text, which only sorts by time when all of them have the same offset
+func (sqliteDialect) convertArgs(args []interface{}) []interface{} {
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch t := arg.(type) {
+		case time.Time:
+			converted[i] = wallClock(t)
+		case sql.NullTime:
+			converted[i] = sql.NullTime{Time: wallClock(t.Time), Valid: t.Valid}
+		default:
+			converted[i] = arg
+		}
+	}
+
+	return converted
+}
+
+// wallClock returns t with its wall clock in UTC
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// isOverlapError reports whether err was raised by the room_restrictions_no_overlap triggers
+func (sqliteDialect) isOverlapError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "room_restrictions_no_overlap")
+}
@@ -0,0 +1,494 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/config"
+	"github.com/454270186/Hotel-booking-web-application/internal/driver"
+	"github.com/454270186/Hotel-booking-web-application/internal/repository"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// migrationsDir holds the migrations soda runs
+const migrationsDir = "../../../migrations"
+
+// newSQLiteRepo returns a repository on a new SQLite file with all migrations applied
+func newSQLiteRepo(t *testing.T) repository.DatabaseRepo {
+	db, err := driver.NewSQLiteDatabase(filepath.Join(t.TempDir(), "bookings.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	migrateSQLite(t, db)
+
+	return NewSQLiteRepo(&config.AppConfig{}, db)
+}
+
+// migrateSQLite applies the up migrations to db in order, as soda does for SQLite: the .sqlite3.up.sql files as
+// they are and the fizz files translated by fizzSchema
+func migrateSQLite(t *testing.T, db *sql.DB) {
+	files, err := filepath.Glob(filepath.Join(migrationsDir, "*.up.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+
+	schema := fizzSchema{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var statements []string
+		switch {
+		case strings.HasSuffix(file, ".up.fizz"):
+			statements, err = schema.translate(string(content))
+			if err != nil {
+				t.Fatalf("%s: %v", filepath.Base(file), err)
+			}
+		case strings.HasSuffix(file, ".sqlite3.up.sql"):
+			statements = []string{string(content)}
+		default:
+			continue
+		}
+
+		for _, s := range statements {
+			if _, err := db.Exec(s); err != nil {
+				t.Fatalf("%s: %v\n%s", filepath.Base(file), err, s)
+			}
+		}
+	}
+}
+
+var (
+	fizzCommand = regexp.MustCompile(`(?s)(create_table|add_column|change_column|add_index|add_foreign_key)\((.*?)\)\s*(\{(.*?)\n\}|\n|$)`)
+	fizzColumn  = regexp.MustCompile(`t\.Column\("(\w+)", "(\w+)", \{(.*?)\}\)`)
+	fizzString  = regexp.MustCompile(`"(\w*)"`)
+	fizzOption  = regexp.MustCompile(`"?(\w+)"?:\s*("[^"]*"|\w+)`)
+)
+
+// fizzSchema translates the fizz commands the migrations use to SQLite the way fizz does, keeping track of the
+// tables as fizz reads them from the database. Like fizz, it rebuilds a table to change a column or add a
+// foreign key, which drops the table's triggers
+type fizzSchema map[string]*fizzTable
+
+type fizzTable struct {
+	name        string
+	columns     []fizzColumnDef
+	foreignKeys []string
+	indexes     []string
+}
+
+type fizzColumnDef struct {
+	name    string
+	sql     string
+	primary bool
+}
+
+// translate returns the SQL statements of the fizz commands in src
+func (s fizzSchema) translate(src string) ([]string, error) {
+	var statements []string
+	for _, m := range fizzCommand.FindAllStringSubmatch(src, -1) {
+		command, args, body := m[1], m[2], m[4]
+		names := fizzString.FindAllStringSubmatch(args, -1)
+		table := names[0][1]
+
+		switch command {
+		case "create_table":
+			t := &fizzTable{name: table}
+			for _, c := range fizzColumn.FindAllStringSubmatch(body, -1) {
+				t.columns = append(t.columns, fizzColumnSQL(c[1], c[2], c[3]))
+			}
+			t.columns = append(t.columns, fizzColumnSQL("created_at", "timestamp", ""), fizzColumnSQL("updated_at", "timestamp", ""))
+			s[table] = t
+			statements = append(statements, t.create())
+
+		case "add_column", "change_column":
+			t, ok := s[table]
+			if !ok {
+				return nil, fmt.Errorf("unknown table %s", table)
+			}
+			options := args[strings.Index(args, "{"):]
+			c := fizzColumnSQL(names[1][1], names[2][1], options)
+			if command == "add_column" {
+				t.columns = append(t.columns, c)
+				statements = append(statements, fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN %s;`, table, c.sql))
+				continue
+			}
+			for i := range t.columns {
+				if t.columns[i].name == c.name {
+					t.columns[i] = c
+				}
+			}
+			statements = append(statements, t.rebuild()...)
+
+		case "add_index":
+			t, ok := s[table]
+			if !ok {
+				return nil, fmt.Errorf("unknown table %s", table)
+			}
+			var columns []string
+			for _, n := range names[1:] {
+				if n[1] == "unique" {
+					break
+				}
+				columns = append(columns, n[1])
+			}
+			unique := ""
+			if strings.Contains(args, `"unique": true`) {
+				unique = "UNIQUE "
+			}
+			index := fmt.Sprintf(`CREATE %sINDEX "%s_%s_idx" ON "%s" (%s);`, unique, table, strings.Join(columns, "_"),
+				table, strings.Join(columns, ", "))
+			t.indexes = append(t.indexes, index)
+			statements = append(statements, index)
+
+		case "add_foreign_key":
+			t, ok := s[table]
+			if !ok {
+				return nil, fmt.Errorf("unknown table %s", table)
+			}
+			t.foreignKeys = append(t.foreignKeys, fmt.Sprintf(
+				`FOREIGN KEY (%s) REFERENCES %s (%s) ON UPDATE CASCADE ON DELETE CASCADE`, names[1][1], names[2][1], names[3][1]))
+			statements = append(statements, t.rebuild()...)
+		}
+	}
+
+	return statements, nil
+}
+
+// fizzColumnSQL returns the definition of a column of typ with the fizz options
+func fizzColumnSQL(name, typ, options string) fizzColumnDef {
+	values := map[string]string{}
+	for _, o := range fizzOption.FindAllStringSubmatch(options, -1) {
+		values[o[1]] = o[2]
+	}
+
+	if values["primary"] == "true" {
+		return fizzColumnDef{name: name, sql: fmt.Sprintf(`"%s" INTEGER PRIMARY KEY AUTOINCREMENT`, name), primary: true}
+	}
+
+	switch typ {
+	case "string", "text":
+		typ = "TEXT"
+	case "timestamp":
+		typ = "DATETIME"
+	default:
+		typ = strings.ToUpper(typ)
+	}
+
+	def := fmt.Sprintf(`"%s" %s`, name, typ)
+	if values["null"] != "true" {
+		def += " NOT NULL"
+	}
+	if d, ok := values["default"]; ok {
+		def += " DEFAULT " + strings.ReplaceAll(d, `"`, "'")
+	}
+
+	return fizzColumnDef{name: name, sql: def}
+}
+
+// create returns the statement creating t
+func (t *fizzTable) create() string {
+	var defs []string
+	for _, c := range t.columns {
+		defs = append(defs, c.sql)
+	}
+	defs = append(defs, t.foreignKeys...)
+
+	return fmt.Sprintf(`CREATE TABLE "%s" (%s);`, t.name, strings.Join(defs, ", "))
+}
+
+// rebuild returns the statements that replace t by a new table with its current definition, keeping the rows
+func (t *fizzTable) rebuild() []string {
+	tmp := "_" + t.name + "_tmp"
+	statements := []string{
+		`PRAGMA foreign_keys = OFF;`,
+		fmt.Sprintf(`ALTER TABLE "%s" RENAME TO "%s";`, t.name, tmp),
+		t.create(),
+		fmt.Sprintf(`INSERT INTO "%s" SELECT * FROM "%s";`, t.name, tmp),
+		fmt.Sprintf(`DROP TABLE "%s";`, tmp),
+	}
+	statements = append(statements, t.indexes...)
+
+	return append(statements, `PRAGMA foreign_keys = ON;`)
+}
+
+func TestSQLiteRepo_Availability(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	// the time zone doesn't change the nights the reservation covers
+	start := time.Date(2050, 1, 10, 0, 0, 0, 0, time.FixedZone("UTC+8", 8*60*60))
+	_, err := repo.CreateReservation(ctx, Models.Reservation{
+		FirstName:        "Erfei",
+		Email:            "me@here.com",
+		StartDate:        start,
+		EndDate:          start.AddDate(0, 0, 2),
+		RoomID:           1,
+		ConfirmationCode: "ABCDEFGHJK",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		start    string
+		end      string
+		expected bool
+	}{
+		{"before", "2050-01-08", "2050-01-10", true},
+		{"after", "2050-01-12", "2050-01-14", true},
+		{"overlap start", "2050-01-09", "2050-01-11", false},
+		{"overlap end", "2050-01-11", "2050-01-13", false},
+		{"inside", "2050-01-10", "2050-01-11", false},
+		{"around", "2049-12-20", "2050-02-01", false},
+	}
+
+	for _, e := range tests {
+		ok, err := repo.SearchAvailabilityByDateByRoomID(ctx, date(e.start), date(e.end), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != e.expected {
+			t.Errorf("for %s, expected availability %t but got %t", e.name, e.expected, ok)
+		}
+	}
+
+	rooms, err := repo.SearchAvailabilityForAllRooms(ctx, date("2050-01-11"), date("2050-01-12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].RoomName != "Major's Suite" {
+		t.Errorf("expected only the seeded Major's Suite to be free, got %+v", rooms)
+	}
+}
+
+func TestSQLiteRepo_CreateReservation(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	res := Models.Reservation{
+		FirstName:        "Erfei",
+		Email:            "me@here.com",
+		StartDate:        date("2050-01-10"),
+		EndDate:          date("2050-01-12"),
+		RoomID:           2,
+		ConfirmationCode: "ABCDEFGHJK",
+	}
+	id, err := repo.CreateReservation(ctx, res, Models.MailData{To: "me@here.com", From: "me@there.com", Subject: "Confirmation"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.StartDate = date("2050-01-11")
+	res.EndDate = date("2050-01-13")
+	res.ConfirmationCode = "BCDEFGHJKL"
+	if _, err := repo.CreateReservation(ctx, res); !errors.Is(err, repository.ErrRoomUnavailable) {
+		t.Fatalf("expected ErrRoomUnavailable booking taken dates, got %v", err)
+	}
+
+	// the triggers reject an overlap that got past the availability check
+	err = repo.InsertRoomRestriction(ctx, Models.RoomRestriction{
+		StartDate:     date("2050-01-11"),
+		EndDate:       date("2050-01-12"),
+		RoomID:        2,
+		ReservationID: id,
+		RestrictionID: 1,
+	})
+	if !errors.Is(err, repository.ErrRoomUnavailable) {
+		t.Fatalf("expected the overlap triggers to raise ErrRoomUnavailable, got %v", err)
+	}
+
+	got, err := repo.GetReservationByCode(ctx, "ABCDEFGHJK", "me@here.com")
+	if err != nil || got.ID != id || !got.StartDate.Equal(date("2050-01-10")) {
+		t.Errorf("expected reservation %d from 2050-01-10, got %+v and %v", id, got, err)
+	}
+	if msgs, _ := repo.GetDueMail(ctx, time.Now(), 10); len(msgs) != 1 {
+		t.Errorf("expected the mail of the reservation only, got %d messages", len(msgs))
+	}
+}
+
+func TestSQLiteRepo_ResetPassword(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	id, err := repo.InsertUser(ctx, Models.User{FirstName: "Front", Email: "desk@here.com", Password: "secret123", AccessLevel: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the expiry is compared in the database
+	tokens := []Models.PasswordResetToken{
+		{UserID: id, TokenHash: "expired", ExpiresAt: time.Now().Add(-time.Minute)},
+		{UserID: id, TokenHash: "valid", ExpiresAt: time.Now().Add(time.Hour)},
+		{UserID: id, TokenHash: "other", ExpiresAt: time.Now().Add(time.Hour)},
+	}
+	for _, tok := range tokens {
+		if err := repo.InsertPasswordResetToken(ctx, tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := repo.ResetPassword(ctx, "expired", "new password"); !errors.Is(err, repository.ErrInvalidResetToken) {
+		t.Fatalf("expected ErrInvalidResetToken for an expired token, got %v", err)
+	}
+	if err := repo.ResetPassword(ctx, "valid", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Authenticate(ctx, "Desk@Here.com", "new password"); err != nil {
+		t.Errorf("expected the new password to work, got %v", err)
+	}
+	// every other token of the user is used up with it
+	if err := repo.ResetPassword(ctx, "other", "another password"); !errors.Is(err, repository.ErrInvalidResetToken) {
+		t.Errorf("expected ErrInvalidResetToken for the other token, got %v", err)
+	}
+}
+
+func TestSQLiteRepo_DeactivateUser(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	id, err := repo.InsertUser(ctx, Models.User{FirstName: "Front", Email: "desk@here.com", Password: "secret123", AccessLevel: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.EnableTwoFactor(ctx, id, "SECRET", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repo.CountRecoveryCodes(ctx, id); err != nil || n != 2 {
+		t.Fatalf("expected 2 recovery codes, got %d and %v", n, err)
+	}
+	if _, err := repo.InsertAPIToken(ctx, Models.APIToken{Name: "desk", TokenHash: "hash", Scopes: "availability:read", UserID: id}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.DeactivateUser(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := repo.GetAPITokenByHash(ctx, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tok.Revoked() || tok.User.Active {
+		t.Errorf("expected the token of the deactivated user to be revoked, got %+v", tok)
+	}
+	if _, _, err := repo.Authenticate(ctx, "desk@here.com", "secret123"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the deactivated user not to be found, got %v", err)
+	}
+}
+
+func TestSQLiteRepo_CancelReservation(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	res := Models.Reservation{
+		FirstName:        "Erfei",
+		Email:            "me@here.com",
+		StartDate:        date("2050-01-10"),
+		EndDate:          date("2050-01-12"),
+		RoomID:           1,
+		ConfirmationCode: "ABCDEFGHJK",
+	}
+	id, err := repo.CreateReservation(ctx, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.CancelReservation(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := repo.SearchAvailabilityByDateByRoomID(ctx, res.StartDate, res.EndDate, 1); err != nil || !ok {
+		t.Errorf("expected the room to be free again, got %v and %v", ok, err)
+	}
+	if got, err := repo.GetReservationByID(ctx, id); err != nil || got.Cancelled != 1 {
+		t.Errorf("expected the reservation to be cancelled, got %+v and %v", got, err)
+	}
+}
+
+func TestSQLiteRepo_UpdateICalFeedStatus(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	id, err := repo.InsertICalFeed(ctx, Models.ICalFeed{RoomID: 1, Name: "Other site", URL: "https://other.example/cal.ics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := Models.ICalFeed{ID: id, LastSyncedAt: time.Now(), Blocks: 3, Skipped: 1, Recurring: 2}
+	if err := repo.UpdateICalFeedStatus(ctx, status); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := repo.GetICalFeedByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Blocks != 3 || f.Skipped != 1 || f.Recurring != 2 || f.LastSyncedAt.IsZero() {
+		t.Errorf("unexpected status %+v", f)
+	}
+}
+
+func TestSQLiteRepo_WithTx(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepo(t)
+
+	err := repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		if err := tx.InsertBlockForRoom(ctx, 1, date("2050-01-01")); err != nil {
+			return err
+		}
+		// the second block overlaps the first, so the whole transaction rolls back
+		return tx.InsertBlockForRoom(ctx, 1, date("2050-01-01"))
+	})
+	if !errors.Is(err, repository.ErrRoomUnavailable) {
+		t.Fatalf("expected ErrRoomUnavailable, got %v", err)
+	}
+
+	restrictions, err := repo.GetRestrictionsForRoomByDate(ctx, 1, date("2050-01-01"), date("2050-02-01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restrictions) != 0 {
+		t.Error("rolled back transaction should not leave any blocks")
+	}
+
+	err = repo.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		if err := tx.InsertBlockForRoom(ctx, 1, date("2050-01-01")); err != nil {
+			return err
+		}
+		return tx.InsertBlockForRoom(ctx, 1, date("2050-01-02"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restrictions, _ = repo.GetRestrictionsForRoomByDate(ctx, 1, date("2050-01-01"), date("2050-02-01"))
+	if len(restrictions) != 2 {
+		t.Errorf("committed transaction should leave 2 blocks, got %d", len(restrictions))
+	}
+}
+
+func TestSQLiteDialect_Rebind(t *testing.T) {
+	d := newSQLiteDialect()
+
+	query := `select id, $1::varchar, $2::timestamp from webhooks where id = $3 or id = $1`
+	expected := `select id, ?1, ?2 from webhooks where id = ?3 or id = ?1`
+	for i := 0; i < 2; i++ {
+		if got := d.rebind(query); got != expected {
+			t.Errorf("expected %q, got %q", expected, got)
+		}
+	}
+}
@@ -1,66 +1,217 @@
 package dbrepo
 
 import (
+	"context"
+	"database/sql"
 	"github.com/454270186/Hotel-booking-web-application/internal/Models"
+	"github.com/454270186/Hotel-booking-web-application/internal/repository"
 	"time"
 )
 
-func (m *testDBRepo) AllUsers() bool {
-	return true
+// WithTx runs fn against the test repository
+func (m *testDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	return fn(m)
 }
 
 // InsertReservation inserts a reservation into database
-func (m *testDBRepo) InsertReservation(res Models.Reservation) (int, error) {
+func (m *testDBRepo) InsertReservation(ctx context.Context, res Models.Reservation) (int, error) {
 	return 1, nil
 }
 
 // InsertRoomRestriction inserts a room restriction into database
-func (m *testDBRepo) InsertRoomRestriction(r Models.RoomRestriction) error {
+func (m *testDBRepo) InsertRoomRestriction(ctx context.Context, r Models.RoomRestriction) error {
 	return nil
 }
 
+// CreateReservation inserts a reservation, its room restriction and its mail, failing for room 2 as if it was just booked
+func (m *testDBRepo) CreateReservation(ctx context.Context, res Models.Reservation, mail ...Models.MailData) (int, error) {
+	if res.RoomID == 2 {
+		return 0, repository.ErrRoomUnavailable
+	}
+
+	return 1, nil
+}
+
 // SearchAvailabilityByDate returns true if availability exists for roomID and false if no availability
-func (m *testDBRepo) SearchAvailabilityByDateByRoomID(start, end time.Time, roomID int) (bool, error) {
+func (m *testDBRepo) SearchAvailabilityByDateByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
 	return false, nil
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
-func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]Models.Room, error) {
+func (m *testDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]Models.Room, error) {
 	var rooms []Models.Room
 
 	return rooms, nil
 }
 
-// GetRoomByID gets a room by given id
-func (m *testDBRepo) GetRoomByID(id int) (Models.Room, error) {
-	var room Models.Room
+// GetRoomByID gets a room by given id, rooms 1 and 2 exist
+func (m *testDBRepo) GetRoomByID(ctx context.Context, id int) (Models.Room, error) {
+	if id != 1 && id != 2 {
+		return Models.Room{}, sql.ErrNoRows
+	}
 
-	return room, nil
+	return Models.Room{ID: id, Active: true}, nil
 }
 
-func (m *testDBRepo) GetUserByID(id int) (Models.User, error) {
+func (m *testDBRepo) GetUserByID(ctx context.Context, id int) (Models.User, error) {
 	var u Models.User
 
 	return u, nil
 }
 
-func (m *testDBRepo) UpdateUser(u Models.User) error {
+// AllUsers returns a slice of all users
+func (m *testDBRepo) AllUsers(ctx context.Context) ([]Models.User, error) {
+	var users []Models.User
+
+	return users, nil
+}
+
+// GetUserByEmail returns the user with the given email, only me@me.com exists
+func (m *testDBRepo) GetUserByEmail(ctx context.Context, email string) (Models.User, error) {
+	if email == "me@me.com" {
+		return Models.User{ID: 1, Email: email, AccessLevel: 4, Active: true}, nil
+	}
+
+	return Models.User{}, sql.ErrNoRows
+}
+
+// InsertUser inserts a user into database
+func (m *testDBRepo) InsertUser(ctx context.Context, u Models.User) (int, error) {
+	return 2, nil
+}
+
+func (m *testDBRepo) UpdateUser(ctx context.Context, u Models.User) error {
+	return nil
+}
+
+// UpdatePassword updates the password of a user
+func (m *testDBRepo) UpdatePassword(ctx context.Context, id int, password string) error {
+	return nil
+}
+
+// DeactivateUser deactivates a user
+func (m *testDBRepo) DeactivateUser(ctx context.Context, id int) error {
+	return nil
+}
+
+// InsertPasswordResetToken stores the hash of a password reset token
+func (m *testDBRepo) InsertPasswordResetToken(ctx context.Context, t Models.PasswordResetToken) error {
+	return nil
+}
+
+// GetPasswordResetToken returns the password reset token with the given hash, none exist
+func (m *testDBRepo) GetPasswordResetToken(ctx context.Context, tokenHash string) (Models.PasswordResetToken, error) {
+	return Models.PasswordResetToken{}, sql.ErrNoRows
+}
+
+// ResetPassword sets a new password with a reset token, every token is invalid
+func (m *testDBRepo) ResetPassword(ctx context.Context, tokenHash, password string) error {
+	return repository.ErrInvalidResetToken
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user
+func (m *testDBRepo) EnableTwoFactor(ctx context.Context, userID int, secret string, recoveryCodeHashes []string) error {
+	return nil
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user
+func (m *testDBRepo) DisableTwoFactor(ctx context.Context, userID int) error {
+	return nil
+}
+
+// UseTOTPStep records the time step of a used code
+func (m *testDBRepo) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	return true, nil
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user
+func (m *testDBRepo) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	return nil
+}
+
+// UseRecoveryCode uses up a recovery code, none exist
+func (m *testDBRepo) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	return false, nil
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of a user
+func (m *testDBRepo) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	return 0, nil
+}
+
+// GetTwoFactorLevels returns the access levels that must use two-factor authentication, none do
+func (m *testDBRepo) GetTwoFactorLevels(ctx context.Context) ([]int, error) {
+	return nil, nil
+}
+
+// UpdateTwoFactorLevels sets the access levels that must use two-factor authentication
+func (m *testDBRepo) UpdateTwoFactorLevels(ctx context.Context, levels []int) error {
 	return nil
 }
 
-func (m *testDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+// InsertLoginAttempt records a failed login
+func (m *testDBRepo) InsertLoginAttempt(ctx context.Context, a Models.LoginAttempt) error {
+	return nil
+}
+
+// GetLoginAttempts returns the failed logins for email or from ip, there are none
+func (m *testDBRepo) GetLoginAttempts(ctx context.Context, email, ip string, since time.Time) ([]Models.LoginAttempt, error) {
+	return nil, nil
+}
+
+// ClearLoginAttempts forgets the failed logins for email
+func (m *testDBRepo) ClearLoginAttempts(ctx context.Context, email string) error {
+	return nil
+}
+
+// LockUser locks a user
+func (m *testDBRepo) LockUser(ctx context.Context, id int, until time.Time) error {
+	return nil
+}
+
+// UnlockUser unlocks a user
+func (m *testDBRepo) UnlockUser(ctx context.Context, id int) error {
+	return nil
+}
+
+func (m *testDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
 	return 0, "", nil
 }
 
+// AllAPITokens returns every API token
+func (m *testDBRepo) AllAPITokens(ctx context.Context) ([]Models.APIToken, error) {
+	return []Models.APIToken{}, nil
+}
+
+// InsertAPIToken inserts an API token
+func (m *testDBRepo) InsertAPIToken(ctx context.Context, t Models.APIToken) (int, error) {
+	return 1, nil
+}
+
+// GetAPITokenByHash returns the API token with the given hash, there is none
+func (m *testDBRepo) GetAPITokenByHash(ctx context.Context, tokenHash string) (Models.APIToken, error) {
+	return Models.APIToken{}, sql.ErrNoRows
+}
+
+// TouchAPIToken records when an API token was last used
+func (m *testDBRepo) TouchAPIToken(ctx context.Context, id int, usedAt time.Time) error {
+	return nil
+}
+
+// RevokeAPIToken revokes an API token
+func (m *testDBRepo) RevokeAPIToken(ctx context.Context, id int) error {
+	return nil
+}
+
 // AllReservations returns a slice of all reservations
-func (m *testDBRepo) AllReservations() ([]Models.Reservation, error) {
+func (m *testDBRepo) AllReservations(ctx context.Context) ([]Models.Reservation, error) {
 	var reservations []Models.Reservation
 
 	return reservations, nil
 }
 
-// AllNewReservations returns all new reservations
-func (m *testDBRepo) AllNewReservations() ([]Models.Reservation, error) {
+// AllNewReservations returns the reservations that are neither processed nor cancelled
+func (m *testDBRepo) AllNewReservations(ctx context.Context) ([]Models.Reservation, error) {
 
 	var reservations []Models.Reservation
 
@@ -68,7 +219,7 @@ func (m *testDBRepo) AllNewReservations() ([]Models.Reservation, error) {
 }
 
 // GetReservationByID returns reservation by given ID
-func (m *testDBRepo) GetReservationByID(id int) (Models.Reservation, error) {
+func (m *testDBRepo) GetReservationByID(ctx context.Context, id int) (Models.Reservation, error) {
 
 	var res Models.Reservation
 
@@ -76,41 +227,279 @@ func (m *testDBRepo) GetReservationByID(id int) (Models.Reservation, error) {
 }
 
 // UpdateReservation updates a reservation in database
-func (m *testDBRepo) UpdateReservation(res Models.Reservation) error {
+func (m *testDBRepo) UpdateReservation(ctx context.Context, res Models.Reservation) error {
 
 	return nil
 }
 
 // DeleteReservation deletes a reservation by given ID
-func (m *testDBRepo) DeleteReservation(id int) error {
+func (m *testDBRepo) DeleteReservation(ctx context.Context, id int) error {
+	return nil
+}
+
+// GetReservationByCode returns the reservation with the confirmation code, if it was made with email
+func (m *testDBRepo) GetReservationByCode(ctx context.Context, code, email string) (Models.Reservation, error) {
+	if code != "ABCD234567" {
+		return Models.Reservation{}, sql.ErrNoRows
+	}
+
+	start := time.Now().AddDate(0, 1, 0)
+	return Models.Reservation{
+		ID:               1,
+		Email:            email,
+		StartDate:        start,
+		EndDate:          start.AddDate(0, 0, 2),
+		RoomID:           1,
+		ConfirmationCode: code,
+	}, nil
+}
+
+// CancelReservation marks a reservation as cancelled
+func (m *testDBRepo) CancelReservation(ctx context.Context, id int) error {
+	return nil
+}
+
+// InsertChangeRequest inserts a request for new dates of a reservation
+func (m *testDBRepo) InsertChangeRequest(ctx context.Context, cr Models.ReservationChangeRequest) error {
 	return nil
 }
 
+// GetChangeRequestsForReservation returns the change requests of a reservation
+func (m *testDBRepo) GetChangeRequestsForReservation(ctx context.Context, reservationID int) ([]Models.ReservationChangeRequest, error) {
+	var requests []Models.ReservationChangeRequest
+
+	return requests, nil
+}
+
 // UpdateProcessedForReservation updates processed for a reservation
-func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+func (m *testDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int) error {
 	return nil
 }
 
 // AllRooms returns a slice of all rooms
-func (m *testDBRepo) AllRooms() ([]Models.Room, error) {
+func (m *testDBRepo) AllRooms(ctx context.Context) ([]Models.Room, error) {
 	var rooms []Models.Room
 
 	return rooms, nil
 }
 
+// GetRoomBySlug gets a room by its slug
+func (m *testDBRepo) GetRoomBySlug(ctx context.Context, slug string) (Models.Room, error) {
+	switch slug {
+	case "generals-quarters":
+		return Models.Room{ID: 1, Slug: slug, Active: true}, nil
+	case "majors-suite":
+		return Models.Room{ID: 2, Slug: slug, Active: true}, nil
+	}
+
+	return Models.Room{}, sql.ErrNoRows
+}
+
+// GetRoomByICalToken gets the room whose calendar feed has the secret token
+func (m *testDBRepo) GetRoomByICalToken(ctx context.Context, token string) (Models.Room, error) {
+	if token == "feed-token" {
+		return Models.Room{ID: 1, RoomName: "General's Quarters", Slug: "generals-quarters", ICalToken: token, Active: true}, nil
+	}
+
+	return Models.Room{}, sql.ErrNoRows
+}
+
+// SetRoomICalToken sets the secret token of a room's calendar feed
+func (m *testDBRepo) SetRoomICalToken(ctx context.Context, id int, token string) error {
+	return nil
+}
+
+// InsertRoom inserts a room into database and returns its ID
+func (m *testDBRepo) InsertRoom(ctx context.Context, room Models.Room) (int, error) {
+	return 1, nil
+}
+
+// UpdateRoom updates a room in database
+func (m *testDBRepo) UpdateRoom(ctx context.Context, room Models.Room) error {
+	return nil
+}
+
+// DeleteRoom deletes a room by given ID
+func (m *testDBRepo) DeleteRoom(ctx context.Context, id int) error {
+	if id == 2 {
+		return repository.ErrRoomInUse
+	}
+
+	return nil
+}
+
 // GetRestrictionsForRoomByDate returns restrictions for a room by date range
-func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]Models.RoomRestriction, error) {
+func (m *testDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]Models.RoomRestriction, error) {
 	var roomRestrictions []Models.RoomRestriction
 
 	return roomRestrictions, nil
 }
 
 // InsertBlockForRoom inserts a room restriction
-func (m *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+func (m *testDBRepo) InsertBlockForRoom(ctx context.Context, id int, startDate time.Time) error {
 	return nil
 }
 
 // DeleteBlockForRoom deletes a room restriction
-func (m *testDBRepo) DeleteBlockForRoom(id int) error {
+func (m *testDBRepo) DeleteBlockForRoom(ctx context.Context, id int) error {
+	return nil
+}
+
+// AllICalFeeds returns every external calendar
+func (m *testDBRepo) AllICalFeeds(ctx context.Context) ([]Models.ICalFeed, error) {
+	return []Models.ICalFeed{}, nil
+}
+
+// GetICalFeedsForRoom returns the external calendars of a room
+func (m *testDBRepo) GetICalFeedsForRoom(ctx context.Context, roomID int) ([]Models.ICalFeed, error) {
+	return []Models.ICalFeed{}, nil
+}
+
+// GetICalFeedByID returns an external calendar by id
+func (m *testDBRepo) GetICalFeedByID(ctx context.Context, id int) (Models.ICalFeed, error) {
+	if id != 1 {
+		return Models.ICalFeed{}, sql.ErrNoRows
+	}
+
+	return Models.ICalFeed{ID: 1, RoomID: 1, Name: "Other site", Content: "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"}, nil
+}
+
+// InsertICalFeed inserts an external calendar and returns its ID
+func (m *testDBRepo) InsertICalFeed(ctx context.Context, f Models.ICalFeed) (int, error) {
+	return 1, nil
+}
+
+// UpdateICalFeedContent replaces the file of an uploaded external calendar
+func (m *testDBRepo) UpdateICalFeedContent(ctx context.Context, id int, content string) error {
+	return nil
+}
+
+// UpdateICalFeedStatus records the outcome of the last sync of an external calendar
+func (m *testDBRepo) UpdateICalFeedStatus(ctx context.Context, f Models.ICalFeed) error {
 	return nil
 }
+
+// DeleteICalFeed deletes an external calendar
+func (m *testDBRepo) DeleteICalFeed(ctx context.Context, id int) error {
+	return nil
+}
+
+// SyncExternalBlocks makes the External restrictions of an external calendar match blocks
+func (m *testDBRepo) SyncExternalBlocks(ctx context.Context, f Models.ICalFeed, blocks []Models.RoomRestriction) (int, error) {
+	return 0, nil
+}
+
+// GetRatePlan returns the rate plan of a room
+func (m *testDBRepo) GetRatePlan(ctx context.Context, roomID int) (Models.RatePlan, error) {
+	return Models.RatePlan{RoomID: roomID, BaseRate: 10000, WeekendRate: 12000}, nil
+}
+
+// UpdateRatePlan saves the base and weekend rate of a room
+func (m *testDBRepo) UpdateRatePlan(ctx context.Context, plan Models.RatePlan) error {
+	return nil
+}
+
+// InsertSeasonalRate inserts a seasonal rate for a room
+func (m *testDBRepo) InsertSeasonalRate(ctx context.Context, s Models.SeasonalRate) error {
+	return nil
+}
+
+// DeleteSeasonalRate deletes a seasonal rate by given ID
+func (m *testDBRepo) DeleteSeasonalRate(ctx context.Context, id int) error {
+	return nil
+}
+
+// AllWebhooks returns every webhook
+func (m *testDBRepo) AllWebhooks(ctx context.Context) ([]Models.Webhook, error) {
+	return []Models.Webhook{}, nil
+}
+
+// GetWebhookByID returns a webhook by id
+func (m *testDBRepo) GetWebhookByID(ctx context.Context, id int) (Models.Webhook, error) {
+	if id != 1 {
+		return Models.Webhook{}, sql.ErrNoRows
+	}
+
+	return Models.Webhook{ID: 1, Name: "Back office", URL: "https://example.com/hook", Secret: "secret",
+		Events: "reservation.created", Active: true}, nil
+}
+
+// InsertWebhook inserts a webhook and returns its ID
+func (m *testDBRepo) InsertWebhook(ctx context.Context, w Models.Webhook) (int, error) {
+	return 1, nil
+}
+
+// UpdateWebhook updates a webhook
+func (m *testDBRepo) UpdateWebhook(ctx context.Context, w Models.Webhook) error {
+	return nil
+}
+
+// DeleteWebhook deletes a webhook
+func (m *testDBRepo) DeleteWebhook(ctx context.Context, id int) error {
+	return nil
+}
+
+// QueueWebhookEvent queues a delivery of payload to every webhook subscribed to event
+func (m *testDBRepo) QueueWebhookEvent(ctx context.Context, event Models.WebhookEvent, payload string) error {
+	return nil
+}
+
+// GetDueWebhookDeliveries returns the deliveries whose next attempt is due
+func (m *testDBRepo) GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]Models.WebhookDelivery, error) {
+	return []Models.WebhookDelivery{}, nil
+}
+
+// GetWebhookDeliveries returns the last deliveries of a webhook
+func (m *testDBRepo) GetWebhookDeliveries(ctx context.Context, webhookID, limit int) ([]Models.WebhookDelivery, error) {
+	return []Models.WebhookDelivery{}, nil
+}
+
+// UpdateWebhookDelivery records an attempt of a webhook delivery
+func (m *testDBRepo) UpdateWebhookDelivery(ctx context.Context, d Models.WebhookDelivery) error {
+	return nil
+}
+
+// RetryWebhookDelivery makes a delivery due right away
+func (m *testDBRepo) RetryWebhookDelivery(ctx context.Context, webhookID, id int) error {
+	return nil
+}
+
+// QueueMail adds a message to the outbox
+func (m *testDBRepo) QueueMail(ctx context.Context, msg Models.MailData) error {
+	return nil
+}
+
+// GetDueMail returns the pending messages that are due
+func (m *testDBRepo) GetDueMail(ctx context.Context, now time.Time, limit int) ([]Models.MailMessage, error) {
+	return nil, nil
+}
+
+// GetMailMessages returns the last messages with status
+func (m *testDBRepo) GetMailMessages(ctx context.Context, status string, limit int) ([]Models.MailMessage, error) {
+	return nil, nil
+}
+
+// UpdateMailMessage records an attempt of a mail message
+func (m *testDBRepo) UpdateMailMessage(ctx context.Context, msg Models.MailMessage) error {
+	return nil
+}
+
+// ResendMail makes a failed message pending again
+func (m *testDBRepo) ResendMail(ctx context.Context, id int) error {
+	return nil
+}
+
+// GetArrivalsToRemind returns the reservations whose guests should be reminded
+func (m *testDBRepo) GetArrivalsToRemind(ctx context.Context, from, to time.Time) ([]Models.Reservation, error) {
+	return []Models.Reservation{}, nil
+}
+
+// GetDeparturesToThank returns the reservations whose guests should be thanked
+func (m *testDBRepo) GetDeparturesToThank(ctx context.Context, from, to time.Time) ([]Models.Reservation, error) {
+	return []Models.Reservation{}, nil
+}
+
+// RecordNotification records a scheduled email of a reservation
+func (m *testDBRepo) RecordNotification(ctx context.Context, reservationID int, kind string, mail ...Models.MailData) (bool, error) {
+	return true, nil
+}
@@ -1,33 +1,117 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"github.com/454270186/Hotel-booking-web-application/internal/Models"
 	"time"
 )
 
+// ErrRoomUnavailable is returned when a room already has a restriction overlapping the requested dates
+var ErrRoomUnavailable = errors.New("room is not available for the requested dates")
+
+// ErrRoomInUse is returned when deleting a room that still has reservations
+var ErrRoomInUse = errors.New("room has reservations")
+
+// ErrInvalidResetToken is returned when a password reset token is unknown, expired or already used
+var ErrInvalidResetToken = errors.New("password reset token is invalid or expired")
+
 type DatabaseRepo interface {
-	AllUsers() bool
-
-	InsertReservation(res Models.Reservation) (int, error)
-	InsertRoomRestriction(r Models.RoomRestriction) error
-	SearchAvailabilityByDateByRoomID(start, end time.Time, roomID int) (bool, error)
-	SearchAvailabilityForAllRooms(start, end time.Time) ([]Models.Room, error)
-	GetRoomByID(id int) (Models.Room, error)
-
-	GetUserByID(id int) (Models.User, error)
-	UpdateUser(u Models.User) error
-	Authenticate(email, testPassword string) (int, string, error)
-
-	AllReservations() ([]Models.Reservation, error)
-	AllNewReservations() ([]Models.Reservation, error)
-	GetReservationByID(id int) (Models.Reservation, error)
-	UpdateReservation(res Models.Reservation) error
-	DeleteReservation(id int) error
-	UpdateProcessedForReservation(id, processed int) error
-
-	AllRooms() ([]Models.Room, error)
-	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]Models.RoomRestriction, error)
-
-	InsertBlockForRoom(id int, startDate time.Time) error
-	DeleteBlockForRoom(id int) error
+	// WithTx runs fn in a transaction, committing it if fn returns nil. fn must only use the repo it is given
+	WithTx(ctx context.Context, fn func(repo DatabaseRepo) error) error
+
+	InsertReservation(ctx context.Context, res Models.Reservation) (int, error)
+	InsertRoomRestriction(ctx context.Context, r Models.RoomRestriction) error
+	CreateReservation(ctx context.Context, res Models.Reservation, mail ...Models.MailData) (int, error)
+	SearchAvailabilityByDateByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error)
+	SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]Models.Room, error)
+	GetRoomByID(ctx context.Context, id int) (Models.Room, error)
+
+	AllUsers(ctx context.Context) ([]Models.User, error)
+	GetUserByID(ctx context.Context, id int) (Models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (Models.User, error)
+	InsertUser(ctx context.Context, u Models.User) (int, error)
+	UpdateUser(ctx context.Context, u Models.User) error
+	UpdatePassword(ctx context.Context, id int, password string) error
+	DeactivateUser(ctx context.Context, id int) error
+	InsertPasswordResetToken(ctx context.Context, t Models.PasswordResetToken) error
+	GetPasswordResetToken(ctx context.Context, tokenHash string) (Models.PasswordResetToken, error)
+	ResetPassword(ctx context.Context, tokenHash, password string) error
+	EnableTwoFactor(ctx context.Context, userID int, secret string, recoveryCodeHashes []string) error
+	DisableTwoFactor(ctx context.Context, userID int) error
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, userID int) (int, error)
+	GetTwoFactorLevels(ctx context.Context) ([]int, error)
+	UpdateTwoFactorLevels(ctx context.Context, levels []int) error
+	InsertLoginAttempt(ctx context.Context, a Models.LoginAttempt) error
+	GetLoginAttempts(ctx context.Context, email, ip string, since time.Time) ([]Models.LoginAttempt, error)
+	ClearLoginAttempts(ctx context.Context, email string) error
+	LockUser(ctx context.Context, id int, until time.Time) error
+	UnlockUser(ctx context.Context, id int) error
+	Authenticate(ctx context.Context, email, testPassword string) (int, string, error)
+	AllAPITokens(ctx context.Context) ([]Models.APIToken, error)
+	InsertAPIToken(ctx context.Context, t Models.APIToken) (int, error)
+	GetAPITokenByHash(ctx context.Context, tokenHash string) (Models.APIToken, error)
+	TouchAPIToken(ctx context.Context, id int, usedAt time.Time) error
+	RevokeAPIToken(ctx context.Context, id int) error
+
+	AllReservations(ctx context.Context) ([]Models.Reservation, error)
+	AllNewReservations(ctx context.Context) ([]Models.Reservation, error)
+	GetReservationByID(ctx context.Context, id int) (Models.Reservation, error)
+	UpdateReservation(ctx context.Context, res Models.Reservation) error
+	DeleteReservation(ctx context.Context, id int) error
+	GetReservationByCode(ctx context.Context, code, email string) (Models.Reservation, error)
+	CancelReservation(ctx context.Context, id int) error
+	InsertChangeRequest(ctx context.Context, cr Models.ReservationChangeRequest) error
+	GetChangeRequestsForReservation(ctx context.Context, reservationID int) ([]Models.ReservationChangeRequest, error)
+	UpdateProcessedForReservation(ctx context.Context, id, processed int) error
+
+	AllRooms(ctx context.Context) ([]Models.Room, error)
+	GetRoomBySlug(ctx context.Context, slug string) (Models.Room, error)
+	GetRoomByICalToken(ctx context.Context, token string) (Models.Room, error)
+	SetRoomICalToken(ctx context.Context, id int, token string) error
+	InsertRoom(ctx context.Context, room Models.Room) (int, error)
+	UpdateRoom(ctx context.Context, room Models.Room) error
+	DeleteRoom(ctx context.Context, id int) error
+
+	GetRatePlan(ctx context.Context, roomID int) (Models.RatePlan, error)
+	UpdateRatePlan(ctx context.Context, plan Models.RatePlan) error
+	InsertSeasonalRate(ctx context.Context, s Models.SeasonalRate) error
+	DeleteSeasonalRate(ctx context.Context, id int) error
+	GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]Models.RoomRestriction, error)
+
+	InsertBlockForRoom(ctx context.Context, id int, startDate time.Time) error
+	DeleteBlockForRoom(ctx context.Context, id int) error
+
+	AllICalFeeds(ctx context.Context) ([]Models.ICalFeed, error)
+	GetICalFeedsForRoom(ctx context.Context, roomID int) ([]Models.ICalFeed, error)
+	GetICalFeedByID(ctx context.Context, id int) (Models.ICalFeed, error)
+	InsertICalFeed(ctx context.Context, f Models.ICalFeed) (int, error)
+	UpdateICalFeedContent(ctx context.Context, id int, content string) error
+	UpdateICalFeedStatus(ctx context.Context, f Models.ICalFeed) error
+	DeleteICalFeed(ctx context.Context, id int) error
+	SyncExternalBlocks(ctx context.Context, f Models.ICalFeed, blocks []Models.RoomRestriction) (int, error)
+
+	AllWebhooks(ctx context.Context) ([]Models.Webhook, error)
+	GetWebhookByID(ctx context.Context, id int) (Models.Webhook, error)
+	InsertWebhook(ctx context.Context, w Models.Webhook) (int, error)
+	UpdateWebhook(ctx context.Context, w Models.Webhook) error
+	DeleteWebhook(ctx context.Context, id int) error
+	QueueWebhookEvent(ctx context.Context, event Models.WebhookEvent, payload string) error
+	GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]Models.WebhookDelivery, error)
+	GetWebhookDeliveries(ctx context.Context, webhookID, limit int) ([]Models.WebhookDelivery, error)
+	UpdateWebhookDelivery(ctx context.Context, d Models.WebhookDelivery) error
+	RetryWebhookDelivery(ctx context.Context, webhookID, id int) error
+
+	QueueMail(ctx context.Context, msg Models.MailData) error
+	GetDueMail(ctx context.Context, now time.Time, limit int) ([]Models.MailMessage, error)
+	GetMailMessages(ctx context.Context, status string, limit int) ([]Models.MailMessage, error)
+	UpdateMailMessage(ctx context.Context, msg Models.MailMessage) error
+	ResendMail(ctx context.Context, id int) error
+
+	GetArrivalsToRemind(ctx context.Context, from, to time.Time) ([]Models.Reservation, error)
+	GetDeparturesToThank(ctx context.Context, from, to time.Time) ([]Models.Reservation, error)
+	RecordNotification(ctx context.Context, reservationID int, kind string, mail ...Models.MailData) (bool, error)
 }
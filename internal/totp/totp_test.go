@@ -0,0 +1,108 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcKey is the SHA1 key of the RFC 6238 test vectors
+var rfcKey = []byte("12345678901234567890")
+
+func TestHOTP_RFC6238(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 rows
+	var tests = []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, e := range tests {
+		got := hotp(rfcKey, Step(time.Unix(e.unix, 0)), 8)
+		if got != e.expected {
+			t.Errorf("at %d expected %s but got %s", e.unix, e.expected, got)
+		}
+	}
+}
+
+func TestHOTP_RFC4226(t *testing.T) {
+	// RFC 4226 appendix D
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for counter, e := range expected {
+		if got := hotp(rfcKey, int64(counter), 6); got != e {
+			t.Errorf("for counter %d expected %s but got %s", counter, e, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString(rfcKey)
+	now := time.Unix(1111111111, 0)
+
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "050471" {
+		t.Errorf("expected the last 6 digits of the RFC code, got %s", code)
+	}
+
+	step, ok := Validate(strings.ToLower(secret), code[:3]+" "+code[3:], now)
+	if !ok || step != Step(now) {
+		t.Errorf("expected the code to be valid for step %d, got %d and %t", Step(now), step, ok)
+	}
+	if _, ok := Validate(secret, code, now.Add(Period*time.Second)); !ok {
+		t.Error("a code of the previous period should still be accepted")
+	}
+	if _, ok := Validate(secret, code, now.Add(2*Period*time.Second)); ok {
+		t.Error("a code two periods old should be rejected")
+	}
+	if _, ok := Validate(secret, "123", now); ok {
+		t.Error("a short code should be rejected")
+	}
+	if _, ok := Validate("not base32!", code, now); ok {
+		t.Error("an invalid secret should never validate")
+	}
+	if _, ok := Validate("", hotp(nil, Step(now), Digits), now); ok {
+		t.Error("an empty secret should never validate")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("expected 32 base32 characters, got %q", secret)
+	}
+
+	code, err := Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(secret, code, time.Now()); !ok {
+		t.Error("the current code of a new secret should be valid")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Bookings", "me@me.com", "JBSWY3DPEHPK3PXP")
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Bookings:me@me.com?") {
+		t.Errorf("unexpected label in %s", uri)
+	}
+	for _, part := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=Bookings", "digits=6", "period=30"} {
+		if !strings.Contains(uri, part) {
+			t.Errorf("expected %s in %s", part, uri)
+		}
+	}
+}
@@ -0,0 +1 @@
+delete from rooms;
\ No newline at end of file
@@ -0,0 +1,3 @@
+INSERT INTO rooms (room_name, created_at, updated_at) VALUES
+('General''s Quarters','2023-01-18 00:00:00','2023-01-18 00:00:00'),
+('Major''s Suite','2023-01-18 00:00:00','2023-01-18 00:00:00');
@@ -0,0 +1 @@
+delete from restrictions;
\ No newline at end of file
@@ -0,0 +1 @@
+delete from users where email = 'me@me.com'
\ No newline at end of file
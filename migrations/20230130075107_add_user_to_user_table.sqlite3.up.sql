@@ -0,0 +1,3 @@
+INSERT INTO users (first_name, last_name, email, password, access_level, created_at, updated_at)
+VALUES
+('Erfei','Yu','me@me.com','$2a$12$o9gGQbVFE3WpRuZLgmWpgeHSbHzPabZ4vRp3H4m0RYtwdFJMtdku.',3,'2023-01-23 00:00:00','2023-01-23 00:00:00');
@@ -0,0 +1,24 @@
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+-- the constraint cannot be added while two restrictions of a room already overlap, so list
+-- those first. To resolve a conflict, cancel the duplicate reservation or delete the owner
+-- block in the admin calendar (or shorten one of the two rows by hand) and run the migration again.
+DO $$
+DECLARE
+    conflicts text;
+BEGIN
+    SELECT string_agg(format('room %s: restriction %s (%s to %s) overlaps restriction %s (%s to %s)',
+                             a.room_id, a.id, a.start_date, a.end_date, b.id, b.start_date, b.end_date), E'\n')
+    INTO conflicts
+    FROM public.room_restrictions a
+    JOIN public.room_restrictions b
+      ON a.room_id = b.room_id AND a.id < b.id
+     AND a.start_date < b.end_date AND a.end_date > b.start_date;
+
+    IF conflicts IS NOT NULL THEN
+        RAISE EXCEPTION 'room_restrictions_no_overlap cannot be added, remove the overlapping restrictions first:%', E'\n' || conflicts;
+    END IF;
+END $$;
+
+ALTER TABLE public.room_restrictions ADD CONSTRAINT room_restrictions_no_overlap
+    EXCLUDE USING gist (room_id WITH =, daterange(start_date, end_date, '[)') WITH &&);
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS room_restrictions_no_overlap_insert;
+DROP TRIGGER IF EXISTS room_restrictions_no_overlap_update;
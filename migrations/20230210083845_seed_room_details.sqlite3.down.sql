@@ -0,0 +1 @@
+UPDATE rooms SET slug = '', description = '', capacity = 2, bed_configuration = '', amenities = '', base_price = 0, image = '';
\ No newline at end of file
@@ -0,0 +1,10 @@
+UPDATE rooms SET slug = 'generals-quarters',
+    description = 'Your home away from home, set on the majestic waters of the Atlantic Ocean, this will be a vacation to remember.',
+    capacity = 2, bed_configuration = '1 Queen', amenities = 'Ocean view, Wi-Fi, Coffee maker',
+    base_price = 8900, image = '/static/images/generals-quarters.png'
+WHERE room_name = 'General''s Quarters';
+UPDATE rooms SET slug = 'majors-suite',
+    description = 'Your home away from home, set on the majestic waters of the Atlantic Ocean, this will be a vacation to remember.',
+    capacity = 4, bed_configuration = '1 King, 1 Sofa bed', amenities = 'Ocean view, Balcony, Wi-Fi, Bathtub',
+    base_price = 12900, image = '/static/images/marjors-suite.png'
+WHERE room_name = 'Major''s Suite';
\ No newline at end of file
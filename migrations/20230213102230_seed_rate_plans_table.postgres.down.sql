@@ -0,0 +1 @@
+DELETE FROM public.rate_plans;
\ No newline at end of file
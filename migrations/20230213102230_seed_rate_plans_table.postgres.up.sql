@@ -0,0 +1,4 @@
+INSERT INTO public.rate_plans (room_id, weekend_rate, created_at, updated_at)
+SELECT id, CASE slug WHEN 'generals-quarters' THEN 10900 WHEN 'majors-suite' THEN 15900 ELSE base_price END,
+       '2023-02-13 00:00:00.000000', '2023-02-13 00:00:00.000000'
+FROM public.rooms;
\ No newline at end of file
@@ -0,0 +1 @@
+DELETE FROM rate_plans;
\ No newline at end of file
@@ -0,0 +1,2 @@
+UPDATE reservations SET confirmation_code = upper(substr(md5(random()::text || id::text), 1, 10))
+WHERE confirmation_code = '';
\ No newline at end of file
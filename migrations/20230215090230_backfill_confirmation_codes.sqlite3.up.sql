@@ -0,0 +1,2 @@
+UPDATE reservations SET confirmation_code = upper(hex(randomblob(5)))
+WHERE confirmation_code = '';
\ No newline at end of file
@@ -0,0 +1 @@
+UPDATE users SET access_level = 3 WHERE email = 'me@me.com';
\ No newline at end of file
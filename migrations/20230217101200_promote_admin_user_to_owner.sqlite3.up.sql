@@ -0,0 +1 @@
+UPDATE users SET access_level = 4 WHERE email = 'me@me.com';
\ No newline at end of file
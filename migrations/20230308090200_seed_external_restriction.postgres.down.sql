@@ -0,0 +1 @@
+delete from restrictions where restriction_name = 'External';
@@ -0,0 +1,2 @@
+INSERT INTO restrictions (restriction_name, created_at, updated_at) VALUES
+('External','2023-03-08 00:00:00','2023-03-08 00:00:00');
@@ -0,0 +1,14 @@
+-- adding the ical_feed_id foreign key rebuilt room_restrictions, which dropped the triggers
+CREATE TRIGGER IF NOT EXISTS room_restrictions_no_overlap_insert BEFORE INSERT ON room_restrictions
+WHEN EXISTS (SELECT 1 FROM room_restrictions
+             WHERE room_id = NEW.room_id AND NEW.start_date < end_date AND NEW.end_date > start_date)
+BEGIN
+    SELECT RAISE(ABORT, 'room_restrictions_no_overlap');
+END;
+
+CREATE TRIGGER IF NOT EXISTS room_restrictions_no_overlap_update BEFORE UPDATE ON room_restrictions
+WHEN EXISTS (SELECT 1 FROM room_restrictions
+             WHERE id <> NEW.id AND room_id = NEW.room_id AND NEW.start_date < end_date AND NEW.end_date > start_date)
+BEGIN
+    SELECT RAISE(ABORT, 'room_restrictions_no_overlap');
+END;